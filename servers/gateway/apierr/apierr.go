@@ -0,0 +1,204 @@
+//Package apierr writes the gateway's error responses. Every error has a
+//stable Code that clients can rely on, which determines its HTTP status,
+//and is sent as an RFC 7807 application/problem+json body naming the
+//request, so that a client's report can be matched with the logs.
+package apierr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/synapse-api/servers/gateway/reqlog"
+)
+
+//ContentType is the media type of error responses, from RFC 7807
+const ContentType = "application/problem+json"
+
+//HeaderRequestID carries the ID of a request, which is
+//returned in error responses so they can be traced in the logs
+const HeaderRequestID = reqlog.HeaderRequestID
+
+//typePrefix is prepended to codes to make the type URIs of problems
+const typePrefix = "urn:synapse:error:"
+
+//Code identifies the kind of an error. Codes are stable, so
+//clients can rely on them rather than on the message.
+type Code string
+
+//Error codes, and the HTTP status each is returned with
+const (
+	//CodeBadRequest means the request was malformed in a way no other code covers
+	CodeBadRequest Code = "bad_request"
+	//CodeInvalidJSON means the request body couldn't be decoded
+	CodeInvalidJSON Code = "invalid_json"
+	//CodeValidationFailed means the request body was decoded but isn't valid
+	CodeValidationFailed Code = "validation_failed"
+	//CodeEmailTaken means another account uses the email address
+	CodeEmailTaken Code = "email_taken"
+	//CodeUserNameTaken means another account uses the user name
+	CodeUserNameTaken Code = "user_name_taken"
+	//CodeFileRequired means the request didn't name a file
+	CodeFileRequired Code = "file_required"
+	//CodeInvalidToken means the reset, verification or single sign-on token is unknown, used or expired
+	CodeInvalidToken Code = "invalid_token"
+	//CodeUnauthorized means the request has no valid session
+	CodeUnauthorized Code = "unauthorized"
+	//CodeInvalidCredentials means the email or password is wrong
+	CodeInvalidCredentials Code = "invalid_credentials"
+	//CodeInvalidRefreshToken means the refresh token is unknown, used or expired
+	CodeInvalidRefreshToken Code = "invalid_refresh_token"
+	//CodeForbidden means the user may not do what was asked
+	CodeForbidden Code = "forbidden"
+	//CodeAccountDisabled means the account was disabled by an admin
+	CodeAccountDisabled Code = "account_disabled"
+	//CodeIncorrectPassword means the current password given to confirm a change is wrong
+	CodeIncorrectPassword Code = "incorrect_password"
+	//CodeIncorrectCode means the two-factor code given to confirm a change is wrong
+	CodeIncorrectCode Code = "incorrect_code"
+	//CodeReauthenticationRequired means the user must sign in again, or give
+	//a two-factor code, to confirm a change
+	CodeReauthenticationRequired Code = "reauthentication_required"
+	//CodeEmailNotVerified means the user must verify their email address first
+	CodeEmailNotVerified Code = "email_not_verified"
+	//CodeNotFound means the resource doesn't exist
+	CodeNotFound Code = "not_found"
+	//CodeMethodNotAllowed means the resource doesn't support the method
+	CodeMethodNotAllowed Code = "method_not_allowed"
+	//CodeConflict means the resource is already in the state asked for
+	CodeConflict Code = "conflict"
+	//CodeTooManyRequests means the client must wait before trying again
+	CodeTooManyRequests Code = "too_many_requests"
+	//CodeInternal means the gateway failed to handle a valid request
+	CodeInternal Code = "internal"
+	//CodeUpstreamUnavailable means a microservice couldn't be reached
+	CodeUpstreamUnavailable Code = "upstream_unavailable"
+	//CodeUpstreamTimeout means a microservice didn't respond in time
+	CodeUpstreamTimeout Code = "upstream_timeout"
+)
+
+//statuses holds the HTTP status of each code
+var statuses = map[Code]int{
+	CodeBadRequest:               http.StatusBadRequest,
+	CodeInvalidJSON:              http.StatusBadRequest,
+	CodeValidationFailed:         http.StatusBadRequest,
+	CodeEmailTaken:               http.StatusBadRequest,
+	CodeUserNameTaken:            http.StatusBadRequest,
+	CodeFileRequired:             http.StatusBadRequest,
+	CodeInvalidToken:             http.StatusBadRequest,
+	CodeUnauthorized:             http.StatusUnauthorized,
+	CodeInvalidCredentials:       http.StatusUnauthorized,
+	CodeInvalidRefreshToken:      http.StatusUnauthorized,
+	CodeForbidden:                http.StatusForbidden,
+	CodeAccountDisabled:          http.StatusForbidden,
+	CodeIncorrectPassword:        http.StatusForbidden,
+	CodeIncorrectCode:            http.StatusForbidden,
+	CodeReauthenticationRequired: http.StatusForbidden,
+	CodeEmailNotVerified:         http.StatusForbidden,
+	CodeNotFound:                 http.StatusNotFound,
+	CodeMethodNotAllowed:         http.StatusMethodNotAllowed,
+	CodeConflict:                 http.StatusConflict,
+	CodeTooManyRequests:          http.StatusTooManyRequests,
+	CodeInternal:                 http.StatusInternalServerError,
+	CodeUpstreamUnavailable:      http.StatusBadGateway,
+	CodeUpstreamTimeout:          http.StatusGatewayTimeout,
+}
+
+//Status returns the HTTP status errors with the code are returned with
+func (c Code) Status() int {
+	if status, found := statuses[c]; found {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+//Error is an error to return to a client
+type Error struct {
+	Code Code
+	//Detail explains the error to the client
+	Detail string
+	//Err is the error that caused it, if any. It is only sent to
+	//the client for client errors; server errors are logged instead.
+	Err error
+}
+
+//New returns an Error with the code and detail
+func New(code Code, detail string) *Error {
+	return &Error{Code: code, Detail: detail}
+}
+
+//Wrap returns an Error with the code and detail caused by `err`
+func Wrap(code Code, detail string, err error) *Error {
+	return &Error{Code: code, Detail: detail, Err: err}
+}
+
+//Error returns the detail, followed by the cause if there is one
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Detail
+	}
+	return fmt.Sprintf("%s: %v", e.Detail, e.Err)
+}
+
+//Unwrap returns the cause of the error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//Problem is the body of an error response, in the
+//"problem detail" format of RFC 7807
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      Code   `json:"code"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+//Write responds to the request with the error. Errors that aren't an
+//*Error are internal errors. The request ID is the one given by
+//reqlog.Middleware, or, outside of it, the one in the request's
+//X-Request-ID header or a new one, which is set on the response.
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	e := &Error{}
+	if !errors.As(err, &e) {
+		e = Wrap(CodeInternal, "internal error", err)
+	}
+	status := e.Code.Status()
+
+	requestID := reqlog.RequestID(r.Context())
+	logger := reqlog.Logger(r.Context())
+	if len(requestID) == 0 {
+		if requestID = r.Header.Get(HeaderRequestID); !reqlog.ValidID(requestID) {
+			requestID = reqlog.NewID()
+		}
+		w.Header().Set(HeaderRequestID, requestID)
+		logger = logger.With("requestId", requestID)
+	}
+
+	detail := e.Error()
+	if status >= http.StatusInternalServerError {
+		//the cause may reveal how the gateway works, so it is only logged
+		logger.Error(e.Detail, "code", e.Code, "error", e.Err)
+		detail = e.Detail
+	}
+
+	problem := &Problem{
+		Type:      typePrefix + string(e.Code),
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		RequestID: requestID,
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(problem); err != nil {
+		logger.Error("error encoding problem", "error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package apierr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	cases := []struct {
+		name           string
+		err            error
+		requestID      string
+		expectedStatus int
+		expectedCode   Code
+		expectedDetail string
+	}{
+		{
+			"Client Error",
+			New(CodeFileRequired, "no file specified"),
+			"",
+			http.StatusBadRequest,
+			CodeFileRequired,
+			"no file specified",
+		},
+		{
+			"Client Error With Cause",
+			Wrap(CodeInvalidJSON, "error decoding JSON", fmt.Errorf("unexpected EOF")),
+			"abc123",
+			http.StatusBadRequest,
+			CodeInvalidJSON,
+			"error decoding JSON: unexpected EOF",
+		},
+		{
+			"Wrapped Error",
+			fmt.Errorf("saving: %w", New(CodeNotFound, "file not found")),
+			"",
+			http.StatusNotFound,
+			CodeNotFound,
+			"file not found",
+		},
+		{
+			"Server Error Hides Cause",
+			Wrap(CodeInternal, "error getting user", fmt.Errorf("connection refused at 10.0.0.3")),
+			"",
+			http.StatusInternalServerError,
+			CodeInternal,
+			"error getting user",
+		},
+		{
+			"Plain Error",
+			fmt.Errorf("something broke"),
+			"",
+			http.StatusInternalServerError,
+			CodeInternal,
+			"internal error",
+		},
+		{
+			"Upstream",
+			Wrap(CodeUpstreamTimeout, "error reaching the qeeg service", fmt.Errorf("timeout")),
+			"",
+			http.StatusGatewayTimeout,
+			CodeUpstreamTimeout,
+			"error reaching the qeeg service",
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/v1/upload", nil)
+		if len(c.requestID) > 0 {
+			r.Header.Set(HeaderRequestID, c.requestID)
+		}
+		w := httptest.NewRecorder()
+		Write(w, r, c.err)
+
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ContentType {
+			t.Errorf("case %s: expected content type %s but got %s", c.name, ContentType, ct)
+		}
+		p := &Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+			t.Fatalf("case %s: error decoding problem: %v", c.name, err)
+		}
+		if p.Code != c.expectedCode || p.Status != c.expectedStatus || p.Detail != c.expectedDetail {
+			t.Errorf("case %s: expected %s (%d) %q but got %s (%d) %q",
+				c.name, c.expectedCode, c.expectedStatus, c.expectedDetail, p.Code, p.Status, p.Detail)
+		}
+		if p.Type != "urn:synapse:error:"+string(c.expectedCode) || p.Title != http.StatusText(c.expectedStatus) || p.Instance != "/v1/upload" {
+			t.Errorf("case %s: unexpected problem %+v", c.name, p)
+		}
+
+		//the request ID is the client's if it sent one, and is returned in a header too
+		if len(p.RequestID) == 0 || w.Header().Get(HeaderRequestID) != p.RequestID {
+			t.Errorf("case %s: expected the request ID in the body and header but got %q and %q",
+				c.name, p.RequestID, w.Header().Get(HeaderRequestID))
+		}
+		if len(c.requestID) > 0 && p.RequestID != c.requestID {
+			t.Errorf("case %s: expected request ID %s but got %s", c.name, c.requestID, p.RequestID)
+		}
+	}
+}
+
+func TestCodes(t *testing.T) {
+	//every code has a status, and codes aren't reused
+	codes := []Code{CodeBadRequest, CodeInvalidJSON, CodeValidationFailed, CodeEmailTaken, CodeUserNameTaken,
+		CodeFileRequired, CodeInvalidToken, CodeUnauthorized, CodeInvalidCredentials, CodeInvalidRefreshToken, CodeForbidden,
+		CodeAccountDisabled, CodeIncorrectPassword, CodeIncorrectCode, CodeReauthenticationRequired, CodeEmailNotVerified, CodeNotFound,
+		CodeMethodNotAllowed, CodeConflict, CodeTooManyRequests, CodeInternal, CodeUpstreamUnavailable, CodeUpstreamTimeout}
+	seen := map[Code]bool{}
+	for _, code := range codes {
+		if _, found := statuses[code]; !found {
+			t.Errorf("code %s has no status", code)
+		}
+		if seen[code] || strings.ToLower(string(code)) != string(code) {
+			t.Errorf("code %s is reused or not lowercase", code)
+		}
+		seen[code] = true
+	}
+	if len(statuses) != len(codes) {
+		t.Errorf("expected %d statuses but got %d", len(codes), len(statuses))
+	}
+	if status := Code("unknown").Status(); status != http.StatusInternalServerError {
+		t.Errorf("expected unknown codes to be internal errors but got %d", status)
+	}
+}
@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"context"
+	"time"
+)
+
+//Actions recorded in the audit log
+const (
+	ActionSignUp         = "user.create"
+	ActionProfileUpdate  = "user.update"
+	ActionPasswordChange = "user.password.change"
+	ActionPasswordReset  = "user.password.reset"
+	ActionEmailChange    = "user.email.change"
+	ActionAccountDelete  = "user.delete"
+	ActionTOTPEnable     = "user.totp.enable"
+	ActionTOTPDisable    = "user.totp.disable"
+	ActionRoleChange     = "admin.user.role"
+	ActionUserDisable    = "admin.user.disable"
+	ActionUserEnable     = "admin.user.enable"
+	ActionUnlock         = "admin.lockout.unlock"
+	ActionSignIn         = "session.begin"
+	ActionSignOut        = "session.end"
+	ActionFileUpload     = "file.upload"
+	ActionFileDelete     = "file.delete"
+	ActionRunAnalysis    = "analysis.run"
+	ActionReadAnalysis   = "analysis.read"
+)
+
+//Outcomes of an audited action
+const (
+	OutcomeSuccess = "success"
+	//OutcomeFailure means the action failed, for example because of a wrong password
+	OutcomeFailure = "failure"
+	//OutcomeDenied means the actor wasn't allowed to try, for example because
+	//they lack the permission or their account is disabled or locked out
+	OutcomeDenied = "denied"
+)
+
+//Event is a security or data event, such as a sign-in or an upload
+type Event struct {
+	Time time.Time `json:"time"`
+	//Actor is the ID of the user who acted, if known
+	Actor  string `json:"actor,omitempty"`
+	Action string `json:"action"`
+	//Target is what was acted on, such as a file name,
+	//or the email address that was used to sign in
+	Target  string `json:"target,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Outcome string `json:"outcome"`
+}
+
+//Filter selects events from the log. Empty fields match any event.
+type Filter struct {
+	Actor   string
+	Action  string
+	Target  string
+	Outcome string
+	//Since is the earliest time of events to include
+	Since time.Time
+	//Until is the time before which events are included
+	Until time.Time
+}
+
+//Match reports whether the event passes the filter
+func (f *Filter) Match(event *Event) bool {
+	return (len(f.Actor) == 0 || f.Actor == event.Actor) &&
+		(len(f.Action) == 0 || f.Action == event.Action) &&
+		(len(f.Target) == 0 || f.Target == event.Target) &&
+		(len(f.Outcome) == 0 || f.Outcome == event.Outcome) &&
+		(f.Since.IsZero() || !event.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || event.Time.Before(f.Until))
+}
+
+//Store is an append-only log of events. There is deliberately no way
+//to change or remove events once they are appended. Events are ordered
+//by when they were appended, which is normally the order of their times.
+type Store interface {
+	//Append adds the event to the log
+	Append(ctx context.Context, event *Event) error
+
+	//Find returns up to `limit` events matching the filter,
+	//latest first, skipping the first `offset`
+	Find(ctx context.Context, filter *Filter, offset int, limit int) ([]*Event, error)
+
+	//Each calls `fn` with every event matching the filter, earliest
+	//first, and stops at the first error `fn` returns
+	Each(ctx context.Context, filter *Filter, fn func(event *Event) error) error
+}
@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"context"
+	"sync"
+)
+
+//MemStore keeps the audit log in memory.
+//This should be used only for testing and prototyping,
+//since the log is lost when the process exits.
+type MemStore struct {
+	events []*Event
+	mx     sync.RWMutex
+}
+
+//NewMemStore constructs and returns a new MemStore
+func NewMemStore() *MemStore {
+	return &MemStore{}
+}
+
+//Append adds the event to the log
+func (ms *MemStore) Append(ctx context.Context, event *Event) error {
+	e := *event
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.events = append(ms.events, &e)
+	return nil
+}
+
+//Find returns up to `limit` events matching the filter,
+//latest first, skipping the first `offset`
+func (ms *MemStore) Find(ctx context.Context, filter *Filter, offset int, limit int) ([]*Event, error) {
+	ms.mx.RLock()
+	defer ms.mx.RUnlock()
+
+	events := []*Event{}
+	for i := len(ms.events) - 1; i >= 0 && len(events) < limit; i-- {
+		if !filter.Match(ms.events[i]) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		e := *ms.events[i]
+		events = append(events, &e)
+	}
+	return events, nil
+}
+
+//Each calls `fn` with every event matching the filter, earliest first
+func (ms *MemStore) Each(ctx context.Context, filter *Filter, fn func(event *Event) error) error {
+	ms.mx.RLock()
+	events := make([]*Event, len(ms.events))
+	copy(events, ms.events)
+	ms.mx.RUnlock()
+
+	for _, event := range events {
+		if !filter.Match(event) {
+			continue
+		}
+		e := *event
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//MongoStore keeps the audit log in a MongoDB collection.
+//Documents are only ever inserted, so the gateway's database
+//user can be limited to the insert and find actions on it.
+type MongoStore struct {
+	col *mongo.Collection
+}
+
+//NewMongoStore constructs a new MongoStore
+func NewMongoStore(client *mongo.Client, dbName string, collectionName string) *MongoStore {
+	if client == nil {
+		panic("nil pointer passed for client")
+	}
+	return &MongoStore{
+		col: client.Database(dbName).Collection(collectionName),
+	}
+}
+
+//EnsureIndexes creates the indexes used to filter events.
+//It should be called once at startup.
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "time", Value: 1}}},
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating indexes: %v", err)
+	}
+	return nil
+}
+
+//Append adds the event to the log
+func (s *MongoStore) Append(ctx context.Context, event *Event) error {
+	if _, err := s.col.InsertOne(ctx, event); err != nil {
+		return fmt.Errorf("error appending event: %v", err)
+	}
+	return nil
+}
+
+//Find returns up to `limit` events matching the filter,
+//latest first, skipping the first `offset`
+func (s *MongoStore) Find(ctx context.Context, filter *Filter, offset int, limit int) ([]*Event, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	cur, err := s.col.Find(ctx, mongoFilter(filter), opts)
+	if err != nil {
+		return nil, fmt.Errorf("error finding events: %v", err)
+	}
+	events := []*Event{}
+	if err := cur.All(ctx, &events); err != nil {
+		return nil, fmt.Errorf("error decoding events: %v", err)
+	}
+	return events, nil
+}
+
+//Each calls `fn` with every event matching the filter, earliest first
+func (s *MongoStore) Each(ctx context.Context, filter *Filter, fn func(event *Event) error) error {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := s.col.Find(ctx, mongoFilter(filter), opts)
+	if err != nil {
+		return fmt.Errorf("error finding events: %v", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		event := &Event{}
+		if err := cur.Decode(event); err != nil {
+			return fmt.Errorf("error decoding event: %v", err)
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
+
+//mongoFilter converts the filter to a MongoDB query
+func mongoFilter(filter *Filter) bson.M {
+	query := bson.M{}
+	fields := map[string]string{
+		"actor":   filter.Actor,
+		"action":  filter.Action,
+		"target":  filter.Target,
+		"outcome": filter.Outcome,
+	}
+	for field, value := range fields {
+		if len(value) > 0 {
+			query[field] = value
+		}
+	}
+	times := bson.M{}
+	if !filter.Since.IsZero() {
+		times["$gte"] = filter.Since
+	}
+	if !filter.Until.IsZero() {
+		times["$lt"] = filter.Until
+	}
+	if len(times) > 0 {
+		query["time"] = times
+	}
+	return query
+}
@@ -0,0 +1,163 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//SQL drivers supported by SQLStore
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+//SQLStore keeps the audit log in the audit_events table of a SQL database.
+//PostgreSQL and SQLite are supported; the caller registers the driver.
+//Rows are only ever inserted, so the gateway's database user can be
+//limited to INSERT and SELECT on the table.
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+}
+
+//NewSQLStore constructs a new SQLStore, creating the table if needed
+func NewSQLStore(db *sql.DB, driver string) (*SQLStore, error) {
+	if db == nil {
+		panic("nil pointer passed for db")
+	}
+	if driver != DriverPostgres && driver != DriverSQLite {
+		return nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	s := &SQLStore{
+		db:     db,
+		driver: driver,
+	}
+
+	id := "INTEGER PRIMARY KEY AUTOINCREMENT"
+	if driver == DriverPostgres {
+		id = "BIGSERIAL PRIMARY KEY"
+	}
+	//times are stored as Unix nanoseconds, so that they compare
+	//correctly whatever time zone or format the driver uses
+	stmts := []string{
+		"CREATE TABLE IF NOT EXISTS audit_events (id " + id + ", unix_nano BIGINT NOT NULL, " +
+			"actor TEXT NOT NULL, action TEXT NOT NULL, target TEXT NOT NULL, ip TEXT NOT NULL, outcome TEXT NOT NULL)",
+		"CREATE INDEX IF NOT EXISTS audit_events_time ON audit_events (unix_nano)",
+		"CREATE INDEX IF NOT EXISTS audit_events_actor ON audit_events (actor, id)",
+		"CREATE INDEX IF NOT EXISTS audit_events_action ON audit_events (action, id)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("error creating audit_events table: %v", err)
+		}
+	}
+	return s, nil
+}
+
+//Append adds the event to the log
+func (s *SQLStore) Append(ctx context.Context, event *Event) error {
+	_, err := s.db.ExecContext(ctx, s.rebind("INSERT INTO audit_events (unix_nano, actor, action, target, ip, outcome) "+
+		"VALUES (?, ?, ?, ?, ?, ?)"), event.Time.UnixNano(), event.Actor, event.Action, event.Target, event.IP, event.Outcome)
+	if err != nil {
+		return fmt.Errorf("error appending event: %v", err)
+	}
+	return nil
+}
+
+//Find returns up to `limit` events matching the filter,
+//latest first, skipping the first `offset`
+func (s *SQLStore) Find(ctx context.Context, filter *Filter, offset int, limit int) ([]*Event, error) {
+	events := []*Event{}
+	where, args := sqlFilter(filter)
+	err := s.query(ctx, where+" ORDER BY id DESC LIMIT ? OFFSET ?", append(args, limit, offset), func(event *Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+//Each calls `fn` with every event matching the filter, earliest first
+func (s *SQLStore) Each(ctx context.Context, filter *Filter, fn func(event *Event) error) error {
+	where, args := sqlFilter(filter)
+	return s.query(ctx, where+" ORDER BY id", args, fn)
+}
+
+//query selects the events with the clauses after FROM and calls `fn` with each
+func (s *SQLStore) query(ctx context.Context, clauses string, args []interface{}, fn func(event *Event) error) error {
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT unix_nano, actor, action, target, ip, outcome FROM audit_events"+clauses), args...)
+	if err != nil {
+		return fmt.Errorf("error finding events: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event := &Event{}
+		var unixNano int64
+		if err := rows.Scan(&unixNano, &event.Actor, &event.Action, &event.Target, &event.IP, &event.Outcome); err != nil {
+			return fmt.Errorf("error scanning event: %v", err)
+		}
+		event.Time = time.Unix(0, unixNano).UTC()
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+//sqlFilter converts the filter to a WHERE clause and its arguments
+func sqlFilter(filter *Filter) (string, []interface{}) {
+	conds := []string{}
+	args := []interface{}{}
+	fields := []struct {
+		column string
+		value  string
+	}{
+		{"actor", filter.Actor},
+		{"action", filter.Action},
+		{"target", filter.Target},
+		{"outcome", filter.Outcome},
+	}
+	for _, f := range fields {
+		if len(f.value) > 0 {
+			conds = append(conds, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "unix_nano >= ?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "unix_nano < ?")
+		args = append(args, filter.Until.UnixNano())
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+//rebind replaces the ? placeholders in the query with the driver's placeholders
+func (s *SQLStore) rebind(query string) string {
+	if s.driver != DriverPostgres {
+		return query
+	}
+	buf := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			buf.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		buf.WriteRune(c)
+	}
+	return buf.String()
+}
@@ -0,0 +1,177 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+//testStore runs every Store implementation through the same scenario
+func testStore(t *testing.T, store Store) {
+	ctx := context.Background()
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	appended := []*Event{
+		{Time: start, Actor: "a", Action: ActionSignIn, Target: "a@uw.edu", IP: "10.0.0.1", Outcome: OutcomeSuccess},
+		{Time: start.Add(time.Minute), Action: ActionSignIn, Target: "b@uw.edu", IP: "10.0.0.2", Outcome: OutcomeFailure},
+		{Time: start.Add(2 * time.Minute), Actor: "a", Action: ActionFileUpload, Target: "rec.csv", IP: "10.0.0.1", Outcome: OutcomeSuccess},
+		{Time: start.Add(3 * time.Minute), Actor: "b", Action: ActionRunAnalysis, Target: "/v1/clean/rec.csv", IP: "10.0.0.2", Outcome: OutcomeDenied},
+		{Time: start.Add(4 * time.Minute), Actor: "a", Action: ActionSignOut, IP: "10.0.0.1", Outcome: OutcomeSuccess},
+	}
+	for _, event := range appended {
+		if err := store.Append(ctx, event); err != nil {
+			t.Fatalf("error appending event: %v", err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		filter   *Filter
+		offset   int
+		limit    int
+		expected []int
+	}{
+		{"All", &Filter{}, 0, 10, []int{4, 3, 2, 1, 0}},
+		{"Limit", &Filter{}, 0, 2, []int{4, 3}},
+		{"Offset", &Filter{}, 3, 10, []int{1, 0}},
+		{"Past the End", &Filter{}, 10, 10, []int{}},
+		{"Actor", &Filter{Actor: "a"}, 0, 10, []int{4, 2, 0}},
+		{"Action", &Filter{Action: ActionSignIn}, 0, 10, []int{1, 0}},
+		{"Target", &Filter{Target: "rec.csv"}, 0, 10, []int{2}},
+		{"Outcome", &Filter{Outcome: OutcomeSuccess}, 0, 10, []int{4, 2, 0}},
+		{"Time Range", &Filter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, 0, 10, []int{2, 1}},
+		{"Combined", &Filter{Actor: "a", Since: start.Add(time.Second)}, 0, 1, []int{4}},
+		{"No Match", &Filter{Actor: "c"}, 0, 10, []int{}},
+	}
+	for _, c := range cases {
+		events, err := store.Find(ctx, c.filter, c.offset, c.limit)
+		if err != nil {
+			t.Fatalf("case %s: error finding events: %v", c.name, err)
+		}
+		if len(events) != len(c.expected) {
+			t.Errorf("case %s: expected %d events but got %d", c.name, len(c.expected), len(events))
+			continue
+		}
+		for i, event := range events {
+			if !sameEvent(event, appended[c.expected[i]]) {
+				t.Errorf("case %s: expected event %d to be %+v but got %+v", c.name, i, appended[c.expected[i]], event)
+			}
+		}
+	}
+
+	//Each visits events earliest first
+	visited := []*Event{}
+	err := store.Each(ctx, &Filter{Actor: "a"}, func(event *Event) error {
+		visited = append(visited, event)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error visiting events: %v", err)
+	}
+	if len(visited) != 3 || !sameEvent(visited[0], appended[0]) || !sameEvent(visited[2], appended[4]) {
+		t.Errorf("expected events 0, 2 and 4 in order but got %+v", visited)
+	}
+
+	//and stops at the first error
+	stop := errors.New("stop")
+	n := 0
+	err = store.Each(ctx, &Filter{}, func(event *Event) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("expected Each to stop at the first error but it returned %v after %d events", err, n)
+	}
+}
+
+//sameEvent reports whether the events are equal, ignoring time zones
+func sameEvent(a *Event, b *Event) bool {
+	return a.Time.Equal(b.Time) && a.Actor == b.Actor && a.Action == b.Action &&
+		a.Target == b.Target && a.IP == b.IP && a.Outcome == b.Outcome
+}
+
+//TestMemStore tests the MemStore object
+func TestMemStore(t *testing.T) {
+	testStore(t, NewMemStore())
+}
+
+//TestSQLiteStore tests the SQLStore object with SQLite
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open(DriverSQLite, filepath.Join(dir, "audit.db"))
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLStore(db, DriverSQLite)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	//creating the table again is harmless
+	if _, err := NewSQLStore(db, DriverSQLite); err != nil {
+		t.Fatalf("error creating store again: %v", err)
+	}
+	testStore(t, store)
+}
+
+//TestPostgresStore tests the SQLStore object with the PostgreSQL
+//database at POSTGRES_DSN, and is skipped if that isn't set
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	db, err := sql.Open(DriverPostgres, dsn)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Exec("DROP TABLE IF EXISTS audit_events"); err != nil {
+		t.Fatalf("error dropping table: %v", err)
+	}
+	store, err := NewSQLStore(db, DriverPostgres)
+	if err != nil {
+		t.Fatalf("error creating store: %v", err)
+	}
+	testStore(t, store)
+}
+
+//TestMongoStore tests the MongoStore object with the MongoDB
+//server at MONGO_ADDR, and is skipped if that isn't set
+func TestMongoStore(t *testing.T) {
+	addr := os.Getenv("MONGO_ADDR")
+	if len(addr) == 0 {
+		t.Skip("MONGO_ADDR not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://"+addr))
+	if err != nil {
+		t.Fatalf("error connecting to mongo: %v", err)
+	}
+	defer client.Disconnect(ctx)
+
+	if err := client.Database("mgo").Collection("audit-test").Drop(ctx); err != nil {
+		t.Fatalf("error dropping collection: %v", err)
+	}
+	store := NewMongoStore(client, "mgo", "audit-test")
+	if err := store.EnsureIndexes(ctx); err != nil {
+		t.Fatalf("error creating indexes: %v", err)
+	}
+	testStore(t, store)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//Output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+//app holds what the commands work with. The stores are opened
+//by the commands that need them, so that checking storage
+//usage doesn't need the database to be reachable.
+type app struct {
+	out    io.Writer
+	errOut io.Writer
+	in     io.Reader
+	format string
+
+	userStore      func() (users.Store, error)
+	sessionManager func() (sessions.Manager, error)
+	//publish sends a message to the gateways subscribed to
+	//the redis channel, and returns how many received it
+	publish func(channel string, message string) (int64, error)
+	files   *files.Dir
+}
+
+//command is a subcommand of synapsectl
+type command struct {
+	usage string
+	run   func(a *app, args []string) error
+}
+
+//commands are the subcommands of synapsectl, by name
+var commands = map[string]*command{
+	"users create":  {"create a user", (*app).usersCreate},
+	"users passwd":  {"set a user's password and end their sessions", (*app).usersPasswd},
+	"sessions list": {"list the active sessions of a user", (*app).sessionsList},
+	"sessions kill": {"end one or all sessions of a user", (*app).sessionsKill},
+	"trie rebuild":  {"ask the gateways to reload their user search tries", (*app).trieRebuild},
+	"files usage":   {"show the storage used by each user", (*app).filesUsage},
+	"files verify":  {"check users' files against their recorded checksums", (*app).filesVerify},
+}
+
+//run parses the global flags and runs the command named by the arguments
+func (a *app) run(args []string) error {
+	fs := flag.NewFlagSet("synapsectl", flag.ContinueOnError)
+	fs.SetOutput(a.errOut)
+	fs.StringVar(&a.format, "o", formatTable, "output format, table or json")
+	fs.Usage = a.usage
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if a.format != formatTable && a.format != formatJSON {
+		return fmt.Errorf("unsupported output format %q", a.format)
+	}
+
+	args = fs.Args()
+	if len(args) < 2 {
+		a.usage()
+		return errors.New("no command given")
+	}
+	name := args[0] + " " + args[1]
+	cmd, found := commands[name]
+	if !found {
+		a.usage()
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return cmd.run(a, args[2:])
+}
+
+//usage lists the commands
+func (a *app) usage() {
+	fmt.Fprintln(a.errOut, "usage: synapsectl [-o table|json] <command> <subcommand> [flags]")
+	fmt.Fprintln(a.errOut, "\ncommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(a.errOut, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(a.errOut, "\nrun a command with -h to see its flags")
+}
+
+//flags returns the flag set of the named command
+func (a *app) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("synapsectl "+name, flag.ContinueOnError)
+	fs.SetOutput(a.errOut)
+	return fs
+}
+
+//print writes `v` as JSON, or the rows as a table under the header
+func (a *app) print(v interface{}, header []string, rows [][]string) error {
+	if a.format == formatJSON {
+		enc := json.NewEncoder(a.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := tabwriter.NewWriter(a.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+//required returns an error naming the first of the flags that wasn't set
+func required(flags map[string]string) error {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(flags[name]) == 0 {
+			return fmt.Errorf("please set -%s", name)
+		}
+	}
+	return nil
+}
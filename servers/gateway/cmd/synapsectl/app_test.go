@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/config"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//testState is a session state naming its user, like the gateway's
+type testState struct {
+	User *users.User
+}
+
+//Subject returns the ID of the user
+func (s *testState) Subject() string {
+	return s.User.ID.Hex()
+}
+
+func TestCommands(t *testing.T) {
+	root, err := ioutil.TempDir("", "synapsectl-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	dir := files.NewDir(root)
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	manager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	published := []string{}
+	messages := []string{}
+	gateways := int64(1)
+
+	run := func(stdin string, args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		a := &app{
+			out:    out,
+			errOut: ioutil.Discard,
+			in:     strings.NewReader(stdin),
+			userStore: func() (users.Store, error) {
+				return userStore, nil
+			},
+			sessionManager: func() (sessions.Manager, error) {
+				return manager, nil
+			},
+			publish: func(channel string, message string) (int64, error) {
+				published = append(published, channel)
+				messages = append(messages, message)
+				return gateways, nil
+			},
+			files: dir,
+		}
+		err := a.run(args)
+		return out.String(), err
+	}
+
+	cases := []struct {
+		name            string
+		stdin           string
+		args            []string
+		expectError     bool
+		expectedOutputs []string
+	}{
+		{
+			"No Command",
+			"",
+			[]string{},
+			true,
+			nil,
+		},
+		{
+			"Unknown Command",
+			"",
+			[]string{"users", "frobnicate"},
+			true,
+			nil,
+		},
+		{
+			"Unknown Format",
+			"",
+			[]string{"-o", "yaml", "files", "usage"},
+			true,
+			nil,
+		},
+		{
+			"Create User",
+			"",
+			[]string{"users", "create", "-email", "fred@uw.edu", "-username", "fred", "-password", "123456", "-role", "admin"},
+			false,
+			[]string{"fred@uw.edu", "admin", "true"},
+		},
+		{
+			"Create User With Password On Stdin",
+			"654321\n",
+			[]string{"users", "create", "-email", "alice@uw.edu", "-username", "alice", "-verified=false"},
+			false,
+			[]string{"alice@uw.edu", "researcher", "false"},
+		},
+		{
+			"Create Duplicate User",
+			"",
+			[]string{"users", "create", "-email", "fred@uw.edu", "-username", "fred2", "-password", "123456"},
+			true,
+			nil,
+		},
+		{
+			"Create User With Unknown Role",
+			"",
+			[]string{"users", "create", "-email", "bob@uw.edu", "-username", "bob", "-password", "123456", "-role", "superuser"},
+			true,
+			nil,
+		},
+		{
+			"Create User Without Email",
+			"",
+			[]string{"users", "create", "-username", "bob", "-password", "123456"},
+			true,
+			nil,
+		},
+		{
+			"Set Short Password",
+			"",
+			[]string{"users", "passwd", "-email", "fred@uw.edu", "-password", "123"},
+			true,
+			nil,
+		},
+		{
+			"Set Password Of Unknown User",
+			"",
+			[]string{"users", "passwd", "-email", "nobody@uw.edu", "-password", "abcdef"},
+			true,
+			nil,
+		},
+		{
+			"Rebuild Trie",
+			"",
+			[]string{"-o", "json", "trie", "rebuild"},
+			false,
+			[]string{`"gateways": 1`},
+		},
+	}
+
+	for _, c := range cases {
+		output, err := run(c.stdin, c.args...)
+		if c.expectError && err == nil {
+			t.Errorf("case %s: expected error but didn't get one", c.name)
+		}
+		if !c.expectError && err != nil {
+			t.Errorf("case %s: unexpected error: %v", c.name, err)
+		}
+		for _, expected := range c.expectedOutputs {
+			if !strings.Contains(output, expected) {
+				t.Errorf("case %s: expected output to contain %q but got:\n%s", c.name, expected, output)
+			}
+		}
+	}
+
+	//created users can sign in, and the gateways are told to add them to their tries
+	fred, err := userStore.GetByEmail(context.Background(), "fred@uw.edu")
+	if err != nil {
+		t.Fatalf("error getting created user: %v", err)
+	}
+	if err := fred.Authenticate("123456"); err != nil || fred.Role != users.RoleAdmin {
+		t.Errorf("expected fred to be an admin with the given password but got %s, %v", fred.Role, err)
+	}
+	if len(published) != 3 || published[0] != config.TrieUpdateChannel || published[2] != config.TrieRebuildChannel {
+		t.Fatalf("expected trie updates for 2 created users and a rebuild for 1 command but got %v", published)
+	}
+	u := &indexes.Update[bson.ObjectId]{}
+	if err := json.Unmarshal([]byte(messages[0]), u); err != nil || u.Value != fred.ID || len(u.Added) != len(fred.SearchKeys()) {
+		t.Errorf("expected an update adding fred to the trie but got %s (%v)", messages[0], err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := manager.Begin(&testState{User: fred}, httptest.NewRecorder()); err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+	}
+	output, err := run("", "-o", "json", "sessions", "list", "-email", "fred@uw.edu")
+	if err != nil {
+		t.Fatalf("error listing sessions: %v", err)
+	}
+	list := []*session{}
+	if err := json.Unmarshal([]byte(output), &list); err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 sessions but got %s (%v)", output, err)
+	}
+
+	if _, err := run("", "sessions", "kill", "-email", "fred@uw.edu", "-id", "not a session"); err == nil {
+		t.Errorf("expected error killing unknown session")
+	}
+	if _, err := run("", "sessions", "kill", "-email", "fred@uw.edu", "-id", list[0].ID); err != nil {
+		t.Errorf("error killing session: %v", err)
+	}
+	if sids, _ := manager.Sessions(fred.ID.Hex()); len(sids) != 1 || sids[0].String() != list[1].ID {
+		t.Errorf("expected only the other session to remain but got %v", sids)
+	}
+
+	//setting the password ends the remaining sessions
+	output, err = run("abcdef\n", "users", "passwd", "-email", "fred@uw.edu")
+	if err != nil {
+		t.Fatalf("error setting password: %v", err)
+	}
+	if !strings.Contains(output, "fred@uw.edu") {
+		t.Errorf("expected output to name the user but got:\n%s", output)
+	}
+	if sids, _ := manager.Sessions(fred.ID.Hex()); len(sids) != 0 {
+		t.Errorf("expected sessions to be ended but got %v", sids)
+	}
+	if fred, _ = userStore.GetByEmail(context.Background(), "fred@uw.edu"); fred.Authenticate("abcdef") != nil {
+		t.Errorf("expected new password to work")
+	}
+
+	//files
+	userPath, _ := dir.UserPath("fred")
+	if err := os.MkdirAll(userPath, 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	for _, name := range []string{"a.edf", "b.edf"} {
+		if err := ioutil.WriteFile(filepath.Join(userPath, name), []byte(name), 0600); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		if err := dir.RecordChecksum("fred", name); err != nil {
+			t.Fatalf("error recording checksum: %v", err)
+		}
+	}
+	output, err = run("", "files", "usage")
+	if err != nil {
+		t.Fatalf("error getting usage: %v", err)
+	}
+	if !strings.Contains(output, "fred") || !strings.Contains(output, "(total)") {
+		t.Errorf("expected usage of fred and a total but got:\n%s", output)
+	}
+	if _, err := run("", "files", "verify"); err != nil {
+		t.Errorf("unexpected error verifying intact files: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(userPath, "b.edf"), []byte("corrupted"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	output, err = run("", "files", "verify", "-user", "fred")
+	if err == nil {
+		t.Errorf("expected error verifying corrupted file")
+	}
+	if !strings.Contains(output, "b.edf") || strings.Contains(output, "a.edf") {
+		t.Errorf("expected only the corrupted file to be listed but got:\n%s", output)
+	}
+}
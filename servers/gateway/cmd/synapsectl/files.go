@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/synapse-api/servers/gateway/files"
+)
+
+//filesUsage shows the storage used by each user
+func (a *app) filesUsage(args []string) error {
+	if err := a.flags("files usage").Parse(args); err != nil {
+		return err
+	}
+	usage, deleted, err := a.files.Usage()
+	if err != nil {
+		return fmt.Errorf("error getting usage: %v", err)
+	}
+
+	total := &files.Usage{UserName: "total"}
+	rows := [][]string{}
+	for _, u := range append(usage, deleted) {
+		total.Files += u.Files
+		total.Bytes += u.Bytes
+	}
+	for _, u := range usage {
+		rows = append(rows, []string{u.UserName, fmt.Sprint(u.Files), fmt.Sprint(u.Bytes)})
+	}
+	rows = append(rows,
+		[]string{"(deleted)", fmt.Sprint(deleted.Files), fmt.Sprint(deleted.Bytes)},
+		[]string{"(total)", fmt.Sprint(total.Files), fmt.Sprint(total.Bytes)})
+	return a.print(map[string]interface{}{"users": usage, "deleted": deleted, "total": total},
+		[]string{"USERNAME", "FILES", "BYTES"}, rows)
+}
+
+//filesVerify checks the files of one or all users against their recorded
+//checksums, and fails if any file changed or went missing
+func (a *app) filesVerify(args []string) error {
+	fs := a.flags("files verify")
+	userName := fs.String("user", "", "user name whose files to check; all users if not given")
+	all := fs.Bool("all", false, "also list files that match or have no recorded checksum")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	names := []string{*userName}
+	if len(*userName) == 0 {
+		var err error
+		if names, err = a.files.Users(); err != nil {
+			return fmt.Errorf("error listing users: %v", err)
+		}
+	}
+	checks := []*files.Check{}
+	failed := 0
+	for _, name := range names {
+		userChecks, err := a.files.Verify(name)
+		if err != nil {
+			return fmt.Errorf("error verifying files of %s: %v", name, err)
+		}
+		for _, c := range userChecks {
+			bad := c.Status == files.ChecksumMismatch || c.Status == files.ChecksumMissing
+			if bad {
+				failed++
+			}
+			if bad || *all {
+				checks = append(checks, c)
+			}
+		}
+	}
+
+	rows := make([][]string, len(checks))
+	for i, c := range checks {
+		rows[i] = []string{c.UserName, c.File, c.Status}
+	}
+	if err := a.print(checks, []string{"USERNAME", "FILE", "STATUS"}, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d files failed verification", failed)
+	}
+	return nil
+}
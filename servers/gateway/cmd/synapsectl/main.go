@@ -0,0 +1,45 @@
+//Command synapsectl manages the users, sessions and files of a deployment
+//without going through the gateway. It reads the same environment variables
+//as the gateway to find the stores, so run it with the gateway's environment.
+//
+//	synapsectl [-o table|json] <command> <subcommand> [flags]
+//
+//Run synapsectl without arguments to list the commands.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/synapse-api/servers/gateway/config"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func main() {
+	client := config.RedisClient()
+	a := &app{
+		out:    os.Stdout,
+		errOut: os.Stderr,
+		in:     os.Stdin,
+		userStore: func() (users.Store, error) {
+			userStore, _, err := config.Stores(context.Background())
+			return userStore, err
+		},
+		sessionManager: func() (sessions.Manager, error) {
+			return config.SessionManager(client, nil)
+		},
+		publish: func(channel string, message string) (int64, error) {
+			return client.Publish(channel, message).Result()
+		},
+		files: config.DataDir(),
+	}
+	if err := a.run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "synapsectl: %v\n", err)
+		os.Exit(1)
+	}
+}
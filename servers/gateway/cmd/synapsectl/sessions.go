@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//session is an active session of a user
+type session struct {
+	UserName string `json:"userName"`
+	ID       string `json:"id"`
+}
+
+//sessionsList lists the active sessions of a user
+func (a *app) sessionsList(args []string) error {
+	fs := a.flags("sessions list")
+	email := fs.String("email", "", "email address of the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"email": *email}); err != nil {
+		return err
+	}
+	user, manager, err := a.sessionUser(*email)
+	if err != nil {
+		return err
+	}
+	sids, err := manager.Sessions(user.ID.Hex())
+	if err != nil {
+		return fmt.Errorf("error listing sessions: %v", err)
+	}
+
+	list := make([]*session, len(sids))
+	rows := make([][]string, len(sids))
+	for i, sid := range sids {
+		list[i] = &session{UserName: user.UserName, ID: sid.String()}
+		rows[i] = []string{user.UserName, sid.String()}
+	}
+	return a.print(list, []string{"USERNAME", "SESSION"}, rows)
+}
+
+//sessionsKill ends one or all of the sessions of a user
+func (a *app) sessionsKill(args []string) error {
+	fs := a.flags("sessions kill")
+	email := fs.String("email", "", "email address of the user")
+	id := fs.String("id", "", "session to end, as listed by sessions list; all sessions if not given")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"email": *email}); err != nil {
+		return err
+	}
+	user, _, err := a.sessionUser(*email)
+	if err != nil {
+		return err
+	}
+	ended, err := a.endSessions(user, sessions.SessionID(*id))
+	if err != nil {
+		return err
+	}
+	if len(*id) > 0 && ended == 0 {
+		return fmt.Errorf("%s has no active session %s", user.UserName, *id)
+	}
+	return a.print(map[string]int{"endedSessions": ended},
+		[]string{"ENDED SESSIONS"}, [][]string{{fmt.Sprint(ended)}})
+}
+
+//sessionUser finds the user with the email address, and opens the session manager
+func (a *app) sessionUser(email string) (*users.User, sessions.Manager, error) {
+	userStore, err := a.userStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := userStore.GetByEmail(context.Background(), email)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error finding user: %v", err)
+	}
+	manager, err := a.sessionManager()
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, manager, nil
+}
+
+//endSessions ends the session `only` of the user, or all of their sessions
+//if `only` is empty, and returns how many were ended
+func (a *app) endSessions(user *users.User, only sessions.SessionID) (int, error) {
+	manager, err := a.sessionManager()
+	if err != nil {
+		return 0, err
+	}
+	sids, err := manager.Sessions(user.ID.Hex())
+	if err != nil {
+		return 0, fmt.Errorf("error listing sessions: %v", err)
+	}
+	ended := 0
+	for _, sid := range sids {
+		if len(only) > 0 && sid != only {
+			continue
+		}
+		if err := manager.Revoke(sid); err != nil {
+			return ended, fmt.Errorf("error ending session: %v", err)
+		}
+		ended++
+	}
+	return ended, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/synapse-api/servers/gateway/config"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//usersCreate creates a user, who can sign in straight away
+func (a *app) usersCreate(args []string) error {
+	fs := a.flags("users create")
+	nu := &users.NewUser{}
+	fs.StringVar(&nu.Email, "email", "", "email address")
+	fs.StringVar(&nu.UserName, "username", "", "user name")
+	fs.StringVar(&nu.FirstName, "first", "", "first name")
+	fs.StringVar(&nu.LastName, "last", "", "last name")
+	fs.StringVar(&nu.Password, "password", "", "password, read from standard input if not given")
+	role := fs.String("role", users.RoleResearcher, "role: admin, researcher or viewer")
+	verified := fs.Bool("verified", true, "whether the email address is treated as verified")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"email": nu.Email, "username": nu.UserName}); err != nil {
+		return err
+	}
+	if err := users.ValidateRole(*role); err != nil {
+		return err
+	}
+	if len(nu.Password) == 0 {
+		password, err := a.readPassword()
+		if err != nil {
+			return err
+		}
+		nu.Password = password
+	}
+	nu.PasswordConf = nu.Password
+
+	userStore, err := a.userStore()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	user, err := userStore.Insert(ctx, nu)
+	if err != nil {
+		return fmt.Errorf("error creating user: %v", err)
+	}
+	if *role != user.EffectiveRole() {
+		if err := userStore.SetRole(ctx, user.ID, *role); err != nil {
+			return fmt.Errorf("error setting role: %v", err)
+		}
+		user.Role = *role
+	}
+	if *verified {
+		if err := userStore.SetEmailVerified(ctx, user.ID, true); err != nil {
+			return fmt.Errorf("error verifying email address: %v", err)
+		}
+		user.EmailVerified = true
+	}
+
+	//the gateways only index users created through them, so they are told of the user
+	if err := a.indexUser(user); err != nil {
+		fmt.Fprintf(a.errOut, "warning: %v; run synapsectl trie rebuild so the user can be found\n", err)
+	}
+	return a.printUsers([]*users.User{user})
+}
+
+//usersPasswd sets the password of a user, and ends their sessions
+//in case the old password was compromised
+func (a *app) usersPasswd(args []string) error {
+	fs := a.flags("users passwd")
+	email := fs.String("email", "", "email address of the user")
+	password := fs.String("password", "", "new password, read from standard input if not given")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := required(map[string]string{"email": *email}); err != nil {
+		return err
+	}
+	if len(*password) == 0 {
+		p, err := a.readPassword()
+		if err != nil {
+			return err
+		}
+		*password = p
+	}
+	if err := users.ValidatePassword(*password, *password); err != nil {
+		return err
+	}
+
+	userStore, err := a.userStore()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	user, err := userStore.GetByEmail(ctx, *email)
+	if err != nil {
+		return fmt.Errorf("error finding user: %v", err)
+	}
+	if err := user.SetPassword(*password); err != nil {
+		return fmt.Errorf("error hashing password: %v", err)
+	}
+	if err := userStore.SetPassHash(ctx, user.ID, user.PassHash); err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	ended, err := a.endSessions(user, "")
+	if err != nil {
+		return err
+	}
+	return a.print(map[string]interface{}{"user": user, "endedSessions": ended},
+		[]string{"ID", "EMAIL", "ENDED SESSIONS"},
+		[][]string{{user.ID.Hex(), user.Email, fmt.Sprint(ended)}})
+}
+
+//trieRebuild asks the running gateways to reload their user search tries
+func (a *app) trieRebuild(args []string) error {
+	if err := a.flags("trie rebuild").Parse(args); err != nil {
+		return err
+	}
+	receivers, err := a.publish(config.TrieRebuildChannel, "")
+	if err != nil {
+		return fmt.Errorf("error asking gateways to rebuild: %v", err)
+	}
+	return a.print(map[string]int64{"gateways": receivers},
+		[]string{"GATEWAYS"}, [][]string{{fmt.Sprint(receivers)}})
+}
+
+//indexUser asks the running gateways to add the user to
+//their user search tries, and fails if none are listening
+func (a *app) indexUser(user *users.User) error {
+	buf, err := json.Marshal(&indexes.Update[bson.ObjectId]{Value: user.ID, Added: user.SearchKeys(), Origin: "synapsectl"})
+	if err != nil {
+		return err
+	}
+	receivers, err := a.publish(config.TrieUpdateChannel, string(buf))
+	if err != nil {
+		return fmt.Errorf("error telling gateways of the user: %v", err)
+	}
+	if receivers == 0 {
+		return errors.New("no gateways are listening")
+	}
+	return nil
+}
+
+//printUsers prints the users
+func (a *app) printUsers(list []*users.User) error {
+	rows := make([][]string, len(list))
+	for i, u := range list {
+		rows[i] = []string{u.ID.Hex(), u.Email, u.UserName, u.EffectiveRole(), fmt.Sprint(u.EmailVerified)}
+	}
+	return a.print(list, []string{"ID", "EMAIL", "USERNAME", "ROLE", "VERIFIED"}, rows)
+}
+
+//readPassword reads a password from the first line of standard input
+func (a *app) readPassword() (string, error) {
+	scanner := bufio.NewScanner(a.in)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("error reading password: %v", err)
+		}
+		return "", errors.New("please set -password or give the password on standard input")
+	}
+	return strings.TrimRight(scanner.Text(), "\r"), nil
+}
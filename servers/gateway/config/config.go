@@ -0,0 +1,258 @@
+//Package config reads the gateway's configuration from environment
+//variables, so that the gateway and synapsectl open the same stores
+package config
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//TrieRebuildChannel is the redis channel on which gateways
+//are asked to rebuild their user search tries
+const TrieRebuildChannel = "trie:rebuild"
+
+//TrieUpdateChannel is the redis channel on which gateways share
+//the changes to users that their user search tries need
+const TrieUpdateChannel = "trie:updates"
+
+//RedisClient returns a client for the redis server at REDISADDR,
+//which holds sessions, lockouts and single sign-on logins
+func RedisClient() *redis.Client {
+	redisAddr := os.Getenv("REDISADDR")
+	if len(redisAddr) == 0 {
+		redisAddr = "redis:6379"
+	}
+	return redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+	})
+}
+
+//Stores opens the user store and the audit log.
+//USER_STORE chooses where they are kept: "mongo" (the default) at DBADDR,
+//or "postgres" or "sqlite3" with the data source name in USER_STORE_DSN.
+//For SQLite, add "?_txlock=immediate&_busy_timeout=5000" so that
+//concurrent updates wait for each other.
+//The SQL drivers must be imported by the caller.
+func Stores(ctx context.Context) (users.Store, audit.Store, error) {
+	switch driver := os.Getenv("USER_STORE"); driver {
+	case "", "mongo":
+		dbAddr := os.Getenv("DBADDR")
+		if len(dbAddr) == 0 {
+			dbAddr = "mymongo:27017"
+		}
+
+		//DBADDR may be a host:port, or a full connection string
+		if !strings.HasPrefix(dbAddr, "mongodb://") && !strings.HasPrefix(dbAddr, "mongodb+srv://") {
+			dbAddr = "mongodb://" + dbAddr
+		}
+
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		//commands are traced as part of the requests they are made for
+		mongoClient, err := mongo.Connect(dialCtx, options.Client().ApplyURI(dbAddr).SetMonitor(otelmongo.NewMonitor()))
+		if err == nil {
+			err = mongoClient.Ping(dialCtx, nil)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to dial mongodb: %v", err)
+		}
+		userStore := users.NewMongoStore(mongoClient, "mgo", "users")
+		if err := userStore.EnsureIndexes(dialCtx); err != nil {
+			return nil, nil, fmt.Errorf("error creating user indexes: %v", err)
+		}
+		auditLog := audit.NewMongoStore(mongoClient, "mgo", "audit")
+		if err := auditLog.EnsureIndexes(dialCtx); err != nil {
+			return nil, nil, fmt.Errorf("error creating audit indexes: %v", err)
+		}
+		return userStore, auditLog, nil
+	case users.DriverPostgres, users.DriverSQLite:
+		db, err := sql.Open(driver, os.Getenv("USER_STORE_DSN"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening %s database: %v", driver, err)
+		}
+		userStore, err := users.NewSQLStore(db, driver)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error setting up %s user store: %v", driver, err)
+		}
+		auditLog, err := audit.NewSQLStore(db, driver)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error setting up %s audit log: %v", driver, err)
+		}
+		return userStore, auditLog, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported USER_STORE %q", driver)
+	}
+}
+
+//defaultSessionTTL is how long sessions last without being used,
+//unless SESSION_TTL says otherwise
+const defaultSessionTTL = 30 * 24 * time.Hour
+
+//SessionManager returns the session manager chosen by SESSION_MODE:
+//"opaque" session IDs signed with SESSIONKEY whose state lives in redis
+//(the default), or "jwt" signed access tokens with refresh tokens.
+//Sessions end once they haven't been used for SESSION_TTL (30 days
+//by default), and so do the redis sets listing each user's sessions.
+//In "jwt" mode, every request still makes one round trip to redis, to check
+//that the token's session hasn't been ended. The denylist isn't cached,
+//since an instance that missed a revocation would keep accepting the token
+//until it expired, after ACCESS_TOKEN_TTL (15 minutes by default).
+//If `wrap` isn't nil, the manager uses the store it returns for the
+//redis store, such as one whose operations are timed.
+func SessionManager(client *redis.Client, wrap func(sessions.Store) sessions.Store) (sessions.Manager, error) {
+	sskey := os.Getenv("SESSIONKEY")
+	if len(sskey) == 0 {
+		return nil, errors.New("please set SESSIONKEY")
+	}
+
+	sessionTTL := defaultSessionTTL
+	if ttl := os.Getenv("SESSION_TTL"); len(ttl) > 0 {
+		var err error
+		if sessionTTL, err = time.ParseDuration(ttl); err != nil || sessionTTL <= 0 {
+			return nil, fmt.Errorf("invalid SESSION_TTL %q", ttl)
+		}
+	}
+
+	var redisStore sessions.Store = sessions.NewRedisStore(client, sessionTTL)
+	if wrap != nil {
+		redisStore = wrap(redisStore)
+	}
+	sessionIndex := sessions.NewRedisIndex(client, sessionTTL)
+	switch mode := os.Getenv("SESSION_MODE"); mode {
+	case "", "opaque":
+		opaqueManager := sessions.NewOpaqueManager(sskey, redisStore)
+		opaqueManager.Index = sessionIndex
+		return opaqueManager, nil
+	case "jwt":
+		var signer sessions.TokenSigner
+		var err error
+		switch alg := os.Getenv("JWT_ALG"); alg {
+		case "", "HS256":
+			jwtKey := os.Getenv("JWT_KEY")
+			if len(jwtKey) == 0 {
+				jwtKey = sskey
+			}
+			signer, err = sessions.NewHS256Signer(jwtKey)
+		case "EdDSA":
+			seed, decodeErr := base64.StdEncoding.DecodeString(os.Getenv("JWT_ED25519_SEED"))
+			if decodeErr != nil {
+				return nil, fmt.Errorf("invalid JWT_ED25519_SEED: %v", decodeErr)
+			}
+			signer, err = sessions.NewEdDSASigner(seed)
+		default:
+			return nil, fmt.Errorf("unsupported JWT_ALG %q", alg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error creating token signer: %v", err)
+		}
+
+		accessDuration := 15 * time.Minute
+		if ttl := os.Getenv("ACCESS_TOKEN_TTL"); len(ttl) > 0 {
+			if accessDuration, err = time.ParseDuration(ttl); err != nil {
+				return nil, fmt.Errorf("invalid ACCESS_TOKEN_TTL: %v", err)
+			}
+		}
+
+		tokenManager := sessions.NewTokenManager(sskey, redisStore, signer,
+			sessions.NewRedisDenylist(client), accessDuration)
+		tokenManager.Index = sessionIndex
+		return tokenManager, nil
+	default:
+		return nil, fmt.Errorf("unsupported SESSION_MODE %q", mode)
+	}
+}
+
+//DataDir returns DATA_DIR, which holds one directory of
+//recordings and analysis results per user
+func DataDir() *files.Dir {
+	dataDir := os.Getenv("DATA_DIR")
+	if len(dataDir) == 0 {
+		dataDir = files.DefaultRoot
+	}
+	return files.NewDir(dataDir)
+}
+
+//Logger returns the logger the gateway logs with, which writes to stdout.
+//LOG_FORMAT chooses "json" (the default) or "text" lines, and LOG_LEVEL
+//the least severe level logged: "debug", "info" (the default), "warn"
+//or "error".
+func Logger() (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if l := os.Getenv("LOG_LEVEL"); len(l) > 0 {
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			return nil, fmt.Errorf("invalid LOG_LEVEL: %v", err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf("unsupported LOG_FORMAT %q", format)
+	}
+}
+
+//Tracing sets up the global TracerProvider that the gateway's spans are
+//sent to, and the W3C trace context propagator. OTEL_TRACES_EXPORTER
+//chooses where spans are exported: "none" (the default) turns tracing
+//off, "otlp" sends them to the OpenTelemetry collector configured by the
+//standard OTEL_EXPORTER_OTLP_* variables, over HTTP, and "stdout" writes
+//them to standard output, for trying tracing out without a collector.
+//The service is named "gateway" unless OTEL_SERVICE_NAME says otherwise.
+//The returned function flushes the spans that are yet to be exported.
+func Tracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := os.Getenv("OTEL_TRACES_EXPORTER"); name {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_TRACES_EXPORTER %q", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace exporter: %v", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("gateway")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error describing the service: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,174 @@
+package files
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//checksumDirName is the directory, inside the root, holding one manifest of
+//SHA-256 checksums per user, in the format written by sha256sum
+const checksumDirName = ".checksums"
+
+//checksumManifest is the manifest of the checksums of each user's files
+var checksumManifest = &manifest[string]{
+	name:    "checksums",
+	dirName: checksumDirName,
+	ext:     ".sha256",
+	decode:  decodeChecksums,
+	encode:  encodeChecksums,
+}
+
+//Statuses of a file checked by Verify
+const (
+	//ChecksumOK means the file matches its recorded checksum
+	ChecksumOK = "ok"
+	//ChecksumMismatch means the file has changed since its checksum was recorded
+	ChecksumMismatch = "mismatch"
+	//ChecksumMissing means a checksum was recorded for a file that no longer exists
+	ChecksumMissing = "missing"
+	//ChecksumUnrecorded means no checksum was recorded for the file, such as for
+	//files uploaded before checksums were kept, or written by the analysis services
+	ChecksumUnrecorded = "unrecorded"
+)
+
+//Check is the result of verifying one file of a user
+type Check struct {
+	UserName string `json:"userName"`
+	File     string `json:"file"`
+	Status   string `json:"status"`
+}
+
+//RecordChecksum computes the checksum of the user's file, given by its path
+//relative to the user's directory, and records it in the user's manifest
+func (d *Dir) RecordChecksum(userName string, file string) error {
+	userPath, err := d.UserPath(userName)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsLocal(filepath.FromSlash(file)) {
+		return ErrInvalidFileName
+	}
+	sum, err := fileChecksum(filepath.Join(userPath, filepath.FromSlash(file)))
+	if err != nil {
+		return err
+	}
+	return checksumManifest.update(d, userName, func(sums map[string]string) {
+		sums[file] = sum
+	})
+}
+
+//RemoveChecksum forgets the checksum of the user's file
+func (d *Dir) RemoveChecksum(userName string, file string) error {
+	return checksumManifest.update(d, userName, func(sums map[string]string) {
+		delete(sums, file)
+	})
+}
+
+//Verify compares the user's files with their recorded checksums, and
+//returns the result for every file, ordered by name
+func (d *Dir) Verify(userName string) ([]*Check, error) {
+	userPath, err := d.UserPath(userName)
+	if err != nil {
+		return nil, err
+	}
+	sums, err := checksumManifest.read(d, userName)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []*Check{}
+	seen := map[string]bool{}
+	err = filepath.Walk(userPath, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == userPath {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(userPath, path)
+		if err != nil {
+			return err
+		}
+		file := filepath.ToSlash(rel)
+		seen[file] = true
+		check := &Check{UserName: userName, File: file, Status: ChecksumUnrecorded}
+		if expected, found := sums[file]; found {
+			sum, err := fileChecksum(path)
+			if err != nil {
+				return err
+			}
+			check.Status = ChecksumOK
+			if sum != expected {
+				check.Status = ChecksumMismatch
+			}
+		}
+		checks = append(checks, check)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error verifying files: %v", err)
+	}
+	for file := range sums {
+		if !seen[file] {
+			checks = append(checks, &Check{UserName: userName, File: file, Status: ChecksumMissing})
+		}
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].File < checks[j].File
+	})
+	return checks, nil
+}
+
+//decodeChecksums reads a manifest in the format written by sha256sum
+func decodeChecksums(r io.Reader) (map[string]string, error) {
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line %q", scanner.Text())
+		}
+		sums[fields[1]] = fields[0]
+	}
+	return sums, scanner.Err()
+}
+
+//encodeChecksums writes a manifest, ordered by file, so that
+//it can be checked with `sha256sum -c` from the user's directory
+func encodeChecksums(w io.Writer, sums map[string]string) error {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s  %s\n", sums[name], name)
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+//fileChecksum returns the hex-encoded SHA-256 checksum of the file at `path`
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,150 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksums(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	d := NewDir(root)
+
+	userPath, _ := d.UserPath("fredhw")
+	if err := os.MkdirAll(filepath.Join(userPath, "results"), 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	contents := map[string]string{
+		"changed.edf":         "recording",
+		"deleted.edf":         "recording",
+		"recording.edf":       "recording",
+		"results/summary.txt": "summary",
+	}
+	for name, c := range contents {
+		if err := ioutil.WriteFile(filepath.Join(userPath, name), []byte(c), 0600); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	for _, name := range []string{"changed.edf", "deleted.edf", "recording.edf", "removed.edf"} {
+		if name == "removed.edf" {
+			if err := ioutil.WriteFile(filepath.Join(userPath, name), []byte("removed"), 0600); err != nil {
+				t.Fatalf("error writing file: %v", err)
+			}
+		}
+		if err := d.RecordChecksum("fredhw", name); err != nil {
+			t.Fatalf("error recording checksum of %s: %v", name, err)
+		}
+	}
+	if err := d.RecordChecksum("fredhw", "nothing.edf"); err == nil {
+		t.Errorf("expected error recording checksum of a file that doesn't exist")
+	}
+	if err := d.RecordChecksum("fredhw", "../alice/recording.edf"); err != ErrInvalidFileName {
+		t.Errorf("expected ErrInvalidFileName for a file outside the user's directory but got %v", err)
+	}
+
+	//removed.edf is deleted through the gateway, the others behind its back
+	if err := os.Remove(filepath.Join(userPath, "removed.edf")); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if err := d.RemoveChecksum("fredhw", "removed.edf"); err != nil {
+		t.Fatalf("error removing checksum: %v", err)
+	}
+	if err := os.Remove(filepath.Join(userPath, "deleted.edf")); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(userPath, "changed.edf"), []byte("corrupted"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	checks, err := d.Verify("fredhw")
+	if err != nil {
+		t.Fatalf("error verifying: %v", err)
+	}
+	expected := []Check{
+		{"fredhw", "changed.edf", ChecksumMismatch},
+		{"fredhw", "deleted.edf", ChecksumMissing},
+		{"fredhw", "recording.edf", ChecksumOK},
+		{"fredhw", "results/summary.txt", ChecksumUnrecorded},
+	}
+	if len(checks) != len(expected) {
+		t.Fatalf("expected %d checks but got %d", len(expected), len(checks))
+	}
+	for i, c := range checks {
+		if *c != expected[i] {
+			t.Errorf("expected check %d to be %+v but got %+v", i, expected[i], *c)
+		}
+	}
+
+	if checks, err := d.Verify("nobody"); err != nil || len(checks) != 0 {
+		t.Errorf("expected no checks for user without files but got %v, %v", checks, err)
+	}
+
+	//a new user with the same name doesn't inherit the checksums
+	if err := d.ScheduleDeletion("fredhw", time.Now()); err != nil {
+		t.Fatalf("error scheduling deletion: %v", err)
+	}
+	if checks, err := d.Verify("fredhw"); err != nil || len(checks) != 0 {
+		t.Errorf("expected no checks after deletion but got %v, %v", checks, err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	d := NewDir(root)
+
+	if usage, deleted, err := d.Usage(); err != nil || len(usage) != 0 || deleted.Files != 0 {
+		t.Errorf("expected no usage of empty root but got %v, %v, %v", usage, deleted, err)
+	}
+
+	contents := map[string]string{
+		"fredhw/recording.edf":       "recording",
+		"fredhw/results/summary.txt": "summary",
+		"alice/recording.edf":        "alice",
+		"bob/recording.edf":          "bob",
+	}
+	for name, c := range contents {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("error creating dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(c), 0600); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	if err := d.RecordChecksum("fredhw", "recording.edf"); err != nil {
+		t.Fatalf("error recording checksum: %v", err)
+	}
+	if err := d.ScheduleDeletion("bob", time.Now()); err != nil {
+		t.Fatalf("error scheduling deletion: %v", err)
+	}
+
+	usage, deleted, err := d.Usage()
+	if err != nil {
+		t.Fatalf("error getting usage: %v", err)
+	}
+	expected := []Usage{
+		{"alice", 1, 5},
+		{"fredhw", 2, 16},
+	}
+	if len(usage) != len(expected) {
+		t.Fatalf("expected usage of %d users but got %d", len(expected), len(usage))
+	}
+	for i, u := range usage {
+		if *u != expected[i] {
+			t.Errorf("expected usage %d to be %+v but got %+v", i, expected[i], *u)
+		}
+	}
+	if deleted.Files != 1 || deleted.Bytes != 3 {
+		t.Errorf("expected 1 deleted file of 3 bytes but got %+v", *deleted)
+	}
+}
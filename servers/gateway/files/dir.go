@@ -0,0 +1,249 @@
+//Package files manages the directories where users' recordings and
+//analysis results are kept, one directory per user name
+package files
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//trashDirName is the directory, inside the root, holding the
+//directories of deleted users until they are purged
+const trashDirName = ".deleted"
+
+//DefaultRoot is the root that holds users' recordings and
+//analysis results unless the gateway is given another
+const DefaultRoot = "/root/gateway/raw-data"
+
+//Dir is the root directory holding one directory per user
+type Dir struct {
+	Root string
+	//mx serializes updates of the checksum manifests
+	mx sync.Mutex
+}
+
+//NewDir constructs a new Dir
+func NewDir(root string) *Dir {
+	return &Dir{
+		Root: root,
+	}
+}
+
+//ErrInvalidUserName is returned for user names that can't be used as a directory name
+var ErrInvalidUserName = errors.New("user name can't be used as a directory name")
+
+//UserPath returns the path of the user's directory
+func (d *Dir) UserPath(userName string) (string, error) {
+	if !ValidUserName(userName) {
+		return "", ErrInvalidUserName
+	}
+	return filepath.Join(d.Root, userName), nil
+}
+
+//ValidUserName reports whether the user name can be used as a directory name
+func ValidUserName(userName string) bool {
+	return ValidFileName(userName) &&
+		userName != trashDirName && userName != checksumDirName && userName != recordingDirName
+}
+
+//ErrInvalidFileName is returned for file names that aren't a single element of a path
+var ErrInvalidFileName = errors.New("file name can't contain a path")
+
+//ValidFileName reports whether the name is a single, clean path element,
+//which can only name a file directly inside a user's directory
+func ValidFileName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.ContainsAny(name, "/\\\x00")
+}
+
+//Export writes a zip archive of the user's files to `w`, along with any
+//`extra` files given by name. A user without a directory gets an archive
+//of just the extra files.
+func (d *Dir) Export(userName string, w io.Writer, extra map[string][]byte) error {
+	zw := zip.NewWriter(w)
+	for name, contents := range extra {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(contents); err != nil {
+			return err
+		}
+	}
+
+	root, err := d.UserPath(userName)
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fw, err := zw.Create(filepath.ToSlash(filepath.Join("files", rel)))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(fw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error exporting files: %v", err)
+	}
+	return zw.Close()
+}
+
+//ScheduleDeletion moves the user's directory out of the way, so that it can
+//no longer be read, and a new user with the same name starts empty. It is
+//removed for good by Purge once the retention period has passed.
+func (d *Dir) ScheduleDeletion(userName string, now time.Time) error {
+	src, err := d.UserPath(userName)
+	if err != nil {
+		return err
+	}
+	//the checksums and recordings are of no use once the files can't be read
+	if err := checksumManifest.remove(d, userName); err != nil {
+		return err
+	}
+	if err := recordingManifest.remove(d, userName); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	trash := filepath.Join(d.Root, trashDirName)
+	if err := os.MkdirAll(trash, 0700); err != nil {
+		return err
+	}
+	dst := filepath.Join(trash, filepath.Base(src)+"."+strconv.FormatInt(now.UnixNano(), 10))
+	return os.Rename(src, dst)
+}
+
+//Purge removes the directories of deleted users that were scheduled
+//for deletion more than `retention` ago, and returns how many it removed
+func (d *Dir) Purge(retention time.Duration, now time.Time) (int, error) {
+	trash := filepath.Join(d.Root, trashDirName)
+	entries, err := os.ReadDir(trash)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, e := range entries {
+		name := e.Name()
+		ns, err := strconv.ParseInt(name[strings.LastIndex(name, ".")+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		if now.Sub(time.Unix(0, ns)) < retention {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(trash, name)); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+//Usage is the storage used by the files of a user
+type Usage struct {
+	UserName string `json:"userName"`
+	Files    int    `json:"files"`
+	Bytes    int64  `json:"bytes"`
+}
+
+//CheckWritable checks that files can be created in the root directory,
+//by creating a file there and removing it
+func (d *Dir) CheckWritable() error {
+	f, err := os.CreateTemp(d.Root, ".probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+//Users returns the names of the users who have a directory, in order
+func (d *Dir) Users() ([]string, error) {
+	entries, err := os.ReadDir(d.Root)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if e.IsDir() && ValidUserName(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+//Usage returns the storage used by each user with a directory, in order
+//of user name, and the storage used by the files of deleted users that
+//have not been purged yet
+func (d *Dir) Usage() ([]*Usage, *Usage, error) {
+	names, err := d.Users()
+	if err != nil {
+		return nil, nil, err
+	}
+	usage := make([]*Usage, len(names))
+	for i, name := range names {
+		usage[i] = &Usage{UserName: name}
+		if err := du(filepath.Join(d.Root, name), usage[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	deleted := &Usage{}
+	if err := du(filepath.Join(d.Root, trashDirName), deleted); err != nil {
+		return nil, nil, err
+	}
+	return usage, deleted, nil
+}
+
+//du adds the number and size of the regular files under `root` to `usage`
+func du(root string, usage *Usage) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			usage.Files++
+			usage.Bytes += info.Size()
+		}
+		return nil
+	})
+}
@@ -0,0 +1,175 @@
+package files
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidUserName(t *testing.T) {
+	cases := []struct {
+		name     string
+		userName string
+		valid    bool
+	}{
+		{"Valid", "fredhw", true},
+		{"Dots Inside", "fred.hw", true},
+		{"Empty", "", false},
+		{"Dot", ".", false},
+		{"Parent", "..", false},
+		{"Trash", trashDirName, false},
+		{"Checksums", checksumDirName, false},
+		{"Recordings", recordingDirName, false},
+		{"Slash", "fred/hw", false},
+		{"Backslash", "fred\\hw", false},
+		{"NUL", "fred\x00hw", false},
+	}
+
+	for _, c := range cases {
+		if valid := ValidUserName(c.userName); valid != c.valid {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.valid, valid)
+		}
+	}
+
+	d := NewDir("/data")
+	if _, err := d.UserPath(".."); err != ErrInvalidUserName {
+		t.Errorf("expected ErrInvalidUserName but got %v", err)
+	}
+}
+
+func TestValidFileName(t *testing.T) {
+	cases := []struct {
+		name     string
+		fileName string
+		valid    bool
+	}{
+		{"Valid", "P01_rest.txt", true},
+		{"Hidden", ".notes", true},
+		{"Empty", "", false},
+		{"Dot", ".", false},
+		{"Parent", "..", false},
+		{"Escaping", "../P01_rest.txt", false},
+		{"Subdirectory", "results/P01_rest.txt", false},
+		{"Backslash", "..\\P01_rest.txt", false},
+		{"NUL", "P01\x00rest.txt", false},
+	}
+
+	for _, c := range cases {
+		if valid := ValidFileName(c.fileName); valid != c.valid {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.valid, valid)
+		}
+	}
+}
+
+func TestExportAndDelete(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	d := NewDir(root)
+
+	userPath, _ := d.UserPath("fredhw")
+	if err := os.MkdirAll(filepath.Join(userPath, "results"), 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	contents := map[string]string{
+		"recording.edf":       "recording",
+		"results/summary.txt": "summary",
+	}
+	for name, c := range contents {
+		if err := ioutil.WriteFile(filepath.Join(userPath, name), []byte(c), 0600); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := d.Export("fredhw", buf, map[string][]byte{"account.json": []byte("{}")}); err != nil {
+		t.Fatalf("error exporting: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("error reading export: %v", err)
+	}
+	exported := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("error opening %s: %v", f.Name, err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		exported[f.Name] = string(b)
+	}
+	expected := map[string]string{
+		"account.json":              "{}",
+		"files/recording.edf":       "recording",
+		"files/results/summary.txt": "summary",
+	}
+	if len(exported) != len(expected) {
+		t.Errorf("expected %d files in export but got %d: %v", len(expected), len(exported), exported)
+	}
+	for name, c := range expected {
+		if exported[name] != c {
+			t.Errorf("expected %s to contain %q but got %q", name, c, exported[name])
+		}
+	}
+
+	//users without files still get their extra files
+	buf.Reset()
+	if err := d.Export("nobody", buf, map[string][]byte{"account.json": []byte("{}")}); err != nil {
+		t.Errorf("error exporting user without files: %v", err)
+	}
+
+	now := time.Now()
+	if err := d.ScheduleDeletion("fredhw", now); err != nil {
+		t.Fatalf("error scheduling deletion: %v", err)
+	}
+	if _, err := os.Stat(userPath); !os.IsNotExist(err) {
+		t.Errorf("expected user dir to be moved away but got %v", err)
+	}
+	if err := d.ScheduleDeletion("nobody", now); err != nil {
+		t.Errorf("error scheduling deletion of user without files: %v", err)
+	}
+
+	if n, err := d.Purge(time.Hour, now.Add(time.Minute)); err != nil || n != 0 {
+		t.Errorf("expected nothing to be purged before the retention period but got %d, %v", n, err)
+	}
+	if n, err := d.Purge(time.Hour, now.Add(2*time.Hour)); err != nil || n != 1 {
+		t.Errorf("expected 1 dir to be purged but got %d, %v", n, err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(root, trashDirName))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected trash to be empty but got %d entries, %v", len(entries), err)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	cases := []struct {
+		name     string
+		root     string
+		writable bool
+	}{
+		{"Writable", root, true},
+		{"Missing", filepath.Join(root, "missing"), false},
+	}
+	for _, c := range cases {
+		if err := NewDir(c.root).CheckWritable(); (err == nil) != c.writable {
+			t.Errorf("case %s: expected writable to be %t but got %v", c.name, c.writable, err)
+		}
+	}
+	//the probe is removed
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("expected the root to be left empty but found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,105 @@
+package files
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//WriteFileAtomic replaces the file at `path` with what `write` writes,
+//creating its directory if need be. It writes a new file and renames it,
+//so the file is never half-written, even if the gateway stops midway.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+//manifest is a file per user, in a directory inside the root, recording
+//something about each of the user's files, such as its checksum, by the
+//file's path relative to the user's directory
+type manifest[T any] struct {
+	//name describes the manifest in errors
+	name    string
+	dirName string
+	ext     string
+	decode  func(r io.Reader) (map[string]T, error)
+	encode  func(w io.Writer, entries map[string]T) error
+}
+
+//path returns the path of the user's manifest
+func (m *manifest[T]) path(d *Dir, userName string) (string, error) {
+	if !ValidUserName(userName) {
+		return "", ErrInvalidUserName
+	}
+	return filepath.Join(d.Root, m.dirName, userName+m.ext), nil
+}
+
+//read reads the user's manifest. A user without a manifest has no entries.
+func (m *manifest[T]) read(d *Dir, userName string) (map[string]T, error) {
+	path, err := m.path(d, userName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]T{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := m.decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s of %s: %v", m.name, userName, err)
+	}
+	return entries, nil
+}
+
+//update applies `fn` to the user's manifest while holding the lock
+func (m *manifest[T]) update(d *Dir, userName string, fn func(entries map[string]T)) error {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	entries, err := m.read(d, userName)
+	if err != nil {
+		return err
+	}
+	fn(entries)
+	path, err := m.path(d, userName)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return m.encode(w, entries)
+	})
+}
+
+//remove removes the user's manifest
+func (m *manifest[T]) remove(d *Dir, userName string) error {
+	path, err := m.path(d, userName)
+	if err != nil {
+		return err
+	}
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
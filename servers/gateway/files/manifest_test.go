@@ -0,0 +1,51 @@
+package files
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "snapshots", "trie.gob")
+
+	//write writes the content, then fails with `fail` if it isn't nil
+	write := func(content string, fail error) func(w io.Writer) error {
+		return func(w io.Writer) error {
+			if _, err := io.WriteString(w, content); err != nil {
+				return err
+			}
+			return fail
+		}
+	}
+	cases := []struct {
+		name     string
+		content  string
+		err      error
+		expected string
+	}{
+		{"New File", "first", nil, "first"},
+		{"Replaced", "second", nil, "second"},
+		{"Failed Write", "half", errors.New("disk full"), "second"},
+	}
+	for _, c := range cases {
+		if err := WriteFileAtomic(path, write(c.content, c.err)); err != c.err {
+			t.Errorf("case %s: expected error %v but got %v", c.name, c.err, err)
+		}
+		buf, err := os.ReadFile(path)
+		if err != nil || string(buf) != c.expected {
+			t.Errorf("case %s: expected %q but got %q, %v", c.name, c.expected, buf, err)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("case %s: expected no temporary file to be left but got %v", c.name, err)
+		}
+	}
+}
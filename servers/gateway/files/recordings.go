@@ -0,0 +1,142 @@
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//recordingDirName is the directory, inside the root, holding one
+//JSON manifest per user of what is known about their recordings
+const recordingDirName = ".recordings"
+
+//recordingManifest is the manifest of the recordings of each user
+var recordingManifest = &manifest[*Recording]{
+	name:    "recordings",
+	dirName: recordingDirName,
+	ext:     ".json",
+	decode:  decodeRecordings,
+	encode:  encodeRecordings,
+}
+
+//Recording describes one of a user's files
+type Recording struct {
+	UserName string   `json:"userName"`
+	File     string   `json:"file"`
+	Subject  string   `json:"subject"`
+	Session  string   `json:"session"`
+	Device   string   `json:"device,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	//RecordedAt is when the recording was made, or else when it was uploaded
+	RecordedAt time.Time `json:"recordedAt"`
+}
+
+//ParseRecordingName returns the subject and session of a file named
+//`<subject>_<session>.<ext>`, like the files the analysis services read.
+//Names without an underscore are taken to be just the subject.
+func ParseRecordingName(file string) (string, string) {
+	name := path.Base(file)
+	name = strings.TrimSuffix(name, path.Ext(name))
+	subject, session, _ := strings.Cut(name, "_")
+	return subject, session
+}
+
+//SetRecording records what is known about one of the user's files,
+//replacing anything recorded before
+func (d *Dir) SetRecording(rec *Recording) error {
+	return recordingManifest.update(d, rec.UserName, func(recs map[string]*Recording) {
+		recs[rec.File] = rec
+	})
+}
+
+//RemoveRecording forgets what is known about one of the user's files
+func (d *Dir) RemoveRecording(userName string, file string) error {
+	return recordingManifest.update(d, userName, func(recs map[string]*Recording) {
+		delete(recs, file)
+	})
+}
+
+//Recordings returns every file of the user, ordered by name. Files
+//without a recorded description, such as those uploaded before they
+//were kept, get one from their name and modification time.
+func (d *Dir) Recordings(userName string) ([]*Recording, error) {
+	userPath, err := d.UserPath(userName)
+	if err != nil {
+		return nil, err
+	}
+	d.mx.Lock()
+	recorded, err := recordingManifest.read(d, userName)
+	d.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []*Recording{}
+	err = filepath.Walk(userPath, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == userPath {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(userPath, p)
+		if err != nil {
+			return err
+		}
+		file := filepath.ToSlash(rel)
+		rec, found := recorded[file]
+		if !found {
+			subject, session := ParseRecordingName(file)
+			rec = &Recording{File: file, Subject: subject, Session: session, RecordedAt: info.ModTime().UTC()}
+		}
+		rec.UserName = userName
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing recordings: %v", err)
+	}
+	sort.Slice(recs, func(i, j int) bool {
+		return recs[i].File < recs[j].File
+	})
+	return recs, nil
+}
+
+//decodeRecordings reads a manifest of recordings
+func decodeRecordings(r io.Reader) (map[string]*Recording, error) {
+	list := []*Recording{}
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+	recs := map[string]*Recording{}
+	for _, rec := range list {
+		recs[rec.File] = rec
+	}
+	return recs, nil
+}
+
+//encodeRecordings writes a manifest of the recordings, ordered by file
+func encodeRecordings(w io.Writer, recs map[string]*Recording) error {
+	list := make([]*Recording, 0, len(recs))
+	for _, rec := range recs {
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].File < list[j].File
+	})
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
@@ -0,0 +1,102 @@
+package files
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRecordingName(t *testing.T) {
+	cases := []struct {
+		name            string
+		file            string
+		expectedSubject string
+		expectedSession string
+	}{
+		{"Subject And Session", "P01_rest.txt", "P01", "rest"},
+		{"Underscore In Session", "P01_eyes_closed.edf", "P01", "eyes_closed"},
+		{"No Session", "P01.txt", "P01", ""},
+		{"No Extension", "P01_rest", "P01", "rest"},
+		{"In Directory", "2024/P02_task.txt", "P02", "task"},
+	}
+
+	for _, c := range cases {
+		subject, session := ParseRecordingName(c.file)
+		if subject != c.expectedSubject || session != c.expectedSession {
+			t.Errorf("case %s: expected %q and %q but got %q and %q",
+				c.name, c.expectedSubject, c.expectedSession, subject, session)
+		}
+	}
+}
+
+func TestRecordings(t *testing.T) {
+	root, err := ioutil.TempDir("", "files-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	d := NewDir(root)
+
+	userPath, _ := d.UserPath("fredhw")
+	if err := os.MkdirAll(userPath, 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	for _, name := range []string{"P01_rest.txt", "P02_task.txt", "removed.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(userPath, name), []byte("recording"), 0600); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+	}
+	uploaded := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(userPath, "P02_task.txt"), uploaded, uploaded); err != nil {
+		t.Fatalf("error setting file times: %v", err)
+	}
+
+	recorded := &Recording{
+		UserName:   "fredhw",
+		File:       "P01_rest.txt",
+		Subject:    "P01",
+		Session:    "rest",
+		Device:     "emotiv",
+		Tags:       []string{"pilot"},
+		RecordedAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for _, rec := range []*Recording{recorded, {UserName: "fredhw", File: "removed.txt"}} {
+		if err := d.SetRecording(rec); err != nil {
+			t.Fatalf("error setting recording: %v", err)
+		}
+	}
+	if err := d.RemoveRecording("fredhw", "removed.txt"); err != nil {
+		t.Fatalf("error removing recording: %v", err)
+	}
+
+	recs, err := d.Recordings("fredhw")
+	if err != nil {
+		t.Fatalf("error getting recordings: %v", err)
+	}
+	expected := []*Recording{
+		recorded,
+		{UserName: "fredhw", File: "P02_task.txt", Subject: "P02", Session: "task", RecordedAt: uploaded},
+		{UserName: "fredhw", File: "removed.txt", Subject: "removed", RecordedAt: recs[2].RecordedAt},
+	}
+	if !reflect.DeepEqual(recs, expected) {
+		for i := range recs {
+			t.Logf("recording %d: %+v", i, recs[i])
+		}
+		t.Fatalf("expected recorded, described and unrecorded files")
+	}
+
+	if recs, err := d.Recordings("nobody"); err != nil || len(recs) != 0 {
+		t.Errorf("expected no recordings for a user without a directory but got %v, %v", recs, err)
+	}
+
+	if err := d.ScheduleDeletion("fredhw", time.Now()); err != nil {
+		t.Fatalf("error scheduling deletion: %v", err)
+	}
+	path, _ := recordingManifest.path(d, "fredhw")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the manifest to be removed with the user's files but got %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//passwordChange is the body of a request to change the current user's password
+type passwordChange struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+	NewPasswordConf string `json:"newPasswordConf"`
+}
+
+//emailChange is the body of a request to change the current user's email address
+type emailChange struct {
+	CurrentPassword string `json:"currentPassword"`
+	Email           string `json:"email"`
+}
+
+//accountDeletion is the body of a request to delete the current user's account.
+//Users linked to the identity provider may give a two-factor code instead of
+//their current password, or neither if they signed in with the provider recently.
+type accountDeletion struct {
+	CurrentPassword string `json:"currentPassword"`
+	Code            string `json:"code"`
+	Export          bool   `json:"export"`
+}
+
+//UsersMePasswordHandler handles requests for the current user's "password" resource,
+//and allows users to change their password using PUT /v1/users/me/password.
+//All of the user's other sessions are ended.
+func (ctx *Context) UsersMePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	state := &sessionState{}
+	sid, err := ctx.getSession(r, state)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		pc := &passwordChange{}
+		if err := json.NewDecoder(r.Body).Decode(pc); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+		if err := users.ValidatePassword(pc.NewPassword, pc.NewPasswordConf); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error validating password", err))
+			return
+		}
+
+		user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if !ctx.reauthenticate(w, r, user, pc.CurrentPassword, audit.ActionPasswordChange) {
+			return
+		}
+
+		if err := user.SetPassword(pc.NewPassword); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error hashing password", err))
+			return
+		}
+		if err := ctx.userStore.SetPassHash(r.Context(), user.ID, user.PassHash); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+
+		ctx.record(r, user, audit.ActionPasswordChange, user.ID.Hex(), audit.OutcomeSuccess)
+
+		if err := ctx.endOtherSessions(user, sid); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error ending other sessions", err))
+			return
+		}
+
+		state.User = user
+		if err := ctx.sessionManager.Update(sid, state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user in store", err))
+			return
+		}
+
+		respond(w, user)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be PUT"))
+		return
+	}
+}
+
+//UsersMeEmailHandler handles requests for the current user's "email" resource,
+//and allows users to change their email address using PUT /v1/users/me/email.
+//The new address must be verified again, and the old one is told about the change.
+func (ctx *Context) UsersMeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	state := &sessionState{}
+	sid, err := ctx.getSession(r, state)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		ec := &emailChange{}
+		if err := json.NewDecoder(r.Body).Decode(ec); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+		if _, err := mail.ParseAddress(ec.Email); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "invalid email address", err))
+			return
+		}
+
+		user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if !ctx.reauthenticate(w, r, user, ec.CurrentPassword, audit.ActionEmailChange) {
+			return
+		}
+
+		if ec.Email == user.Email {
+			apierr.Write(w, r, apierr.New(apierr.CodeValidationFailed, "that is already your email address"))
+			return
+		}
+		if err := ctx.checkEmailAvailable(r, ec.Email); err == users.ErrEmailTaken {
+			apierr.Write(w, r, apierr.New(apierr.CodeEmailTaken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+
+		if err := ctx.userStore.SetEmail(r.Context(), user.ID, ec.Email); err == users.ErrEmailTaken {
+			//taken since the check above
+			apierr.Write(w, r, apierr.New(apierr.CodeEmailTaken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+		ctx.updateTrie(&indexes.Update[bson.ObjectId]{Value: user.ID, Removed: []string{user.Email}, Added: []string{ec.Email}})
+		ctx.record(r, user, audit.ActionEmailChange, user.ID.Hex(), audit.OutcomeSuccess)
+
+		oldEmail := user.Email
+		user.Email = ec.Email
+		user.EmailVerified = false
+
+		if err := ctx.sendVerification(r, user); err != nil {
+			reqlog.Logger(r.Context()).Error("error sending verification email", "error", err)
+		}
+		go ctx.sendMail(&mailer.Message{
+			To:      oldEmail,
+			Subject: "Your Synapse email address was changed",
+			Body: fmt.Sprintf("The email address of your Synapse account %s was changed to %s.\n\n"+
+				"If you didn't do this, please reset your password and contact us.\n", user.UserName, user.Email),
+		})
+
+		state.User = user
+		if err := ctx.sessionManager.Update(sid, state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user in store", err))
+			return
+		}
+
+		respond(w, user)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be PUT"))
+		return
+	}
+}
+
+//deleteAccount deletes the current user after checking their password. Their
+//sessions are ended and their files are scheduled for deletion. If they asked
+//for an export, the response is a zip archive of their account and files.
+func (ctx *Context) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	state := &sessionState{}
+	if _, err := ctx.getSession(r, state); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+		return
+	}
+
+	ad := &accountDeletion{}
+	if err := json.NewDecoder(r.Body).Decode(ad); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+		return
+	}
+
+	user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+		return
+	}
+	if !ctx.confirmDeletion(w, r, state, user, ad) {
+		return
+	}
+
+	//export before anything is deleted, so a failed export loses nothing
+	var export *os.File
+	if ad.Export {
+		account, err := json.MarshalIndent(user, "", "  ")
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error encoding user", err))
+			return
+		}
+		export, err = ioutil.TempFile("", "synapse-export-")
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error exporting account", err))
+			return
+		}
+		defer os.Remove(export.Name())
+		defer export.Close()
+		if err := ctx.files.Export(user.UserName, export, map[string][]byte{"account.json": account}); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error exporting account", err))
+			return
+		}
+	}
+
+	if err := ctx.userStore.Delete(r.Context(), user.ID); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error deleting user", err))
+		return
+	}
+	ctx.updateTrie(&indexes.Update[bson.ObjectId]{Value: user.ID, Removed: user.SearchKeys()})
+	ctx.record(r, user, audit.ActionAccountDelete, user.ID.Hex(), audit.OutcomeSuccess)
+
+	if err := ctx.endOtherSessions(user, sessions.InvalidSessionID); err != nil {
+		reqlog.Logger(r.Context()).Error("error ending sessions of deleted user", "deletedUserId", user.ID.Hex(), "error", err)
+	}
+	ctx.recordings.RemoveUser(user.UserName)
+	if err := ctx.files.ScheduleDeletion(user.UserName, time.Now()); err != nil {
+		reqlog.Logger(r.Context()).Error("error scheduling deletion of files of deleted user", "deletedUserId", user.ID.Hex(), "error", err)
+	}
+
+	if export == nil {
+		w.Header().Add(headerContentType, "text/plain")
+		fmt.Fprintln(w, "account deleted")
+		return
+	}
+
+	if _, err := export.Seek(0, io.SeekStart); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error reading export", err))
+		return
+	}
+	w.Header().Add(headerContentType, contentTypeZip)
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user.UserName+".zip"))
+	if _, err := io.Copy(w, export); err != nil {
+		reqlog.Logger(r.Context()).Error("error writing export", "error", err)
+	}
+}
+
+//reauthenticate checks the current password of a signed-in user before
+//a sensitive change. Wrong passwords count as failed sign-in attempts,
+//so a stolen session can't be used to guess the password. If the check
+//fails, it is recorded in the audit log as `action`, and it responds and
+//returns false.
+func (ctx *Context) reauthenticate(w http.ResponseWriter, r *http.Request, user *users.User, password string, action string) bool {
+	attempt, ok := ctx.checkLoginGuard(w, r, user.Email, clientIP(r))
+	if !ok {
+		ctx.record(r, user, action, user.ID.Hex(), audit.OutcomeDenied)
+		return false
+	}
+	defer ctx.releaseLoginAttempt(r, attempt)
+	if err := user.Authenticate(password); err != nil {
+		if err := attempt.Fail(); err != nil {
+			reqlog.Logger(r.Context()).Error("error recording failed sign-in", "error", err)
+		}
+		ctx.record(r, user, action, user.ID.Hex(), audit.OutcomeFailure)
+		apierr.Write(w, r, apierr.New(apierr.CodeIncorrectPassword, "current password is incorrect"))
+		return false
+	}
+	return true
+}
+
+//confirmDeletion checks that the user confirmed deleting their account. Users
+//created by signing in with the identity provider have no password they know,
+//so users linked to it may instead give a two-factor code, or have signed in
+//with the provider recently. If the deletion isn't confirmed, it responds and
+//returns false.
+func (ctx *Context) confirmDeletion(w http.ResponseWriter, r *http.Request, state *sessionState, user *users.User, ad *accountDeletion) bool {
+	if user.SSO == nil || len(ad.CurrentPassword) > 0 {
+		return ctx.reauthenticate(w, r, user, ad.CurrentPassword, audit.ActionAccountDelete)
+	}
+	if len(ad.Code) > 0 {
+		return ctx.confirmSecondFactor(w, r, user, ad.Code, audit.ActionAccountDelete)
+	}
+	if state.SSO && time.Since(state.Time) <= ssoReauthDuration {
+		return true
+	}
+	ctx.record(r, user, audit.ActionAccountDelete, user.ID.Hex(), audit.OutcomeDenied)
+	apierr.Write(w, r, apierr.New(apierr.CodeReauthenticationRequired,
+		"sign in with your identity provider again, or give your current password or a two-factor code, to delete your account"))
+	return false
+}
+
+//checkEmailAvailable returns users.ErrEmailTaken if another account uses the email address
+func (ctx *Context) checkEmailAvailable(r *http.Request, email string) error {
+	_, err := ctx.userStore.GetByEmail(r.Context(), email)
+	if err == users.ErrUserNotFound {
+		return nil
+	}
+	if err == nil {
+		return users.ErrEmailTaken
+	}
+	return err
+}
+
+//endOtherSessions ends all of the user's sessions except `current`,
+//which may be sessions.InvalidSessionID to end them all
+func (ctx *Context) endOtherSessions(user *users.User, current sessions.SessionID) error {
+	sids, err := ctx.sessionManager.Sessions(user.ID.Hex())
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		if sid == current {
+			continue
+		}
+		if err := ctx.sessionManager.Revoke(sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestChangePasswordAndEmail(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	ctx.SetMailer(make(chanMailer, 10), "https://synapse.test")
+
+	for _, nu := range []*users.NewUser{
+		{Email: "fredhw@uw.edu", Password: "123456", PasswordConf: "123456", UserName: "fredhw", FirstName: "Fred", LastName: "Wijaya"},
+		{Email: "other@uw.edu", Password: "123456", PasswordConf: "123456", UserName: "other", FirstName: "Other", LastName: "User"},
+	} {
+		user, err := userStore.Insert(context.Background(), nu)
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		ctx.trie.Apply(&indexes.Update[bson.ObjectId]{Value: user.ID, Added: user.SearchKeys()})
+	}
+
+	do := func(handler http.HandlerFunc, method string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	signIn := func(password string) string {
+		w := do(ctx.SessionsHandler, "POST", "", `{"email": "fredhw@uw.edu", "password": "`+password+`"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		return w.Header().Get(headerAuthorization)
+	}
+	me := func(auth string) *users.User {
+		w := do(ctx.UsersMeHandler, "GET", auth, "")
+		if w.Code != http.StatusOK {
+			return nil
+		}
+		user := &users.User{}
+		if err := json.NewDecoder(w.Body).Decode(user); err != nil {
+			t.Fatalf("error decoding user: %v", err)
+		}
+		return user
+	}
+
+	first := signIn("123456")
+	second := signIn("123456")
+
+	if w := do(ctx.UsersMePasswordHandler, "PUT", first,
+		`{"currentPassword": "wrong", "newPassword": "abcdef", "newPasswordConf": "abcdef"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d for wrong current password but got %d", http.StatusForbidden, w.Code)
+	}
+	if w := do(ctx.UsersMePasswordHandler, "PUT", first,
+		`{"currentPassword": "123456", "newPassword": "abcdef", "newPasswordConf": "abcdef"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for password change but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if me(first) == nil {
+		t.Errorf("expected the session that changed the password to stay signed in")
+	}
+	if me(second) != nil {
+		t.Errorf("expected other sessions to be ended after a password change")
+	}
+	signIn("abcdef")
+
+	if w := do(ctx.UsersMeEmailHandler, "PUT", first,
+		`{"currentPassword": "abcdef", "email": "other@uw.edu"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an email address in use but got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := do(ctx.UsersMeEmailHandler, "PUT", first,
+		`{"currentPassword": "abcdef", "email": "fred@synapse.test"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for email change but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if user := me(first); user == nil || user.Email != "fred@synapse.test" || user.EmailVerified {
+		t.Errorf("expected cached user to have the new, unverified email address but got %+v", user)
+	}
+	if ids := ctx.trie.Get(20, "fred@synapse"); len(ids) != 1 {
+		t.Errorf("expected new email address to be indexed but found %d users", len(ids))
+	}
+	if ids := ctx.trie.Get(20, "fredhw@uw"); len(ids) != 0 {
+		t.Errorf("expected old email address to be removed from the index but found %d users", len(ids))
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	root, err := ioutil.TempDir("", "handlers-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	ctx.SetFiles(files.NewDir(root))
+
+	user, err := userStore.Insert(context.Background(), &users.NewUser{Email: "fredhw@uw.edu", Password: "123456", PasswordConf: "123456",
+		UserName: "fredhw", FirstName: "Fred", LastName: "Wijaya"})
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	ctx.trie.Apply(&indexes.Update[bson.ObjectId]{Value: user.ID, Added: user.SearchKeys()})
+
+	if err := os.Mkdir(filepath.Join(root, "fredhw"), 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "fredhw", "recording.edf"), []byte("recording"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	do := func(method string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/users/me", strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		ctx.UsersMeHandler(w, r)
+		return w
+	}
+	signIn := func() string {
+		r := httptest.NewRequest("POST", "/v1/sessions", strings.NewReader(`{"email": "fredhw@uw.edu", "password": "123456"}`))
+		w := httptest.NewRecorder()
+		ctx.SessionsHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		return w.Header().Get(headerAuthorization)
+	}
+
+	first := signIn()
+	second := signIn()
+
+	if w := do("DELETE", first, `{"currentPassword": "wrong"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d for wrong password but got %d", http.StatusForbidden, w.Code)
+	}
+	w := do("DELETE", first, `{"currentPassword": "123456", "export": true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for deletion but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get(headerContentType); ct != contentTypeZip {
+		t.Errorf("expected content type %s but got %s", contentTypeZip, ct)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("error reading export: %v", err)
+	}
+	exported := map[string]bool{}
+	for _, f := range zr.File {
+		exported[f.Name] = true
+	}
+	if !exported["account.json"] || !exported["files/recording.edf"] {
+		t.Errorf("expected export to contain the account and files but got %v", exported)
+	}
+
+	if _, err := userStore.GetByID(context.Background(), user.ID); err != users.ErrUserNotFound {
+		t.Errorf("expected user to be deleted but got %v", err)
+	}
+	if ids := ctx.trie.Get(20, "fred"); len(ids) != 0 {
+		t.Errorf("expected user to be removed from the index but found %d users", len(ids))
+	}
+	if w := do("GET", second, ""); w.Code == http.StatusOK {
+		t.Errorf("expected all sessions to be ended")
+	}
+	if _, err := os.Stat(filepath.Join(root, "fredhw")); !os.IsNotExist(err) {
+		t.Errorf("expected user's files to be scheduled for deletion but got %v", err)
+	}
+}
+
+func TestDeleteSSOAccount(t *testing.T) {
+	root, err := ioutil.TempDir("", "handlers-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	ctx.SetFiles(files.NewDir(root))
+
+	totp, err := users.NewTOTP()
+	if err != nil {
+		t.Fatalf("error generating TOTP: %v", err)
+	}
+	totp.Enabled = true
+	code, err := totp.Code(time.Now())
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		linked         bool
+		totp           bool
+		sso            bool
+		signedIn       time.Duration
+		body           string
+		expectedStatus int
+		expectedCode   apierr.Code
+	}{
+		{"Recent SSO Sign-In", true, false, true, time.Minute, `{}`, http.StatusOK, ""},
+		{"Old SSO Sign-In", true, false, true, ssoReauthDuration + time.Minute, `{}`, http.StatusForbidden, apierr.CodeReauthenticationRequired},
+		{"Password Sign-In", true, false, false, time.Minute, `{}`, http.StatusForbidden, apierr.CodeReauthenticationRequired},
+		{"Two-Factor Code", true, true, false, time.Hour, `{"code": "` + code + `"}`, http.StatusOK, ""},
+		{"Wrong Two-Factor Code", true, true, false, time.Hour, `{"code": "000000x"}`, http.StatusForbidden, apierr.CodeIncorrectCode},
+		{"Password", true, false, false, time.Hour, `{"currentPassword": "123456"}`, http.StatusOK, ""},
+		{"Not Linked", false, true, false, time.Minute, `{"code": "` + code + `"}`, http.StatusForbidden, apierr.CodeIncorrectPassword},
+	}
+
+	for i, c := range cases {
+		name := fmt.Sprintf("user%d", i)
+		user, err := userStore.Insert(context.Background(), &users.NewUser{Email: name + "@uw.edu", Password: "123456",
+			PasswordConf: "123456", UserName: name})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		if c.linked {
+			user.SSO = &users.SSOIdentity{Issuer: "https://idp.test", Subject: name}
+			if err := userStore.SetSSO(context.Background(), user.ID, user.SSO); err != nil {
+				t.Fatalf("error linking user: %v", err)
+			}
+		}
+		if c.totp {
+			if err := userStore.UpdateTOTP(context.Background(), user.ID, totp); err != nil {
+				t.Fatalf("error updating TOTP: %v", err)
+			}
+		}
+		w := httptest.NewRecorder()
+		if _, err := sessionManager.Begin(&sessionState{Time: time.Now().Add(-c.signedIn), User: user, SSO: c.sso}, w); err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+
+		r := httptest.NewRequest("DELETE", "/v1/users/me", strings.NewReader(c.body))
+		r.Header.Set(headerAuthorization, w.Header().Get(headerAuthorization))
+		w = httptest.NewRecorder()
+		ctx.UsersMeHandler(w, r)
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+			continue
+		}
+		_, err = userStore.GetByID(context.Background(), user.ID)
+		if c.expectedStatus == http.StatusOK && err != users.ErrUserNotFound {
+			t.Errorf("case %s: expected user to be deleted but got %v", c.name, err)
+		}
+		if c.expectedStatus != http.StatusOK {
+			p := &apierr.Problem{}
+			if err := json.Unmarshal(w.Body.Bytes(), p); err != nil || p.Code != c.expectedCode {
+				t.Errorf("case %s: expected problem %s but got %v (%v)", c.name, c.expectedCode, p.Code, err)
+			}
+		}
+	}
+}
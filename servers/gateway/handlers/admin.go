@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//defaultListLimit is the number of users or events listed when no limit is given
+const defaultListLimit = 50
+
+//maxListLimit is the largest number of users or events listed at once
+const maxListLimit = 500
+
+//adminUserUpdates is the body of a request to change another user's account.
+//Fields that are left out aren't changed.
+type adminUserUpdates struct {
+	Role     *string `json:"role"`
+	Disabled *bool   `json:"disabled"`
+}
+
+//requireAdmin responds and returns false unless the request was authorized
+//for a user allowed to manage users. The admin handlers should be wrapped
+//with Require(users.PermManageUsers); this guards against forgetting that.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*users.User, bool) {
+	user := authorizedUser(r)
+	if user == nil || !user.Can(users.PermManageUsers) {
+		apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "only admins may manage users"))
+		return nil, false
+	}
+	return user, true
+}
+
+//AdminUsersHandler handles requests for the "admin users" resource, and allows
+//admins to list all users using GET /v1/admin/users?offset=0&limit=50
+func (ctx *Context) AdminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		offset, limit, ok := listPage(w, r)
+		if !ok {
+			return
+		}
+
+		list, err := ctx.userStore.List(r.Context(), offset, limit)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error listing users", err))
+			return
+		}
+		respond(w, list)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET"))
+		return
+	}
+}
+
+//SpecificAdminUserHandler handles requests for a specific user, and allows admins to
+//get a user using GET /v1/admin/users/{id}, or change their role or disable their
+//account using PATCH /v1/admin/users/{id}. Disabling an account ends all of its sessions.
+func (ctx *Context) SpecificAdminUserHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	if !bson.IsObjectIdHex(id) {
+		apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "invalid user ID"))
+		return
+	}
+	user, err := ctx.userStore.GetByID(r.Context(), bson.ObjectIdHex(id))
+	if err == users.ErrUserNotFound {
+		apierr.Write(w, r, apierr.New(apierr.CodeNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		respond(w, user)
+
+	case "PATCH":
+		upd := &adminUserUpdates{}
+		if err := json.NewDecoder(r.Body).Decode(upd); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		//admins can't lock themselves out by accident
+		if user.ID == admin.ID && ((upd.Role != nil && *upd.Role != users.RoleAdmin) ||
+			(upd.Disabled != nil && *upd.Disabled)) {
+			apierr.Write(w, r, apierr.New(apierr.CodeValidationFailed, "admins can't demote or disable themselves"))
+			return
+		}
+
+		if upd.Role != nil {
+			if err := users.ValidateRole(*upd.Role); err != nil {
+				apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error validating role", err))
+				return
+			}
+			if err := ctx.userStore.SetRole(r.Context(), user.ID, *upd.Role); err != nil {
+				apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+				return
+			}
+			user.Role = *upd.Role
+			ctx.record(r, admin, audit.ActionRoleChange, user.ID.Hex(), audit.OutcomeSuccess)
+		}
+
+		if upd.Disabled != nil {
+			if err := ctx.userStore.SetDisabled(r.Context(), user.ID, *upd.Disabled); err != nil {
+				apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+				return
+			}
+			user.Disabled = *upd.Disabled
+			action := audit.ActionUserEnable
+			if user.Disabled {
+				action = audit.ActionUserDisable
+			}
+			ctx.record(r, admin, action, user.ID.Hex(), audit.OutcomeSuccess)
+			if user.Disabled {
+				if err := ctx.endOtherSessions(user, sessions.InvalidSessionID); err != nil {
+					apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error ending sessions", err))
+					return
+				}
+			}
+		}
+
+		respond(w, user)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET or PATCH"))
+		return
+	}
+}
+
+//listPage reads the offset and limit query parameters of a list request.
+//If they are invalid, it responds and returns false.
+func listPage(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	offset, limit := 0, defaultListLimit
+	var err error
+	if v := r.URL.Query().Get("offset"); len(v) > 0 {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "offset must be a non-negative integer"))
+			return 0, 0, false
+		}
+	}
+	if v := r.URL.Query().Get("limit"); len(v) > 0 {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxListLimit {
+			apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit)))
+			return 0, 0, false
+		}
+	}
+	return offset, limit, true
+}
+
+//AdminLockoutsHandler handles requests for the "lockouts" resource, and allows
+//admins to unlock an account that was locked out after too many failed
+//sign-in attempts, using DELETE /v1/admin/lockouts/{email}
+func (ctx *Context) AdminLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	admin, ok := requireAdmin(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case "DELETE":
+		email := path.Base(r.URL.Path)
+		if len(email) == 0 || email == "lockouts" || email == "/" {
+			apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "no email specified"))
+			return
+		}
+
+		if err := ctx.loginGuard.Unlock(email); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error unlocking account", err))
+			return
+		}
+		ctx.record(r, admin, audit.ActionUnlock, email, audit.OutcomeSuccess)
+
+		w.Header().Add(headerContentType, "text/plain")
+		fmt.Fprintln(w, "unlocked")
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be DELETE"))
+		return
+	}
+}
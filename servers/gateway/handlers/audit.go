@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+)
+
+//record appends an event to the audit log. `actor` is nil if the user isn't
+//known, such as for failed sign-ins. Errors are logged rather than returned,
+//since the action has already happened by the time it is recorded.
+func (ctx *Context) record(r *http.Request, actor *users.User, action string, target string, outcome string) {
+	event := &audit.Event{
+		Time:    time.Now(),
+		Action:  action,
+		Target:  target,
+		IP:      clientIP(r),
+		Outcome: outcome,
+	}
+	if actor != nil {
+		event.Actor = actor.ID.Hex()
+	}
+	//record the event even if the client has gone away
+	if err := ctx.auditLog.Append(context.Background(), event); err != nil {
+		reqlog.Logger(r.Context()).Error("error recording audit event", "action", action, "error", err)
+	}
+}
+
+//statusRecorder is a ResponseWriter that remembers the status code written
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+//WriteHeader records the status code and writes it
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+//Unwrap returns the original ResponseWriter, so that
+//http.ResponseController can flush it
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+//MethodActions maps HTTP methods to the action their requests are audited as.
+//The action for "*" applies to methods that aren't listed.
+type MethodActions map[string]string
+
+//Audit wraps `next`, usually a service proxy, so that every request is recorded
+//in the audit log as `action` on the request path. The outcome follows from the
+//response status. Wrap it around Require or Authorize, so that requests they
+//turn away are recorded as denied.
+func (ctx *Context) Audit(action string, next http.Handler) http.Handler {
+	return ctx.AuditMethods(MethodActions{"*": action}, next)
+}
+
+//AuditMethods is like Audit, but records requests as the action for their
+//method, so that reading a result isn't mistaken for running an analysis.
+//Requests with methods that have no action aren't recorded.
+func (ctx *Context) AuditMethods(actions MethodActions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action, found := actions[r.Method]
+		if !found {
+			action, found = actions["*"]
+		}
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+
+		var actor *users.User
+		state := &sessionState{}
+		if _, err := ctx.getSession(r, state); err == nil {
+			actor = state.User
+		}
+		outcome := audit.OutcomeSuccess
+		switch {
+		case sr.status == http.StatusUnauthorized || sr.status == http.StatusForbidden:
+			outcome = audit.OutcomeDenied
+		case sr.status >= 400:
+			outcome = audit.OutcomeFailure
+		}
+		ctx.record(r, actor, action, r.URL.Path, outcome)
+	})
+}
+
+//AdminAuditHandler handles requests for the "audit" resource, and allows admins
+//to list audit events, latest first, using GET /v1/admin/audit. The optional
+//actor, action, target and outcome parameters select events with those values,
+//since and until (RFC 3339 times) select a time range, and offset and limit
+//page through the results.
+func (ctx *Context) AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAuditor(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		filter, ok := auditFilter(w, r)
+		if !ok {
+			return
+		}
+		offset, limit, ok := listPage(w, r)
+		if !ok {
+			return
+		}
+
+		events, err := ctx.auditLog.Find(r.Context(), filter, offset, limit)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error finding audit events", err))
+			return
+		}
+		respond(w, events)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET"))
+		return
+	}
+}
+
+//AdminAuditExportHandler handles requests for the "audit export" resource, and
+//allows admins to download all audit events matching the same parameters as
+//GET /v1/admin/audit as JSON Lines, earliest first, using GET /v1/admin/audit/export
+func (ctx *Context) AdminAuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAuditor(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		filter, ok := auditFilter(w, r)
+		if !ok {
+			return
+		}
+
+		w.Header().Add(headerContentType, contentTypeJSONLines)
+		w.Header().Add("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		enc := json.NewEncoder(w)
+		//the status has been sent once the first event is written,
+		//so later errors can only be logged
+		each := func(event *audit.Event) error {
+			return enc.Encode(event)
+		}
+		if err := ctx.auditLog.Each(r.Context(), filter, each); err != nil {
+			reqlog.Logger(r.Context()).Error("error exporting audit events", "error", err)
+		}
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET"))
+		return
+	}
+}
+
+//requireAuditor responds and returns false unless the request was authorized
+//for a user allowed to view the audit log. The audit handlers should be wrapped
+//with Require(users.PermViewAudit); this guards against forgetting that.
+func requireAuditor(w http.ResponseWriter, r *http.Request) bool {
+	user := authorizedUser(r)
+	if user == nil || !user.Can(users.PermViewAudit) {
+		apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "only admins may view the audit log"))
+		return false
+	}
+	return true
+}
+
+//auditFilter reads the audit event filter from the query parameters.
+//If they are invalid, it responds and returns false.
+func auditFilter(w http.ResponseWriter, r *http.Request) (*audit.Filter, bool) {
+	q := r.URL.Query()
+	filter := &audit.Filter{
+		Actor:   q.Get("actor"),
+		Action:  q.Get("action"),
+		Target:  q.Get("target"),
+		Outcome: q.Get("outcome"),
+	}
+	if !queryTime(w, r, "since", &filter.Since) || !queryTime(w, r, "until", &filter.Until) {
+		return nil, false
+	}
+	return filter, true
+}
+
+//queryTime reads the named RFC 3339 time from the query parameters into
+//`dest`, which is left alone if it isn't given. If it is invalid, it
+//responds and returns false.
+func queryTime(w http.ResponseWriter, r *http.Request, name string, dest *time.Time) bool {
+	v := r.URL.Query().Get(name)
+	if len(v) == 0 {
+		return true
+	}
+	parsed, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeBadRequest, fmt.Sprintf("%s must be an RFC 3339 time", name), err))
+		return false
+	}
+	*dest = parsed
+	return true
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestAuditLog(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	auditLog := audit.NewMemStore()
+	ctx.SetAuditLog(auditLog)
+
+	accounts := map[string]*users.User{}
+	for _, name := range []string{"admin", "fred"} {
+		user, err := userStore.Insert(context.Background(), &users.NewUser{
+			Email:        name + "@uw.edu",
+			Password:     "123456",
+			PasswordConf: "123456",
+			UserName:     name,
+		})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		accounts[name] = user
+	}
+	if err := userStore.SetRole(context.Background(), accounts["admin"].ID, users.RoleAdmin); err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+
+	do := func(handler http.Handler, method string, target string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	signIn := func(name string, password string) *httptest.ResponseRecorder {
+		return do(http.HandlerFunc(ctx.SessionsHandler), "POST", "/v1/sessions", "",
+			`{"email": "`+name+`@uw.edu", "password": "`+password+`"}`)
+	}
+
+	if w := signIn("fred", "wrong password"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected %d for wrong password but got %d", http.StatusUnauthorized, w.Code)
+	}
+	fred := signIn("fred", "123456")
+	if fred.Code != http.StatusOK {
+		t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, fred.Code, fred.Body.String())
+	}
+	admin := signIn("admin", "123456")
+	if admin.Code != http.StatusOK {
+		t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, admin.Code, admin.Body.String())
+	}
+	fredToken := fred.Header().Get(headerAuthorization)
+	adminToken := admin.Header().Get(headerAuthorization)
+
+	//requests turned away by Require are recorded as denied
+	analysis := ctx.Audit(audit.ActionRunAnalysis, ctx.Require(users.PermManageUsers,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	if w := do(analysis, "POST", "/v1/spectrum/", fredToken, ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected %d for researcher but got %d", http.StatusForbidden, w.Code)
+	}
+
+	list := ctx.Require(users.PermViewAudit, http.HandlerFunc(ctx.AdminAuditHandler))
+	export := ctx.Require(users.PermViewAudit, http.HandlerFunc(ctx.AdminAuditExportHandler))
+
+	cases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       []audit.Event
+	}{
+		{
+			"All Events",
+			"",
+			http.StatusOK,
+			[]audit.Event{
+				{Actor: accounts["fred"].ID.Hex(), Action: audit.ActionRunAnalysis, Target: "/v1/spectrum/", Outcome: audit.OutcomeDenied},
+				{Actor: accounts["admin"].ID.Hex(), Action: audit.ActionSignIn, Target: "admin@uw.edu", Outcome: audit.OutcomeSuccess},
+				{Actor: accounts["fred"].ID.Hex(), Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeSuccess},
+				{Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeFailure},
+			},
+		},
+		{
+			"Filtered Events",
+			"?action=session.begin&target=fred@uw.edu",
+			http.StatusOK,
+			[]audit.Event{
+				{Actor: accounts["fred"].ID.Hex(), Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeSuccess},
+				{Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeFailure},
+			},
+		},
+		{
+			"Paged Events",
+			"?outcome=success&limit=1&offset=1",
+			http.StatusOK,
+			[]audit.Event{
+				{Actor: accounts["fred"].ID.Hex(), Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeSuccess},
+			},
+		},
+		{
+			"Future Events",
+			"?since=" + time.Now().Add(time.Hour).Format(time.RFC3339),
+			http.StatusOK,
+			[]audit.Event{},
+		},
+		{
+			"Invalid Time",
+			"?until=yesterday",
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		w := do(list, "GET", "/v1/admin/audit"+c.query, adminToken, "")
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+			continue
+		}
+		if c.expected == nil {
+			continue
+		}
+		events := []*audit.Event{}
+		if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+			t.Errorf("case %s: error decoding events: %v", c.name, err)
+			continue
+		}
+		if len(events) != len(c.expected) {
+			t.Errorf("case %s: expected %d events but got %d", c.name, len(c.expected), len(events))
+			continue
+		}
+		for i, event := range events {
+			expected := c.expected[i]
+			if event.Actor != expected.Actor || event.Action != expected.Action ||
+				event.Target != expected.Target || event.Outcome != expected.Outcome {
+				t.Errorf("case %s: expected event %d to be %+v but got %+v", c.name, i, expected, event)
+			}
+		}
+	}
+
+	if w := do(list, "GET", "/v1/admin/audit", fredToken, ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d for researcher viewing the audit log but got %d", http.StatusForbidden, w.Code)
+	}
+
+	w := do(export, "GET", "/v1/admin/audit/export?actor="+accounts["fred"].ID.Hex(), adminToken, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for export but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get(headerContentType); ct != contentTypeJSONLines {
+		t.Errorf("expected content type %s but got %s", contentTypeJSONLines, ct)
+	}
+	actions := []string{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		event := &audit.Event{}
+		if err := json.Unmarshal(scanner.Bytes(), event); err != nil {
+			t.Fatalf("error decoding exported line %q: %v", scanner.Text(), err)
+		}
+		actions = append(actions, event.Action)
+	}
+	//exports are earliest first
+	if strings.Join(actions, ",") != audit.ActionSignIn+","+audit.ActionRunAnalysis {
+		t.Errorf("expected fred's sign-in then analysis but got %v", actions)
+	}
+}
+
+func TestAuditAccountEvents(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	auditLog := audit.NewMemStore()
+	ctx.SetAuditLog(auditLog)
+
+	accounts := map[string]*users.User{}
+	for _, name := range []string{"admin", "fred"} {
+		user, err := userStore.Insert(context.Background(), &users.NewUser{
+			Email:        name + "@uw.edu",
+			Password:     "123456",
+			PasswordConf: "123456",
+			UserName:     name,
+		})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		accounts[name] = user
+	}
+	if err := userStore.SetRole(context.Background(), accounts["admin"].ID, users.RoleAdmin); err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+
+	do := func(handler http.Handler, method string, target string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	signIn := func(name string) string {
+		w := do(http.HandlerFunc(ctx.SessionsHandler), "POST", "/v1/sessions", "",
+			`{"email": "`+name+`@uw.edu", "password": "123456"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		return w.Header().Get(headerAuthorization)
+	}
+	fredToken := signIn("fred")
+	adminToken := signIn("admin")
+	fredID := accounts["fred"].ID.Hex()
+	adminID := accounts["admin"].ID.Hex()
+
+	password := http.HandlerFunc(ctx.UsersMePasswordHandler)
+	adminUser := ctx.Require(users.PermManageUsers, http.HandlerFunc(ctx.SpecificAdminUserHandler))
+	lockouts := ctx.Require(users.PermManageUsers, http.HandlerFunc(ctx.AdminLockoutsHandler))
+	analysis := ctx.AuditMethods(MethodActions{"GET": audit.ActionReadAnalysis, "*": audit.ActionRunAnalysis},
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	requests := []struct {
+		handler        http.Handler
+		method         string
+		target         string
+		auth           string
+		body           string
+		expectedStatus int
+	}{
+		{password, "PUT", "/v1/users/me/password", fredToken,
+			`{"currentPassword": "wrong password", "newPassword": "654321", "newPasswordConf": "654321"}`, http.StatusForbidden},
+		{password, "PUT", "/v1/users/me/password", fredToken,
+			`{"currentPassword": "123456", "newPassword": "654321", "newPasswordConf": "654321"}`, http.StatusOK},
+		{adminUser, "PATCH", "/v1/admin/users/" + fredID, adminToken, `{"role": "admin"}`, http.StatusOK},
+		{adminUser, "PATCH", "/v1/admin/users/" + fredID, adminToken, `{"disabled": true}`, http.StatusOK},
+		{lockouts, "DELETE", "/v1/admin/lockouts/fred@uw.edu", adminToken, "", http.StatusOK},
+		{analysis, "GET", "/v1/sumfile/?filename=rest.txt", adminToken, "", http.StatusOK},
+		{analysis, "POST", "/v1/sumfile/", adminToken, "", http.StatusOK},
+	}
+	for i, req := range requests {
+		if w := do(req.handler, req.method, req.target, req.auth, req.body); w.Code != req.expectedStatus {
+			t.Fatalf("request %d: expected status %d but got %d: %s", i, req.expectedStatus, w.Code, w.Body.String())
+		}
+	}
+
+	expected := []audit.Event{
+		{Actor: fredID, Action: audit.ActionSignIn, Target: "fred@uw.edu", Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionSignIn, Target: "admin@uw.edu", Outcome: audit.OutcomeSuccess},
+		{Actor: fredID, Action: audit.ActionPasswordChange, Target: fredID, Outcome: audit.OutcomeFailure},
+		{Actor: fredID, Action: audit.ActionPasswordChange, Target: fredID, Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionRoleChange, Target: fredID, Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionUserDisable, Target: fredID, Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionUnlock, Target: "fred@uw.edu", Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionReadAnalysis, Target: "/v1/sumfile/", Outcome: audit.OutcomeSuccess},
+		{Actor: adminID, Action: audit.ActionRunAnalysis, Target: "/v1/sumfile/", Outcome: audit.OutcomeSuccess},
+	}
+	events := []*audit.Event{}
+	if err := auditLog.Each(context.Background(), &audit.Filter{}, func(event *audit.Event) error {
+		events = append(events, event)
+		return nil
+	}); err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events but got %d: %v", len(expected), len(events), events)
+	}
+	for i, event := range events {
+		if event.Actor != expected[i].Actor || event.Action != expected[i].Action ||
+			event.Target != expected[i].Target || event.Outcome != expected[i].Outcome {
+			t.Errorf("expected event %d to be %+v but got %+v", i, expected[i], event)
+		}
+	}
+}
@@ -1,18 +1,30 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
 	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/lockout"
 	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
 	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/tracing"
+	"gopkg.in/mgo.v2/bson"
 )
 
 //TODO: define HTTP handler functions as described in the
@@ -38,39 +50,57 @@ func (ctx *Context) UsersHandler(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		nu := users.NewUser{}
 		if err := json.NewDecoder(r.Body).Decode(&nu); err != nil {
-			http.Error(w, fmt.Sprintf("error decoding JSON: %v", err), http.StatusBadRequest)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
 			return
 		}
 		if err := nu.Validate(); err != nil {
-			http.Error(w, fmt.Sprintf("error validating user: %v", err), http.StatusInternalServerError)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error validating user", err))
 			return
 		}
 
-		if _, err := ctx.userStore.GetByEmail(nu.Email); err != users.ErrUserNotFound {
-			http.Error(w, fmt.Sprintf("there is already a user with same email address: %v", err), http.StatusBadRequest)
+		if err := ctx.checkEmailAvailable(r, nu.Email); err == users.ErrEmailTaken {
+			apierr.Write(w, r, apierr.New(apierr.CodeEmailTaken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
 			return
 		}
 
-		if _, err := ctx.userStore.GetByUserName(nu.UserName); err != users.ErrUserNotFound {
-			http.Error(w, fmt.Sprintf("there is already a user with same user name: %v", err), http.StatusBadRequest)
+		if _, err := ctx.userStore.GetByUserName(r.Context(), nu.UserName); err == nil {
+			apierr.Write(w, r, apierr.New(apierr.CodeUserNameTaken, users.ErrUserNameTaken.Error()))
+			return
+		} else if err != users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
 			return
 		}
 
-		user, err := ctx.userStore.Insert(&nu)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error inserting user: %v", err), http.StatusInternalServerError)
+		user, err := ctx.userStore.Insert(r.Context(), &nu)
+		if err == users.ErrEmailTaken {
+			//taken since the checks above
+			apierr.Write(w, r, apierr.New(apierr.CodeEmailTaken, err.Error()))
+			return
+		} else if err == users.ErrUserNameTaken {
+			apierr.Write(w, r, apierr.New(apierr.CodeUserNameTaken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error inserting user", err))
 			return
 		}
 
-		addToTrie(user, ctx.trie)
+		ctx.updateTrie(&indexes.Update[bson.ObjectId]{Value: user.ID, Added: user.SearchKeys()})
+		ctx.record(r, user, audit.ActionSignUp, user.Email, audit.OutcomeSuccess)
+
+		if err := ctx.sendVerification(r, user); err != nil {
+			reqlog.Logger(r.Context()).Error("error sending verification email", "error", err)
+		}
 
 		state := &sessionState{
 			Time: time.Now(),
 			User: user,
 		}
 
-		if _, err := sessions.BeginSession(ctx.signingKey, ctx.sessionStore, state, w); err != nil {
-			http.Error(w, "error beginning session", http.StatusInternalServerError)
+		if _, err := ctx.sessionManager.Begin(state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning session", err))
 			return
 		}
 
@@ -78,7 +108,7 @@ func (ctx *Context) UsersHandler(w http.ResponseWriter, r *http.Request) {
 		respond(w, user)
 
 	default:
-		http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
 		return
 	}
 }
@@ -88,11 +118,12 @@ func (ctx *Context) UsersMeHandler(w http.ResponseWriter, r *http.Request) {
 	//GET: get the current user from the session state and respond with that user encoded as JSON object.
 	//PATCH: update the current user with the JSON in the request body, and respond with the newly updated user,
 	//encoded as a JSON object. Remember that you are also caching the current user data in your session store, so update that as well.
+	//DELETE: delete the current user's account after checking their password, see deleteAccount.
 	switch r.Method {
 	case "GET":
 		state := &sessionState{}
-		if _, err := sessions.GetState(r, ctx.signingKey, ctx.sessionStore, state); err != nil {
-			http.Error(w, fmt.Sprintf("error retrieving session state: %v", err), http.StatusInternalServerError)
+		if _, err := ctx.getSession(r, state); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
 			return
 		}
 
@@ -101,43 +132,56 @@ func (ctx *Context) UsersMeHandler(w http.ResponseWriter, r *http.Request) {
 	case "PATCH":
 		//get state from context
 		state := &sessionState{}
-		sid, err := sessions.GetState(r, ctx.signingKey, ctx.sessionStore, state)
+		sid, err := ctx.getSession(r, state)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error retrieving session state: %v", err), http.StatusInternalServerError)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
 			return
 		}
 
 		//retrieve updates
 		upd := users.Updates{}
 		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
-			http.Error(w, fmt.Sprintf("error decoding JSON: %v", err), http.StatusBadRequest)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
 			return
 		}
-
-		//apply updates
-		if err := ctx.userStore.Update(state.User.ID, &upd); err != nil {
-			http.Error(w, fmt.Sprintf("error updating user: %v", err), http.StatusBadRequest)
+		//check the updates on a blank user, so that the
+		//store only fails when something is wrong with it
+		if err := (&users.User{}).ApplyUpdates(&upd); err != nil {
+			ctx.record(r, state.User, audit.ActionProfileUpdate, state.User.ID.Hex(), audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error validating updates", err))
 			return
 		}
 
-		if err := addAndRemove(state.User, ctx.trie, &upd); err != nil {
-			http.Error(w, fmt.Sprintf("error with trie: %v", err), http.StatusInternalServerError)
+		//apply updates
+		if err := ctx.userStore.Update(r.Context(), state.User.ID, &upd); err != nil {
+			ctx.record(r, state.User, audit.ActionProfileUpdate, state.User.ID.Hex(), audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
 			return
 		}
+		ctx.record(r, state.User, audit.ActionProfileUpdate, state.User.ID.Hex(), audit.OutcomeSuccess)
+
+		ctx.updateTrie(&indexes.Update[bson.ObjectId]{
+			Value:   state.User.ID,
+			Removed: []string{state.User.FirstName, state.User.LastName},
+			Added:   []string{upd.FirstName, upd.LastName},
+		})
 
 		if err := state.User.ApplyUpdates(&upd); err != nil {
-			http.Error(w, fmt.Sprintf("error updating user: %v", err), http.StatusBadRequest)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error updating user", err))
 			return
 		}
 
-		if err := ctx.sessionStore.Save(sid, state); err != nil {
-			http.Error(w, fmt.Sprintf("error updating user in store: %v", err), http.StatusBadRequest)
+		if err := ctx.sessionManager.Update(sid, state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user in store", err))
 			return
 		}
 
 		respond(w, state.User)
+
+	case "DELETE":
+		ctx.deleteAccount(w, r)
 	default:
-		http.Error(w, "method must be GET or PATCH", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET, PATCH or DELETE"))
 		return
 	}
 }
@@ -151,34 +195,66 @@ func (ctx *Context) SessionsHandler(w http.ResponseWriter, r *http.Request) {
 	case "POST":
 		cd := users.Credentials{}
 		if err := json.NewDecoder(r.Body).Decode(&cd); err != nil {
-			http.Error(w, fmt.Sprintf("error decoding JSON: %v", err), http.StatusBadRequest)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
 			return
 		}
 
-		user, err := ctx.userStore.GetByEmail(cd.Email)
-		if err != nil {
-			http.Error(w, "invalid email", http.StatusUnauthorized)
+		attempt, ok := ctx.checkLoginGuard(w, r, cd.Email, clientIP(r))
+		if !ok {
+			ctx.record(r, nil, audit.ActionSignIn, cd.Email, audit.OutcomeDenied)
+			return
+		}
+		defer ctx.releaseLoginAttempt(r, attempt)
+
+		//respond the same way, and take as long, whether the email or the password was wrong
+		user, err := ctx.userStore.GetByEmail(r.Context(), cd.Email)
+		if err != nil && err != users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if err == users.ErrUserNotFound {
+			user = dummyUser()
+		}
+		if authErr := user.Authenticate(cd.Password); authErr != nil || err != nil {
+			if err := attempt.Fail(); err != nil {
+				reqlog.Logger(r.Context()).Error("error recording failed sign-in", "error", err)
+			}
+			ctx.record(r, nil, audit.ActionSignIn, cd.Email, audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidCredentials, "invalid credentials"))
 			return
 		}
 
-		if err := user.Authenticate(cd.Password); err != nil {
-			http.Error(w, "invalid password", http.StatusUnauthorized)
+		if user.Disabled {
+			ctx.record(r, user, audit.ActionSignIn, cd.Email, audit.OutcomeDenied)
+			apierr.Write(w, r, apierr.New(apierr.CodeAccountDisabled, "account is disabled"))
 			return
 		}
 
+		//failures are only cleared once the two-factor code is checked as well,
+		//so that guessing codes can't be reset by entering the password again
+		if user.TOTPEnabled() {
+			ctx.beginPendingTOTP(w, r, user, false)
+			return
+		}
+
+		if err := attempt.Succeed(); err != nil {
+			reqlog.Logger(r.Context()).Error("error recording sign-in", "error", err)
+		}
+
 		state := &sessionState{
 			Time: time.Now(),
 			User: user,
 		}
 
-		if _, err := sessions.BeginSession(ctx.signingKey, ctx.sessionStore, state, w); err != nil {
-			http.Error(w, "error beginning session", http.StatusInternalServerError)
+		if _, err := ctx.sessionManager.Begin(state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning session", err))
 			return
 		}
+		ctx.record(r, user, audit.ActionSignIn, cd.Email, audit.OutcomeSuccess)
 
 		respond(w, user)
 	default:
-		http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
 		return
 	}
 }
@@ -187,62 +263,97 @@ func (ctx *Context) SessionsHandler(w http.ResponseWriter, r *http.Request) {
 func (ctx *Context) SessionsMineHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "DELETE":
-		if _, err := sessions.EndSession(r, ctx.signingKey, ctx.sessionStore); err != nil {
-			http.Error(w, fmt.Sprintf("error ending session: %v", err), http.StatusInternalServerError)
+		//get the user before the session is gone
+		var actor *users.User
+		state := &sessionState{}
+		if _, err := ctx.getSession(r, state); err == nil {
+			actor = state.User
+		}
+		if _, err := ctx.sessionManager.End(r); err != nil {
+			ctx.record(r, actor, audit.ActionSignOut, "", audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error ending session", err))
+			return
 		}
+		ctx.record(r, actor, audit.ActionSignOut, "", audit.OutcomeSuccess)
 
 		w.Header().Add(headerContentType, "text/plain")
 		fmt.Fprintln(w, "signed out")
 
 	default:
-		http.Error(w, "method must be DELETE", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be DELETE"))
 		return
 	}
 }
 
-//SearchHandler handles user search requests for authenticated users
-func (ctx *Context) SearchHandler(w http.ResponseWriter, r *http.Request) {
+//SessionsRefreshHandler handles requests for the "refresh" resource, and allows clients
+//holding a refresh token to exchange it for a new access token and refresh token.
+//It is only available when the gateway issues access tokens.
+func (ctx *Context) SessionsRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	tm, ok := ctx.sessionManager.(sessions.Refresher)
+	if !ok {
+		apierr.Write(w, r, apierr.New(apierr.CodeNotFound, "refresh tokens are not enabled"))
+		return
+	}
+
 	switch r.Method {
-	case "GET":
-		//get state from context
-		state := &sessionState{}
-		_, err := sessions.GetState(r, ctx.signingKey, ctx.sessionStore, state)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error retrieving session state: %v", err), http.StatusUnauthorized)
+	case "POST":
+		rt := &refreshRequest{}
+		if err := json.NewDecoder(r.Body).Decode(rt); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
 			return
 		}
 
-		q := r.URL.Query().Get("q")
-		if len(q) == 0 {
-			respond(w, "")
+		pair, err := tm.Refresh(rt.RefreshToken)
+		if err == sessions.ErrInvalidRefreshToken {
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidRefreshToken, err.Error()))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error refreshing session", err))
+			return
 		}
-		q = strings.ToLower(q)
-		ids := ctx.trie.Get(20, q)
-		users := ctx.userStore.GetByIDSlice(ids)
-		respond(w, users)
 
+		w.Header().Set(headerAuthorization, "Bearer "+pair.AccessToken)
+		w.Header().Set(sessions.HeaderRefreshToken, pair.RefreshToken)
+		respond(w, pair)
 	default:
-		http.Error(w, "method must be GET", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
 		return
 	}
 }
 
-//NewServiceProxy uses addresses to create reverse proxies for microservices
-func (ctx *Context) NewServiceProxy(addrs []string) *httputil.ReverseProxy {
+//NewServiceProxy uses addresses to create reverse proxies for microservices.
+//Any X-User headers sent by the client are replaced with the signed-in user
+//(if any) and a signature for `audience`, the name of the microservice.
+func (ctx *Context) NewServiceProxy(audience string, addrs []string) *httputil.ReverseProxy {
 	nextIndex := 0
 	mx := sync.Mutex{}
 	return &httputil.ReverseProxy{
 		Director: func(r *http.Request) {
-			state := &sessionState{}
-			sessions.GetState(r, ctx.signingKey, ctx.sessionStore, state)
-			if state.User != nil {
-				userJSON, err := json.Marshal(state.User)
-				if err != nil {
-					log.Printf("error marshaling user: %v", err)
+			//prefer the user loaded by Authorize, or else load it, since the
+			//user cached in the session may be out of date
+			user := authorizedUser(r)
+			if user == nil {
+				state := &sessionState{}
+				if _, err := ctx.getSession(r, state); err == nil {
+					current, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+					if err != nil && err != users.ErrUserNotFound {
+						reqlog.Logger(r.Context()).Error("error getting user", "error", err)
+					}
+					if err == nil && !current.Disabled {
+						user = current
+					}
+				}
+			}
+			var userJSON []byte
+			if user != nil {
+				var err error
+				if userJSON, err = json.Marshal(user); err != nil {
+					reqlog.Logger(r.Context()).Error("error marshaling user", "error", err)
 				}
-				r.Header.Add("X-User", string(userJSON))
-			} else {
-				r.Header.Del("X-User")
+			}
+			if err := ctx.userSigner.Sign(r.Header, userJSON, audience); err != nil {
+				reqlog.Logger(r.Context()).Error("error signing X-User header", "error", err)
 			}
 
 			mx.Lock()
@@ -250,50 +361,92 @@ func (ctx *Context) NewServiceProxy(addrs []string) *httputil.ReverseProxy {
 			nextIndex++
 			mx.Unlock()
 			r.URL.Scheme = "http"
+
+			//let the service log with the same request ID
+			if id := reqlog.RequestID(r.Context()); len(id) > 0 {
+				r.Header.Set(reqlog.HeaderRequestID, id)
+			}
+			reqlog.Logger(r.Context()).Debug("proxying request", "service", audience, "upstream", r.URL.Host)
+		},
+		Transport:      tracing.Transport(audience, ctx.metrics.Transport(audience, http.DefaultTransport)),
+		ModifyResponse: stripCORSHeaders,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			code := apierr.CodeUpstreamUnavailable
+			if errors.Is(err, context.DeadlineExceeded) {
+				code = apierr.CodeUpstreamTimeout
+			}
+			apierr.Write(w, r, apierr.Wrap(code, fmt.Sprintf("error reaching the %s service", audience), err))
 		},
 	}
 }
 
-//respond encodes `value` into JSON and writes that to the response
-func respond(w http.ResponseWriter, value interface{}) {
-	w.Header().Add(headerContentType, contentTypeJSON)
-	if err := json.NewEncoder(w).Encode(value); err != nil {
-		http.Error(w, fmt.Sprintf("error encoding response value to JSON: %v", err), http.StatusInternalServerError)
+//clientIP returns the IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
 }
 
-//addToTrie indexes user fields into the Trie
-func addToTrie(user *users.User, trie *indexes.Trie) {
-	em := strings.ToLower(user.Email)
-	un := strings.ToLower(user.UserName)
-	fn := strings.ToLower(user.FirstName)
-	ln := strings.ToLower(user.LastName)
-
-	trie.Add(em, user.ID)
-	trie.Add(un, user.ID)
-	trie.Add(fn, user.ID)
-	trie.Add(ln, user.ID)
+//checkLoginGuard begins a sign-in attempt for the account from the IP address,
+//and returns it if it may proceed. If not, it responds and returns false.
+//Release the attempt when the handler returns, so that it only counts as
+//a failure if it was ended with Fail.
+func (ctx *Context) checkLoginGuard(w http.ResponseWriter, r *http.Request, email string, ip string) (*lockout.Attempt, bool) {
+	attempt, err := ctx.loginGuard.Begin(email, ip)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error checking sign-in attempts", err))
+		return nil, false
+	}
+	if !attempt.Allowed() {
+		w.Header().Set(headerRetryAfter, strconv.Itoa(int(math.Ceil(attempt.RetryAfter.Seconds()))))
+		apierr.Write(w, r, apierr.New(apierr.CodeTooManyRequests, "too many failed sign-in attempts, try again later"))
+		return nil, false
+	}
+	return attempt, true
 }
 
-//removeFromTrie removes indexed user fields from the Trie
-func addAndRemove(user *users.User, trie *indexes.Trie, upd *users.Updates) error {
-	of := strings.ToLower(user.FirstName)
-	ol := strings.ToLower(user.LastName)
-	fn := strings.ToLower(upd.FirstName)
-	ln := strings.ToLower(upd.LastName)
-
-	if err := trie.Remove(of, user.ID); err != nil {
-		return fmt.Errorf("error removing first name from trie: %v", err)
+//releaseLoginAttempt stops counting the attempt as a failure,
+//unless it was already ended with Fail or Succeed
+func (ctx *Context) releaseLoginAttempt(r *http.Request, attempt *lockout.Attempt) {
+	if err := attempt.Release(); err != nil {
+		reqlog.Logger(r.Context()).Error("error releasing sign-in attempt", "error", err)
 	}
-	if err := trie.Remove(ol, user.ID); err != nil {
-		return fmt.Errorf("error removing lastname from trie: %v", err)
+}
+
+var dummy struct {
+	once sync.Once
+	user *users.User
+}
+
+//dummyUser returns a user with a password nobody knows, so that sign-in
+//attempts for unknown emails still pay for a password hash comparison
+func dummyUser() *users.User {
+	dummy.once.Do(func() {
+		pw := make([]byte, 32)
+		if _, err := rand.Read(pw); err != nil {
+			slog.Error("error generating dummy password", "error", err)
+		}
+		dummy.user = &users.User{}
+		if err := dummy.user.SetPassword(base64.StdEncoding.EncodeToString(pw)); err != nil {
+			slog.Error("error hashing dummy password", "error", err)
+		}
+	})
+	return dummy.user
+}
+
+//respond encodes `value` into JSON and writes that to the response
+func respond(w http.ResponseWriter, value interface{}) {
+	w.Header().Add(headerContentType, contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		//the status has already been sent, so the error can only be logged
+		slog.Error("error encoding response value to JSON", "error", err)
 	}
-	trie.Add(fn, user.ID)
-	trie.Add(ln, user.ID)
-	return nil
 }
 
 
+
 // // Files struct has
 // type Files struct {
 // 	FileNames    []string      `json:"fileNames,omitempty"`
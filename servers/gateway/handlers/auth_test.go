@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestErrorResponses(t *testing.T) {
+	root, err := ioutil.TempDir("", "handlers-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	ctx.SetFiles(files.NewDir(root))
+	if _, err := userStore.Insert(context.Background(), &users.NewUser{Email: "fred@uw.edu", Password: "123456",
+		PasswordConf: "123456", UserName: "fredhw"}); err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	r := httptest.NewRequest("POST", "/v1/sessions", strings.NewReader(`{"email": "fred@uw.edu", "password": "123456"}`))
+	w := httptest.NewRecorder()
+	ctx.SessionsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	token := w.Header().Get(headerAuthorization)
+
+	//nothing listens on a closed listener's address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.Close()
+	proxy := ctx.NewServiceProxy("qeeg", []string{l.Addr().String()})
+
+	cases := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		body           string
+		headers        map[string]string
+		expectedStatus int
+		expectedCode   apierr.Code
+	}{
+		{
+			"Invalid JSON",
+			ctx.UsersHandler,
+			"POST",
+			`{"email": `,
+			nil,
+			http.StatusBadRequest,
+			apierr.CodeInvalidJSON,
+		},
+		{
+			"Invalid New User",
+			ctx.UsersHandler,
+			"POST",
+			`{"email": "new@uw.edu", "password": "123", "passwordConf": "123", "userName": "new"}`,
+			nil,
+			http.StatusBadRequest,
+			apierr.CodeValidationFailed,
+		},
+		{
+			"Email Taken",
+			ctx.UsersHandler,
+			"POST",
+			`{"email": "fred@uw.edu", "password": "123456", "passwordConf": "123456", "userName": "new"}`,
+			nil,
+			http.StatusBadRequest,
+			apierr.CodeEmailTaken,
+		},
+		{
+			"User Name Taken",
+			ctx.UsersHandler,
+			"POST",
+			`{"email": "new@uw.edu", "password": "123456", "passwordConf": "123456", "userName": "fredhw"}`,
+			nil,
+			http.StatusBadRequest,
+			apierr.CodeUserNameTaken,
+		},
+		{
+			"Wrong Method",
+			ctx.UsersHandler,
+			"GET",
+			"",
+			nil,
+			http.StatusMethodNotAllowed,
+			apierr.CodeMethodNotAllowed,
+		},
+		{
+			"Invalid Credentials",
+			ctx.SessionsHandler,
+			"POST",
+			`{"email": "fred@uw.edu", "password": "654321"}`,
+			nil,
+			http.StatusUnauthorized,
+			apierr.CodeInvalidCredentials,
+		},
+		{
+			"No Session",
+			ctx.UsersMeHandler,
+			"GET",
+			"",
+			nil,
+			http.StatusUnauthorized,
+			apierr.CodeUnauthorized,
+		},
+		{
+			"Invalid Updates",
+			ctx.UsersMeHandler,
+			"PATCH",
+			`{"firstName": "Fred"}`,
+			map[string]string{headerAuthorization: token},
+			http.StatusBadRequest,
+			apierr.CodeValidationFailed,
+		},
+		{
+			"No File",
+			ctx.FileHandler,
+			"POST",
+			"",
+			map[string]string{headerAuthorization: token},
+			http.StatusBadRequest,
+			apierr.CodeFileRequired,
+		},
+		{
+			"Missing File",
+			ctx.FileHandler,
+			"DELETE",
+			"",
+			map[string]string{headerAuthorization: token, "filename": "missing.edf"},
+			http.StatusNotFound,
+			apierr.CodeNotFound,
+		},
+		{
+			"Invalid Base64",
+			ctx.FileHandler,
+			"POST",
+			"not base64!",
+			map[string]string{headerAuthorization: token, "filename": "recording.edf"},
+			http.StatusBadRequest,
+			apierr.CodeBadRequest,
+		},
+		{
+			"Upstream Down",
+			proxy.ServeHTTP,
+			"GET",
+			"",
+			nil,
+			http.StatusBadGateway,
+			apierr.CodeUpstreamUnavailable,
+		},
+	}
+
+	for _, c := range cases {
+		requestID := "request-" + strings.ReplaceAll(c.name, " ", "-")
+		r := httptest.NewRequest(c.method, "/v1/test", strings.NewReader(c.body))
+		r.Header.Set(apierr.HeaderRequestID, requestID)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		c.handler(w, r)
+
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get(headerContentType); ct != apierr.ContentType {
+			t.Errorf("case %s: expected content type %s but got %s", c.name, apierr.ContentType, ct)
+			continue
+		}
+		p := &apierr.Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+			t.Errorf("case %s: error decoding problem: %v", c.name, err)
+			continue
+		}
+		if p.Code != c.expectedCode || p.RequestID != requestID {
+			t.Errorf("case %s: expected code %s for request %q but got %+v", c.name, c.expectedCode, requestID, p)
+		}
+	}
+}
+
+func TestServiceProxyRequestID(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(reqlog.HeaderRequestID)
+	}))
+	defer upstream.Close()
+	u, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatalf("error parsing upstream URL: %v", err)
+	}
+
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, users.NewMemStore(time.Hour, time.Minute), xuser.NewHMACSigner([]byte("test key")))
+	proxy := reqlog.Middleware(slog.New(slog.NewTextHandler(ioutil.Discard, nil)), ctx.NewServiceProxy("summary", []string{u.Host}))
+
+	cases := []struct {
+		name      string
+		requestID string
+	}{
+		{"Client ID", "abc-123"},
+		{"Generated ID", ""},
+	}
+
+	for _, c := range cases {
+		upstreamID = ""
+		r := httptest.NewRequest("GET", "/v1/summary/", nil)
+		if len(c.requestID) > 0 {
+			r.Header.Set(reqlog.HeaderRequestID, c.requestID)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+
+		//the service sees the ID the client gets back
+		responseID := w.Header().Get(reqlog.HeaderRequestID)
+		if len(upstreamID) == 0 || upstreamID != responseID {
+			t.Errorf("case %s: expected the service to get request ID %q but got %q", c.name, responseID, upstreamID)
+		}
+		if len(c.requestID) > 0 && upstreamID != c.requestID {
+			t.Errorf("case %s: expected request ID %q but got %q", c.name, c.requestID, upstreamID)
+		}
+	}
+}
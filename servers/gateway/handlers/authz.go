@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+)
+
+//contextKey is the type of keys for values this package adds to request contexts
+type contextKey int
+
+//authorizedUserKey is the request context key of the user loaded by Authorize
+const authorizedUserKey contextKey = iota
+
+//MethodPermissions maps HTTP methods to the permission required to use them.
+//The permission for "*" applies to methods that aren't listed.
+type MethodPermissions map[string]users.Permission
+
+//Require wraps `next` so that only signed-in users with the permission can use it
+func (ctx *Context) Require(perm users.Permission, next http.Handler) http.Handler {
+	return ctx.Authorize(MethodPermissions{"*": perm}, next)
+}
+
+//Authorize wraps `next` so that only signed-in users with the permission for the
+//request method can use it. The user is loaded from the store on every request
+//rather than taken from the session, so that role changes, disabled accounts and
+//changes made in the user's other sessions, such as a new email address, take
+//effect immediately. Handlers and proxies can get that user with
+//authorizedUser.
+func (ctx *Context) Authorize(perms MethodPermissions, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perm, found := perms[r.Method]
+		if !found {
+			perm, found = perms["*"]
+		}
+		if !found {
+			apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method)))
+			return
+		}
+
+		state := &sessionState{}
+		sid, err := ctx.getSession(r, state)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+			return
+		}
+
+		user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+		if err == users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.New(apierr.CodeUnauthorized, "user no longer exists"))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if user.Disabled {
+			apierr.Write(w, r, apierr.New(apierr.CodeAccountDisabled, "account is disabled"))
+			return
+		}
+		if !user.Can(perm) {
+			apierr.Write(w, r, apierr.New(apierr.CodeForbidden, fmt.Sprintf("permission %s required", perm)))
+			return
+		}
+
+		//keep the cached user current, so that handlers reading the session, and
+		//access tokens in JWT mode, see changes made in the user's other sessions
+		if cachedUserChanged(state.User, user) {
+			state.User = user
+			if err := ctx.sessionManager.Update(sid, state, w); err != nil {
+				reqlog.Logger(r.Context()).Error("error updating user in store", "error", err)
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authorizedUserKey, user)))
+	})
+}
+
+//authorizedUser returns the user loaded by Authorize, or nil if the
+//request didn't pass through it
+func authorizedUser(r *http.Request) *users.User {
+	user, _ := r.Context().Value(authorizedUserKey).(*users.User)
+	return user
+}
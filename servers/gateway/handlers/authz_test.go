@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestAuthorize(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+
+	accounts := map[string]*users.User{}
+	tokens := map[string]string{}
+	for _, name := range []string{"admin", "fred"} {
+		user, err := userStore.Insert(context.Background(), &users.NewUser{
+			Email:        name + "@uw.edu",
+			Password:     "123456",
+			PasswordConf: "123456",
+			UserName:     name,
+		})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		accounts[name] = user
+		w := httptest.NewRecorder()
+		if _, err := sessionManager.Begin(&sessionState{Time: time.Now(), User: user}, w); err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+		tokens[name] = w.Header().Get(headerAuthorization)
+	}
+	if err := userStore.SetRole(context.Background(), accounts["admin"].ID, users.RoleAdmin); err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+
+	upload := ctx.Authorize(MethodPermissions{
+		"GET": users.PermReadFiles,
+		"*":   users.PermWriteFiles,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, authorizedUser(r).UserName)
+	}))
+	admin := ctx.Require(users.PermManageUsers, http.HandlerFunc(ctx.SpecificAdminUserHandler))
+
+	do := func(handler http.Handler, method string, target string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	fredURL := "/v1/admin/users/" + accounts["fred"].ID.Hex()
+	problemCode := func(w *httptest.ResponseRecorder) apierr.Code {
+		p := &apierr.Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+			t.Errorf("error decoding problem: %v", err)
+		}
+		return p.Code
+	}
+
+	if w := do(upload, "POST", "/", "", ""); w.Code != http.StatusUnauthorized || problemCode(w) != apierr.CodeUnauthorized {
+		t.Errorf("expected %d without a session but got %d: %s", http.StatusUnauthorized, w.Code, w.Body.String())
+	}
+	if w := do(upload, "POST", "/", tokens["fred"], ""); w.Code != http.StatusOK || w.Body.String() != "fred" {
+		t.Errorf("expected researcher to upload but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(admin, "PATCH", fredURL, tokens["fred"], `{"role": "viewer"}`); w.Code != http.StatusForbidden || problemCode(w) != apierr.CodeForbidden {
+		t.Errorf("expected %d for researcher using admin endpoint but got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+	}
+
+	//the role change applies to fred's existing session straight away
+	if w := do(admin, "PATCH", fredURL, tokens["admin"], `{"role": "viewer"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for role change but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := do(upload, "POST", "/", tokens["fred"], ""); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d for viewer uploading but got %d", http.StatusForbidden, w.Code)
+	}
+	if w := do(upload, "GET", "/", tokens["fred"], ""); w.Code != http.StatusOK {
+		t.Errorf("expected viewer to read files but got %d: %s", w.Code, w.Body.String())
+	}
+	state := &sessionState{}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(headerAuthorization, tokens["fred"])
+	if _, err := sessionManager.Get(r, state); err != nil || state.User.Role != users.RoleViewer {
+		t.Errorf("expected cached user to have the new role but got %v (%v)", state.User, err)
+	}
+
+	//an email change made in one of fred's sessions reaches his other sessions too
+	w := httptest.NewRecorder()
+	if _, err := sessionManager.Begin(&sessionState{Time: time.Now(), User: accounts["fred"]}, w); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	otherToken := w.Header().Get(headerAuthorization)
+	if w := do(http.HandlerFunc(ctx.UsersMeEmailHandler), "PUT", "/v1/users/me/email", tokens["fred"],
+		`{"email": "frederick@uw.edu", "currentPassword": "123456"}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for email change but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := do(upload, "GET", "/", otherToken, ""); w.Code != http.StatusOK {
+		t.Errorf("expected viewer to read files but got %d: %s", w.Code, w.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(headerAuthorization, otherToken)
+	if _, err := sessionManager.Get(r, state); err != nil || state.User.Email != "frederick@uw.edu" {
+		t.Errorf("expected other session's cached user to have the new email but got %v (%v)", state.User, err)
+	}
+
+	if w := do(admin, "PATCH", fredURL, tokens["admin"], `{"role": "superuser"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for unknown role but got %d", http.StatusBadRequest, w.Code)
+	}
+	if w := do(admin, "PATCH", "/v1/admin/users/"+accounts["admin"].ID.Hex(), tokens["admin"], `{"disabled": true}`); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for admin disabling themselves but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	if w := do(admin, "PATCH", fredURL, tokens["admin"], `{"disabled": true}`); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for disabling account but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := do(upload, "GET", "/", tokens["fred"], ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected sessions of disabled account to be ended but got %d", w.Code)
+	}
+	if w := do(http.HandlerFunc(ctx.SessionsHandler), "POST", "/v1/sessions", "",
+		`{"email": "frederick@uw.edu", "password": "123456"}`); w.Code != http.StatusForbidden {
+		t.Errorf("expected %d for disabled account signing in but got %d", http.StatusForbidden, w.Code)
+	}
+
+	list := ctx.Require(users.PermManageUsers, http.HandlerFunc(ctx.AdminUsersHandler))
+	if w := do(list, "GET", "/v1/admin/users?limit=1&offset=1", tokens["admin"], ""); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), accounts["fred"].ID.Hex()) {
+		t.Errorf("expected second page to list fred but got %d: %s", w.Code, w.Body.String())
+	}
+}
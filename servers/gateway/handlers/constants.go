@@ -1,5 +1,49 @@
 package handlers
 
+import "time"
+
 const headerContentType = "Content-Type"
 
 const contentTypeJSON = "application/json"
+
+const headerRetryAfter = "Retry-After"
+
+//headerLink links to the next page of a paginated response
+const headerLink = "Link"
+
+//Headers describing an uploaded recording
+const (
+	headerSubject    = "subject"
+	headerSession    = "session"
+	headerDevice     = "device"
+	headerTags       = "tags"
+	headerRecordedAt = "recorded-at"
+)
+
+//totpIssuer names this service in authenticator apps
+const totpIssuer = "Synapse"
+
+//pendingTOTPDuration is how long a user has to enter their
+//two-factor code after entering their password
+const pendingTOTPDuration = 5 * time.Minute
+
+//resetTokenDuration is how long a password reset link can be used
+const resetTokenDuration = time.Hour
+
+//verificationTokenDuration is how long an email verification link can be used
+const verificationTokenDuration = 24 * time.Hour
+
+const contentTypeZip = "application/zip"
+
+//contentTypeJSONLines is the type of JSON Lines exports, one JSON value per line
+const contentTypeJSONLines = "application/x-ndjson"
+
+//ssoLoginDuration is how long a user has to sign in at the identity provider
+const ssoLoginDuration = 10 * time.Minute
+
+//ssoReauthDuration is how long after signing in with the identity provider
+//users linked to it may confirm deleting their account without a password
+const ssoReauthDuration = 10 * time.Minute
+
+//ssoStateCookie ties a sign-in at the identity provider to the browser that started it
+const ssoStateCookie = "sso_state"
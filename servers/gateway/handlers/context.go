@@ -1,11 +1,22 @@
 package handlers
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"strings"
+	"time"
 
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/files"
 	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/lockout"
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/metrics"
 	"github.com/synapse-api/servers/gateway/models/users"
 	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/sso"
+	"github.com/synapse-api/servers/gateway/xuser"
+	"gopkg.in/mgo.v2/bson"
 )
 
 //TODO: define a handler context struct that
@@ -17,28 +28,148 @@ import (
 
 //Context holds context values used by multiple handler functions.
 type Context struct {
-	signingKey   string
-	userStore    users.Store
-	sessionStore sessions.Store
-	trie         *indexes.Trie
+	sessionManager sessions.Manager
+	userStore      users.Store
+	trie           *indexes.Trie[bson.ObjectId]
+	userSigner     *xuser.Signer
+
+	trieStream indexes.Stream[bson.ObjectId]
+	//origin identifies this gateway in the trie updates it publishes
+	origin string
+
+	loginGuard      *lockout.Guard
+	lockoutNotifier LockoutNotifier
+
+	mailer          mailer.Mailer
+	appURL          string
+	requireVerified bool
+
+	files      *files.Dir
+	recordings *indexes.RecordingIndex
+
+	auditLog audit.Store
+
+	metrics *metrics.Metrics
+
+	ssoProvider    *sso.Provider
+	ssoLogins      sso.Store
+	ssoCreateUsers bool
 }
 
+//LockoutNotifier is called when a user's account is locked out after
+//too many failed sign-in attempts, so the user can be told about it
+type LockoutNotifier func(user *users.User, until time.Time)
+
 //NewHandlerContext returns a struct that
 //will be a receiver on any of your HTTP
 //handler functions that need access to
-//globals, such as the key used for signing
-//and verifying SessionIDs, the session store
-//and the user store
-func NewHandlerContext(key string, userStore users.Store, sessionStore sessions.Store) *Context {
-	trie := indexes.NewTrie()
-	if err := userStore.GetAll(trie); err != nil {
-		log.Fatalf("error loading users: %v", err)
+//globals, such as the session manager,
+//the user store and the signer for the
+//X-User header sent to microservices.
+//The user search trie starts out empty, so that the context can be used
+//straight away; fill it with RestoreTrie or RebuildTrie.
+func NewHandlerContext(sessionManager sessions.Manager, userStore users.Store, userSigner *xuser.Signer) *Context {
+	ctx := &Context{
+		sessionManager: sessionManager,
+		userStore:      userStore,
+		trie:           indexes.NewTrie[bson.ObjectId](),
+		userSigner:     userSigner,
+		origin:         bson.NewObjectId().Hex(),
+		mailer:         mailer.NewLogMailer(nil),
+		files:          files.NewDir(files.DefaultRoot),
+		recordings:     indexes.NewRecordingIndex(),
+		auditLog:       audit.NewMemStore(),
 	}
+	ctx.SetLoginGuard(lockout.NewGuard(lockout.NewMemStore(time.Minute)))
+	ctx.SetMetrics(metrics.New())
+	return ctx
+}
+
+//SetLoginGuard replaces the guard that tracks failed sign-in attempts.
+//By default failed attempts are only tracked in memory.
+func (ctx *Context) SetLoginGuard(guard *lockout.Guard) {
+	guard.OnLockout = ctx.notifyLockout
+	ctx.loginGuard = guard
+}
+
+//SetLockoutNotifier sets the function called when an account is locked out
+func (ctx *Context) SetLockoutNotifier(notifier LockoutNotifier) {
+	ctx.lockoutNotifier = notifier
+}
 
-	return &Context{
-		signingKey:   key,
-		userStore:    userStore,
-		sessionStore: sessionStore,
-		trie:         trie,
+//SetMailer sets the mailer used for password reset and email verification
+//messages, and the URL of the web client that their links point to.
+//By default messages are only logged.
+func (ctx *Context) SetMailer(m mailer.Mailer, appURL string) {
+	ctx.mailer = m
+	ctx.appURL = strings.TrimSuffix(appURL, "/")
+}
+
+//SetRequireVerified sets whether users must verify their email address before uploading files
+func (ctx *Context) SetRequireVerified(require bool) {
+	ctx.requireVerified = require
+}
+
+//SetFiles sets the directory holding users' recordings and analysis results.
+//Its recordings can't be searched until they are loaded with LoadRecordings.
+func (ctx *Context) SetFiles(dir *files.Dir) {
+	ctx.files = dir
+	ctx.recordings = indexes.NewRecordingIndex()
+}
+
+//LoadRecordings indexes the recordings of every user with files, so they
+//can be searched. Recordings uploaded and deleted through the gateway are
+//indexed as they change, so this only needs doing when the gateway starts.
+func (ctx *Context) LoadRecordings() error {
+	names, err := ctx.files.Users()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		recs, err := ctx.files.Recordings(name)
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			ctx.recordings.Add(rec)
+		}
+	}
+	return nil
+}
+
+//SetAuditLog sets where security and data events are recorded
+func (ctx *Context) SetAuditLog(log audit.Store) {
+	ctx.auditLog = log
+}
+
+//SetMetrics sets the metrics that uploads, the user search trie and
+//proxied requests are recorded in. It must be called before the
+//proxies are created. By default metrics are kept but not served.
+func (ctx *Context) SetMetrics(m *metrics.Metrics) {
+	m.SetTrieSize(ctx.trie.Len)
+	ctx.metrics = m
+}
+
+//SetSSO enables signing in with an OpenID Connect provider. Sign-ins in
+//progress are kept in `logins`. If `createUsers` is true, users of the
+//provider without an account get one when they first sign in.
+func (ctx *Context) SetSSO(provider *sso.Provider, logins sso.Store, createUsers bool) {
+	ctx.ssoProvider = provider
+	ctx.ssoLogins = logins
+	ctx.ssoCreateUsers = createUsers
+}
+
+//notifyLockout looks up the user whose account was locked out and
+//passes them to the lockout notifier. Lockouts of email addresses
+//without an account are not reported.
+func (ctx *Context) notifyLockout(email string, until time.Time) {
+	slog.Warn("account locked out", "email", email, "until", until)
+	if ctx.lockoutNotifier == nil {
+		return
+	}
+	user, err := ctx.userStore.GetByEmail(context.Background(), email)
+	if err != nil {
+		return
 	}
+	ctx.lockoutNotifier(user, until)
 }
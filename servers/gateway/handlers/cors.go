@@ -1,68 +1,252 @@
 package handlers
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
-/* TODO: implement a CORS middleware handler, as described
-in https://drstearns.github.io/tutorials/cors/ that responds
-with the following headers to all requests:
-
-  Access-Control-Allow-Origin: *
-  Access-Control-Allow-Methods: GET, PUT, POST, PATCH, DELETE
-  Access-Control-Allow-Headers: Content-Type, Authorization
-  Access-Control-Expose-Headers: Authorization
-  Access-Control-Max-Age: 600
-*/
+	"github.com/synapse-api/servers/gateway/apierr"
+)
 
 const (
-	headerAllowOrigin   = "Access-Control-Allow-Origin"
-	headerAllowMethods  = "Access-Control-Allow-Methods"
-	headerAllowHeaders  = "Access-Control-Allow-Headers"
-	headerExposeHeaders = "Access-Control-Expose-Headers"
-	headerMaxAge        = "Access-Control-Max-Age"
+	headerAllowOrigin      = "Access-Control-Allow-Origin"
+	headerAllowMethods     = "Access-Control-Allow-Methods"
+	headerAllowHeaders     = "Access-Control-Allow-Headers"
+	headerAllowCredentials = "Access-Control-Allow-Credentials"
+	headerExposeHeaders    = "Access-Control-Expose-Headers"
+	headerMaxAge           = "Access-Control-Max-Age"
 
 	headerOrigin         = "Origin"
+	headerVary           = "Vary"
 	headerAuthorization  = "Authorization"
 	headerRequestMethod  = "Access-Control-Request-Method"
 	headerRequestHeaders = "Access-Control-Request-Headers"
 )
 
-//CORSHandler is a middleware that handles requests
+//CORSRoute overrides the allowed methods and headers of a CORSPolicy
+//for every request path that starts with PathPrefix
+type CORSRoute struct {
+	PathPrefix     string
+	AllowedMethods []string
+	AllowedHeaders []string
+}
+
+//CORSPolicy describes which cross-origin requests the gateway allows.
+//Entries in AllowedOrigins are either exact origins ("https://fredhw.me"),
+//wildcard subdomains ("https://*.fredhw.me") or "*" for any origin.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           int
+	Routes           []*CORSRoute
+}
+
+//errCORSWildcardCredentials is returned for policies that would let any
+//origin make requests with the user's cookies
+var errCORSWildcardCredentials = errors.New(`credentials can't be allowed for the "*" origin, list the allowed origins instead`)
+
+//NewCORSPolicy returns a policy for the given origins that allows the
+//methods and headers the gateway has always allowed. Credentials may
+//only be allowed for origins that are listed, not for "*".
+func NewCORSPolicy(origins []string, allowCredentials bool) (*CORSPolicy, error) {
+	policy := &CORSPolicy{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "PUT", "POST", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{headerContentType, headerAuthorization},
+		ExposedHeaders:   []string{headerAuthorization},
+		AllowCredentials: allowCredentials,
+		MaxAge:           600,
+	}
+	if allowCredentials && policy.allowsAnyOrigin() {
+		return nil, errCORSWildcardCredentials
+	}
+	return policy, nil
+}
+
+//AddRoute sets the allowed methods and headers for requests whose
+//path starts with `prefix`. A nil slice keeps the policy-wide value.
+func (p *CORSPolicy) AddRoute(prefix string, methods []string, headers []string) {
+	p.Routes = append(p.Routes, &CORSRoute{
+		PathPrefix:     prefix,
+		AllowedMethods: methods,
+		AllowedHeaders: headers,
+	})
+}
+
+//allowsOrigin reports whether the origin matches one of the allowed origins
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	o, err := url.Parse(origin)
+	if err != nil || len(o.Scheme) == 0 || len(o.Host) == 0 {
+		return false
+	}
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		a, err := url.Parse(allowed)
+		if err != nil || !strings.HasPrefix(a.Host, "*.") || !strings.EqualFold(a.Scheme, o.Scheme) {
+			continue
+		}
+		//"*.fredhw.me" matches "api.fredhw.me" but not "fredhw.me" itself
+		suffix := strings.ToLower(a.Host[1:])
+		if strings.HasSuffix(strings.ToLower(o.Host), suffix) && len(o.Host) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//allowsAnyOrigin reports whether the policy contains the "*" wildcard
+func (p *CORSPolicy) allowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//route returns the allowed methods and headers for the request path,
+//using the longest matching route prefix
+func (p *CORSPolicy) route(path string) ([]string, []string) {
+	methods := p.AllowedMethods
+	headers := p.AllowedHeaders
+	matched := -1
+	for _, rt := range p.Routes {
+		if strings.HasPrefix(path, rt.PathPrefix) && len(rt.PathPrefix) > matched {
+			matched = len(rt.PathPrefix)
+			methods = p.AllowedMethods
+			headers = p.AllowedHeaders
+			if rt.AllowedMethods != nil {
+				methods = rt.AllowedMethods
+			}
+			if rt.AllowedHeaders != nil {
+				headers = rt.AllowedHeaders
+			}
+		}
+	}
+	return methods, headers
+}
+
+//CORSHandler is a middleware that applies a CORSPolicy to requests
 type CORSHandler struct {
 	Handler http.Handler
+	Policy  *CORSPolicy
 }
 
 func (ch *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	//use the `Origin` and `Access-Control-Request-*` headers to
-	//determine if this request should be allowed
-	//for example...
-	// if r.Header.Get("Origin") != "https://fredhw.me" {
-	// 	http.Error(w, "error origin", http.StatusUnauthorized)
-	// 	return
-	// }
-
-	//set the various CORS response headers depending on
-	//what you want your server to allow
-	w.Header().Add(headerAllowOrigin, "*")
-	w.Header().Add(headerAllowMethods, "GET")
-	w.Header().Add(headerAllowMethods, "PUT")
-	w.Header().Add(headerAllowMethods, "POST")
-	w.Header().Add(headerAllowMethods, "PATCH")
-	w.Header().Add(headerAllowMethods, "DELETE")
-	w.Header().Add(headerAllowHeaders, headerContentType)
-	w.Header().Add(headerAllowHeaders, headerAuthorization)
-	w.Header().Add(headerAllowHeaders, "filename")
-	w.Header().Add(headerExposeHeaders, headerAuthorization)
-	w.Header().Add(headerMaxAge, "600")
-
-	//if this is preflight request, the method will
-	//be OPTIONS, so call the real handler only if
-	//the method is something else
-	if r.Method != "OPTIONS" {
+	//responses differ by origin, so caches must key on it
+	w.Header().Add(headerVary, headerOrigin)
+
+	origin := r.Header.Get(headerOrigin)
+	preflight := r.Method == "OPTIONS" && len(origin) > 0 && len(r.Header.Get(headerRequestMethod)) > 0
+
+	//requests without an Origin header are not cross-origin requests
+	if len(origin) == 0 {
 		ch.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if !ch.Policy.allowsOrigin(origin) {
+		if preflight {
+			apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "origin not allowed"))
+			return
+		}
+		//the browser will block the response without the CORS headers
+		ch.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	methods, headers := ch.Policy.route(r.URL.Path)
+
+	if preflight {
+		w.Header().Add(headerVary, headerRequestMethod)
+		w.Header().Add(headerVary, headerRequestHeaders)
+
+		if !containsFold(methods, r.Header.Get(headerRequestMethod)) {
+			apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "method not allowed by CORS policy"))
+			return
+		}
+		for _, h := range splitHeaderList(r.Header.Get(headerRequestHeaders)) {
+			if !containsFold(headers, h) {
+				apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "header "+h+" not allowed by CORS policy"))
+				return
+			}
+		}
+
+		ch.setOriginHeaders(w, origin)
+		w.Header().Set(headerAllowMethods, strings.Join(methods, ", "))
+		if len(headers) > 0 {
+			w.Header().Set(headerAllowHeaders, strings.Join(headers, ", "))
+		}
+		if ch.Policy.MaxAge > 0 {
+			w.Header().Set(headerMaxAge, strconv.Itoa(ch.Policy.MaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	ch.setOriginHeaders(w, origin)
+	if len(ch.Policy.ExposedHeaders) > 0 {
+		w.Header().Set(headerExposeHeaders, strings.Join(ch.Policy.ExposedHeaders, ", "))
+	}
+	ch.Handler.ServeHTTP(w, r)
+}
+
+//setOriginHeaders sets the allow-origin and allow-credentials headers
+//for an allowed origin. Any origin is allowed with "*", which browsers
+//never send credentials to, so the origin is only echoed when it was listed.
+func (ch *CORSHandler) setOriginHeaders(w http.ResponseWriter, origin string) {
+	if ch.Policy.allowsAnyOrigin() {
+		w.Header().Set(headerAllowOrigin, "*")
+		return
+	}
+	w.Header().Set(headerAllowOrigin, origin)
+	if ch.Policy.AllowCredentials {
+		w.Header().Set(headerAllowCredentials, "true")
 	}
 }
 
 //NewCORSHandler adds CORS support to all handler functions in a mux
-func NewCORSHandler(handlerToWrap http.Handler) *CORSHandler {
-	return &CORSHandler{handlerToWrap}
+func NewCORSHandler(handlerToWrap http.Handler, policy *CORSPolicy) *CORSHandler {
+	return &CORSHandler{
+		Handler: handlerToWrap,
+		Policy:  policy,
+	}
+}
+
+//stripCORSHeaders removes CORS headers set by upstream services so they
+//don't duplicate the ones the gateway already set on the response
+func stripCORSHeaders(resp *http.Response) error {
+	for _, h := range []string{headerAllowOrigin, headerAllowMethods, headerAllowHeaders,
+		headerAllowCredentials, headerExposeHeaders, headerMaxAge} {
+		resp.Header.Del(h)
+	}
+	return nil
+}
+
+//splitHeaderList splits a comma-separated header value into trimmed, non-empty entries
+func splitHeaderList(val string) []string {
+	list := []string{}
+	for _, v := range strings.Split(val, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+//containsFold reports whether `list` contains `val`, ignoring case
+func containsFold(list []string, val string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, val) {
+			return true
+		}
+	}
+	return false
 }
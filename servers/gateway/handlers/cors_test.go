@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSHandler(t *testing.T) {
+	policy, err := NewCORSPolicy([]string{"https://fredhw.me", "https://*.synapse-solutions.net"}, false)
+	if err != nil {
+		t.Fatalf("error creating policy: %v", err)
+	}
+	policy.AddRoute("/v1/upload", []string{"GET", "POST"}, []string{"Content-Type", "Authorization", "filename"})
+
+	called := false
+	handler := NewCORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}), policy)
+
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		origin         string
+		requestMethod  string
+		requestHeaders string
+		expectStatus   int
+		expectOrigin   string
+		expectCalled   bool
+	}{
+		{"No Origin", "GET", "/v1/users", "", "", "", http.StatusOK, "", true},
+		{"Exact Origin", "GET", "/v1/users", "https://fredhw.me", "", "", http.StatusOK, "https://fredhw.me", true},
+		{"Wildcard Subdomain", "GET", "/v1/users", "https://app.synapse-solutions.net", "", "", http.StatusOK, "https://app.synapse-solutions.net", true},
+		{"Wildcard Does Not Match Apex", "GET", "/v1/users", "https://synapse-solutions.net", "", "", http.StatusOK, "", true},
+		{"Wildcard Scheme Mismatch", "GET", "/v1/users", "http://app.synapse-solutions.net", "", "", http.StatusOK, "", true},
+		{"Disallowed Origin", "GET", "/v1/users", "https://evil.com", "", "", http.StatusOK, "", true},
+		{"Valid Preflight", "OPTIONS", "/v1/users", "https://fredhw.me", "PATCH", "content-type", http.StatusNoContent, "https://fredhw.me", false},
+		{"Preflight Disallowed Origin", "OPTIONS", "/v1/users", "https://evil.com", "GET", "", http.StatusForbidden, "", false},
+		{"Preflight Disallowed Method", "OPTIONS", "/v1/users", "https://fredhw.me", "TRACE", "", http.StatusForbidden, "", false},
+		{"Preflight Disallowed Header", "OPTIONS", "/v1/users", "https://fredhw.me", "POST", "filename", http.StatusForbidden, "", false},
+		{"Preflight Route Header", "OPTIONS", "/v1/upload", "https://fredhw.me", "POST", "Authorization, filename", http.StatusNoContent, "https://fredhw.me", false},
+		{"Preflight Route Method", "OPTIONS", "/v1/upload", "https://fredhw.me", "PATCH", "", http.StatusForbidden, "", false},
+		{"Plain OPTIONS", "OPTIONS", "/v1/users", "https://fredhw.me", "", "", http.StatusOK, "https://fredhw.me", true},
+	}
+
+	for _, c := range cases {
+		called = false
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if len(c.origin) > 0 {
+			r.Header.Set(headerOrigin, c.origin)
+		}
+		if len(c.requestMethod) > 0 {
+			r.Header.Set(headerRequestMethod, c.requestMethod)
+		}
+		if len(c.requestHeaders) > 0 {
+			r.Header.Set(headerRequestHeaders, c.requestHeaders)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != c.expectStatus {
+			t.Errorf("case %s: incorrect status code: expected %d but got %d", c.name, c.expectStatus, w.Code)
+		}
+		if got := w.Header().Get(headerAllowOrigin); got != c.expectOrigin {
+			t.Errorf("case %s: incorrect %s: expected %q but got %q", c.name, headerAllowOrigin, c.expectOrigin, got)
+		}
+		if called != c.expectCalled {
+			t.Errorf("case %s: expected handler called to be %t", c.name, c.expectCalled)
+		}
+		if !containsFold(w.Header()[headerVary], headerOrigin) {
+			t.Errorf("case %s: expected %s: %s", c.name, headerVary, headerOrigin)
+		}
+	}
+}
+
+func TestCORSHandlerCredentials(t *testing.T) {
+	//any origin could make requests with the user's cookies
+	if _, err := NewCORSPolicy([]string{"https://fredhw.me", "*"}, true); err != errCORSWildcardCredentials {
+		t.Errorf("expected credentials for any origin to be rejected but got %v", err)
+	}
+
+	policy, err := NewCORSPolicy([]string{"*"}, false)
+	if err != nil {
+		t.Fatalf("error creating policy: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/v1/users", nil)
+	r.Header.Set(headerOrigin, "https://fredhw.me")
+	w := httptest.NewRecorder()
+	NewCORSHandler(http.NotFoundHandler(), policy).ServeHTTP(w, r)
+	if got := w.Header().Get(headerAllowOrigin); got != "*" {
+		t.Errorf("incorrect %s without credentials: expected * but got %q", headerAllowOrigin, got)
+	}
+
+	policy, err = NewCORSPolicy([]string{"https://fredhw.me"}, true)
+	if err != nil {
+		t.Fatalf("error creating policy: %v", err)
+	}
+	w = httptest.NewRecorder()
+	NewCORSHandler(http.NotFoundHandler(), policy).ServeHTTP(w, r)
+	if got := w.Header().Get(headerAllowOrigin); got != "https://fredhw.me" {
+		t.Errorf("incorrect %s with credentials: expected origin but got %q", headerAllowOrigin, got)
+	}
+	if got := w.Header().Get(headerAllowCredentials); got != "true" {
+		t.Errorf("incorrect %s: expected true but got %q", headerAllowCredentials, got)
+	}
+}
@@ -3,14 +3,15 @@ package handlers
 import (
 	"io"
 	"encoding/base64"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"io/ioutil"
 
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/files"
 	"github.com/synapse-api/servers/gateway/models/users"
-	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/reqlog"
 )
 
 // Files struct has
@@ -23,27 +24,31 @@ type Files struct {
 func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 
 	state := &sessionState{}
-	if _, err := sessions.GetState(r, ctx.signingKey, ctx.sessionStore, state); err != nil {
-		http.Error(w, fmt.Sprintf("error retrieving session state: %v", err), http.StatusInternalServerError)
+	if _, err := ctx.getSession(r, state); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
 		return
 	}
+	path, err := ctx.files.UserPath(state.User.UserName)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeBadRequest, "error finding files", err))
+		return
+	}
+	logger := reqlog.Logger(r.Context())
 	switch r.Method {
 	case "GET":
-		fmt.Println("fetching files...")
+		logger.Debug("listing files", "path", path)
 
 		// check for directory
-		path := "/root/gateway/raw-data/" + state.User.UserName
-
-		fmt.Printf("user-path: %s\n", path)
 
 		if _, err := os.Stat(path); os.IsNotExist(err) {
 			os.Mkdir(path, os.ModePerm)
 		}
 
 		// get contents of directory
-		files, err := ioutil.ReadDir("/root/gateway/raw-data/" + state.User.UserName)
+		files, err := ioutil.ReadDir(path)
 		if err != nil {
-			log.Fatal(err)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error listing files", err))
+			return
 		}
 
 		ot := Files{}
@@ -56,6 +61,11 @@ func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 		respond(w, ot)
 
 	case "POST":
+		if !ctx.checkVerified(w, r, state.User) {
+			ctx.record(r, state.User, audit.ActionFileUpload, r.Header.Get("filename"), audit.OutcomeDenied)
+			return
+		}
+
 		// parse file
 
 		//fmt.Println("uploading...")
@@ -69,15 +79,22 @@ func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 		
 		val := r.Header.Get("filename");
 		if len(val) == 0 {
-			http.Error(w, "no file specified", http.StatusUnauthorized)
+			apierr.Write(w, r, apierr.New(apierr.CodeFileRequired, "no file specified"))
+			return
+		}
+		//the name is joined to the user's directory, so it mustn't lead out of it
+		if !files.ValidFileName(val) {
+			ctx.record(r, state.User, audit.ActionFileUpload, val, audit.OutcomeDenied)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "invalid file name", files.ErrInvalidFileName))
+			return
+		}
+		rec, err := recordingFromHeaders(r.Header, state.User.UserName, val)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error describing recording", err))
 			return
 		}
 
 		// check for directory
-		path := "/root/gateway/raw-data/" + state.User.UserName
-
-		fmt.Printf("user-path: %s\n", path)
-
 		if _, err := os.Stat(path); os.IsNotExist(err) {
 			os.Mkdir(path, os.ModePerm)
 		}
@@ -85,7 +102,8 @@ func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 		// look for duplicate file
 		files, err := ioutil.ReadDir(path)
 		if err != nil {
-			log.Fatal(err)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error listing files", err))
+			return
 		}
 
 		var dupeFile string
@@ -97,30 +115,51 @@ func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if len(dupeFile) > 0 {
-			fmt.Println("dupe found, removing")
-			deleteFile(w, dupeFile, path)
+			logger.Debug("replacing file", "file", val, "path", path)
+			if err := deleteFile(dupeFile, path); err != nil {
+				ctx.record(r, state.User, audit.ActionFileUpload, val, audit.OutcomeFailure)
+				apierr.Write(w, r, err)
+				return
+			}
 		}
 		
 		// save file
-        if err := saveFile(w, r, path, val); err != nil {
-			fmt.Fprintf(w, "%v", err)
-            return
+		logger.Debug("saving file", "file", val, "path", path)
+		size, err := saveFile(r, path, val)
+		if err != nil {
+			ctx.record(r, state.User, audit.ActionFileUpload, val, audit.OutcomeFailure)
+			apierr.Write(w, r, err)
+			return
+		}
+		ctx.metrics.AddUploadBytes(size)
+		//the file is saved either way, and `synapsectl files verify`
+		//reports it as unrecorded
+		if err := ctx.files.RecordChecksum(state.User.UserName, val); err != nil {
+			logger.Error("error recording checksum", "file", val, "error", err)
 		}
+		//the index is updated either way, and rebuilt from
+		//the file's name when the gateway restarts
+		if err := ctx.files.SetRecording(rec); err != nil {
+			logger.Error("error describing recording", "file", val, "error", err)
+		}
+		ctx.recordings.Add(rec)
+		ctx.record(r, state.User, audit.ActionFileUpload, val, audit.OutcomeSuccess)
+		w.WriteHeader(http.StatusCreated)
 		respond(w, state.User)
 	
 	case "DELETE":
-		fmt.Println("deleting...")
-
 		val := r.Header.Get("filename")
 
 		if len(val) == 0 {
-			http.Error(w, "no file specified", http.StatusUnauthorized)
+			apierr.Write(w, r, apierr.New(apierr.CodeFileRequired, "no file specified"))
 			return
 		}
 
-		files, err := ioutil.ReadDir("/root/gateway/raw-data/" + state.User.UserName)
-		if err != nil {
-			log.Fatal(err)
+		//users who never uploaded anything have no directory
+		files, err := ioutil.ReadDir(path)
+		if err != nil && !os.IsNotExist(err) {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error listing files", err))
+			return
 		}
 
 		var deleteFileName string
@@ -131,28 +170,36 @@ func (ctx *Context) FileHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		
-		// check for directory
-		path := "/root/gateway/raw-data/" + state.User.UserName
-
-		fmt.Printf("user-path: %s\n", path)
-
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			os.Mkdir(path, os.ModePerm)
+		logger.Debug("deleting file", "file", val, "path", path)
+		if err := deleteFile(deleteFileName, path); err != nil {
+			ctx.record(r, state.User, audit.ActionFileDelete, val, audit.OutcomeFailure)
+			apierr.Write(w, r, err)
+			return
 		}
-
-		deleteFile(w, deleteFileName, path)
+		if err := ctx.files.RemoveChecksum(state.User.UserName, val); err != nil {
+			logger.Error("error removing checksum", "file", val, "error", err)
+		}
+		if err := ctx.files.RemoveRecording(state.User.UserName, val); err != nil {
+			logger.Error("error removing description of recording", "file", val, "error", err)
+		}
+		ctx.recordings.Remove(state.User.UserName, val)
+		ctx.record(r, state.User, audit.ActionFileDelete, val, audit.OutcomeSuccess)
 
 		respond(w, state.User)
 
     default:
-		http.Error(w, "method must be GET, POST, PATCH, or DELETE", http.StatusMethodNotAllowed)
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET, POST, PATCH, or DELETE"))
 		return
 	}
 }
 
-func saveFile(w http.ResponseWriter, r *http.Request, path string, filename string) error {
-	fmt.Printf("saving file: %v\n", filename)
-
+//saveFile saves the base64-encoded body of the request as the file
+//named `filename` in the directory at `path`, and returns its size.
+//The name must be a single path element, see files.ValidFileName.
+func saveFile(r *http.Request, path string, filename string) (int64, error) {
+	if !files.ValidFileName(filename) {
+		return 0, apierr.Wrap(apierr.CodeValidationFailed, "invalid file name", files.ErrInvalidFileName)
+	}
 	//file multipart.File, handle *multipart.FileHeader
 
     // data, err := ioutil.ReadAll(file)
@@ -171,32 +218,33 @@ func saveFile(w http.ResponseWriter, r *http.Request, path string, filename stri
 
 	f, err := os.Create(path+"/"+filename)
 	if err != nil {
-		log.Fatalf("os.Create failed: %v", err)
+		return 0, apierr.Wrap(apierr.CodeInternal, "error creating file", err)
 	}
 	defer f.Close()
 
-	if _, err := io.Copy(f, dec); err != nil {
-		fmt.Fprintf(w, "%v", err)
-		return err
+	size, err := io.Copy(f, dec)
+	if err != nil {
+		//a body that isn't base64 is the client's fault
+		if _, corrupt := err.(base64.CorruptInputError); corrupt {
+			return 0, apierr.Wrap(apierr.CodeBadRequest, "error decoding file", err)
+		}
+		return 0, apierr.Wrap(apierr.CodeInternal, "error saving file", err)
 	}
-	
-	w.WriteHeader(http.StatusCreated)
-	return nil
+	return size, nil
 }
 
-func deleteFile(w http.ResponseWriter, deleteFileName string, path string) {
+//deleteFile deletes the file from the directory at `path`,
+//returning an *apierr.Error if that fails
+func deleteFile(deleteFileName string, path string) error {
 	if len(deleteFileName) == 0 {
-		http.Error(w, "file not found", http.StatusUnauthorized)
-		return
+		return apierr.Wrap(apierr.CodeNotFound, "file not found", os.ErrNotExist)
 	}
 
 	fullpath := path + "/" + deleteFileName
 	//fmt.Printf("fullpath: %v\n", fullpath)
 
 	if err := os.Remove(fullpath); err != nil {
-		fmt.Fprintf(w, "%v", err)
-		return
+		return apierr.Wrap(apierr.CodeInternal, "error deleting file", err)
 	}
-
-	fmt.Println("deleted")
+	return nil
 }
\ No newline at end of file
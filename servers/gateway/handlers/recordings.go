@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+)
+
+//RecordingSearchHandler handles requests for the "recording search" resource,
+//and allows users to find the recordings they may read, latest first, using
+//GET /v1/files/search. The optional subject, session and device parameters
+//select recordings whose values start with them, tags (separated by commas)
+//selects recordings with all of those tags, since and until (RFC 3339 times)
+//select a time range, and offset and limit page through the results.
+func (ctx *Context) RecordingSearchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		state := &sessionState{}
+		if _, err := ctx.getSession(r, state); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+			return
+		}
+
+		q := r.URL.Query()
+		filter := &indexes.RecordingFilter{
+			UserNames: readableUsers(state.User),
+			Subject:   q.Get("subject"),
+			Session:   q.Get("session"),
+			Device:    q.Get("device"),
+			Tags:      splitTags(q.Get("tags")),
+		}
+		if !queryTime(w, r, "since", &filter.Since) || !queryTime(w, r, "until", &filter.Until) {
+			return
+		}
+		offset, limit, ok := listPage(w, r)
+		if !ok {
+			return
+		}
+
+		found := ctx.recordings.Find(filter)
+		start := min(offset, len(found))
+		end := min(start+limit, len(found))
+		respond(w, found[start:end])
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET"))
+		return
+	}
+}
+
+//readableUsers returns the names of the users whose files the user may
+//read. Files are kept in a directory per user, and only read by their owner.
+func readableUsers(user *users.User) []string {
+	return []string{user.UserName}
+}
+
+//recordingFromHeaders describes the user's file being uploaded from the
+//request headers. The subject and session default to those in the file's
+//name, and the time it was recorded defaults to now.
+func recordingFromHeaders(header http.Header, userName string, file string) (*files.Recording, error) {
+	subject, session := files.ParseRecordingName(file)
+	rec := &files.Recording{
+		UserName:   userName,
+		File:       file,
+		Subject:    subject,
+		Session:    session,
+		Device:     header.Get(headerDevice),
+		Tags:       splitTags(header.Get(headerTags)),
+		RecordedAt: time.Now().UTC(),
+	}
+	if v := header.Get(headerSubject); len(v) > 0 {
+		rec.Subject = v
+	}
+	if v := header.Get(headerSession); len(v) > 0 {
+		rec.Session = v
+	}
+	if v := header.Get(headerRecordedAt); len(v) > 0 {
+		recordedAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time: %v", headerRecordedAt, err)
+		}
+		rec.RecordedAt = recordedAt.UTC()
+	}
+	return rec, nil
+}
+
+//splitTags splits a list of tags separated by commas, leaving out empty ones
+func splitTags(v string) []string {
+	var tags []string
+	for _, tag := range strings.Split(v, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
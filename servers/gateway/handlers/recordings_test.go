@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestRecordingSearchHandler(t *testing.T) {
+	root, err := ioutil.TempDir("", "handlers-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	ctx.SetFiles(files.NewDir(root))
+
+	//files that were there before the gateway started are indexed by name
+	if err := os.Mkdir(filepath.Join(root, "fredhw"), 0700); err != nil {
+		t.Fatalf("error creating user dir: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "fredhw", "P03_rest.txt"), []byte("recording"), 0600); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	old := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "fredhw", "P03_rest.txt"), old, old); err != nil {
+		t.Fatalf("error setting file times: %v", err)
+	}
+	if err := ctx.LoadRecordings(); err != nil {
+		t.Fatalf("error loading recordings: %v", err)
+	}
+
+	tokens := map[string]string{}
+	for _, name := range []string{"fredhw", "alice"} {
+		_, err := userStore.Insert(context.Background(), &users.NewUser{
+			Email:        name + "@uw.edu",
+			Password:     "123456",
+			PasswordConf: "123456",
+			UserName:     name,
+		})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+		r := httptest.NewRequest("POST", "/v1/sessions", strings.NewReader(`{"email": "`+name+`@uw.edu", "password": "123456"}`))
+		w := httptest.NewRecorder()
+		ctx.SessionsHandler(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		tokens[name] = w.Header().Get(headerAuthorization)
+	}
+
+	upload := func(user string, method string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/v1/upload", strings.NewReader(base64.StdEncoding.EncodeToString([]byte("recording"))))
+		r.Header.Set(headerAuthorization, tokens[user])
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ctx.FileHandler(w, r)
+		return w
+	}
+	uploads := []struct {
+		user    string
+		headers map[string]string
+	}{
+		{"fredhw", map[string]string{"filename": "P01_rest.txt", headerDevice: "Emotiv", headerTags: "pilot, noisy", headerRecordedAt: "2024-03-01T09:00:00Z"}},
+		{"fredhw", map[string]string{"filename": "P01_task.txt", headerDevice: "OpenBCI", headerRecordedAt: "2024-03-02T09:00:00Z"}},
+		{"fredhw", map[string]string{"filename": "recording.edf", headerSubject: "P02", headerSession: "rest", headerTags: "pilot", headerRecordedAt: "2024-03-03T09:00:00Z"}},
+		{"fredhw", map[string]string{"filename": "deleted.edf", headerSubject: "P01", headerSession: "rest"}},
+		{"alice", map[string]string{"filename": "P01_rest.txt", headerTags: "pilot"}},
+	}
+	for _, u := range uploads {
+		if w := upload(u.user, "POST", u.headers); w.Code != http.StatusCreated {
+			t.Fatalf("expected %d for upload but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	if w := upload("fredhw", "DELETE", map[string]string{"filename": "deleted.edf"}); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for delete but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := upload("fredhw", "POST", map[string]string{"filename": "P04_rest.txt", headerRecordedAt: "yesterday"}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid recording time but got %d", http.StatusBadRequest, w.Code)
+	}
+	for _, name := range []string{"../alice/P01_rest.txt", "../escape.txt", "sub/P05_rest.txt", ".."} {
+		if w := upload("fredhw", "POST", map[string]string{"filename": name}); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %d for uploading %q but got %d", http.StatusBadRequest, name, w.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be written outside the user's directory but got %v", err)
+	}
+	if alice, err := ioutil.ReadFile(filepath.Join(root, "alice", "P01_rest.txt")); err != nil || string(alice) != "recording" {
+		t.Errorf("expected alice's file to be untouched but got %q (%v)", alice, err)
+	}
+
+	cases := []struct {
+		name           string
+		user           string
+		query          string
+		expectedStatus int
+		expected       []string
+	}{
+		{
+			"All Readable",
+			"fredhw",
+			"",
+			http.StatusOK,
+			[]string{"recording.edf", "P01_task.txt", "P01_rest.txt", "P03_rest.txt"},
+		},
+		{
+			"Subject Prefix And Session",
+			"fredhw",
+			"?subject=p0&session=rest",
+			http.StatusOK,
+			[]string{"recording.edf", "P01_rest.txt", "P03_rest.txt"},
+		},
+		{
+			"Device",
+			"fredhw",
+			"?device=emotiv",
+			http.StatusOK,
+			[]string{"P01_rest.txt"},
+		},
+		{
+			"Tags",
+			"fredhw",
+			"?tags=pilot,noisy",
+			http.StatusOK,
+			[]string{"P01_rest.txt"},
+		},
+		{
+			"Date Range",
+			"fredhw",
+			"?since=2024-03-01T12:00:00Z&until=2024-03-03T00:00:00Z",
+			http.StatusOK,
+			[]string{"P01_task.txt"},
+		},
+		{
+			"Paged",
+			"fredhw",
+			"?offset=1&limit=2",
+			http.StatusOK,
+			[]string{"P01_task.txt", "P01_rest.txt"},
+		},
+		{
+			"Only Own Files",
+			"alice",
+			"?tags=pilot",
+			http.StatusOK,
+			[]string{"P01_rest.txt"},
+		},
+		{
+			"Invalid Time",
+			"fredhw",
+			"?since=yesterday",
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"Invalid Limit",
+			"fredhw",
+			"?limit=0",
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/v1/files/search"+c.query, nil)
+		r.Header.Set(headerAuthorization, tokens[c.user])
+		w := httptest.NewRecorder()
+		ctx.RecordingSearchHandler(w, r)
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+			continue
+		}
+		if c.expected == nil {
+			continue
+		}
+		found := []*files.Recording{}
+		if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+			t.Errorf("case %s: error decoding recordings: %v", c.name, err)
+			continue
+		}
+		names := []string{}
+		for _, rec := range found {
+			if rec.UserName != c.user {
+				t.Errorf("case %s: expected only recordings of %s but got one of %s", c.name, c.user, rec.UserName)
+			}
+			names = append(names, rec.File)
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expected, names)
+		}
+	}
+
+	//descriptions given at upload outlast a restart
+	restarted := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	restarted.SetFiles(files.NewDir(root))
+	if err := restarted.LoadRecordings(); err != nil {
+		t.Fatalf("error loading recordings: %v", err)
+	}
+	if found := restarted.recordings.Find(&indexes.RecordingFilter{UserNames: []string{"fredhw"}, Tags: []string{"noisy"}}); len(found) != 1 {
+		t.Errorf("expected the tagged recording to be found after a restart but got %d recordings", len(found))
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//resetRequest is the body of a request for a password reset email
+type resetRequest struct {
+	Email string `json:"email"`
+}
+
+//passwordReset is the body of a request to reset a password
+type passwordReset struct {
+	Token        string `json:"token"`
+	Password     string `json:"password"`
+	PasswordConf string `json:"passwordConf"`
+}
+
+//ResetsHandler handles requests for the "resets" resource, and allows clients to
+//request a password reset email using POST /v1/resets. It responds the same way
+//whether or not there is an account for the email address.
+func (ctx *Context) ResetsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		rr := &resetRequest{}
+		if err := json.NewDecoder(r.Body).Decode(rr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		user, err := ctx.userStore.GetByEmail(r.Context(), rr.Email)
+		if err != nil && err != users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if err == nil {
+			if err := ctx.sendReset(r, user); err != nil {
+				apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error creating reset token", err))
+				return
+			}
+		}
+
+		w.Header().Add(headerContentType, "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "if there is an account for that email address, a reset link has been sent to it")
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
+		return
+	}
+}
+
+//SpecificResetHandler handles requests for a specific reset, and allows clients to choose
+//a new password using the token from the reset email, using PUT /v1/resets/{email}.
+//All of the user's sessions are ended.
+func (ctx *Context) SpecificResetHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		pr := &passwordReset{}
+		if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+		if err := users.ValidatePassword(pr.Password, pr.PasswordConf); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error validating password", err))
+			return
+		}
+
+		email := path.Base(r.URL.Path)
+		user, err := ctx.userStore.GetByEmail(r.Context(), email)
+		if err == users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidToken, users.ErrInvalidToken.Error()))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+
+		if err := ctx.userStore.UseToken(r.Context(), user.ID, users.PurposePasswordReset, pr.Token); err == users.ErrInvalidToken {
+			ctx.record(r, nil, audit.ActionPasswordReset, user.Email, audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidToken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error checking reset token", err))
+			return
+		}
+
+		if err := user.SetPassword(pr.Password); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error hashing password", err))
+			return
+		}
+		if err := ctx.userStore.SetPassHash(r.Context(), user.ID, user.PassHash); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+		ctx.record(r, user, audit.ActionPasswordReset, user.Email, audit.OutcomeSuccess)
+		if err := ctx.endOtherSessions(user, sessions.InvalidSessionID); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error ending sessions", err))
+			return
+		}
+
+		//the token was delivered to the user's email address, which proves they own it
+		if !user.EmailVerified {
+			if err := ctx.userStore.SetEmailVerified(r.Context(), user.ID, true); err != nil {
+				reqlog.Logger(r.Context()).Error("error verifying email address", "error", err)
+			}
+		}
+		if err := ctx.loginGuard.Unlock(user.Email); err != nil {
+			reqlog.Logger(r.Context()).Error("error unlocking account", "error", err)
+		}
+
+		w.Header().Add(headerContentType, "text/plain")
+		fmt.Fprintln(w, "password reset")
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be PUT"))
+		return
+	}
+}
+
+//sendReset creates a new password reset token for the user, replacing any
+//earlier one, and emails it to them in the background so that the response
+//takes as long whether or not the account exists
+func (ctx *Context) sendReset(r *http.Request, user *users.User) error {
+	token, ott, err := users.NewOneTimeToken(resetTokenDuration)
+	if err != nil {
+		return err
+	}
+	if err := ctx.userStore.SetToken(r.Context(), user.ID, users.PurposePasswordReset, ott); err != nil {
+		return err
+	}
+
+	link := ctx.appLink("/reset", user.Email, token)
+	go ctx.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Synapse password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Synapse account.\n\n"+
+			"To choose a new password, open this link within an hour:\n\n%s\n\n"+
+			"If you didn't ask for this, you can ignore this email.\n", link),
+	})
+	return nil
+}
+
+//appLink returns a link to `page` of the web client, carrying the email address and token
+func (ctx *Context) appLink(page string, email string, token string) string {
+	q := url.Values{}
+	q.Set("email", email)
+	q.Set("token", token)
+	return ctx.appURL + page + "?" + q.Encode()
+}
+
+//sendMail sends the message, logging any error
+func (ctx *Context) sendMail(msg *mailer.Message) {
+	if err := ctx.mailer.Send(msg); err != nil {
+		slog.Error("error sending mail", "to", msg.To, "error", err)
+	}
+}
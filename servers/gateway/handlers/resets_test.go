@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+//chanMailer passes sent messages to a channel
+type chanMailer chan *mailer.Message
+
+func (m chanMailer) Send(msg *mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+//receiveToken waits for a message and returns the token in its link
+func receiveToken(t *testing.T, m chanMailer) string {
+	select {
+	case msg := <-m:
+		start := strings.Index(msg.Body, "https://")
+		if start < 0 {
+			t.Fatalf("no link in message: %s", msg.Body)
+		}
+		link, err := url.Parse(strings.Fields(msg.Body[start:])[0])
+		if err != nil {
+			t.Fatalf("error parsing link: %v", err)
+		}
+		return link.Query().Get("token")
+	case <-time.After(time.Second):
+		t.Fatalf("no message was sent")
+	}
+	return ""
+}
+
+func TestResetsAndVerifications(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	m := make(chanMailer, 10)
+	ctx.SetMailer(m, "https://synapse.test/")
+	ctx.SetRequireVerified(true)
+
+	user, err := userStore.Insert(context.Background(), &users.NewUser{
+		Email:        "fredhw@uw.edu",
+		Password:     "123456",
+		PasswordConf: "123456",
+		UserName:     "fredhw",
+		FirstName:    "Fred",
+		LastName:     "Wijaya",
+	})
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	do := func(handler http.HandlerFunc, method string, target string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	if w := do(ctx.ResetsHandler, "POST", "/v1/resets", `{"email": "nobody@uw.edu"}`); w.Code != http.StatusAccepted {
+		t.Errorf("expected %d for unknown email but got %d", http.StatusAccepted, w.Code)
+	}
+	select {
+	case msg := <-m:
+		t.Errorf("expected no message for unknown email but got one to %s", msg.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if w := do(ctx.ResetsHandler, "POST", "/v1/resets", `{"email": "fredhw@uw.edu"}`); w.Code != http.StatusAccepted {
+		t.Fatalf("expected %d but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	token := receiveToken(t, m)
+
+	reset := func(token string) int {
+		return do(ctx.SpecificResetHandler, "PUT", "/v1/resets/fredhw@uw.edu",
+			`{"token": "`+token+`", "password": "abcdef", "passwordConf": "abcdef"}`).Code
+	}
+	if code := reset("wrong"); code != http.StatusBadRequest {
+		t.Errorf("expected %d for wrong token but got %d", http.StatusBadRequest, code)
+	}
+	if code := reset(token); code != http.StatusOK {
+		t.Fatalf("expected %d for reset but got %d", http.StatusOK, code)
+	}
+	if code := reset(token); code != http.StatusBadRequest {
+		t.Errorf("expected %d for reused token but got %d", http.StatusBadRequest, code)
+	}
+
+	user, err = userStore.GetByID(context.Background(), user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if err := user.Authenticate("abcdef"); err != nil {
+		t.Errorf("expected new password to work but got %v", err)
+	}
+	if !user.EmailVerified {
+		t.Errorf("expected reset to verify the email address")
+	}
+
+	//verification tokens can't be used for resets
+	if err := userStore.SetEmailVerified(context.Background(), user.ID, false); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+	if ctx.checkVerified(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), user) {
+		t.Errorf("expected unverified user to be blocked from uploading")
+	}
+	if err := ctx.sendVerification(httptest.NewRequest("GET", "/", nil), user); err != nil {
+		t.Fatalf("error sending verification: %v", err)
+	}
+	token = receiveToken(t, m)
+	if code := reset(token); code != http.StatusBadRequest {
+		t.Errorf("expected %d for verification token used as reset token but got %d", http.StatusBadRequest, code)
+	}
+	w := do(ctx.SpecificVerificationHandler, "PUT", "/v1/verifications/fredhw@uw.edu", `{"token": "`+token+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for verification but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if !ctx.checkVerified(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), user) {
+		t.Errorf("expected verified user to be allowed to upload")
+	}
+}
@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//defaultSearchLimit is how many users a search returns unless the request gives a limit
+const defaultSearchLimit = 20
+
+//maxSearchLimit is the most users a search returns at once
+const maxSearchLimit = 100
+
+//searchCandidates is how many users matching every word of a query
+//are ranked, which bounds the work done for broad queries
+const searchCandidates = 200
+
+//Scores of a word matching a field of a user. The kind of match counts for
+//more than the field, so that exact matches come before prefix matches,
+//which come before fuzzy ones, whatever fields they are in.
+const (
+	scoreExact  = 300
+	scorePrefix = 200
+	scoreFuzzy  = 100
+	//scorePerEdit is taken off fuzzy matches for every edit they need
+	scorePerEdit = 10
+	//scorePerWeight is added for every point of the field's weight
+	scorePerWeight = 10
+)
+
+//errInvalidCursor is returned for cursors that weren't returned by a search
+var errInvalidCursor = errors.New("invalid cursor")
+
+//searchField is a field of a user that is searched, with its weight
+type searchField struct {
+	value  string
+	weight int
+}
+
+//searchFields returns the searched fields of the user. The user name
+//weighs the most, since it is the surest way to tell users apart.
+func searchFields(user *users.User) []searchField {
+	return []searchField{
+		{user.UserName, 4},
+		{user.Email, 3},
+		{user.FirstName, 2},
+		{user.LastName, 1},
+	}
+}
+
+//rankedUser is a user with the score of its best matches
+type rankedUser struct {
+	user  *users.User
+	score int
+}
+
+//searchCursor is the position in the ranking after which the next page starts
+type searchCursor struct {
+	score int
+	id    bson.ObjectId
+}
+
+//SearchHandler handles user search requests for authenticated users. Users
+//match if every word of `q` matches one of their fields, and are ranked by
+//how well they match. Pages of `limit` users are returned, with a Link
+//header to the next page, which carries a `cursor` parameter.
+func (ctx *Context) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		//get state from context
+		state := &sessionState{}
+		_, err := ctx.getSession(r, state)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+			return
+		}
+
+		query := r.URL.Query()
+		limit := defaultSearchLimit
+		if v := query.Get("limit"); len(v) > 0 {
+			if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxSearchLimit {
+				apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)))
+				return
+			}
+		}
+		var after *searchCursor
+		if v := query.Get("cursor"); len(v) > 0 {
+			if after, err = decodeSearchCursor(v); err != nil {
+				apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, err.Error()))
+				return
+			}
+		}
+
+		terms := strings.Fields(indexes.Normalize(query.Get("q")))
+		if len(terms) == 0 {
+			respond(w, []*users.User{})
+			return
+		}
+
+		found, err := ctx.userStore.GetByIDSlice(r.Context(), ctx.searchCandidates(terms))
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting users", err))
+			return
+		}
+		ranked := rankUsers(found, terms)
+
+		start := 0
+		if after != nil {
+			start = sort.Search(len(ranked), func(i int) bool {
+				return ranksAfter(ranked[i], after)
+			})
+		}
+		end := min(start+limit, len(ranked))
+		page := make([]*users.User, 0, end-start)
+		for _, ru := range ranked[start:end] {
+			page = append(page, ru.user)
+		}
+		if end < len(ranked) {
+			last := ranked[end-1]
+			next := *r.URL
+			params := r.URL.Query()
+			params.Set("limit", strconv.Itoa(limit))
+			params.Set("cursor", encodeSearchCursor(&searchCursor{last.score, last.user.ID}))
+			next.RawQuery = params.Encode()
+			w.Header().Set(headerLink, fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
+		}
+		respond(w, page)
+
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET"))
+		return
+	}
+}
+
+//searchCandidates returns the IDs of up to searchCandidates users with a key
+//matching each of the normalized terms, according to the trie. The matches
+//of every term are intersected, starting from the term with the fewest, so
+//that users matching all of them aren't missed when one term is common.
+func (ctx *Context) searchCandidates(terms []string) []bson.ObjectId {
+	lists := make([][]*indexes.Match[bson.ObjectId], len(terms))
+	for i, term := range terms {
+		lists[i] = ctx.trie.Search(term, maxEdits(term), math.MaxInt)
+	}
+	sort.SliceStable(lists, func(i, j int) bool {
+		return len(lists[i]) < len(lists[j])
+	})
+
+	candidates := make([]bson.ObjectId, 0, len(lists[0]))
+	for _, m := range lists[0] {
+		candidates = append(candidates, m.Value)
+	}
+	for _, matches := range lists[1:] {
+		if len(candidates) == 0 {
+			break
+		}
+		matched := make(map[bson.ObjectId]bool, len(matches))
+		for _, m := range matches {
+			matched[m.Value] = true
+		}
+		kept := candidates[:0]
+		for _, id := range candidates {
+			if matched[id] {
+				kept = append(kept, id)
+			}
+		}
+		candidates = kept
+	}
+	return candidates[:min(len(candidates), searchCandidates)]
+}
+
+//rankUsers scores the users by how well each of the normalized terms
+//matches their fields, and returns those matching every term, best
+//first. Users with the same score are ordered by ID.
+func rankUsers(found []*users.User, terms []string) []*rankedUser {
+	ranked := []*rankedUser{}
+	for _, user := range found {
+		fields := searchFields(user)
+		total := 0
+		for _, term := range terms {
+			best := 0
+			for _, f := range fields {
+				best = max(best, matchScore(term, indexes.Normalize(f.value), f.weight))
+			}
+			if best == 0 {
+				total = 0
+				break
+			}
+			total += best
+		}
+		if total > 0 {
+			ranked = append(ranked, &rankedUser{user, total})
+		}
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].user.ID < ranked[j].user.ID
+	})
+	return ranked
+}
+
+//matchScore returns the score of the normalized term matching
+//the normalized field of the given weight, or 0 if it doesn't
+func matchScore(term string, field string, weight int) int {
+	kind := 0
+	switch {
+	case field == term:
+		kind = scoreExact
+	case strings.HasPrefix(field, term):
+		kind = scorePrefix
+	default:
+		if d := indexes.Distance(term, field); d <= maxEdits(term) {
+			kind = scoreFuzzy - d*scorePerEdit
+		}
+	}
+	if kind == 0 {
+		return 0
+	}
+	return kind + weight*scorePerWeight
+}
+
+//maxEdits returns how many typos are tolerated in the term.
+//Short terms get none, since a typo could make them match anything.
+func maxEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n < 4:
+		return 0
+	case n < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+//ranksAfter reports whether the user ranks after the cursor
+func ranksAfter(ru *rankedUser, after *searchCursor) bool {
+	return ru.score < after.score || (ru.score == after.score && ru.user.ID > after.id)
+}
+
+//encodeSearchCursor encodes the cursor for a URL
+func encodeSearchCursor(c *searchCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%s", c.score, c.id.Hex())))
+}
+
+//decodeSearchCursor decodes a cursor encoded by encodeSearchCursor
+func decodeSearchCursor(v string) (*searchCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	parts := strings.SplitN(string(buf), ".", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return nil, errInvalidCursor
+	}
+	score, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	return &searchCursor{score, bson.ObjectIdHex(parts[1])}, nil
+}
@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSearchHandler(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	for _, u := range [][]string{
+		{"jane", "Jane", "Smith"},
+		{"janedoe", "Jane", "Doe"},
+		{"janet", "Janet", "Lee"},
+		{"june", "June", "Park"},
+		{"doej", "John", "Doe"},
+		{"smith", "Will", "Jones"},
+	} {
+		_, err := userStore.Insert(context.Background(), &users.NewUser{
+			Email:        u[0] + "@example.com",
+			Password:     "123456",
+			PasswordConf: "123456",
+			UserName:     u[0],
+			FirstName:    u[1],
+			LastName:     u[2],
+		})
+		if err != nil {
+			t.Fatalf("error inserting user: %v", err)
+		}
+	}
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	if err := ctx.RebuildTrie(); err != nil {
+		t.Fatalf("error building trie: %v", err)
+	}
+
+	do := func(target string, auth string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		ctx.SearchHandler(w, r)
+		return w
+	}
+	r := httptest.NewRequest("POST", "/v1/sessions", strings.NewReader(`{"email": "jane@example.com", "password": "123456"}`))
+	w := httptest.NewRecorder()
+	ctx.SessionsHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	token := w.Header().Get(headerAuthorization)
+
+	cases := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       []string
+		expectNext     bool
+	}{
+		{
+			"Exact Before Prefix Before Fuzzy",
+			"?q=Jane",
+			http.StatusOK,
+			[]string{"jane", "janedoe", "janet", "june"},
+			false,
+		},
+		{
+			"User Name Before Last Name",
+			"?q=smith",
+			http.StatusOK,
+			[]string{"smith", "jane"},
+			false,
+		},
+		{
+			"Every Word Matches",
+			"?q=jane+doe",
+			http.StatusOK,
+			[]string{"janedoe"},
+			false,
+		},
+		{
+			"Typo",
+			"?q=janwt",
+			http.StatusOK,
+			[]string{"janet"},
+			false,
+		},
+		{
+			"No Typos In Short Words",
+			"?q=doo",
+			http.StatusOK,
+			[]string{},
+			false,
+		},
+		{
+			"First Page",
+			"?q=jane&limit=2",
+			http.StatusOK,
+			[]string{"jane", "janedoe"},
+			true,
+		},
+		{
+			"Empty Query",
+			"?q=",
+			http.StatusOK,
+			[]string{},
+			false,
+		},
+		{
+			"Invalid Limit",
+			"?q=jane&limit=0",
+			http.StatusBadRequest,
+			nil,
+			false,
+		},
+		{
+			"Limit Too High",
+			"?q=jane&limit=1000",
+			http.StatusBadRequest,
+			nil,
+			false,
+		},
+		{
+			"Invalid Cursor",
+			"?q=jane&cursor=zzz",
+			http.StatusBadRequest,
+			nil,
+			false,
+		},
+	}
+
+	for _, c := range cases {
+		w := do("/v1/users"+c.query, token)
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+			continue
+		}
+		if c.expected == nil {
+			continue
+		}
+		found := []*users.User{}
+		if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+			t.Errorf("case %s: error decoding users: %v", c.name, err)
+			continue
+		}
+		names := []string{}
+		for _, u := range found {
+			names = append(names, u.UserName)
+		}
+		if strings.Join(names, ",") != strings.Join(c.expected, ",") {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expected, names)
+		}
+		if link := w.Header().Get(headerLink); (len(link) > 0) != c.expectNext {
+			t.Errorf("case %s: expected next page link to be given: %t, but got %q", c.name, c.expectNext, link)
+		}
+	}
+
+	//following the Link header gets the rest of the results
+	link := do("/v1/users?q=jane&limit=2", token).Header().Get(headerLink)
+	if !strings.HasPrefix(link, "<") || !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("expected a link to the next page but got %q", link)
+	}
+	w = do(strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`), token)
+	found := []*users.User{}
+	if err := json.NewDecoder(w.Body).Decode(&found); err != nil {
+		t.Fatalf("error decoding users: %v", err)
+	}
+	if len(found) != 2 || found[0].UserName != "janet" || found[1].UserName != "june" {
+		t.Errorf("expected janet and june on the second page but got %+v", found)
+	}
+	if link := w.Header().Get(headerLink); len(link) > 0 {
+		t.Errorf("expected no link after the last page but got %q", link)
+	}
+
+	if w := do("/v1/users?q=jane", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d without a session but got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestSearchCandidates(t *testing.T) {
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, users.NewMemStore(time.Hour, time.Minute), xuser.NewHMACSigner([]byte("test key")))
+
+	//many users share a first name, and the one with the last name
+	//comes after more of them than are ranked for a single word
+	for i := 0; i < 2*searchCandidates; i++ {
+		ctx.trie.Add("alex", bson.NewObjectId())
+	}
+	target := bson.NewObjectId()
+	ctx.trie.Add("alex", target)
+	ctx.trie.Add("zephyr", target)
+
+	for _, q := range []string{"alex zephyr", "zephyr alex"} {
+		candidates := ctx.searchCandidates(strings.Fields(q))
+		if len(candidates) != 1 || candidates[0] != target {
+			t.Errorf("query %q: expected only the shared match but got %d candidates", q, len(candidates))
+		}
+	}
+
+	//broad queries are still bounded
+	if candidates := ctx.searchCandidates([]string{"alex"}); len(candidates) != searchCandidates {
+		t.Errorf("expected %d candidates but got %d", searchCandidates, len(candidates))
+	}
+}
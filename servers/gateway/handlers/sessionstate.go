@@ -1,9 +1,15 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"time"
 
 	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+	"github.com/synapse-api/servers/gateway/sessions"
 )
 
 //TODO: define a session state struct for this web server
@@ -13,4 +19,60 @@ import (
 type sessionState struct {
 	Time time.Time
 	User *users.User
+	//PendingTOTP is true when the password was correct but the user
+	//still has to enter a two-factor code. Such a session may only
+	//be used to finish signing in.
+	PendingTOTP bool `json:",omitempty"`
+	//SSO is true when the user signed in with the identity provider
+	//rather than their password
+	SSO bool `json:",omitempty"`
+}
+
+//errPendingTOTP is returned for sessions still waiting for a two-factor code
+var errPendingTOTP = errors.New("two-factor code required")
+
+//getSession gets the state of a fully signed-in session
+func (ctx *Context) getSession(r *http.Request, state *sessionState) (sessions.SessionID, error) {
+	sid, err := ctx.sessionManager.Get(r, state)
+	if err != nil {
+		return sid, err
+	}
+	if state.PendingTOTP {
+		return sid, errPendingTOTP
+	}
+	reqlog.SetUser(r.Context(), state.Subject())
+	return sid, nil
+}
+
+//cachedUserChanged reports whether the user cached in a session differs
+//from the stored user, in what is encoded in the session
+func cachedUserChanged(cached *users.User, stored *users.User) bool {
+	a, err := json.Marshal(cached)
+	if err != nil {
+		return true
+	}
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return true
+	}
+	return !bytes.Equal(a, b)
+}
+
+//refreshRequest is the body of a request to refresh an access token
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+//Subject returns the ID of the signed-in user, so that access tokens
+//carry it in their "sub" claim
+func (s *sessionState) Subject() string {
+	if s.User == nil {
+		return ""
+	}
+	return s.User.ID.Hex()
+}
+
+//totpRequest is the body of a request carrying a two-factor code
+type totpRequest struct {
+	Code string `json:"code"`
 }
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+	"github.com/synapse-api/servers/gateway/sso"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//errSSONotLinked is returned when an identity at the provider has no account
+var errSSONotLinked = errors.New("there is no account for this identity, sign in with your password to link it")
+
+//errSSOLinkedElsewhere is returned when the account with the identity's
+//email address is already linked to another identity at the provider
+var errSSOLinkedElsewhere = errors.New("the account with this email address is linked to another identity")
+
+//ssoBegin is the response to starting a single sign-on
+type ssoBegin struct {
+	URL string `json:"url"`
+}
+
+//ssoFinish is the body of a request to finish a single sign-on, with
+//the parameters the provider sent the user back to the web client with
+type ssoFinish struct {
+	State string `json:"state"`
+	Code  string `json:"code"`
+}
+
+//SessionsSSOHandler handles requests for the "single sign-on" resource. GET starts
+//signing in with the identity provider, and responds with the URL to send the user to.
+//The provider sends them back to the web client, which POSTs the state and code it was
+//given. The user is linked to an account by their identity at the provider or their
+//verified email address, and a session is begun just like POST /v1/sessions.
+//The state must match the cookie set when the sign-in was started, so that nobody
+//can finish a sign-in they started themselves in someone else's browser.
+func (ctx *Context) SessionsSSOHandler(w http.ResponseWriter, r *http.Request) {
+	if ctx.ssoProvider == nil {
+		apierr.Write(w, r, apierr.New(apierr.CodeNotFound, "single sign-on is not enabled"))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		authURL, login, err := ctx.ssoProvider.Begin()
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning sign-in", err))
+			return
+		}
+		if err := ctx.ssoLogins.Save(login, ssoLoginDuration); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error saving sign-in", err))
+			return
+		}
+
+		http.SetCookie(w, newSSOStateCookie(hashSSOState(login.State), ssoLoginDuration))
+		respond(w, &ssoBegin{URL: authURL})
+
+	case "POST":
+		sf := &ssoFinish{}
+		if err := json.NewDecoder(r.Body).Decode(sf); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		//the state can only be tried once in this browser either way
+		cookie, err := r.Cookie(ssoStateCookie)
+		http.SetCookie(w, newSSOStateCookie("", -1))
+		if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashSSOState(sf.State))) != 1 {
+			ctx.record(r, nil, audit.ActionSignIn, ctx.ssoProvider.Issuer, audit.OutcomeDenied)
+			apierr.Write(w, r, apierr.New(apierr.CodeForbidden, "sign-in wasn't started in this browser, please sign in again"))
+			return
+		}
+
+		login, err := ctx.ssoLogins.Take(sf.State)
+		if err == sso.ErrLoginNotFound {
+			ctx.record(r, nil, audit.ActionSignIn, ctx.ssoProvider.Issuer, audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidToken, "sign-in expired or was already finished, please sign in again"))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting sign-in", err))
+			return
+		}
+
+		id, err := ctx.ssoProvider.Finish(r.Context(), login, sf.Code)
+		if err != nil {
+			ctx.record(r, nil, audit.ActionSignIn, ctx.ssoProvider.Issuer, audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error signing in with identity provider", err))
+			return
+		}
+
+		user, err := ctx.ssoUser(r, id)
+		if err == errSSONotLinked || err == errSSOLinkedElsewhere {
+			ctx.record(r, nil, audit.ActionSignIn, id.Email, audit.OutcomeDenied)
+			apierr.Write(w, r, apierr.New(apierr.CodeForbidden, err.Error()))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+
+		if user.Disabled {
+			ctx.record(r, user, audit.ActionSignIn, user.Email, audit.OutcomeDenied)
+			apierr.Write(w, r, apierr.New(apierr.CodeAccountDisabled, "account is disabled"))
+			return
+		}
+
+		if user.TOTPEnabled() {
+			ctx.beginPendingTOTP(w, r, user, true)
+			return
+		}
+
+		state := &sessionState{
+			Time: time.Now(),
+			User: user,
+			SSO:  true,
+		}
+
+		if _, err := ctx.sessionManager.Begin(state, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning session", err))
+			return
+		}
+		ctx.record(r, user, audit.ActionSignIn, user.Email, audit.OutcomeSuccess)
+
+		respond(w, user)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be GET or POST"))
+		return
+	}
+}
+
+//hashSSOState returns the hash of a sign-in's state kept in the browser's
+//cookie, so that the state itself is only ever sent to the provider
+func hashSSOState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//newSSOStateCookie returns the cookie holding the hash of a sign-in's state,
+//which lasts for `maxAge`, or deletes the cookie if `maxAge` is negative.
+//It is only sent back to the gateway, and not on requests from other sites.
+func newSSOStateCookie(value string, maxAge time.Duration) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     ssoStateCookie,
+		Value:    value,
+		Path:     "/v1/sessions/sso",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+//ssoUser returns the user linked to the identity. Identities that aren't linked yet
+//are linked to the account with the same email address, if the provider verified it.
+//If there is no such account, one is created when that is enabled.
+func (ctx *Context) ssoUser(r *http.Request, id *sso.Identity) (*users.User, error) {
+	user, err := ctx.userStore.GetBySSO(r.Context(), id.Issuer, id.Subject)
+	if err != users.ErrUserNotFound {
+		return user, err
+	}
+
+	if !id.EmailVerified || len(id.Email) == 0 {
+		return nil, errSSONotLinked
+	}
+	user, err = ctx.userStore.GetByEmail(r.Context(), id.Email)
+	if err == users.ErrUserNotFound {
+		if !ctx.ssoCreateUsers {
+			return nil, errSSONotLinked
+		}
+		user, err = ctx.createSSOUser(r, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.SSO != nil {
+		return nil, errSSOLinkedElsewhere
+	}
+
+	user.SSO = &users.SSOIdentity{
+		Issuer:  id.Issuer,
+		Subject: id.Subject,
+	}
+	if err := ctx.userStore.SetSSO(r.Context(), user.ID, user.SSO); err != nil {
+		return nil, err
+	}
+	//the provider verified the email address
+	if !user.EmailVerified {
+		if err := ctx.userStore.SetEmailVerified(r.Context(), user.ID, true); err != nil {
+			return nil, err
+		}
+		user.EmailVerified = true
+	}
+	reqlog.Logger(r.Context()).Info("linked user", "linkedUserId", user.ID.Hex(), "subject", id.Subject, "issuer", id.Issuer)
+	return user, nil
+}
+
+//createSSOUser creates an account for a new user of the identity provider.
+//The account gets a random password, which the user can replace by
+//resetting it if they ever want to sign in without the provider.
+func (ctx *Context) createSSOUser(r *http.Request, id *sso.Identity) (*users.User, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	password := base64.RawURLEncoding.EncodeToString(buf)
+
+	userName, err := ctx.availableUserName(r, id)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := ctx.userStore.Insert(r.Context(), &users.NewUser{
+		Email:        id.Email,
+		Password:     password,
+		PasswordConf: password,
+		UserName:     userName,
+		FirstName:    id.GivenName,
+		LastName:     id.FamilyName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx.updateTrie(&indexes.Update[bson.ObjectId]{Value: user.ID, Added: user.SearchKeys()})
+	return user, nil
+}
+
+//availableUserName returns a user name for a new user of the identity provider,
+//based on their preferred user name or email address, that nobody uses yet
+func (ctx *Context) availableUserName(r *http.Request, id *sso.Identity) (string, error) {
+	base := id.PreferredUsername
+	if len(base) == 0 {
+		base = id.Email
+	}
+	if i := strings.Index(base, "@"); i >= 0 {
+		base = base[:i]
+	}
+	base = strings.TrimLeft(base, ".")
+	if !files.ValidUserName(base) {
+		base = "user"
+	}
+
+	for i := 1; i <= 100; i++ {
+		userName := base
+		if i > 1 {
+			userName += strconv.Itoa(i)
+		}
+		_, err := ctx.userStore.GetByUserName(r.Context(), userName)
+		if err == users.ErrUserNotFound {
+			return userName, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no user name available for %s", base)
+}
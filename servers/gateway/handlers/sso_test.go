@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/sso"
+	"github.com/synapse-api/servers/gateway/sso/ssotest"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestSessionsSSOHandler(t *testing.T) {
+	fake := ssotest.NewProvider("synapse", "secret")
+	defer fake.Close()
+	provider, err := sso.NewProvider(context.Background(), fake.Issuer, "synapse", "secret", "https://synapse.test/sso")
+	if err != nil {
+		t.Fatalf("error creating provider: %v", err)
+	}
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	auditLog := audit.NewMemStore()
+	ctx.SetAuditLog(auditLog)
+
+	existing, err := userStore.Insert(context.Background(), &users.NewUser{Email: "fredhw@uw.edu", Password: "123456", PasswordConf: "123456",
+		UserName: "fredhw", FirstName: "Fred", LastName: "Wijaya"})
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	//begin starts signing in at the provider, and returns the state, the code
+	//it sends the user back with and the cookie set in the user's browser
+	begin := func(claims *ssotest.Claims) (string, string, *http.Cookie) {
+		w := httptest.NewRecorder()
+		ctx.SessionsSSOHandler(w, httptest.NewRequest("GET", "/v1/sessions/sso", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d beginning sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != ssoStateCookie || !cookies[0].HttpOnly ||
+			cookies[0].SameSite != http.SameSiteLaxMode {
+			t.Fatalf("expected an HttpOnly, SameSite=Lax state cookie but got %v", cookies)
+		}
+		b := &ssoBegin{}
+		if err := json.NewDecoder(w.Body).Decode(b); err != nil {
+			t.Fatalf("error decoding response: %v", err)
+		}
+		code, state, err := fake.Authorize(b.URL, claims)
+		if err != nil {
+			t.Fatalf("error authorizing: %v", err)
+		}
+		if cookies[0].Value == state {
+			t.Fatalf("expected the cookie to hold a hash of the state")
+		}
+		return state, code, cookies[0]
+	}
+	//finish finishes signing in, in the browser with the cookie if it isn't nil
+	finish := func(state string, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(&ssoFinish{State: state, Code: code})
+		r := httptest.NewRequest("POST", "/v1/sessions/sso", strings.NewReader(string(body)))
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		ctx.SessionsSSOHandler(w, r)
+		return w
+	}
+	//signIn goes through the whole flow and returns the response to finishing it
+	signIn := func(claims *ssotest.Claims) *httptest.ResponseRecorder {
+		return finish(begin(claims))
+	}
+
+	w := httptest.NewRecorder()
+	ctx.SessionsSSOHandler(w, httptest.NewRequest("GET", "/v1/sessions/sso", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d when single sign-on is disabled but got %d", http.StatusNotFound, w.Code)
+	}
+	ctx.SetSSO(provider, sso.NewMemStore(time.Minute), false)
+
+	cases := []struct {
+		name         string
+		claims       *ssotest.Claims
+		expectStatus int
+		expectUser   string
+	}{
+		{
+			"Unverified Email",
+			&ssotest.Claims{Subject: "1", Email: "fredhw@uw.edu", EmailVerified: false},
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"Link By Verified Email",
+			&ssotest.Claims{Subject: "1", Email: "fredhw@uw.edu", EmailVerified: true},
+			http.StatusOK,
+			"fredhw",
+		},
+		{
+			"Linked By Subject",
+			&ssotest.Claims{Subject: "1", Email: "changed@uw.edu", EmailVerified: false},
+			http.StatusOK,
+			"fredhw",
+		},
+		{
+			"Linked To Another Subject",
+			&ssotest.Claims{Subject: "2", Email: "fredhw@uw.edu", EmailVerified: true},
+			http.StatusForbidden,
+			"",
+		},
+		{
+			"No Account",
+			&ssotest.Claims{Subject: "3", Email: "new@uw.edu", EmailVerified: true},
+			http.StatusForbidden,
+			"",
+		},
+	}
+
+	for _, c := range cases {
+		w := signIn(c.claims)
+		if w.Code != c.expectStatus {
+			t.Errorf("case %s: expected %d but got %d: %s", c.name, c.expectStatus, w.Code, w.Body.String())
+			continue
+		}
+		if c.expectStatus != http.StatusOK {
+			continue
+		}
+		user := &users.User{}
+		if err := json.NewDecoder(w.Body).Decode(user); err != nil {
+			t.Fatalf("case %s: error decoding user: %v", c.name, err)
+		}
+		if user.UserName != c.expectUser || !user.EmailVerified {
+			t.Errorf("case %s: expected verified user %s but got %+v", c.name, c.expectUser, user)
+		}
+
+		//the session is the same kind that signing in with a password begins
+		r := httptest.NewRequest("GET", "/v1/users/me", nil)
+		r.Header.Set(headerAuthorization, w.Header().Get(headerAuthorization))
+		state := &sessionState{}
+		if _, err := ctx.getSession(r, state); err != nil || state.User.ID != existing.ID {
+			t.Errorf("case %s: expected a session for the user but got %v", c.name, err)
+		}
+	}
+
+	//states can only be used once
+	state, code, cookie := begin(&ssotest.Claims{Subject: "1", Email: "fredhw@uw.edu"})
+	if w := finish(state, code, cookie); w.Code != http.StatusOK {
+		t.Fatalf("expected %d for sign-in but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if w := finish(state, code, cookie); w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for a finished state but got %d", http.StatusBadRequest, w.Code)
+	}
+
+	//a sign-in started by someone else can't be finished in a user's browser
+	attackerState, attackerCode, _ := begin(&ssotest.Claims{Subject: "1", Email: "fredhw@uw.edu"})
+	_, _, victimCookie := begin(&ssotest.Claims{Subject: "3", Email: "new@uw.edu"})
+	for name, cookie := range map[string]*http.Cookie{"No Cookie": nil, "Other Sign-In": victimCookie} {
+		w := finish(attackerState, attackerCode, cookie)
+		if w.Code != http.StatusForbidden || len(w.Header().Get(headerAuthorization)) > 0 {
+			t.Errorf("case %s: expected %d without a session but got %d", name, http.StatusForbidden, w.Code)
+		}
+	}
+
+	//failed sign-ins are audited
+	failures, err := auditLog.Find(context.Background(), &audit.Filter{Action: audit.ActionSignIn}, 0, 100)
+	if err != nil {
+		t.Fatalf("error finding audit events: %v", err)
+	}
+	outcomes := map[string]int{}
+	for _, event := range failures {
+		outcomes[event.Outcome]++
+	}
+	//unverified, linked elsewhere, no account and the two forged sign-ins were denied, the reused state failed
+	if outcomes[audit.OutcomeDenied] != 5 || outcomes[audit.OutcomeFailure] != 1 {
+		t.Errorf("expected 5 denied and 1 failed sign-ins to be audited but got %v", outcomes)
+	}
+
+	ctx.SetSSO(provider, sso.NewMemStore(time.Minute), true)
+	w = signIn(&ssotest.Claims{Subject: "3", Email: "new@uw.edu", EmailVerified: true, PreferredUsername: "fredhw",
+		GivenName: "New", FamilyName: "User"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d creating a user but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	created, err := userStore.GetBySSO(context.Background(), fake.Issuer, "3")
+	if err != nil {
+		t.Fatalf("expected new user to be linked but got %v", err)
+	}
+	if created.UserName != "fredhw2" || created.Email != "new@uw.edu" || created.FirstName != "New" {
+		t.Errorf("unexpected new user %+v", created)
+	}
+	if ids := ctx.trie.Get(20, "new@"); len(ids) != 1 {
+		t.Errorf("expected new user to be indexed but found %d users", len(ids))
+	}
+}
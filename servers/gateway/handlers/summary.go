@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/synapse-api/servers/gateway/apierr"
 	"golang.org/x/net/html"
 )
 
@@ -57,18 +58,18 @@ func SummaryHandler(w http.ResponseWriter, r *http.Request) {
 
 	pageURL := r.FormValue("url")
 	if len(pageURL) == 0 {
-		http.Error(w, "please provide a url", http.StatusBadRequest)
+		apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "please provide a url"))
 		return
 	}
 
 	respBody, err := fetchHTML(pageURL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeBadRequest, "error fetching page", err))
 		return
 	}
 	summ, err := extractSummary(pageURL, respBody)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeBadRequest, "error summarizing page", err))
 		return
 	}
 	defer respBody.Close()
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/synapse-api/servers/gateway/files"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//SetTrieStream sets the stream on which changes to the user search trie are
+//shared with the other gateways. ApplyTrieUpdates must be run to apply theirs.
+//By default changes are only made to this gateway's trie.
+func (ctx *Context) SetTrieStream(stream indexes.Stream[bson.ObjectId]) {
+	ctx.trieStream = stream
+}
+
+//ApplyTrieUpdates applies the updates the other gateways publish to the
+//trie stream, until it is closed. Updates made by this gateway were
+//applied when they were made, so they are skipped.
+func (ctx *Context) ApplyTrieUpdates() {
+	for u := range ctx.trieStream.Updates() {
+		if u.Origin != ctx.origin {
+			ctx.trie.Apply(u)
+		}
+	}
+}
+
+//updateTrie applies the update to the user search trie, and
+//publishes it for the other gateways to apply to theirs
+func (ctx *Context) updateTrie(u *indexes.Update[bson.ObjectId]) {
+	ctx.trie.Apply(u)
+	if ctx.trieStream == nil {
+		return
+	}
+	u.Origin = ctx.origin
+	if err := ctx.trieStream.Publish(u); err != nil {
+		//the other gateways catch up when their tries are next rebuilt
+		slog.Error("error publishing trie update", "error", err)
+	}
+}
+
+//RebuildTrie reloads the user search trie from the user store. Searches
+//use the old trie until the new one is loaded, and changes made in the
+//meantime are kept.
+func (ctx *Context) RebuildTrie() error {
+	return ctx.trie.Rebuild(func(trie *indexes.Trie[bson.ObjectId]) error {
+		return ctx.userStore.GetAll(context.Background(), trie)
+	})
+}
+
+//SaveTrie writes a snapshot of the user search trie to the file at `path`
+func (ctx *Context) SaveTrie(path string) error {
+	return files.WriteFileAtomic(path, ctx.trie.Snapshot)
+}
+
+//RestoreTrie replaces the user search trie with the snapshot in the file
+//at `path`, so that a restarted gateway can serve searches straight away.
+//The snapshot may be out of date, so the trie should then be rebuilt.
+func (ctx *Context) RestoreTrie(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ctx.trie.Restore(f)
+}
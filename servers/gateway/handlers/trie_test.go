@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestTrieReplicas(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	hub := indexes.NewMemHub[bson.ObjectId]()
+	replicas := make([]*Context, 2)
+	for i := range replicas {
+		replicas[i] = NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+		replicas[i].SetTrieStream(hub.Stream())
+	}
+	a, b := replicas[0], replicas[1]
+
+	//waitFor applies the updates published so far to b's trie
+	waitFor := func(n int) {
+		for i := 0; i < n; i++ {
+			select {
+			case u := <-b.trieStream.Updates():
+				if u.Origin != b.origin {
+					b.trie.Apply(u)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected %d trie updates but got %d", n, i)
+			}
+		}
+	}
+
+	//signing up through one gateway makes the user searchable through the other
+	r := httptest.NewRequest("POST", "/v1/users", strings.NewReader(
+		`{"email": "fred@uw.edu", "password": "123456", "passwordConf": "123456", "userName": "fredhw", "firstName": "Fred", "lastName": "Wijaya"}`))
+	w := httptest.NewRecorder()
+	a.UsersHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected %d for sign-up but got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	token := w.Header().Get(headerAuthorization)
+	waitFor(1)
+	if ids := b.trie.Get(10, "wijaya"); len(ids) != 1 {
+		t.Fatalf("expected the new user in the other gateway's trie but found %d users", len(ids))
+	}
+
+	//as do profile changes
+	r = httptest.NewRequest("PATCH", "/v1/users/me", strings.NewReader(`{"firstName": "Frederick", "lastName": "Wijaya"}`))
+	r.Header.Set(headerAuthorization, token)
+	w = httptest.NewRecorder()
+	a.UsersMeHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d for update but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	waitFor(1)
+	if ids := b.trie.Get(10, "frederick"); len(ids) != 1 {
+		t.Errorf("expected the new first name in the other gateway's trie but found %d users", len(ids))
+	}
+	if ids := b.trie.Get(10, "wij"); len(ids) != 1 {
+		t.Errorf("expected the unchanged last name to be kept but found %d users", len(ids))
+	}
+
+	//the gateway that made a change doesn't apply it twice
+	for len(a.trieStream.Updates()) > 0 {
+		if u := <-a.trieStream.Updates(); u.Origin != a.origin {
+			t.Errorf("expected only a's own updates on its stream but got one from %s", u.Origin)
+		}
+	}
+
+	//ApplyTrieUpdates returns once the stream is closed
+	done := make(chan bool)
+	go func() {
+		b.ApplyTrieUpdates()
+		done <- true
+	}()
+	b.trieStream.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("expected ApplyTrieUpdates to return when the stream is closed")
+	}
+}
+
+func TestTrieSnapshot(t *testing.T) {
+	root, err := ioutil.TempDir("", "handlers-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	path := filepath.Join(root, "snapshots", "trie")
+
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	user, err := userStore.Insert(context.Background(), &users.NewUser{Email: "fred@uw.edu", Password: "123456", PasswordConf: "123456",
+		UserName: "fredhw", FirstName: "Fred", LastName: "Wijaya"})
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	//the trie starts out empty, and is loaded by rebuilding it
+	if ids := ctx.trie.Get(10, "fred"); len(ids) != 0 {
+		t.Fatalf("expected an empty trie but found %d users", len(ids))
+	}
+	if err := ctx.RebuildTrie(); err != nil {
+		t.Fatalf("error rebuilding trie: %v", err)
+	}
+	if err := ctx.SaveTrie(path); err != nil {
+		t.Fatalf("error saving trie: %v", err)
+	}
+
+	restarted := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+	if err := restarted.RestoreTrie(path); err != nil {
+		t.Fatalf("error restoring trie: %v", err)
+	}
+	if ids := restarted.trie.Get(10, "wijaya"); len(ids) != 1 || ids[0] != user.ID {
+		t.Errorf("expected the user in the restored trie but got %v", ids)
+	}
+	if err := restarted.RestoreTrie(filepath.Join(root, "missing")); !os.IsNotExist(err) {
+		t.Errorf("expected a not-exist error restoring a missing snapshot but got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
+)
+
+//totpChallenge is the response to a correct password for
+//an account with two-factor authentication enabled
+type totpChallenge struct {
+	TOTPRequired bool `json:"totpRequired"`
+}
+
+//totpEnrollment is the response to starting two-factor enrollment.
+//The URI should be shown as a QR code for authenticator apps to scan.
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+//totpRecoveryCodes is the response to enabling two-factor authentication
+type totpRecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+//beginPendingTOTP begins a session that can only be used to enter
+//a two-factor code, and tells the client to ask for one. `sso` is
+//whether the user signed in with the identity provider.
+func (ctx *Context) beginPendingTOTP(w http.ResponseWriter, r *http.Request, user *users.User, sso bool) {
+	state := &sessionState{
+		Time:        time.Now(),
+		User:        user,
+		PendingTOTP: true,
+		SSO:         sso,
+	}
+
+	if _, err := ctx.sessionManager.Begin(state, w); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning session", err))
+		return
+	}
+
+	w.Header().Add(headerContentType, contentTypeJSON)
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(&totpChallenge{TOTPRequired: true}); err != nil {
+		slog.Error("error encoding response value to JSON", "error", err)
+	}
+}
+
+//confirmSecondFactor checks and uses up a two-factor code or recovery code
+//confirming a change to the user's account. If it is wrong, it responds,
+//records the failure as `action`, and returns false. Like passwords, only
+//so many wrong codes may be tried, so that a stolen session can't guess them.
+func (ctx *Context) confirmSecondFactor(w http.ResponseWriter, r *http.Request, user *users.User, code string, action string) bool {
+	attempt, ok := ctx.checkLoginGuard(w, r, user.Email, clientIP(r))
+	if !ok {
+		ctx.record(r, user, action, user.ID.Hex(), audit.OutcomeDenied)
+		return false
+	}
+	defer ctx.releaseLoginAttempt(r, attempt)
+
+	factor, err := user.VerifySecondFactor(code, time.Now())
+	if err == nil {
+		err = ctx.userStore.UseSecondFactor(r.Context(), user.ID, factor)
+	}
+	if err == users.ErrTOTPNotEnabled {
+		apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, err.Error()))
+		return false
+	}
+	if err == users.ErrInvalidCode {
+		if err := attempt.Fail(); err != nil {
+			reqlog.Logger(r.Context()).Error("error recording failed two-factor code", "error", err)
+		}
+		ctx.record(r, user, action, user.ID.Hex(), audit.OutcomeFailure)
+		apierr.Write(w, r, apierr.New(apierr.CodeIncorrectCode, err.Error()))
+		return false
+	}
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error verifying two-factor code", err))
+		return false
+	}
+	return true
+}
+
+//SessionsTOTPHandler handles requests for the "two-factor sign-in" resource. After
+//POST /v1/sessions responds with 202 Accepted, clients POST the code from the user's
+//authenticator app, or one of their recovery codes, using the pending session.
+//The pending session is then replaced with a fully signed-in one.
+func (ctx *Context) SessionsTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		state := &sessionState{}
+		if _, err := ctx.sessionManager.Get(r, state); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+			return
+		}
+		if !state.PendingTOTP {
+			apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "session is not waiting for a two-factor code"))
+			return
+		}
+		if time.Since(state.Time) > pendingTOTPDuration {
+			if _, err := ctx.sessionManager.End(r); err != nil {
+				reqlog.Logger(r.Context()).Error("error ending expired session", "error", err)
+			}
+			apierr.Write(w, r, apierr.New(apierr.CodeUnauthorized, "two-factor sign-in expired, please sign in again"))
+			return
+		}
+
+		tr := &totpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		attempt, ok := ctx.checkLoginGuard(w, r, state.User.Email, clientIP(r))
+		if !ok {
+			return
+		}
+		defer ctx.releaseLoginAttempt(r, attempt)
+
+		user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+
+		if user.Disabled {
+			apierr.Write(w, r, apierr.New(apierr.CodeAccountDisabled, "account is disabled"))
+			return
+		}
+
+		//using the code in the store fails if a concurrent request used it first
+		factor, err := user.VerifySecondFactor(tr.Code, time.Now())
+		if err == nil {
+			err = ctx.userStore.UseSecondFactor(r.Context(), user.ID, factor)
+		}
+		if err == users.ErrInvalidCode || err == users.ErrTOTPNotEnabled {
+			if err := attempt.Fail(); err != nil {
+				reqlog.Logger(r.Context()).Error("error recording failed sign-in", "error", err)
+			}
+			ctx.record(r, nil, audit.ActionSignIn, user.Email, audit.OutcomeFailure)
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidCredentials, err.Error()))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error verifying two-factor code", err))
+			return
+		}
+
+		if err := attempt.Succeed(); err != nil {
+			reqlog.Logger(r.Context()).Error("error recording sign-in", "error", err)
+		}
+
+		if _, err := ctx.sessionManager.End(r); err != nil {
+			reqlog.Logger(r.Context()).Error("error ending pending session", "error", err)
+		}
+
+		newState := &sessionState{
+			Time: time.Now(),
+			User: user,
+			SSO:  state.SSO,
+		}
+
+		if _, err := ctx.sessionManager.Begin(newState, w); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error beginning session", err))
+			return
+		}
+		ctx.record(r, user, audit.ActionSignIn, user.Email, audit.OutcomeSuccess)
+
+		respond(w, user)
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
+		return
+	}
+}
+
+//UsersMeTOTPHandler handles requests for the current user's "two-factor" resource.
+//POST starts enrollment and responds with a new secret and its provisioning URI.
+//PUT confirms enrollment with a code generated from that secret, and responds
+//with one-time recovery codes. DELETE disables two-factor authentication,
+//and requires a code or recovery code.
+func (ctx *Context) UsersMeTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	state := &sessionState{}
+	if _, err := ctx.getSession(r, state); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+		return
+	}
+
+	user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		if user.TOTPEnabled() {
+			apierr.Write(w, r, apierr.New(apierr.CodeConflict, "two-factor authentication is already enabled"))
+			return
+		}
+
+		totp, err := users.NewTOTP()
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error generating two-factor secret", err))
+			return
+		}
+		if err := ctx.userStore.UpdateTOTP(r.Context(), user.ID, totp); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+
+		respond(w, &totpEnrollment{
+			Secret: totp.Secret,
+			URI:    totp.URI(totpIssuer, user.Email),
+		})
+
+	case "PUT":
+		tr := &totpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+		if user.TOTP == nil {
+			apierr.Write(w, r, apierr.New(apierr.CodeBadRequest, "two-factor enrollment has not been started"))
+			return
+		}
+		if user.TOTP.Enabled {
+			apierr.Write(w, r, apierr.New(apierr.CodeConflict, "two-factor authentication is already enabled"))
+			return
+		}
+
+		if err := user.TOTP.Verify(tr.Code, time.Now()); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeValidationFailed, "error verifying two-factor code", err))
+			return
+		}
+
+		user.TOTP.Enabled = true
+		codes, err := user.TOTP.GenerateRecoveryCodes()
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error generating recovery codes", err))
+			return
+		}
+		if err := ctx.userStore.UpdateTOTP(r.Context(), user.ID, user.TOTP); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+		ctx.record(r, user, audit.ActionTOTPEnable, user.ID.Hex(), audit.OutcomeSuccess)
+
+		respond(w, &totpRecoveryCodes{RecoveryCodes: codes})
+
+	case "DELETE":
+		tr := &totpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		if !ctx.confirmSecondFactor(w, r, user, tr.Code, audit.ActionTOTPDisable) {
+			return
+		}
+
+		if err := ctx.userStore.UpdateTOTP(r.Context(), user.ID, nil); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+		ctx.record(r, user, audit.ActionTOTPDisable, user.ID.Hex(), audit.OutcomeSuccess)
+
+		w.Header().Add(headerContentType, "text/plain")
+		fmt.Fprintln(w, "two-factor authentication disabled")
+
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST, PUT or DELETE"))
+		return
+	}
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/xuser"
+)
+
+func TestTwoFactorSignIn(t *testing.T) {
+	userStore := users.NewMemStore(time.Hour, time.Minute)
+	sessionManager := sessions.NewOpaqueManager("test key", sessions.NewMemStore(time.Hour, time.Minute))
+	ctx := NewHandlerContext(sessionManager, userStore, xuser.NewHMACSigner([]byte("test key")))
+
+	user, err := userStore.Insert(context.Background(), &users.NewUser{
+		Email:        "fredhw@uw.edu",
+		Password:     "123456",
+		PasswordConf: "123456",
+		UserName:     "fredhw",
+		FirstName:    "Fred",
+		LastName:     "Wijaya",
+	})
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	totp, err := users.NewTOTP()
+	if err != nil {
+		t.Fatalf("error generating TOTP: %v", err)
+	}
+	totp.Enabled = true
+	if err := userStore.UpdateTOTP(context.Background(), user.ID, totp); err != nil {
+		t.Fatalf("error updating TOTP: %v", err)
+	}
+
+	do := func(handler http.HandlerFunc, method string, auth string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		if len(auth) > 0 {
+			r.Header.Set(headerAuthorization, auth)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+
+	w := do(ctx.SessionsHandler, "POST", "", `{"email": "fredhw@uw.edu", "password": "123456"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected %d after password but got %d: %s", http.StatusAccepted, w.Code, w.Body.String())
+	}
+	pending := w.Header().Get(headerAuthorization)
+
+	if w := do(ctx.UsersMeHandler, "GET", pending, ""); w.Code == http.StatusOK {
+		t.Errorf("expected pending session to be rejected by other handlers")
+	}
+
+	//both steps of signing in return errors in the same format
+	problemCode := func(w *httptest.ResponseRecorder) apierr.Code {
+		if ct := w.Header().Get(headerContentType); ct != apierr.ContentType {
+			t.Errorf("expected content type %s but got %s", apierr.ContentType, ct)
+		}
+		p := &apierr.Problem{}
+		if err := json.Unmarshal(w.Body.Bytes(), p); err != nil {
+			t.Errorf("error decoding problem: %v", err)
+		}
+		return p.Code
+	}
+	cases := []struct {
+		name           string
+		auth           string
+		body           string
+		expectedStatus int
+		expectedCode   apierr.Code
+	}{
+		{
+			"No Session",
+			"",
+			`{"code": "000000"}`,
+			http.StatusUnauthorized,
+			apierr.CodeUnauthorized,
+		},
+		{
+			"Invalid JSON",
+			pending,
+			`{"code": `,
+			http.StatusBadRequest,
+			apierr.CodeInvalidJSON,
+		},
+		{
+			"Wrong Code",
+			pending,
+			`{"code": "000000x"}`,
+			http.StatusUnauthorized,
+			apierr.CodeInvalidCredentials,
+		},
+	}
+	for _, c := range cases {
+		w := do(ctx.SessionsTOTPHandler, "POST", c.auth, c.body)
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, w.Code, w.Body.String())
+		}
+		if code := problemCode(w); code != c.expectedCode {
+			t.Errorf("case %s: expected code %s but got %s", c.name, c.expectedCode, code)
+		}
+	}
+
+	code, err := totp.Code(time.Now())
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+	w = do(ctx.SessionsTOTPHandler, "POST", pending, `{"code": "`+code+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d after code but got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	full := w.Header().Get(headerAuthorization)
+
+	if w := do(ctx.UsersMeHandler, "GET", full, ""); w.Code != http.StatusOK {
+		t.Errorf("expected full session to be accepted but got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(ctx.SessionsTOTPHandler, "POST", pending, `{"code": "`+code+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected pending session to be ended but got %d", w.Code)
+	}
+}
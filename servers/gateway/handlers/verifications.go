@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/models/users"
+)
+
+//verificationRequest is the body of a request to verify an email address
+type verificationRequest struct {
+	Token string `json:"token"`
+}
+
+//VerificationsHandler handles requests for the "verifications" resource, and allows
+//signed-in users to have the email verification link sent again using POST /v1/verifications
+func (ctx *Context) VerificationsHandler(w http.ResponseWriter, r *http.Request) {
+	state := &sessionState{}
+	if _, err := ctx.getSession(r, state); err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeUnauthorized, "error retrieving session state", err))
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		user, err := ctx.userStore.GetByID(r.Context(), state.User.ID)
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+		if user.EmailVerified {
+			apierr.Write(w, r, apierr.New(apierr.CodeConflict, "email address is already verified"))
+			return
+		}
+
+		if err := ctx.sendVerification(r, user); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error creating verification token", err))
+			return
+		}
+
+		w.Header().Add(headerContentType, "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "verification link sent")
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be POST"))
+		return
+	}
+}
+
+//SpecificVerificationHandler handles requests for a specific verification, and allows
+//clients to verify an email address using the token from the verification email,
+//using PUT /v1/verifications/{email}
+func (ctx *Context) SpecificVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "PUT":
+		vr := &verificationRequest{}
+		if err := json.NewDecoder(r.Body).Decode(vr); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInvalidJSON, "error decoding JSON", err))
+			return
+		}
+
+		email := path.Base(r.URL.Path)
+		user, err := ctx.userStore.GetByEmail(r.Context(), email)
+		if err == users.ErrUserNotFound {
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidToken, users.ErrInvalidToken.Error()))
+			return
+		}
+		if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+			return
+		}
+
+		if err := ctx.userStore.UseToken(r.Context(), user.ID, users.PurposeEmailVerification, vr.Token); err == users.ErrInvalidToken {
+			apierr.Write(w, r, apierr.New(apierr.CodeInvalidToken, err.Error()))
+			return
+		} else if err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error checking verification token", err))
+			return
+		}
+
+		if err := ctx.userStore.SetEmailVerified(r.Context(), user.ID, true); err != nil {
+			apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user", err))
+			return
+		}
+
+		//if the link was opened where the user is signed in, update their cached user too
+		state := &sessionState{}
+		if sid, err := ctx.getSession(r, state); err == nil && state.User.ID == user.ID {
+			state.User.EmailVerified = true
+			if err := ctx.sessionManager.Update(sid, state, w); err != nil {
+				apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error updating user in store", err))
+				return
+			}
+		}
+
+		w.Header().Add(headerContentType, "text/plain")
+		fmt.Fprintln(w, "email address verified")
+	default:
+		apierr.Write(w, r, apierr.New(apierr.CodeMethodNotAllowed, "method must be PUT"))
+		return
+	}
+}
+
+//sendVerification creates a new email verification token for
+//the user, replacing any earlier one, and emails it to them
+func (ctx *Context) sendVerification(r *http.Request, user *users.User) error {
+	token, ott, err := users.NewOneTimeToken(verificationTokenDuration)
+	if err != nil {
+		return err
+	}
+	if err := ctx.userStore.SetToken(r.Context(), user.ID, users.PurposeEmailVerification, ott); err != nil {
+		return err
+	}
+
+	link := ctx.appLink("/verify", user.Email, token)
+	go ctx.sendMail(&mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Synapse email address",
+		Body: fmt.Sprintf("Welcome to Synapse, %s!\n\n"+
+			"To verify your email address, open this link within a day:\n\n%s\n", user.UserName, link),
+	})
+	return nil
+}
+
+//checkVerified responds and returns false if the user must verify their
+//email address first. The user is read from the store rather than the
+//session, since the session may have been started before verifying.
+func (ctx *Context) checkVerified(w http.ResponseWriter, r *http.Request, user *users.User) bool {
+	if !ctx.requireVerified {
+		return true
+	}
+	current, err := ctx.userStore.GetByID(r.Context(), user.ID)
+	if err != nil {
+		apierr.Write(w, r, apierr.Wrap(apierr.CodeInternal, "error getting user", err))
+		return false
+	}
+	if !current.EmailVerified {
+		apierr.Write(w, r, apierr.New(apierr.CodeEmailNotVerified, "please verify your email address first"))
+		return false
+	}
+	return true
+}
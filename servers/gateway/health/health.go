@@ -0,0 +1,314 @@
+//Package health tells orchestrators whether the gateway is alive and
+//whether it is ready for requests. The gateway is ready when every
+//dependency it checks can be reached and nothing is holding it back,
+//such as the user search trie being loaded or the gateway shutting down.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//Check checks that a dependency can be reached. It should give
+//up once the context is done, but is abandoned at that point anyway.
+type Check func(ctx context.Context) error
+
+//Status is the status of a component
+type Status string
+
+//Statuses of components
+const (
+	StatusUp   Status = "up"
+	StatusDown Status = "down"
+)
+
+//Statuses of the gateway
+const (
+	StatusReady    = "ready"
+	StatusNotReady = "not_ready"
+)
+
+//Component is the result of checking a dependency. Pools of
+//instances are up if any of their instances is up.
+type Component struct {
+	Status    Status                `json:"status"`
+	LatencyMS float64               `json:"latencyMs"`
+	Error     string                `json:"error,omitempty"`
+	Instances map[string]*Component `json:"instances,omitempty"`
+}
+
+//Report is the body of a readiness response
+type Report struct {
+	Status     string                `json:"status"`
+	Components map[string]*Component `json:"components"`
+	//BlockedBy lists what is holding the gateway back, if anything
+	BlockedBy []string `json:"blockedBy,omitempty"`
+}
+
+//component is a dependency, or a pool of instances if `instances` isn't nil
+type component struct {
+	name      string
+	check     Check
+	instances map[string]Check
+}
+
+//Checker checks the gateway's dependencies. It is safe for concurrent use.
+type Checker struct {
+	//Timeout is how long each check may take
+	Timeout    time.Duration
+	components []*component
+	blocks     map[string]bool
+	mx         sync.RWMutex
+
+	//cached holds the results of the last check for PublicReadinessHandler
+	cached   map[string]*Component
+	cachedAt time.Time
+	cacheMx  sync.Mutex
+}
+
+//NewChecker constructs a new Checker whose checks may each take `timeout`
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		Timeout: timeout,
+		blocks:  map[string]bool{},
+	}
+}
+
+//Add adds a dependency to check
+func (c *Checker) Add(name string, check Check) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.components = append(c.components, &component{name: name, check: check})
+}
+
+//AddPool adds a pool of interchangeable instances to check, such as the
+//instances of a microservice, which is up if any of its instances are
+func (c *Checker) AddPool(name string, instances map[string]Check) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.components = append(c.components, &component{name: name, instances: instances})
+}
+
+//Block makes the gateway not ready for the reason until it is unblocked
+func (c *Checker) Block(reason string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.blocks[reason] = true
+}
+
+//Unblock removes a reason the gateway isn't ready
+func (c *Checker) Unblock(reason string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	delete(c.blocks, reason)
+}
+
+//Check checks every dependency at once, and reports whether the gateway is
+//ready. Errors are logged rather than reported, since they may reveal how
+//the gateway's network is laid out.
+func (c *Checker) Check(ctx context.Context) *Report {
+	return c.report(c.checkComponents(ctx))
+}
+
+//checkComponents checks every dependency at once
+func (c *Checker) checkComponents(ctx context.Context) map[string]*Component {
+	c.mx.RLock()
+	components := c.components
+	c.mx.RUnlock()
+
+	results := make([]*Component, len(components))
+	wg := sync.WaitGroup{}
+	for i, comp := range components {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if comp.instances == nil {
+				results[i] = c.run(ctx, comp.name, comp.check)
+			} else {
+				results[i] = c.runPool(ctx, comp.name, comp.instances)
+			}
+		}()
+	}
+	wg.Wait()
+
+	byName := map[string]*Component{}
+	for i, comp := range components {
+		byName[comp.name] = results[i]
+	}
+	return byName
+}
+
+//cachedComponents returns the results of the last check of the dependencies
+//if it is younger than `ttl`, or else checks them again. Callers wait for a
+//check that is under way rather than starting another.
+func (c *Checker) cachedComponents(ctx context.Context, ttl time.Duration) map[string]*Component {
+	c.cacheMx.Lock()
+	defer c.cacheMx.Unlock()
+	if c.cached == nil || time.Since(c.cachedAt) >= ttl {
+		//the results are shared, so the caller going away mustn't fail them
+		c.cached = c.checkComponents(context.WithoutCancel(ctx))
+		c.cachedAt = time.Now()
+	}
+	return c.cached
+}
+
+//report reports whether the gateway is ready with the results of the checks,
+//and what is holding it back right now
+func (c *Checker) report(components map[string]*Component) *Report {
+	c.mx.RLock()
+	blockedBy := []string{}
+	for reason := range c.blocks {
+		blockedBy = append(blockedBy, reason)
+	}
+	c.mx.RUnlock()
+	sort.Strings(blockedBy)
+
+	report := &Report{Status: StatusReady, Components: components}
+	if len(blockedBy) > 0 {
+		report.Status = StatusNotReady
+		report.BlockedBy = blockedBy
+	}
+	for _, comp := range components {
+		if comp.Status != StatusUp {
+			report.Status = StatusNotReady
+		}
+	}
+	return report
+}
+
+//run runs the check, giving up after the timeout
+func (c *Checker) run(ctx context.Context, name string, check Check) *Component {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	//the check may not give up when the context is done, so it isn't waited for
+	done := make(chan error, 1)
+	go func() { done <- check(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := &Component{Status: StatusUp, LatencyMS: milliseconds(time.Since(start))}
+	if err != nil {
+		slog.Warn("dependency check failed", "component", name, "error", err)
+		result.Status = StatusDown
+		result.Error = "unreachable"
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.Error = "timeout"
+		}
+	}
+	return result
+}
+
+//runPool checks every instance of the pool at once
+func (c *Checker) runPool(ctx context.Context, name string, instances map[string]Check) *Component {
+	start := time.Now()
+	pool := &Component{Status: StatusDown, Instances: map[string]*Component{}}
+	mx := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for instance, check := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := c.run(ctx, name+" "+instance, check)
+			mx.Lock()
+			defer mx.Unlock()
+			pool.Instances[instance] = result
+			if result.Status == StatusUp {
+				pool.Status = StatusUp
+			}
+		}()
+	}
+	wg.Wait()
+	pool.LatencyMS = milliseconds(time.Since(start))
+	if pool.Status != StatusUp {
+		pool.Error = "no instance is reachable"
+	}
+	return pool
+}
+
+//LivenessHandler reports that the gateway is alive. It checks nothing
+//else, so that the gateway isn't restarted when a dependency is down.
+func (c *Checker) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	respond(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+//ReadinessHandler checks the dependencies, and responds with the
+//report and 200 if the gateway is ready, or 503 if it isn't
+func (c *Checker) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	report := c.Check(r.Context())
+	status := http.StatusOK
+	if report.Status != StatusReady {
+		status = http.StatusServiceUnavailable
+	}
+	respond(w, status, report)
+}
+
+//PublicReadinessHandler is like ReadinessHandler, for listeners anyone can
+//reach. Dependencies are checked at most once every `ttl`, so that callers
+//can't make the gateway probe them at will, and the instances of pools are
+//left out, since their addresses are internal.
+func (c *Checker) PublicReadinessHandler(ttl time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		components := map[string]*Component{}
+		for name, comp := range c.cachedComponents(r.Context(), ttl) {
+			components[name] = &Component{Status: comp.Status, LatencyMS: comp.LatencyMS, Error: comp.Error}
+		}
+		report := c.report(components)
+		status := http.StatusOK
+		if report.Status != StatusReady {
+			status = http.StatusServiceUnavailable
+		}
+		respond(w, status, report)
+	}
+}
+
+//HTTP returns a check that a service at the URL responds. Any response
+//below 500 will do, since services may refuse requests the gateway hasn't
+//signed, but a service that answers with a server error is down.
+func HTTP(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		r, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(r)
+		if err != nil {
+			return err
+		}
+		if err := resp.Body.Close(); err != nil {
+			return err
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		return nil
+	}
+}
+
+//respond writes the value as JSON with the status
+func respond(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	//probes must see the current state
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Error("error encoding health response", "error", err)
+	}
+}
+
+//milliseconds returns the duration in milliseconds, to the microsecond
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
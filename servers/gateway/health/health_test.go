@@ -0,0 +1,250 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//up is a check that always passes
+func up(ctx context.Context) error {
+	return nil
+}
+
+//down is a check that always fails
+func down(ctx context.Context) error {
+	return errors.New("dial tcp 10.0.0.3:6379: connect: connection refused")
+}
+
+//hang is a check that never returns
+func hang(ctx context.Context) error {
+	select {}
+}
+
+func TestReadiness(t *testing.T) {
+	cases := []struct {
+		name           string
+		checks         map[string]Check
+		pool           map[string]Check
+		blocks         []string
+		expectedStatus int
+		expected       map[string]Status
+		expectedErrors map[string]string
+	}{
+		{
+			"Ready",
+			map[string]Check{"redis": up, "mongo": up},
+			map[string]Check{"qeeg1": up, "qeeg2": up},
+			nil,
+			http.StatusOK,
+			map[string]Status{"redis": StatusUp, "mongo": StatusUp, "qeeg": StatusUp},
+			map[string]string{},
+		},
+		{
+			"Dependency Down",
+			map[string]Check{"redis": down, "mongo": up},
+			map[string]Check{"qeeg1": up},
+			nil,
+			http.StatusServiceUnavailable,
+			map[string]Status{"redis": StatusDown, "mongo": StatusUp, "qeeg": StatusUp},
+			map[string]string{"redis": "unreachable"},
+		},
+		{
+			"Dependency Hangs",
+			map[string]Check{"redis": up, "mongo": hang},
+			map[string]Check{"qeeg1": up},
+			nil,
+			http.StatusServiceUnavailable,
+			map[string]Status{"redis": StatusUp, "mongo": StatusDown, "qeeg": StatusUp},
+			map[string]string{"mongo": "timeout"},
+		},
+		{
+			"Some Instances Down",
+			map[string]Check{"redis": up},
+			map[string]Check{"qeeg1": down, "qeeg2": hang, "qeeg3": up},
+			nil,
+			http.StatusOK,
+			map[string]Status{"redis": StatusUp, "qeeg": StatusUp},
+			map[string]string{},
+		},
+		{
+			"All Instances Down",
+			map[string]Check{"redis": up},
+			map[string]Check{"qeeg1": down, "qeeg2": down},
+			nil,
+			http.StatusServiceUnavailable,
+			map[string]Status{"redis": StatusUp, "qeeg": StatusDown},
+			map[string]string{"qeeg": "no instance is reachable"},
+		},
+		{
+			"Blocked",
+			map[string]Check{"redis": up},
+			map[string]Check{"qeeg1": up},
+			[]string{"trie", "shutdown"},
+			http.StatusServiceUnavailable,
+			map[string]Status{"redis": StatusUp, "qeeg": StatusUp},
+			map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		checker := NewChecker(50 * time.Millisecond)
+		for name, check := range c.checks {
+			checker.Add(name, check)
+		}
+		checker.AddPool("qeeg", c.pool)
+		for _, reason := range c.blocks {
+			checker.Block(reason)
+		}
+
+		start := time.Now()
+		w := httptest.NewRecorder()
+		checker.ReadinessHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+		//checks run at once, and hanging ones are abandoned
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("case %s: expected the checks to time out but they took %v", c.name, elapsed)
+		}
+
+		if w.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("case %s: expected JSON but got %s", c.name, ct)
+		}
+		report := &Report{}
+		if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+			t.Fatalf("case %s: error decoding report: %v", c.name, err)
+		}
+		if ready := report.Status == StatusReady; ready != (c.expectedStatus == http.StatusOK) {
+			t.Errorf("case %s: unexpected status %s", c.name, report.Status)
+		}
+		if len(report.Components) != len(c.expected) {
+			t.Errorf("case %s: expected %d components but got %d", c.name, len(c.expected), len(report.Components))
+		}
+		for name, status := range c.expected {
+			comp := report.Components[name]
+			if comp == nil || comp.Status != status || comp.Error != c.expectedErrors[name] {
+				t.Errorf("case %s: expected %s to be %s with error %q but got %+v",
+					c.name, name, status, c.expectedErrors[name], comp)
+			}
+		}
+		if qeeg := report.Components["qeeg"]; qeeg != nil && len(qeeg.Instances) != len(c.pool) {
+			t.Errorf("case %s: expected %d instances but got %d", c.name, len(c.pool), len(qeeg.Instances))
+		}
+		if len(c.blocks) > 0 && !reflect.DeepEqual(report.BlockedBy, []string{"shutdown", "trie"}) {
+			t.Errorf("case %s: expected to be blocked by the shutdown and trie but got %v", c.name, report.BlockedBy)
+		}
+	}
+}
+
+func TestPublicReadiness(t *testing.T) {
+	var checks int32
+	counted := func(ctx context.Context) error {
+		atomic.AddInt32(&checks, 1)
+		return nil
+	}
+	checker := NewChecker(time.Second)
+	checker.Add("redis", counted)
+	checker.AddPool("qeeg", map[string]Check{"10.0.0.3:80": up, "10.0.0.4:80": down})
+	handler := checker.PublicReadinessHandler(time.Hour)
+
+	get := func() (int, *Report) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/readyz", nil))
+		report := &Report{}
+		if err := json.Unmarshal(w.Body.Bytes(), report); err != nil {
+			t.Fatalf("error decoding report: %v", err)
+		}
+		return w.Code, report
+	}
+
+	//anonymous callers can't make the gateway probe its dependencies at will
+	for i := 0; i < 3; i++ {
+		if status, _ := get(); status != http.StatusOK {
+			t.Errorf("expected status %d but got %d", http.StatusOK, status)
+		}
+	}
+	if n := atomic.LoadInt32(&checks); n != 1 {
+		t.Errorf("expected the dependencies to be checked once but they were checked %d times", n)
+	}
+
+	//nor see the addresses of instances
+	_, report := get()
+	if qeeg := report.Components["qeeg"]; qeeg == nil || qeeg.Status != StatusUp || len(qeeg.Instances) != 0 {
+		t.Errorf("expected qeeg to be up without its instances but got %+v", qeeg)
+	}
+
+	//blocks take effect at once, even while the checks are cached
+	checker.Block("shutdown")
+	if status, report := get(); status != http.StatusServiceUnavailable || report.Status != StatusNotReady {
+		t.Errorf("expected not to be ready once blocked but got %d %s", status, report.Status)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	checker := NewChecker(time.Second)
+	checker.Add("redis", up)
+	checker.Block("trie")
+	checker.Block("trie")
+	if report := checker.Check(context.Background()); report.Status != StatusNotReady {
+		t.Errorf("expected not to be ready while blocked")
+	}
+	checker.Unblock("trie")
+	if report := checker.Check(context.Background()); report.Status != StatusReady || len(report.BlockedBy) != 0 {
+		t.Errorf("expected to be ready once unblocked but got %+v", report)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	//liveness doesn't depend on the dependencies
+	checker := NewChecker(time.Second)
+	checker.Add("redis", down)
+	checker.Block("shutdown")
+	w := httptest.NewRecorder()
+	checker.LivenessHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status %d but got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	//services that refuse the request are still up, but not ones that fail it
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer service.Close()
+
+	//nothing listens on a closed listener's address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.Close()
+
+	cases := []struct {
+		name string
+		url  string
+		up   bool
+	}{
+		{"Refused Request", service.URL + "/echo", true},
+		{"Server Error", service.URL + "/broken", false},
+		{"Nothing Listening", "http://" + l.Addr().String() + "/echo", false},
+	}
+	for _, c := range cases {
+		err := HTTP(http.DefaultClient, c.url)(context.Background())
+		if (err == nil) != c.up {
+			t.Errorf("case %s: expected up to be %t but got %v", c.name, c.up, err)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package indexes
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/files"
+)
+
+//RecordingFilter selects recordings. Empty fields match any recording.
+type RecordingFilter struct {
+	//UserNames are the users whose recordings may be returned, which must be given
+	UserNames []string
+	//Subject, Session and Device are prefixes of the recording's values
+	Subject string
+	Session string
+	Device  string
+	//Tags must all be tags of the recording
+	Tags []string
+	//Since is the earliest time of recordings to include
+	Since time.Time
+	//Until is the time before which recordings are included
+	Until time.Time
+}
+
+//Match reports whether the recording passes the filter
+func (f *RecordingFilter) Match(rec *files.Recording) bool {
+	owned := false
+	for _, userName := range f.UserNames {
+		owned = owned || rec.UserName == userName
+	}
+	if !owned ||
+		!strings.HasPrefix(Normalize(rec.Subject), Normalize(f.Subject)) ||
+		!strings.HasPrefix(Normalize(rec.Session), Normalize(f.Session)) ||
+		!strings.HasPrefix(Normalize(rec.Device), Normalize(f.Device)) ||
+		(!f.Since.IsZero() && rec.RecordedAt.Before(f.Since)) ||
+		(!f.Until.IsZero() && !rec.RecordedAt.Before(f.Until)) {
+		return false
+	}
+	for _, tag := range f.Tags {
+		tagged := false
+		for _, t := range rec.Tags {
+			tagged = tagged || Normalize(t) == Normalize(tag)
+		}
+		if !tagged {
+			return false
+		}
+	}
+	return true
+}
+
+//RecordingIndex indexes users' recordings by subject, session, device
+//and tags, so they can be found without listing every user's files.
+//Keys are prefixed with the user name, so that a search only looks
+//through the recordings of the users it is scoped to. It is safe for
+//concurrent use.
+type RecordingIndex struct {
+	subjects *Trie[*files.Recording]
+	sessions *Trie[*files.Recording]
+	devices  *Trie[*files.Recording]
+	tags     *Trie[*files.Recording]
+	//recordings holds each user's indexed recordings, by file
+	recordings map[string]map[string]*files.Recording
+	mx         sync.RWMutex
+}
+
+//NewRecordingIndex constructs a new, empty RecordingIndex
+func NewRecordingIndex() *RecordingIndex {
+	return &RecordingIndex{
+		subjects:   NewTrie[*files.Recording](),
+		sessions:   NewTrie[*files.Recording](),
+		devices:    NewTrie[*files.Recording](),
+		tags:       NewTrie[*files.Recording](),
+		recordings: map[string]map[string]*files.Recording{},
+	}
+}
+
+//Add indexes the recording, replacing any recording of the same user's file
+func (ix *RecordingIndex) Add(rec *files.Recording) {
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	ix.remove(rec.UserName, rec.File)
+
+	if ix.recordings[rec.UserName] == nil {
+		ix.recordings[rec.UserName] = map[string]*files.Recording{}
+	}
+	ix.recordings[rec.UserName][rec.File] = rec
+	ix.subjects.Add(scopedKey(rec.UserName, rec.Subject), rec)
+	ix.sessions.Add(scopedKey(rec.UserName, rec.Session), rec)
+	ix.devices.Add(scopedKey(rec.UserName, rec.Device), rec)
+	for _, tag := range rec.Tags {
+		ix.tags.Add(scopedKey(rec.UserName, tag), rec)
+	}
+}
+
+//Remove removes the user's file from the index, if it was indexed
+func (ix *RecordingIndex) Remove(userName string, file string) {
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	ix.remove(userName, file)
+}
+
+//RemoveUser removes all of the user's recordings from the index
+func (ix *RecordingIndex) RemoveUser(userName string) {
+	ix.mx.Lock()
+	defer ix.mx.Unlock()
+	for file := range ix.recordings[userName] {
+		ix.remove(userName, file)
+	}
+}
+
+//Find returns the recordings passing the filter, latest first.
+//Recordings made at the same time are ordered by user name and file.
+func (ix *RecordingIndex) Find(filter *RecordingFilter) []*files.Recording {
+	ix.mx.RLock()
+	defer ix.mx.RUnlock()
+
+	found := []*files.Recording{}
+	for _, userName := range filter.UserNames {
+		for _, rec := range ix.candidates(userName, filter) {
+			if filter.Match(rec) {
+				found = append(found, rec)
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if !a.RecordedAt.Equal(b.RecordedAt) {
+			return a.RecordedAt.After(b.RecordedAt)
+		}
+		if a.UserName != b.UserName {
+			return a.UserName < b.UserName
+		}
+		return a.File < b.File
+	})
+	return found
+}
+
+//candidates returns the user's recordings whose keys start with the
+//filter's prefixes according to the tries, or all of the user's
+//recordings if the filter has none. Callers must hold the read lock.
+func (ix *RecordingIndex) candidates(userName string, filter *RecordingFilter) []*files.Recording {
+	type lookup struct {
+		trie   *Trie[*files.Recording]
+		prefix string
+	}
+	lookups := []lookup{
+		{ix.subjects, filter.Subject},
+		{ix.sessions, filter.Session},
+		{ix.devices, filter.Device},
+	}
+	for _, tag := range filter.Tags {
+		lookups = append(lookups, lookup{ix.tags, tag})
+	}
+
+	var candidates []*files.Recording
+	looked := false
+	for _, l := range lookups {
+		if len(l.prefix) == 0 {
+			continue
+		}
+		recs := l.trie.Get(math.MaxInt, scopedKey(userName, l.prefix))
+		if !looked {
+			candidates, looked = recs, true
+			continue
+		}
+		matched := map[*files.Recording]bool{}
+		for _, rec := range recs {
+			matched[rec] = true
+		}
+		kept := candidates[:0]
+		for _, rec := range candidates {
+			if matched[rec] {
+				kept = append(kept, rec)
+			}
+		}
+		candidates = kept
+	}
+	if looked {
+		return candidates
+	}
+	for _, rec := range ix.recordings[userName] {
+		candidates = append(candidates, rec)
+	}
+	return candidates
+}
+
+//remove removes the user's file from the index. Callers must hold the lock.
+func (ix *RecordingIndex) remove(userName string, file string) {
+	rec, found := ix.recordings[userName][file]
+	if !found {
+		return
+	}
+	//the keys were added with the recording, so they are all there
+	ix.subjects.Remove(scopedKey(userName, rec.Subject), rec)
+	ix.sessions.Remove(scopedKey(userName, rec.Session), rec)
+	ix.devices.Remove(scopedKey(userName, rec.Device), rec)
+	for _, tag := range rec.Tags {
+		ix.tags.Remove(scopedKey(userName, tag), rec)
+	}
+	delete(ix.recordings[userName], file)
+	if len(ix.recordings[userName]) == 0 {
+		delete(ix.recordings, userName)
+	}
+}
+
+//scopedKey returns the key under which a value of one of the user's
+//recordings is indexed. User names can't hold a NUL character, so the
+//keys of one user only start with those of users whose names differ
+//just by case, whose recordings Match leaves out.
+func scopedKey(userName string, value string) string {
+	return userName + "\x00" + value
+}
@@ -0,0 +1,106 @@
+package indexes
+
+import (
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/files"
+)
+
+func TestRecordingIndex(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	ix := NewRecordingIndex()
+	for _, rec := range []*files.Recording{
+		{UserName: "fredhw", File: "P01_rest.txt", Subject: "P01", Session: "rest", Device: "Emotiv", Tags: []string{"pilot"}, RecordedAt: day(1)},
+		{UserName: "fredhw", File: "P01_task.txt", Subject: "P01", Session: "task", Device: "OpenBCI", RecordedAt: day(2)},
+		{UserName: "fredhw", File: "P02_rest.txt", Subject: "P02", Session: "rest", Device: "Emotiv", Tags: []string{"pilot", "noisy"}, RecordedAt: day(3)},
+		{UserName: "fredhw", File: "P10_rest.txt", Subject: "P10", Session: "rest", RecordedAt: day(4)},
+		{UserName: "fredhw", File: "removed.txt", Subject: "P01", Session: "rest", RecordedAt: day(5)},
+		{UserName: "alice", File: "P01_rest.txt", Subject: "P01", Session: "rest", Tags: []string{"pilot"}, RecordedAt: day(6)},
+	} {
+		ix.Add(rec)
+	}
+	ix.Remove("fredhw", "removed.txt")
+	//adding a file again replaces it
+	ix.Add(&files.Recording{UserName: "fredhw", File: "P10_rest.txt", Subject: "P10", Session: "rest", Tags: []string{"rerun"}, RecordedAt: day(4)})
+
+	cases := []struct {
+		name     string
+		filter   *RecordingFilter
+		expected []string
+	}{
+		{
+			"All Of A User",
+			&RecordingFilter{UserNames: []string{"fredhw"}},
+			[]string{"P10_rest.txt", "P02_rest.txt", "P01_task.txt", "P01_rest.txt"},
+		},
+		{
+			"Subject Prefix And Session",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Subject: "p0", Session: "rest"},
+			[]string{"P02_rest.txt", "P01_rest.txt"},
+		},
+		{
+			"Device",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Device: "emotiv"},
+			[]string{"P02_rest.txt", "P01_rest.txt"},
+		},
+		{
+			"Every Tag",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Tags: []string{"pilot", "noisy"}},
+			[]string{"P02_rest.txt"},
+		},
+		{
+			"Whole Tags Only",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Tags: []string{"pil"}},
+			[]string{},
+		},
+		{
+			"Replaced Tags",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Tags: []string{"rerun"}},
+			[]string{"P10_rest.txt"},
+		},
+		{
+			"Date Range",
+			&RecordingFilter{UserNames: []string{"fredhw"}, Since: day(2), Until: day(4)},
+			[]string{"P02_rest.txt", "P01_task.txt"},
+		},
+		{
+			"Scoped To Users",
+			&RecordingFilter{UserNames: []string{"alice"}, Tags: []string{"pilot"}},
+			[]string{"P01_rest.txt"},
+		},
+		{
+			"Several Users",
+			&RecordingFilter{UserNames: []string{"fredhw", "alice"}, Subject: "P01", Session: "rest"},
+			[]string{"P01_rest.txt", "P01_rest.txt"},
+		},
+		{
+			"No Users",
+			&RecordingFilter{Subject: "P01"},
+			[]string{},
+		},
+	}
+
+	for _, c := range cases {
+		found := ix.Find(c.filter)
+		if len(found) != len(c.expected) {
+			t.Errorf("case %s: expected %d recordings but got %d", c.name, len(c.expected), len(found))
+			continue
+		}
+		for i, rec := range found {
+			if rec.File != c.expected[i] {
+				t.Errorf("case %s: expected recording %d to be %s but got %s", c.name, i, c.expected[i], rec.File)
+			}
+		}
+	}
+
+	ix.RemoveUser("fredhw")
+	if found := ix.Find(&RecordingFilter{UserNames: []string{"fredhw"}}); len(found) != 0 {
+		t.Errorf("expected no recordings after removing the user but got %d", len(found))
+	}
+	if found := ix.Find(&RecordingFilter{UserNames: []string{"alice"}}); len(found) != 1 {
+		t.Errorf("expected other users' recordings to be kept but got %d", len(found))
+	}
+}
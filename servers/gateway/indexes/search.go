@@ -0,0 +1,159 @@
+package indexes
+
+//Kinds of Match, from best to worst
+const (
+	//MatchExact means the key is the search term
+	MatchExact = iota
+	//MatchPrefix means the key starts with the search term
+	MatchPrefix
+	//MatchFuzzy means the key is within a few edits of the search term
+	MatchFuzzy
+)
+
+//Match is a value whose key matched a search term
+type Match[V comparable] struct {
+	Value V
+	Kind  int
+	//Distance is the number of edits between the key and the term for fuzzy matches
+	Distance int
+}
+
+//Search returns up to `limit` values whose keys match the term, best first:
+//the values of the key that is the term, then those of keys starting with
+//it in order of key, then those of keys within `maxDistance` edits of it,
+//nearest first. Each value is returned once, with its best match.
+func (c *Trie[V]) Search(term string, maxDistance int, limit int) []*Match[V] {
+	term = Normalize(term)
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	matches := []*Match[V]{}
+	if len(term) == 0 || limit <= 0 {
+		return matches
+	}
+	seen := map[V]bool{}
+	add := func(kind int, distance int, v V) bool {
+		if !seen[v] {
+			seen[v] = true
+			matches = append(matches, &Match[V]{Value: v, Kind: kind, Distance: distance})
+		}
+		return len(matches) < limit
+	}
+
+	//the branch below the term holds the exact and prefix matches
+	if branch, rest := c.root.find(term); branch != nil {
+		if len(rest) == 0 {
+			for _, v := range branch.values.items {
+				if !add(MatchExact, 0, v) {
+					return matches
+				}
+			}
+		}
+		more := branch.walk(term+rest, func(key string, v V) bool {
+			return add(MatchPrefix, 0, v)
+		})
+		if !more {
+			return matches
+		}
+	}
+
+	if maxDistance <= 0 {
+		return matches
+	}
+	//fuzzy matches are gathered by distance, so the nearest come first
+	byDistance := make([][]V, maxDistance+1)
+	target := []rune(term)
+	row := make([]int, len(target)+1)
+	for i := range row {
+		row[i] = i
+	}
+	for _, child := range c.root.children {
+		child.fuzzy(target, row, maxDistance, limit, byDistance)
+	}
+	for d := 1; d <= maxDistance; d++ {
+		for _, v := range byDistance[d] {
+			if !add(MatchFuzzy, d, v) {
+				return matches
+			}
+		}
+	}
+	return matches
+}
+
+//find returns the node of the branch holding the keys that start with
+//`prefix`, and the part of its label past the prefix, which is empty if
+//the node's key is the prefix. It returns nil if no key starts with it.
+func (n *node[V]) find(prefix string) (*node[V], string) {
+	current := n
+	for len(prefix) > 0 {
+		_, child := current.child(prefix)
+		if child == nil {
+			return nil, ""
+		}
+		common := commonPrefix(child.label, prefix)
+		if common == len(prefix) {
+			return child, child.label[common:]
+		}
+		if common < len(child.label) {
+			return nil, ""
+		}
+		prefix = prefix[common:]
+		current = child
+	}
+	return current, ""
+}
+
+//fuzzy adds the values of keys in the node's branch that are within
+//`maxDistance` edits of `target` to `byDistance`, by distance. `row` holds
+//the edit distances between the key of the node's parent and each prefix
+//of the target, as in the Wagner-Fischer algorithm. Branches are skipped
+//once every distance in the row exceeds `maxDistance`.
+func (n *node[V]) fuzzy(target []rune, row []int, maxDistance int, limit int, byDistance [][]V) {
+	for _, r := range n.label {
+		next := make([]int, len(row))
+		next[0] = row[0] + 1
+		closest := next[0]
+		for j := 1; j < len(row); j++ {
+			cost := 1
+			if target[j-1] == r {
+				cost = 0
+			}
+			next[j] = min(row[j]+1, next[j-1]+1, row[j-1]+cost)
+			closest = min(closest, next[j])
+		}
+		if closest > maxDistance {
+			return
+		}
+		row = next
+	}
+
+	//distance 0 is an exact match, which was found already
+	if d := row[len(row)-1]; d > 0 && d <= maxDistance && len(byDistance[d]) < limit {
+		byDistance[d] = append(byDistance[d], n.values.items...)
+	}
+	for _, child := range n.children {
+		child.fuzzy(target, row, maxDistance, limit, byDistance)
+	}
+}
+
+//Distance returns the number of single-rune insertions, deletions and
+//substitutions needed to turn one normalized key into the other
+func Distance(a string, b string) int {
+	target := []rune(b)
+	row := make([]int, len(target)+1)
+	for i := range row {
+		row[i] = i
+	}
+	for _, r := range a {
+		next := make([]int, len(row))
+		next[0] = row[0] + 1
+		for j := 1; j < len(row); j++ {
+			cost := 1
+			if target[j-1] == r {
+				cost = 0
+			}
+			next[j] = min(row[j]+1, next[j-1]+1, row[j-1]+cost)
+		}
+		row = next
+	}
+	return row[len(row)-1]
+}
@@ -0,0 +1,127 @@
+package indexes
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestDistance(t *testing.T) {
+	cases := []struct {
+		name     string
+		a        string
+		b        string
+		expected int
+	}{
+		{"Same", "john", "john", 0},
+		{"Empty", "", "john", 4},
+		{"Substitution", "jahn", "john", 1},
+		{"Insertion", "jon", "john", 1},
+		{"Deletion", "johnn", "john", 1},
+		{"Transposition", "jhon", "john", 2},
+		{"Runes", "zoë", "zoe", 1},
+		{"Different", "fred", "alice", 5},
+	}
+
+	for _, c := range cases {
+		if d := Distance(c.a, c.b); d != c.expected {
+			t.Errorf("case %s: expected %d but got %d", c.name, c.expected, d)
+		}
+		if d := Distance(c.b, c.a); d != c.expected {
+			t.Errorf("case %s: expected %d the other way around but got %d", c.name, c.expected, d)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	tr := NewTrie[bson.ObjectId]()
+	ids := map[string]bson.ObjectId{}
+	for _, key := range []string{"john", "johnny", "johnson", "jon", "joan", "jonathan", "mary"} {
+		ids[key] = bson.NewObjectId()
+		tr.Add(key, ids[key])
+	}
+	//a value under several keys is returned once, with its best match
+	tr.Add("jhn", ids["johnny"])
+
+	cases := []struct {
+		name        string
+		term        string
+		maxDistance int
+		limit       int
+		expected    []Match[bson.ObjectId]
+	}{
+		{
+			"Exact Prefix And Fuzzy",
+			"John",
+			1,
+			10,
+			[]Match[bson.ObjectId]{
+				{ids["john"], MatchExact, 0},
+				{ids["johnny"], MatchPrefix, 0},
+				{ids["johnson"], MatchPrefix, 0},
+				{ids["joan"], MatchFuzzy, 1},
+				{ids["jon"], MatchFuzzy, 1},
+			},
+		},
+		{
+			"Without Fuzzy",
+			"john",
+			0,
+			10,
+			[]Match[bson.ObjectId]{
+				{ids["john"], MatchExact, 0},
+				{ids["johnny"], MatchPrefix, 0},
+				{ids["johnson"], MatchPrefix, 0},
+			},
+		},
+		{
+			"Nearest Fuzzy First",
+			"jonh",
+			2,
+			10,
+			[]Match[bson.ObjectId]{
+				{ids["jon"], MatchFuzzy, 1},
+				{ids["johnny"], MatchFuzzy, 2},
+				{ids["joan"], MatchFuzzy, 2},
+				{ids["john"], MatchFuzzy, 2},
+			},
+		},
+		{
+			"Limit",
+			"jo",
+			1,
+			2,
+			[]Match[bson.ObjectId]{
+				{ids["joan"], MatchPrefix, 0},
+				{ids["johnny"], MatchPrefix, 0},
+			},
+		},
+		{
+			"No Match",
+			"alice",
+			1,
+			10,
+			[]Match[bson.ObjectId]{},
+		},
+		{
+			"Empty",
+			"",
+			2,
+			10,
+			[]Match[bson.ObjectId]{},
+		},
+	}
+
+	for _, c := range cases {
+		matches := tr.Search(c.term, c.maxDistance, c.limit)
+		if len(matches) != len(c.expected) {
+			t.Errorf("case %s: expected %d matches but got %d", c.name, len(c.expected), len(matches))
+			continue
+		}
+		for i, m := range matches {
+			if *m != c.expected[i] {
+				t.Errorf("case %s: expected match %d to be %+v but got %+v", c.name, i, c.expected[i], *m)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package indexes
+
+//setIndexSize is the number of values from which a valueSet indexes its
+//values. Most keys have only a few values, and scanning those is as fast
+//as a map lookup, without the memory a map takes up on every node.
+const setIndexSize = 8
+
+//valueSet is a set of the values of a key, which keeps them in the
+//order they were added. Its zero value is an empty set.
+type valueSet[V comparable] struct {
+	items []V
+	//index holds the position of each value in items,
+	//once there are setIndexSize values or more
+	index map[V]int
+}
+
+//newValueSet returns a set holding the distinct values of `items`
+func newValueSet[V comparable](items []V) valueSet[V] {
+	s := valueSet[V]{}
+	for _, v := range items {
+		s.add(v)
+	}
+	return s
+}
+
+//add adds the value to the set, and reports whether it wasn't there already
+func (s *valueSet[V]) add(v V) bool {
+	if s.find(v) >= 0 {
+		return false
+	}
+	s.items = append(s.items, v)
+	if s.index != nil {
+		s.index[v] = len(s.items) - 1
+	} else if len(s.items) >= setIndexSize {
+		s.index = make(map[V]int, len(s.items))
+		for i, item := range s.items {
+			s.index[item] = i
+		}
+	}
+	return true
+}
+
+//remove removes the value from the set, and reports whether it was there
+func (s *valueSet[V]) remove(v V) bool {
+	i := s.find(v)
+	if i < 0 {
+		return false
+	}
+	if len(s.items) == 1 {
+		//release the storage of keys left without values
+		*s = valueSet[V]{}
+		return true
+	}
+	copy(s.items[i:], s.items[i+1:])
+	s.items = s.items[:len(s.items)-1]
+	if s.index != nil {
+		delete(s.index, v)
+		for j := i; j < len(s.items); j++ {
+			s.index[s.items[j]] = j
+		}
+	}
+	return true
+}
+
+//find returns the position of the value in the set, or -1 if it isn't there
+func (s *valueSet[V]) find(v V) int {
+	if s.index != nil {
+		if i, found := s.index[v]; found {
+			return i
+		}
+		return -1
+	}
+	for i, item := range s.items {
+		if item == v {
+			return i
+		}
+	}
+	return -1
+}
+
+//len returns the number of values in the set
+func (s *valueSet[V]) len() int {
+	return len(s.items)
+}
@@ -0,0 +1,72 @@
+package indexes
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestValueSet(t *testing.T) {
+	cases := []struct {
+		name    string
+		size    int
+		indexed bool
+	}{
+		{"Small", setIndexSize - 1, false},
+		{"Indexed", setIndexSize * 4, true},
+	}
+
+	for _, c := range cases {
+		values := make([]string, c.size)
+		for i := range values {
+			values[i] = fmt.Sprintf("v%d", i)
+		}
+		s := valueSet[string]{}
+		for _, v := range values {
+			s.add(v)
+		}
+		//adding a value that is already there leaves the set as it is
+		if s.add(values[1]) {
+			t.Errorf("case %s: expected adding a value that is already there to report false", c.name)
+		}
+		if !reflect.DeepEqual(s.items, values) {
+			t.Fatalf("case %s: expected %v but got %v", c.name, values, s.items)
+		}
+		if (s.index != nil) != c.indexed {
+			t.Errorf("case %s: expected indexed to be %t", c.name, c.indexed)
+		}
+
+		//removing keeps the order of the other values
+		if !s.remove(values[1]) {
+			t.Errorf("case %s: expected removing a value to report true", c.name)
+		}
+		if s.remove(values[1]) {
+			t.Errorf("case %s: expected removing a value that isn't there to report false", c.name)
+		}
+		expected := append([]string{values[0]}, values[2:]...)
+		if !reflect.DeepEqual(s.items, expected) {
+			t.Fatalf("case %s: expected %v but got %v", c.name, expected, s.items)
+		}
+		for i, v := range s.items {
+			if s.find(v) != i {
+				t.Errorf("case %s: expected %q at %d but found it at %d", c.name, v, i, s.find(v))
+			}
+		}
+		s.add(values[1])
+		if last := s.items[len(s.items)-1]; last != values[1] {
+			t.Errorf("case %s: expected a value added again to go last but got %v", c.name, s.items)
+		}
+
+		for _, v := range values {
+			s.remove(v)
+		}
+		if s.len() != 0 || s.items != nil || s.index != nil {
+			t.Errorf("case %s: expected an empty set to release its storage", c.name)
+		}
+	}
+
+	restored := newValueSet([]string{"x", "y", "x"})
+	if expected := []string{"x", "y"}; !reflect.DeepEqual(restored.items, expected) {
+		t.Errorf("expected %v but got %v", expected, restored.items)
+	}
+}
@@ -0,0 +1,85 @@
+package indexes
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+//snapshotVersion is the version of the snapshot format written by Snapshot.
+//It must be changed whenever the format or the way keys are normalized
+//changes, so that old snapshots are rebuilt rather than restored.
+const snapshotVersion = 1
+
+//snapshot is the form in which a Trie is written by Snapshot
+type snapshot[V comparable] struct {
+	Version int
+	Root    *snapshotNode[V]
+}
+
+//snapshotNode is the form in which a node is written by Snapshot
+type snapshotNode[V comparable] struct {
+	Label    string
+	Values   []V
+	Children []*snapshotNode[V]
+}
+
+//Snapshot writes the contents of the Trie to `w`, from which they can be
+//read back with Restore. The Trie can be used while the snapshot is written.
+//Values are written with encoding/gob, so V must be a type it can encode.
+func (c *Trie[V]) Snapshot(w io.Writer) error {
+	c.mx.RLock()
+	root := c.root.snapshot()
+	c.mx.RUnlock()
+	return gob.NewEncoder(w).Encode(&snapshot[V]{Version: snapshotVersion, Root: root})
+}
+
+//Restore replaces the contents of the Trie with a snapshot read from `r`
+func (c *Trie[V]) Restore(r io.Reader) error {
+	s := &snapshot[V]{}
+	if err := gob.NewDecoder(r).Decode(s); err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	root := &node[V]{}
+	size := 0
+	if s.Root != nil {
+		root = s.Root.restore(&size)
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.root = root
+	c.size = size
+	return nil
+}
+
+//snapshot copies the node's branch into snapshotNodes
+func (n *node[V]) snapshot() *snapshotNode[V] {
+	s := &snapshotNode[V]{
+		Label:    n.label,
+		Values:   append([]V(nil), n.values.items...),
+		Children: make([]*snapshotNode[V], len(n.children)),
+	}
+	for i, child := range n.children {
+		s.Children[i] = child.snapshot()
+	}
+	return s
+}
+
+//restore copies the snapshotNode's branch into nodes,
+//adding the number of key/value pairs to `size`
+func (s *snapshotNode[V]) restore(size *int) *node[V] {
+	n := &node[V]{
+		label:    s.Label,
+		values:   newValueSet(s.Values),
+		children: make([]*node[V], len(s.Children)),
+	}
+	*size += n.values.len()
+	for i, child := range s.Children {
+		n.children[i] = child.restore(size)
+	}
+	return n
+}
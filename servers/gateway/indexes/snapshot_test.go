@@ -0,0 +1,86 @@
+package indexes
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestSnapshot(t *testing.T) {
+	users := syntheticUsers(1000)
+	ids := make([]bson.ObjectId, len(users))
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	tr := loadUsers(users, ids)
+
+	buf := &bytes.Buffer{}
+	if err := tr.Snapshot(buf); err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	restored := NewTrie[bson.ObjectId]()
+	restored.Add("replaced", bson.NewObjectId())
+	if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("error restoring snapshot: %v", err)
+	}
+
+	for _, prefix := range []string{"a", "jose", "müller", "zoe", "søren", "o'brien", "ana123@", "replaced"} {
+		expected := tr.Get(len(ids), prefix)
+		if vals := restored.Get(len(ids), prefix); !reflect.DeepEqual(vals, expected) {
+			t.Errorf("expected %d values for %q but got %d", len(expected), prefix, len(vals))
+		}
+	}
+	if restored.Len() != tr.Len() {
+		t.Errorf("expected %d key/value pairs but got %d", tr.Len(), restored.Len())
+	}
+	//the restored trie can be changed like any other
+	restored.Remove(users[0][1], ids[0])
+	restored.Add("new user", ids[0])
+	if vals := restored.Get(10, "new user"); len(vals) != 1 {
+		t.Errorf("expected to find a user added after restoring")
+	}
+
+	empty := &bytes.Buffer{}
+	if err := NewTrie[bson.ObjectId]().Snapshot(empty); err != nil {
+		t.Fatalf("error writing snapshot: %v", err)
+	}
+	if err := NewTrie[bson.ObjectId]().Restore(empty); err != nil {
+		t.Errorf("error restoring empty snapshot: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		snapshot func() []byte
+		expected string
+	}{
+		{
+			"Garbage",
+			func() []byte { return []byte("not a snapshot") },
+			"error reading snapshot",
+		},
+		{
+			"Other Version",
+			func() []byte {
+				buf := &bytes.Buffer{}
+				gob.NewEncoder(buf).Encode(&snapshot[bson.ObjectId]{Version: snapshotVersion + 1, Root: &snapshotNode[bson.ObjectId]{}})
+				return buf.Bytes()
+			},
+			"unsupported snapshot version",
+		},
+	}
+	for _, c := range cases {
+		tr := NewTrie[bson.ObjectId]()
+		tr.Add("kept", bson.NewObjectId())
+		err := tr.Restore(bytes.NewReader(c.snapshot()))
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Errorf("case %s: expected error containing %q but got %v", c.name, c.expected, err)
+		}
+		if vals := tr.Get(10, "kept"); len(vals) != 1 {
+			t.Errorf("case %s: expected the trie to be kept after a failed restore", c.name)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package indexes
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+//streamBuffer is how many received updates are held until they are applied
+const streamBuffer = 100
+
+//ErrStreamClosed is returned when publishing to a closed Stream
+var ErrStreamClosed = errors.New("stream is closed")
+
+//Stream carries trie updates between the gateways sharing a user store,
+//so that each applies the changes made through the others
+type Stream[V comparable] interface {
+	//Publish sends the update to every subscriber of the stream,
+	//including this one
+	Publish(u *Update[V]) error
+
+	//Updates returns the channel on which published updates are
+	//received. It is closed when the stream is closed.
+	Updates() <-chan *Update[V]
+
+	//Close stops receiving updates
+	Close() error
+}
+
+//RedisStream is a Stream over a redis pub/sub channel. Updates published
+//while a gateway isn't subscribed are lost to it, so gateways rebuild
+//their tries when they start. Updates are sent as JSON, so V must be
+//a type encoding/json can encode and decode.
+type RedisStream[V comparable] struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+	updates chan *Update[V]
+}
+
+//NewRedisStream subscribes to the redis channel, and returns
+//once updates published to it will be received
+func NewRedisStream[V comparable](client *redis.Client, channel string) (*RedisStream[V], error) {
+	if client == nil {
+		panic("nil redis client")
+	}
+	pubsub := client.Subscribe(channel)
+	//the first reply confirms the subscription
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	s := &RedisStream[V]{
+		client:  client,
+		channel: channel,
+		pubsub:  pubsub,
+		updates: make(chan *Update[V], streamBuffer),
+	}
+	go s.receive()
+	return s, nil
+}
+
+//Publish sends the update to every gateway subscribed to the channel
+func (s *RedisStream[V]) Publish(u *Update[V]) error {
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return s.client.Publish(s.channel, buf).Err()
+}
+
+//Updates returns the channel on which published updates are received
+func (s *RedisStream[V]) Updates() <-chan *Update[V] {
+	return s.updates
+}
+
+//Close unsubscribes from the channel
+func (s *RedisStream[V]) Close() error {
+	return s.pubsub.Close()
+}
+
+//receive decodes the messages of the channel into updates until it is closed
+func (s *RedisStream[V]) receive() {
+	defer close(s.updates)
+	for msg := range s.pubsub.Channel() {
+		u := &Update[V]{}
+		if err := json.Unmarshal([]byte(msg.Payload), u); err != nil {
+			log.Printf("error decoding trie update: %v", err)
+			continue
+		}
+		s.updates <- u
+	}
+}
+
+//MemHub connects MemStreams, standing in for
+//the redis server that connects RedisStreams
+type MemHub[V comparable] struct {
+	streams map[*MemStream[V]]bool
+	mx      sync.Mutex
+}
+
+//NewMemHub constructs a new MemHub
+func NewMemHub[V comparable]() *MemHub[V] {
+	return &MemHub[V]{
+		streams: map[*MemStream[V]]bool{},
+	}
+}
+
+//Stream returns a new Stream receiving the updates
+//published to any of the hub's streams
+func (h *MemHub[V]) Stream() *MemStream[V] {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	s := &MemStream[V]{
+		hub:     h,
+		updates: make(chan *Update[V], streamBuffer),
+	}
+	h.streams[s] = true
+	return s
+}
+
+//MemStream is an in-memory Stream, for tests
+type MemStream[V comparable] struct {
+	hub     *MemHub[V]
+	updates chan *Update[V]
+}
+
+//Publish sends a copy of the update to every open stream of the hub
+func (s *MemStream[V]) Publish(u *Update[V]) error {
+	s.hub.mx.Lock()
+	defer s.hub.mx.Unlock()
+	if !s.hub.streams[s] {
+		return ErrStreamClosed
+	}
+	for stream := range s.hub.streams {
+		copied := *u
+		stream.updates <- &copied
+	}
+	return nil
+}
+
+//Updates returns the channel on which published updates are received
+func (s *MemStream[V]) Updates() <-chan *Update[V] {
+	return s.updates
+}
+
+//Close removes the stream from the hub
+func (s *MemStream[V]) Close() error {
+	s.hub.mx.Lock()
+	defer s.hub.mx.Unlock()
+	if !s.hub.streams[s] {
+		return ErrStreamClosed
+	}
+	delete(s.hub.streams, s)
+	close(s.updates)
+	return nil
+}
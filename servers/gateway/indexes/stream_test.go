@@ -0,0 +1,43 @@
+package indexes
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMemHub(t *testing.T) {
+	hub := NewMemHub[bson.ObjectId]()
+	a := hub.Stream()
+	b := hub.Stream()
+
+	u := &Update[bson.ObjectId]{Value: bson.NewObjectId(), Added: []string{"fred"}, Origin: "a"}
+	if err := a.Publish(u); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	//every stream receives the update, including the one it was published to
+	for name, s := range map[string]*MemStream[bson.ObjectId]{"a": a, "b": b} {
+		received := <-s.Updates()
+		if received.Value != u.Value || received.Origin != "a" || len(received.Added) != 1 {
+			t.Errorf("expected stream %s to receive %+v but got %+v", name, u, received)
+		}
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("error closing stream: %v", err)
+	}
+	if _, open := <-b.Updates(); open {
+		t.Errorf("expected the updates of a closed stream to be closed")
+	}
+	if err := b.Publish(u); err != ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed publishing to a closed stream but got %v", err)
+	}
+	//closed streams no longer receive updates
+	if err := a.Publish(u); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	<-a.Updates()
+	if err := b.Close(); err != ErrStreamClosed {
+		t.Errorf("expected ErrStreamClosed closing twice but got %v", err)
+	}
+}
@@ -2,213 +2,326 @@ package indexes
 
 import (
 	"fmt"
+	"iter"
 	"sort"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 
-	"gopkg.in/mgo.v2/bson"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
-//TODO: implement a trie data structure that stores
-//keys of type string and values of type bson.ObjectId
-//It must store key/value pairs, where the key is a string and the value is a bson.ObjectId.
-//Multiple values may be stored for the same key, but they should remain a distinct set.
-//That is, if the key/value is already in the trie, don't add the value again.
-
-//It must have a method that returns the first n values that match a given prefix string,
-//where n and the prefix string are parameters.
-//Find the branch of the trie holding keys that start with the prefix string,
-//and then do a recursive depth-first search to find the first n values in that branch.
-
-//It must have a method that removes a given key/value pair from the trie.
-//Since this trie will be read and modified from multiple concurrent goroutines,
-//you must protect the node tree using a RWMutex.
+//Trie is a radix tree mapping string keys to sets of values, such as user
+//IDs. Keys are normalized (see Normalize) when they are added and looked
+//up, and chains of nodes with a single child are compressed into one edge
+//labelled with a run of characters. It is safe for concurrent use.
+type Trie[V comparable] struct {
+	root *node[V]
+	//pending holds the changes made while the Trie is rebuilt,
+	//which are applied to the rebuilt Trie, and is nil otherwise
+	pending []func(t *Trie[V])
+	//size is the number of key/value pairs
+	size int
+	mx   sync.RWMutex
+	//rebuildMx serializes rebuilds
+	rebuildMx sync.Mutex
+}
 
-//Node stores a value
-type Node struct {
-	value []bson.ObjectId
-	child map[string]*Node
-	depth int
+//Update is a change to the keys of a value, such as a user being
+//created, changing their profile or being deleted. The keys
+//are given as they are, and normalized when it is applied.
+type Update[V comparable] struct {
+	Value   V        `json:"value"`
+	Removed []string `json:"removed,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	//Origin identifies where the update was made,
+	//so that it isn't applied there a second time
+	Origin string `json:"origin,omitempty"`
 }
 
-//Trie is a TTL cache that is safe for concurrent use
-type Trie struct {
-	root *Node
-	mx   sync.RWMutex
+//node is a node of the radix tree. Its label is the part of
+//the key on the edge leading to it, which is empty only for
+//the root. Its children are sorted by label, and no two
+//children have labels starting with the same rune.
+type node[V comparable] struct {
+	label    string
+	children []*node[V]
+	values   valueSet[V]
 }
 
 //NewTrie constructs a new Trie object
-func NewTrie() *Trie {
-	return &Trie{
-		root: &Node{
-			child: make(map[string]*Node),
-			value: [](bson.ObjectId){},
-			depth: 0,
-		},
+func NewTrie[V comparable]() *Trie[V] {
+	return &Trie[V]{
+		root: &node[V]{},
 	}
 }
 
-//NewChild constructs a new node corresponding to the given key
-func (n *Node) NewChild(key string) *Node {
-	node := &Node{
-		value: [](bson.ObjectId){},
-		child: make(map[string]*Node),
-		depth: n.depth + 1,
+//Normalize returns the form in which keys are stored and looked up:
+//case-folded, with compatibility characters decomposed and accents
+//removed, so that "José", "JOSE" and "jose" are the same key
+func Normalize(key string) string {
+	if isASCII(key) {
+		return strings.ToLower(key)
 	}
-	n.child[key] = node
-	return node
+	//a Caser keeps state, so a new chain is needed for every call
+	t := transform.Chain(cases.Fold(), norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	normalized, _, err := transform.String(t, strings.ToValidUTF8(key, string(utf8.RuneError)))
+	if err != nil {
+		return strings.ToLower(key)
+	}
+	return normalized
 }
 
-//let current node = root node
-//for each letter in the key...
-//	find the child node of current node associated with that letter
-//	if there is no child node associated with that letter, create a new node and add it to current node as a child associated with the letter
-//	set current node = child node
-//add value to current node
-
-//Add puts the id into the Trie
-func (c *Trie) Add(name string, value bson.ObjectId) {
+//Add puts the key/value pair into the Trie. If the pair
+//is already in the Trie, the value isn't added again.
+func (c *Trie[V]) Add(key string, value V) {
+	key = Normalize(key)
 	c.mx.Lock()
 	defer c.mx.Unlock()
-	current := c.root
-	letters := strings.Split(name, "")
-	for i := range letters {
-		next, found := current.child[letters[i]]
-		if !found {
-			next = current.NewChild(letters[i])
-		}
-		current = next
+	c.add(key, value)
+}
+
+//add puts the normalized key/value pair into the Trie. Callers must hold the lock.
+func (c *Trie[V]) add(key string, value V) {
+	if c.pending != nil {
+		added := key
+		c.pending = append(c.pending, func(t *Trie[V]) { t.add(added, value) })
 	}
-	for _, stored := range current.value {
-		if stored == value {
+	current := c.root
+	for len(key) > 0 {
+		i, child := current.child(key)
+		if child == nil {
+			leaf := &node[V]{label: key}
+			leaf.values.add(value)
+			c.size++
+			current.children = append(current.children, nil)
+			copy(current.children[i+1:], current.children[i:])
+			current.children[i] = leaf
 			return
 		}
+		common := commonPrefix(child.label, key)
+		if common < len(child.label) {
+			//the key leaves the edge part way along, so split it
+			split := &node[V]{label: child.label[:common], children: []*node[V]{child}}
+			child.label = child.label[common:]
+			current.children[i] = split
+			child = split
+		}
+		key = key[common:]
+		current = child
+	}
+	if current.values.add(value) {
+		c.size++
 	}
-	current.value = append(current.value, value)
 }
 
-//ToString returns a string representation of the key/value pair
-func (c *Trie) ToString(name string) string {
+//Remove removes the key/value pair from the Trie. An error is returned
+//if the key isn't in the Trie, but not if the value wasn't stored for it.
+func (c *Trie[V]) Remove(key string, value V) error {
 	c.mx.Lock()
 	defer c.mx.Unlock()
-	result := "result:"
-	current := c.root
-	letters := strings.Split(name, "")
-	for _, k := range letters {
-		next, found := current.child[k]
-		if !found {
-			return "key not found"
-		}
-		result = fmt.Sprintf("%s [%s]%d", result, k, next.depth)
-		current = next
+	if !c.remove(Normalize(key), value) {
+		return fmt.Errorf("key %q not found", key)
 	}
-	return result
+	return nil
 }
 
-//Remove removes the key/value pair from the Trie
-func (c *Trie) Remove(key string, value bson.ObjectId) error {
+//Apply removes the value from the keys the update removes, then adds it
+//to the keys the update adds. Keys that are already gone are skipped, so
+//an update can be applied to a Trie that is yet to catch up with it.
+func (c *Trie[V]) Apply(u *Update[V]) {
 	c.mx.Lock()
 	defer c.mx.Unlock()
-	current := c.root
-	letters := strings.Split(key, "")
-
-	return current.RemoveHelper(letters, value)
+	for _, key := range u.Removed {
+		c.remove(Normalize(key), u.Value)
+	}
+	for _, key := range u.Added {
+		c.add(Normalize(key), u.Value)
+	}
 }
 
-//RemoveHelper removes empty child nodes after value is removed
-func (n *Node) RemoveHelper(keys []string, value bson.ObjectId) error {
-	if len(keys) == 0 {
-		return nil
-	}
-	next, found := n.child[keys[0]]
-	if !found {
-		return fmt.Errorf("error no key value at depth %v, key %v", n.depth, keys)
+//remove removes the normalized key/value pair from the Trie, and reports
+//whether the key was found. Callers must hold the lock.
+func (c *Trie[V]) remove(normalized string, value V) bool {
+	if c.pending != nil {
+		c.pending = append(c.pending, func(t *Trie[V]) { t.remove(normalized, value) })
 	}
 
-	for i, v := range next.value {
-		if v == value {
-			next.value = append(next.value[:i], next.value[i+1:]...)
-			break
+	//path holds the nodes from the root to the node of the key
+	path := []*node[V]{c.root}
+	rest := normalized
+	for len(rest) > 0 {
+		_, child := path[len(path)-1].child(rest)
+		if child == nil || !strings.HasPrefix(rest, child.label) {
+			return false
 		}
+		rest = rest[len(child.label):]
+		path = append(path, child)
 	}
 
-	if err := next.RemoveHelper(keys[1:], value); err != nil {
-		return err
+	if path[len(path)-1].values.remove(value) {
+		c.size--
 	}
 
-	if len(next.child) == 0 && len(next.value) == 0 {
-		delete(n.child, keys[0])
+	//remove nodes that no longer hold anything, and merge nodes
+	//left with a single child into it, so that edges stay compressed
+	for i := len(path) - 1; i > 0; i-- {
+		n, parent := path[i], path[i-1]
+		if n.values.len() > 0 {
+			break
+		}
+		if len(n.children) == 1 {
+			only := n.children[0]
+			n.label += only.label
+			n.children = only.children
+			n.values = only.values
+			break
+		}
+		if len(n.children) > 1 {
+			break
+		}
+		j, _ := parent.child(n.label)
+		parent.children = append(parent.children[:j], parent.children[j+1:]...)
 	}
-	return nil
+	return true
 }
 
-//Get returns the first n values that match a given prefix string,
-//where n and the prefix string are parameters.
-//Find the branch of the trie holding keys that start with the prefix string,
-//and then do a recursive depth-first search to find the first n values in that branch.
-func (c *Trie) Get(n int, prefix string) []bson.ObjectId {
-	c.mx.RLock()
-	defer c.mx.RUnlock()
-	vals := []bson.ObjectId{}
-	if len(prefix) == 0 {
+//Get returns the first n values whose keys start with the prefix,
+//in the order WithPrefix yields them. A value is returned once for
+//each of its keys that starts with the prefix.
+func (c *Trie[V]) Get(n int, prefix string) []V {
+	vals := []V{}
+	if len(Normalize(prefix)) == 0 || n <= 0 {
 		return vals
 	}
-	current := c.root
-	letters := strings.Split(prefix, "")
+	for _, v := range c.WithPrefix(prefix) {
+		vals = append(vals, v)
+		if len(vals) >= n {
+			break
+		}
+	}
+	return vals
+}
+
+//All returns an iterator over the normalized keys of the Trie and their
+//values, in the order WithPrefix yields them. The Trie is read locked
+//while the iteration runs, so it must not be changed from the loop body.
+func (c *Trie[V]) All() iter.Seq2[string, V] {
+	return c.WithPrefix("")
+}
 
-	for i := range letters {
-		next, found := current.child[letters[i]]
-		if !found {
-			return vals
+//WithPrefix returns an iterator over the keys starting with the prefix,
+//normalized, and their values. The branch of the trie holding those keys
+//is searched depth first, in order of key, with the values of longer keys
+//before those of the keys they extend, and the values of a key in the order
+//they were added. The search stops as soon as the loop does. The Trie is
+//read locked while the iteration runs, so it must not be changed from the
+//loop body.
+func (c *Trie[V]) WithPrefix(prefix string) iter.Seq2[string, V] {
+	prefix = Normalize(prefix)
+	return func(yield func(string, V) bool) {
+		c.mx.RLock()
+		defer c.mx.RUnlock()
+		branch, rest := c.root.find(prefix)
+		if branch != nil {
+			branch.walk(prefix+rest, yield)
 		}
-		current = next
 	}
+}
 
-	// do recursion
-	res := current.GetHelper(n)
-	for _, v := range res {
-		vals = append(vals, v)
+//Rebuild replaces the contents of the Trie with a new Trie filled by `load`.
+//The Trie can be used while `load` runs, and the changes made to it in the
+//meantime are made to the new Trie too, before it takes the Trie's place.
+//If `load` fails, the Trie is left as it was.
+func (c *Trie[V]) Rebuild(load func(t *Trie[V]) error) error {
+	c.rebuildMx.Lock()
+	defer c.rebuildMx.Unlock()
+
+	c.mx.Lock()
+	c.pending = []func(t *Trie[V]){}
+	c.mx.Unlock()
+
+	rebuilt := NewTrie[V]()
+	err := load(rebuilt)
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	pending := c.pending
+	c.pending = nil
+	if err != nil {
+		return err
+	}
+	for _, change := range pending {
+		change(rebuilt)
 	}
+	c.root = rebuilt.root
+	c.size = rebuilt.size
+	return nil
+}
 
-	return vals
+//Len returns the number of key/value pairs in the Trie
+func (c *Trie[V]) Len() int {
+	c.mx.RLock()
+	defer c.mx.RUnlock()
+	return c.size
+}
+
+//child returns the child whose label starts with the same rune as `key`,
+//or nil and the index at which such a child would be inserted
+func (n *node[V]) child(key string) (int, *node[V]) {
+	r, _ := utf8.DecodeRuneInString(key)
+	i := sort.Search(len(n.children), func(i int) bool {
+		first, _ := utf8.DecodeRuneInString(n.children[i].label)
+		return first >= r
+	})
+	if i < len(n.children) && strings.HasPrefix(n.children[i].label, string(r)) {
+		return i, n.children[i]
+	}
+	return i, nil
 }
 
-//GetHelper does a recursive depth-first search
-func (n *Node) GetHelper(limit int) []bson.ObjectId {
-	vals := []bson.ObjectId{}
-	lim := limit
-	keys := sortedKeys(n.child)
-	for _, key := range keys {
-		// append all values from the deeper searches to vals
-		next := n.child[key]
-		arr := next.GetHelper(lim)
-		for _, v := range arr {
-			if lim == 0 {
-				return vals
-			}
-			vals = append(vals, v)
-			lim = lim - 1
+//walk yields the keys of the node's branch and their values, in the
+//order documented on WithPrefix, given the key of the node. It reports
+//whether the walk should go on, which is false once `yield` returns false.
+func (n *node[V]) walk(key string, yield func(string, V) bool) bool {
+	for _, child := range n.children {
+		if !child.walk(key+child.label, yield) {
+			return false
+		}
+	}
+	for _, v := range n.values.items {
+		if !yield(key, v) {
+			return false
 		}
 	}
+	return true
+}
 
-	// append the value (if any) from current node
-	if len(n.value) > 0 {
-		for _, v := range n.value {
-			if lim == 0 {
-				return vals
-			}
-			vals = append(vals, v)
-			lim = lim - 1
+//isASCII reports whether the string only holds ASCII characters,
+//which have no accents and only need to be lowercased
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
 		}
 	}
-	return vals
+	return true
 }
 
-func sortedKeys(m map[string]*Node) []string {
-	keys := make([]string, 0, len(m))
-	for key := range m {
-		keys = append(keys, key)
+//commonPrefix returns the length in bytes of the longest common
+//prefix of `a` and `b` that doesn't end part way through a rune
+func commonPrefix(a string, b string) int {
+	i := 0
+	for i < len(a) {
+		_, size := utf8.DecodeRuneInString(a[i:])
+		if i+size > len(b) || a[i:i+size] != b[i:i+size] {
+			break
+		}
+		i += size
 	}
-	sort.Strings(keys)
-	return keys
+	return i
 }
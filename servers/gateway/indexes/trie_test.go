@@ -1,13 +1,21 @@
 package indexes
 
-import "testing"
-import "gopkg.in/mgo.v2/bson"
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
 
 //TODO: implement automated tests for your trie data structure
 
 func TestTrie(t *testing.T) {
 	var origin []bson.ObjectId
-	tr := NewTrie()
+	tr := NewTrie[bson.ObjectId]()
 
 	id1 := bson.NewObjectId()
 	id2 := bson.NewObjectId()
@@ -62,4 +70,445 @@ func TestTrie(t *testing.T) {
 	if res := tr.Get(3, "ab"); len(res) != 0 {
 		t.Errorf("expected empty slice but got %v", res)
 	}
+
+	//a rebuilt trie replaces the contents
+	if err := tr.Rebuild(func(rebuilt *Trie[bson.ObjectId]) error {
+		rebuilt.Add("b", id2)
+		return nil
+	}); err != nil {
+		t.Fatalf("error rebuilding trie: %v", err)
+	}
+	if res := tr.Get(3, "a"); len(res) != 0 {
+		t.Errorf("expected old keys to be gone but got %v", res)
+	}
+	if res := tr.Get(3, "b"); len(res) != 1 || res[0] != id2 {
+		t.Errorf("expected rebuilt keys but got %v", res)
+	}
+}
+
+func TestTrieIterators(t *testing.T) {
+	tr := NewTrie[string]()
+	tr.Add("Lab", "#lab")
+	tr.Add("lab-eeg", "#lab-eeg")
+	tr.Add("Lab-EEG", "#eeg")
+	tr.Add("lab-eeg", "#lab-eeg")
+	tr.Add("general", "#general")
+
+	type pair struct {
+		key   string
+		value string
+	}
+	collect := func(seq func(yield func(string, string) bool), limit int) []pair {
+		pairs := []pair{}
+		for key, value := range seq {
+			if len(pairs) >= limit {
+				break
+			}
+			pairs = append(pairs, pair{key, value})
+		}
+		return pairs
+	}
+
+	cases := []struct {
+		name     string
+		seq      func(yield func(string, string) bool)
+		limit    int
+		expected []pair
+	}{
+		{
+			"All",
+			tr.All(),
+			10,
+			[]pair{{"general", "#general"}, {"lab-eeg", "#lab-eeg"}, {"lab-eeg", "#eeg"}, {"lab", "#lab"}},
+		},
+		{
+			"Prefix",
+			tr.WithPrefix("LAB"),
+			10,
+			[]pair{{"lab-eeg", "#lab-eeg"}, {"lab-eeg", "#eeg"}, {"lab", "#lab"}},
+		},
+		{
+			"Prefix Inside Edge",
+			tr.WithPrefix("lab-e"),
+			10,
+			[]pair{{"lab-eeg", "#lab-eeg"}, {"lab-eeg", "#eeg"}},
+		},
+		{
+			"No Match",
+			tr.WithPrefix("random"),
+			10,
+			[]pair{},
+		},
+		{
+			"Early Termination",
+			tr.All(),
+			2,
+			[]pair{{"general", "#general"}, {"lab-eeg", "#lab-eeg"}},
+		},
+	}
+	for _, c := range cases {
+		if pairs := collect(c.seq, c.limit); !reflect.DeepEqual(pairs, c.expected) {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expected, pairs)
+		}
+	}
+
+	//the lock is released when the loop stops early, so the trie can be changed
+	for range tr.All() {
+		break
+	}
+	tr.Add("random", "#random")
+	if vals := tr.Get(10, "rand"); len(vals) != 1 || vals[0] != "#random" {
+		t.Errorf("expected to find a value added after an iteration but got %v", vals)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	cases := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{"Lowercase", "jose", "jose"},
+		{"Uppercase", "JOSE", "jose"},
+		{"Precomposed Accent", "José", "jose"},
+		{"Combining Accent", "José", "jose"},
+		{"Umlaut", "Müller", "muller"},
+		{"Sharp S", "Straße", "strasse"},
+		{"Dotted Capital I", "İstanbul", "istanbul"},
+		{"Fullwidth", "Ｆｒｅｄ", "fred"},
+		{"Ligature", "ﬁnn", "finn"},
+		{"Greek", "Κώστας", "κωστασ"},
+		{"Email", "Fred.HW@UW.edu", "fred.hw@uw.edu"},
+		{"Invalid UTF-8", "fr\xffed", "fr�ed"},
+	}
+
+	for _, c := range cases {
+		if normalized := Normalize(c.key); normalized != c.expected {
+			t.Errorf("case %s: expected %q but got %q", c.name, c.expected, normalized)
+		}
+	}
+}
+
+func TestTrieUnicode(t *testing.T) {
+	tr := NewTrie[bson.ObjectId]()
+	jose := bson.NewObjectId()
+	joseph := bson.NewObjectId()
+	zoe := bson.NewObjectId()
+	tr.Add("José", jose)
+	tr.Add("joseph", joseph)
+	tr.Add("Zoë", zoe)
+
+	cases := []struct {
+		name     string
+		prefix   string
+		expected []bson.ObjectId
+	}{
+		{"Without Accent", "jose", []bson.ObjectId{joseph, jose}},
+		{"With Accent", "JOSÉ", []bson.ObjectId{joseph, jose}},
+		{"Combining Accent", "josép", []bson.ObjectId{joseph}},
+		{"Inside Edge", "jo", []bson.ObjectId{joseph, jose}},
+		{"Diaeresis", "zoe", []bson.ObjectId{zoe}},
+		{"Past Edge", "josex", []bson.ObjectId{}},
+		{"No Match", "fred", []bson.ObjectId{}},
+		{"Empty", "", []bson.ObjectId{}},
+	}
+
+	for _, c := range cases {
+		vals := tr.Get(10, c.prefix)
+		if len(vals) != len(c.expected) {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expected, vals)
+			continue
+		}
+		for i := range vals {
+			if vals[i] != c.expected[i] {
+				t.Errorf("case %s: expected %v but got %v", c.name, c.expected, vals)
+				break
+			}
+		}
+	}
+
+	//removing with a differently written key finds the same one
+	if err := tr.Remove("JOSE", jose); err != nil {
+		t.Errorf("error removing value: %v", err)
+	}
+	if vals := tr.Get(10, "jose"); len(vals) != 1 || vals[0] != joseph {
+		t.Errorf("expected only joseph to remain but got %v", vals)
+	}
+	if err := tr.Remove("jos", jose); err == nil {
+		t.Errorf("expected error removing a key that ends inside an edge")
+	}
+	if err := tr.Remove("fred", jose); err == nil {
+		t.Errorf("expected error removing a key that isn't in the trie")
+	}
+}
+
+func TestTrieCompression(t *testing.T) {
+	tr := NewTrie[bson.ObjectId]()
+	ids := map[string]bson.ObjectId{}
+	for _, key := range []string{"romane", "romanus", "romulus", "rubens", "ruber", "rubicon", "rubicundus"} {
+		ids[key] = bson.NewObjectId()
+		tr.Add(key, ids[key])
+	}
+
+	//every node but the root has a label, and nodes without values branch
+	var check func(n *node[bson.ObjectId], key string) int
+	check = func(n *node[bson.ObjectId], key string) int {
+		if n != tr.root && len(n.label) == 0 {
+			t.Errorf("node below %q has an empty label", key)
+		}
+		if n != tr.root && n.values.len() == 0 && len(n.children) < 2 {
+			t.Errorf("node %q should have been compressed", key+n.label)
+		}
+		count := 1
+		for _, child := range n.children {
+			count += check(child, key+n.label)
+		}
+		return count
+	}
+	if count := check(tr.root, ""); count != 14 {
+		t.Errorf("expected 14 nodes but got %d", count)
+	}
+
+	for key, id := range ids {
+		if err := tr.Remove(key, id); err != nil {
+			t.Errorf("error removing %s: %v", key, err)
+		}
+		check(tr.root, "")
+	}
+	if len(tr.root.children) != 0 {
+		t.Errorf("expected empty trie but root has %d children", len(tr.root.children))
+	}
+}
+
+func TestTrieMatchesMap(t *testing.T) {
+	//compare the trie with a plain map from keys to values
+	rnd := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "é", "ß", "中"}
+	randomKey := func() string {
+		key := ""
+		for i := rnd.Intn(5); i >= 0; i-- {
+			key += alphabet[rnd.Intn(len(alphabet))]
+		}
+		return key
+	}
+	ids := make([]bson.ObjectId, 5)
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+
+	tr := NewTrie[bson.ObjectId]()
+	stored := map[string]map[bson.ObjectId]bool{}
+	for i := 0; i < 5000; i++ {
+		key := randomKey()
+		id := ids[rnd.Intn(len(ids))]
+		normalized := Normalize(key)
+		if rnd.Intn(3) == 0 {
+			err := tr.Remove(key, id)
+			if _, found := stored[normalized]; !found {
+				//the key may still be a node on the way to longer keys
+				continue
+			}
+			if err != nil {
+				t.Fatalf("error removing %q: %v", key, err)
+			}
+			delete(stored[normalized], id)
+			if len(stored[normalized]) == 0 {
+				delete(stored, normalized)
+			}
+			continue
+		}
+		tr.Add(key, id)
+		if stored[normalized] == nil {
+			stored[normalized] = map[bson.ObjectId]bool{}
+		}
+		stored[normalized][id] = true
+	}
+
+	pairs := 0
+	for _, vals := range stored {
+		pairs += len(vals)
+	}
+	if tr.Len() != pairs {
+		t.Fatalf("expected %d key/value pairs but got %d", pairs, tr.Len())
+	}
+
+	for i := 0; i < 500; i++ {
+		prefix := randomKey()
+		expected := 0
+		for key, vals := range stored {
+			if strings.HasPrefix(key, Normalize(prefix)) {
+				expected += len(vals)
+			}
+		}
+		if vals := tr.Get(len(ids)*1000, prefix); len(vals) != expected {
+			t.Fatalf("expected %d values for %q but got %d", expected, prefix, len(vals))
+		}
+	}
+}
+
+//syntheticUsers returns the indexed names of `n` users, generated
+//from a fixed seed so that benchmarks are comparable between runs
+func syntheticUsers(n int) [][]string {
+	rnd := rand.New(rand.NewSource(42))
+	first := []string{"Ana", "Björn", "Chloé", "Dmitri", "Émile", "Fatima", "Günther", "Hana", "Inés", "José",
+		"Kenji", "Léa", "Mateo", "Nora", "Oğuz", "Priya", "Quinn", "Raúl", "Søren", "Zoë"}
+	last := []string{"Andersson", "Bergström", "Castillo", "Dubois", "García", "Hernández", "Ivanov", "Jensen",
+		"Kowalski", "López", "Müller", "Nguyen", "O'Brien", "Pérez", "Rossi", "Schröder", "Tanaka", "Weiß"}
+	users := make([][]string, n)
+	for i := range users {
+		fn := first[rnd.Intn(len(first))]
+		ln := last[rnd.Intn(len(last))]
+		un := fmt.Sprintf("%s%s%d", strings.ToLower(fn[:1]), strings.ToLower(ln), i)
+		users[i] = []string{un + "@uw.edu", un, fn, ln}
+	}
+	return users
+}
+
+//loadUsers adds the names of the users to a new trie
+func loadUsers(users [][]string, ids []bson.ObjectId) *Trie[bson.ObjectId] {
+	tr := NewTrie[bson.ObjectId]()
+	for i, names := range users {
+		for _, name := range names {
+			tr.Add(name, ids[i])
+		}
+	}
+	return tr
+}
+
+func BenchmarkTrieLoad(b *testing.B) {
+	users := syntheticUsers(100000)
+	ids := make([]bson.ObjectId, len(users))
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		loadUsers(users, ids)
+	}
+}
+
+func BenchmarkTrieMemory(b *testing.B) {
+	users := syntheticUsers(100000)
+	ids := make([]bson.ObjectId, len(users))
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	var tr *Trie[bson.ObjectId]
+	var before, after runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		tr = nil
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		tr = loadUsers(users, ids)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+	}
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(users)), "heap-bytes/user")
+	runtime.KeepAlive(tr)
+}
+
+func BenchmarkTrieGet(b *testing.B) {
+	users := syntheticUsers(100000)
+	ids := make([]bson.ObjectId, len(users))
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	tr := loadUsers(users, ids)
+	prefixes := []string{"j", "jose", "mul", "Müller", "gar", "kbergstrom12", "zz"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.Get(20, prefixes[i%len(prefixes)])
+	}
+}
+
+func BenchmarkTrieAddShared(b *testing.B) {
+	//many users sharing a key, such as a common last name
+	ids := make([]bson.ObjectId, 10000)
+	for i := range ids {
+		ids[i] = bson.NewObjectId()
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr := NewTrie[bson.ObjectId]()
+		for _, id := range ids {
+			tr.Add("Nguyen", id)
+		}
+	}
+}
+
+func TestTrieApply(t *testing.T) {
+	tr := NewTrie[bson.ObjectId]()
+	id := bson.NewObjectId()
+	tr.Apply(&Update[bson.ObjectId]{Value: id, Added: []string{"fred@uw.edu", "fredhw", "Fred", "Wijaya"}})
+	//removing keys that are already gone is not an error
+	tr.Apply(&Update[bson.ObjectId]{Value: id, Removed: []string{"Fred", "Wijaya", "Nobody"}, Added: []string{"Frederick", "Wijaya"}})
+
+	cases := []struct {
+		prefix   string
+		expected int
+	}{
+		{"fredhw", 1},
+		{"frederick", 1},
+		{"fred@", 1},
+		{"wijaya", 1},
+		{"nobody", 0},
+	}
+	for _, c := range cases {
+		if vals := tr.Get(10, c.prefix); len(vals) != c.expected {
+			t.Errorf("expected %d values for %q but got %d", c.expected, c.prefix, len(vals))
+		}
+	}
+}
+
+func TestTrieRebuild(t *testing.T) {
+	tr := NewTrie[bson.ObjectId]()
+	stale := bson.NewObjectId()
+	tr.Add("stale", stale)
+
+	kept := bson.NewObjectId()
+	loaded := bson.NewObjectId()
+	err := tr.Rebuild(func(rebuilt *Trie[bson.ObjectId]) error {
+		rebuilt.Add("loaded", loaded)
+		rebuilt.Add("renamed", loaded)
+		//the trie is still in use while it is rebuilt
+		if vals := tr.Get(10, "stale"); len(vals) != 1 {
+			t.Errorf("expected the old contents to be searched during the rebuild")
+		}
+		tr.Add("kept", kept)
+		tr.Apply(&Update[bson.ObjectId]{Value: loaded, Removed: []string{"renamed"}, Added: []string{"new name"}})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error rebuilding: %v", err)
+	}
+
+	cases := []struct {
+		prefix   string
+		expected []bson.ObjectId
+	}{
+		{"stale", []bson.ObjectId{}},
+		{"loaded", []bson.ObjectId{loaded}},
+		{"kept", []bson.ObjectId{kept}},
+		{"renamed", []bson.ObjectId{}},
+		{"new name", []bson.ObjectId{loaded}},
+	}
+	for _, c := range cases {
+		if vals := tr.Get(10, c.prefix); !reflect.DeepEqual(vals, c.expected) {
+			t.Errorf("expected %v for %q but got %v", c.expected, c.prefix, vals)
+		}
+	}
+	if tr.Len() != 3 {
+		t.Errorf("expected 3 key/value pairs after the rebuild but got %d", tr.Len())
+	}
+
+	//a failed rebuild leaves the trie as it was
+	err = tr.Rebuild(func(rebuilt *Trie[bson.ObjectId]) error {
+		return fmt.Errorf("store unavailable")
+	})
+	if err == nil {
+		t.Errorf("expected the error loading the trie")
+	}
+	if vals := tr.Get(10, "kept"); len(vals) != 1 {
+		t.Errorf("expected the trie to be kept after a failed rebuild")
+	}
 }
@@ -0,0 +1,224 @@
+//Package lockout protects sign-in against password guessing. Every failed
+//attempt is counted per account and per client IP address. After a few free
+//attempts each further attempt must wait an exponentially growing delay,
+//and after too many failures the key is locked out for a while.
+package lockout
+
+import (
+	"strings"
+	"time"
+)
+
+//Policy describes how failed attempts for one kind of key are throttled
+type Policy struct {
+	//FreeAttempts is the number of failures allowed without any delay
+	FreeAttempts int
+	//BaseDelay is the delay after the first failure beyond FreeAttempts.
+	//It doubles with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	//LockoutThreshold is the number of failures that locks the key out
+	LockoutThreshold int
+	//LockoutDuration is how long a locked out key stays locked, and how
+	//long failures are remembered after the most recent one
+	LockoutDuration time.Duration
+}
+
+//DefaultAccountPolicy throttles guesses against a single account
+var DefaultAccountPolicy = Policy{
+	FreeAttempts:     3,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 10,
+	LockoutDuration:  15 * time.Minute,
+}
+
+//DefaultIPPolicy throttles guesses from a single client, across accounts
+var DefaultIPPolicy = Policy{
+	FreeAttempts:     10,
+	BaseDelay:        time.Second,
+	MaxDelay:         time.Minute,
+	LockoutThreshold: 50,
+	LockoutDuration:  time.Hour,
+}
+
+//wait returns how long the key must wait before its next attempt,
+//and whether it is locked out rather than just delayed
+func (p *Policy) wait(rec *Record, now time.Time) (time.Duration, bool) {
+	since := now.Sub(rec.LastFailure)
+	if rec.Failures >= p.LockoutThreshold {
+		if since < p.LockoutDuration {
+			return p.LockoutDuration - since, true
+		}
+		return 0, false
+	}
+	if rec.Failures <= p.FreeAttempts {
+		return 0, false
+	}
+	delay := p.BaseDelay << uint(rec.Failures-p.FreeAttempts-1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+	if since < delay {
+		return delay - since, false
+	}
+	return 0, false
+}
+
+//Status is the result of checking whether a sign-in attempt may proceed
+type Status struct {
+	//RetryAfter is how long the client must wait, or zero if it may proceed
+	RetryAfter time.Duration
+	//Locked is true if the account or IP is locked out,
+	//rather than just delayed
+	Locked bool
+}
+
+//Allowed reports whether the attempt may proceed
+func (s *Status) Allowed() bool {
+	return s.RetryAfter <= 0
+}
+
+//Guard tracks failed sign-in attempts per account and per IP address
+type Guard struct {
+	Store         Store
+	AccountPolicy Policy
+	IPPolicy      Policy
+	//OnLockout is called with the account key when an account becomes locked out
+	OnLockout func(account string, until time.Time)
+
+	now func() time.Time
+}
+
+//NewGuard constructs a new Guard using the default policies
+func NewGuard(store Store) *Guard {
+	if store == nil {
+		panic("nil store passed to NewGuard")
+	}
+	return &Guard{
+		Store:         store,
+		AccountPolicy: DefaultAccountPolicy,
+		IPPolicy:      DefaultIPPolicy,
+		now:           time.Now,
+	}
+}
+
+//Attempt is a sign-in attempt, which is counted as a failure from the moment
+//it begins until it turns out otherwise. It must end with Fail, Succeed or
+//Release, and the ones after the first do nothing.
+type Attempt struct {
+	Status
+	guard       *Guard
+	account     string
+	ip          string
+	at          time.Time
+	accountPrev *Record
+	ipPrev      *Record
+	done        bool
+}
+
+//Begin begins a sign-in attempt for the account from the IP address, and
+//reports whether it may proceed. It should be called before checking
+//credentials. Each attempt is counted before it is decided on, so attempts
+//made at the same time can't all get through before any of them fails.
+//Attempts that may not proceed are not counted.
+func (g *Guard) Begin(account string, ip string) (*Attempt, error) {
+	now := g.now()
+	accountPrev, err := g.Store.Fail(accountKey(account), now, g.AccountPolicy.LockoutDuration)
+	if err != nil {
+		return nil, err
+	}
+	ipPrev, err := g.Store.Fail(ipKey(ip), now, g.IPPolicy.LockoutDuration)
+	if err != nil {
+		g.Store.Forgive(accountKey(account), now, accountPrev.LastFailure)
+		return nil, err
+	}
+
+	a := &Attempt{
+		guard:       g,
+		account:     account,
+		ip:          ip,
+		at:          now,
+		accountPrev: accountPrev,
+		ipPrev:      ipPrev,
+	}
+	for _, c := range []struct {
+		rec    *Record
+		policy *Policy
+	}{
+		{accountPrev, &g.AccountPolicy},
+		{ipPrev, &g.IPPolicy},
+	} {
+		wait, locked := c.policy.wait(c.rec, now)
+		if wait > a.RetryAfter {
+			a.RetryAfter = wait
+		}
+		a.Locked = a.Locked || locked
+	}
+	if !a.Allowed() {
+		if err := a.Release(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+//Fail ends the attempt as a failure, which it was already counted as
+func (a *Attempt) Fail() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	g := a.guard
+	if a.accountPrev.Failures+1 == g.AccountPolicy.LockoutThreshold && g.OnLockout != nil {
+		g.OnLockout(normalize(a.account), a.at.Add(g.AccountPolicy.LockoutDuration))
+	}
+	return nil
+}
+
+//Succeed ends the attempt as a successful sign-in, which clears the failures
+//for the account. Failures for the IP address are kept, so that an attacker
+//can't reset them by signing in to their own account between guesses at other
+//accounts, though this attempt is no longer counted.
+func (a *Attempt) Succeed() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	if err := a.guard.Store.Reset(accountKey(a.account)); err != nil {
+		return err
+	}
+	return a.guard.Store.Forgive(ipKey(a.ip), a.at, a.ipPrev.LastFailure)
+}
+
+//Release ends the attempt without counting it, for attempts that neither
+//failed nor signed in, such as a right password before the two-factor code
+//or an attempt whose credentials couldn't be checked
+func (a *Attempt) Release() error {
+	if a.done {
+		return nil
+	}
+	a.done = true
+	if err := a.guard.Store.Forgive(accountKey(a.account), a.at, a.accountPrev.LastFailure); err != nil {
+		return err
+	}
+	return a.guard.Store.Forgive(ipKey(a.ip), a.at, a.ipPrev.LastFailure)
+}
+
+//Unlock clears the failures for the account, unlocking it
+func (g *Guard) Unlock(account string) error {
+	return g.Store.Reset(accountKey(account))
+}
+
+//normalize returns the canonical form of an account key
+func normalize(account string) string {
+	return strings.ToLower(strings.TrimSpace(account))
+}
+
+func accountKey(account string) string {
+	return "account:" + normalize(account)
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
@@ -0,0 +1,168 @@
+package lockout
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGuard(t *testing.T) {
+	now := time.Now()
+	guard := NewGuard(NewMemStore(time.Minute))
+	guard.now = func() time.Time { return now }
+	guard.AccountPolicy = Policy{
+		FreeAttempts:     2,
+		BaseDelay:        time.Second,
+		MaxDelay:         4 * time.Second,
+		LockoutThreshold: 6,
+		LockoutDuration:  time.Hour,
+	}
+
+	lockedOut := ""
+	guard.OnLockout = func(account string, until time.Time) {
+		lockedOut = account
+	}
+
+	begin := func(name string, expectRetry time.Duration, expectLocked bool) *Attempt {
+		attempt, err := guard.Begin("Fred@UW.edu", "10.0.0.1")
+		if err != nil {
+			t.Fatalf("%s: error beginning attempt: %v", name, err)
+		}
+		if attempt.RetryAfter != expectRetry || attempt.Locked != expectLocked {
+			t.Errorf("%s: expected retry after %v (locked %t) but got %v (locked %t)",
+				name, expectRetry, expectLocked, attempt.RetryAfter, attempt.Locked)
+		}
+		return attempt
+	}
+	fail := func(name string) {
+		if err := begin(name, 0, false).Fail(); err != nil {
+			t.Fatalf("%s: error recording failure: %v", name, err)
+		}
+	}
+
+	fail("No Failures")
+	fail("Free Attempt")
+	fail("Last Free Attempt")
+
+	//delays double with every failure past the free attempts, up to the max,
+	//and attempts turned away while waiting don't count
+	begin("First Delay", time.Second, false)
+	begin("First Delay Again", time.Second, false)
+	now = now.Add(time.Second)
+	fail("First Delay Waited")
+	begin("Second Delay", 2*time.Second, false)
+	now = now.Add(time.Second)
+	begin("Partially Waited", time.Second, false)
+	now = now.Add(time.Second)
+	fail("Fully Waited")
+	begin("Third Delay", 4*time.Second, false)
+	now = now.Add(4 * time.Second)
+
+	//attempts that turn out not to fail aren't counted
+	if err := begin("Released", 0, false).Release(); err != nil {
+		t.Fatalf("error releasing attempt: %v", err)
+	}
+	begin("Released Again", 0, false).Release()
+
+	fail("Locking Out")
+	begin("Locked Out", time.Hour, true)
+	if lockedOut != "fred@uw.edu" {
+		t.Errorf("expected lockout notification for fred@uw.edu but got %q", lockedOut)
+	}
+
+	if err := guard.Unlock("FRED@uw.edu"); err != nil {
+		t.Fatalf("error unlocking: %v", err)
+	}
+	begin("Unlocked", 0, false).Succeed()
+}
+
+func TestGuardIP(t *testing.T) {
+	now := time.Now()
+	guard := NewGuard(NewMemStore(time.Minute))
+	guard.now = func() time.Time { return now }
+	guard.IPPolicy = Policy{
+		FreeAttempts:     1,
+		BaseDelay:        time.Second,
+		MaxDelay:         time.Minute,
+		LockoutThreshold: 3,
+		LockoutDuration:  time.Hour,
+	}
+
+	//guesses spread over many accounts are still limited per IP
+	for i, account := range []string{"a@uw.edu", "b@uw.edu", "c@uw.edu"} {
+		attempt, err := guard.Begin(account, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("error beginning attempt: %v", err)
+		}
+		if !attempt.Allowed() {
+			t.Fatalf("expected attempt %d to be allowed but got %+v", i, attempt.Status)
+		}
+		attempt.Fail()
+		now = now.Add(time.Minute)
+	}
+	attempt, err := guard.Begin("d@uw.edu", "10.0.0.1")
+	if err != nil {
+		t.Fatalf("error beginning attempt: %v", err)
+	}
+	if attempt.Allowed() || !attempt.Locked {
+		t.Errorf("expected IP to be locked out but got %+v", attempt.Status)
+	}
+
+	//succeeding on an account from another IP doesn't reset the IP
+	attempt, _ = guard.Begin("d@uw.edu", "10.0.0.2")
+	if !attempt.Allowed() {
+		t.Errorf("expected other IPs to be allowed but got %+v", attempt.Status)
+	}
+	if err := attempt.Succeed(); err != nil {
+		t.Fatalf("error recording success: %v", err)
+	}
+	if attempt, _ := guard.Begin("d@uw.edu", "10.0.0.1"); attempt.Allowed() {
+		t.Errorf("expected IP to stay locked out after a successful sign-in")
+	}
+}
+
+func TestGuardParallelAttempts(t *testing.T) {
+	guard := NewGuard(NewMemStore(time.Minute))
+	guard.AccountPolicy = Policy{
+		FreeAttempts:     3,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 10,
+		LockoutDuration:  time.Hour,
+	}
+
+	//guesses made at once can't all get in before any of them fails
+	const n = 50
+	allowed := make(chan *Attempt, n)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			attempt, err := guard.Begin("fred@uw.edu", "10.0.0.1")
+			if err != nil {
+				t.Errorf("error beginning attempt: %v", err)
+				return
+			}
+			if attempt.Allowed() {
+				allowed <- attempt
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(allowed)
+
+	//attempts are only allowed after no more than the free failures
+	if len(allowed) != guard.AccountPolicy.FreeAttempts+1 {
+		t.Errorf("expected %d attempts to be allowed but got %d", guard.AccountPolicy.FreeAttempts+1, len(allowed))
+	}
+	for attempt := range allowed {
+		attempt.Fail()
+	}
+	if rec, _ := guard.Store.Get(accountKey("fred@uw.edu")); rec.Failures != guard.AccountPolicy.FreeAttempts+1 {
+		t.Errorf("expected only the allowed attempts to be counted but got %d", rec.Failures)
+	}
+}
@@ -0,0 +1,78 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+//MemStore is an in-process memory Store.
+//This should be used only for testing and single-instance deployments.
+type MemStore struct {
+	entries *cache.Cache
+	mx      sync.Mutex
+}
+
+//NewMemStore constructs and returns a new MemStore
+func NewMemStore(purgeInterval time.Duration) *MemStore {
+	return &MemStore{
+		entries: cache.New(cache.NoExpiration, purgeInterval),
+	}
+}
+
+//Get returns the record for the key
+func (ms *MemStore) Get(key string) (*Record, error) {
+	rec, found := ms.entries.Get(key)
+	if !found {
+		return &Record{}, nil
+	}
+	copied := rec.(Record)
+	return &copied, nil
+}
+
+//Fail records a failed attempt for the key
+func (ms *MemStore) Fail(key string, at time.Time, ttl time.Duration) (*Record, error) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	rec := Record{}
+	if existing, found := ms.entries.Get(key); found {
+		rec = existing.(Record)
+	}
+	prev := rec
+	rec.Failures++
+	rec.LastFailure = at
+	ms.entries.Set(key, rec, ttl)
+	return &prev, nil
+}
+
+//Forgive takes back a failed attempt for the key
+func (ms *MemStore) Forgive(key string, at time.Time, last time.Time) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	existing, expiry, found := ms.entries.GetWithExpiration(key)
+	if !found {
+		return nil
+	}
+	rec := existing.(Record)
+	rec.Failures--
+	if rec.Failures <= 0 {
+		ms.entries.Delete(key)
+		return nil
+	}
+	if rec.LastFailure.Equal(at) {
+		rec.LastFailure = last
+	}
+	ms.entries.Set(key, rec, time.Until(expiry))
+	return nil
+}
+
+//Reset forgets all failures for the key
+func (ms *MemStore) Reset(key string) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	ms.entries.Delete(key)
+	return nil
+}
@@ -0,0 +1,112 @@
+package lockout
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//forgiveScript takes back a failure, deleting the record if none are left,
+//and puts back the last failure unless another was recorded since
+var forgiveScript = redis.NewScript(`
+local failures = tonumber(redis.call("HGET", KEYS[1], "failures"))
+if not failures then
+	return 0
+end
+if failures <= 1 then
+	redis.call("DEL", KEYS[1])
+	return 0
+end
+redis.call("HINCRBY", KEYS[1], "failures", -1)
+if redis.call("HGET", KEYS[1], "last") == ARGV[1] then
+	redis.call("HSET", KEYS[1], "last", ARGV[2])
+end
+return 0
+`)
+
+//RedisStore is a Store shared through redis, so that every
+//gateway instance sees the same failed attempts
+type RedisStore struct {
+	Client *redis.Client
+}
+
+//NewRedisStore constructs a new RedisStore
+func NewRedisStore(client *redis.Client) *RedisStore {
+	if client == nil {
+		panic("nil pointer passed for client")
+	}
+	return &RedisStore{
+		Client: client,
+	}
+}
+
+//Get returns the record for the key
+func (rs *RedisStore) Get(key string) (*Record, error) {
+	vals, err := rs.Client.HMGet(getRedisKey(key), "failures", "last").Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseRecord(vals[0], vals[1])
+}
+
+//Fail records a failed attempt for the key. The record is read, the counter
+//incremented and the expiry reset in a single transaction.
+func (rs *RedisStore) Fail(key string, at time.Time, ttl time.Duration) (*Record, error) {
+	rkey := getRedisKey(key)
+	pipe := rs.Client.TxPipeline()
+	prev := pipe.HMGet(rkey, "failures", "last")
+	pipe.HIncrBy(rkey, "failures", 1)
+	pipe.HSet(rkey, "last", formatTime(at))
+	pipe.Expire(rkey, ttl)
+	if _, err := pipe.Exec(); err != nil {
+		return nil, err
+	}
+	vals := prev.Val()
+	return parseRecord(vals[0], vals[1])
+}
+
+//Forgive takes back a failed attempt for the key
+func (rs *RedisStore) Forgive(key string, at time.Time, last time.Time) error {
+	return forgiveScript.Run(rs.Client, []string{getRedisKey(key)}, formatTime(at), formatTime(last)).Err()
+}
+
+//Reset forgets all failures for the key
+func (rs *RedisStore) Reset(key string) error {
+	return rs.Client.Del(getRedisKey(key)).Err()
+}
+
+//parseRecord converts the hash fields returned by HMGET into a Record
+func parseRecord(failures interface{}, last interface{}) (*Record, error) {
+	rec := &Record{}
+	if s, ok := failures.(string); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		rec.Failures = n
+	}
+	if s, ok := last.(string); ok {
+		ns, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if ns != 0 {
+			rec.LastFailure = time.Unix(0, ns)
+		}
+	}
+	return rec, nil
+}
+
+//formatTime formats the time of a failure for the record's hash
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+//getRedisKey returns the redis key for a lockout key
+func getRedisKey(key string) string {
+	return "lockout:" + key
+}
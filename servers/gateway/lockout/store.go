@@ -0,0 +1,34 @@
+package lockout
+
+import (
+	"time"
+)
+
+//Record holds the consecutive failed sign-in attempts for a key
+type Record struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+//Store tracks failed sign-in attempts per key, such as an account
+//email address or a client IP address. This is an abstract interface
+//so that attempts can be tracked in memory or in a shared redis server.
+type Store interface {
+	//Get returns the record for the key, which is
+	//the zero Record if there were no recent failures
+	Get(key string) (*Record, error)
+
+	//Fail records a failed attempt at time `at` and returns the record as it
+	//was before, in one atomic operation, so that concurrent attempts each see
+	//the ones before them. The record is forgotten once `ttl` has passed
+	//without another failure.
+	Fail(key string, at time.Time, ttl time.Duration) (*Record, error)
+
+	//Forgive takes back the failure recorded at `at`, when the attempt turned
+	//out not to fail. The last failure goes back to `last` unless another
+	//failure was recorded since.
+	Forgive(key string, at time.Time, last time.Time) error
+
+	//Reset forgets all failures for the key
+	Reset(key string) error
+}
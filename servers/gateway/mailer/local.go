@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+//FileMailer writes each message to a new .eml file in a directory
+//instead of sending it. Use it for development and tests.
+type FileMailer struct {
+	Dir  string
+	From string
+
+	mx    sync.Mutex
+	count int
+}
+
+//NewFileMailer constructs a new FileMailer, creating `dir` if needed
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating mail directory: %v", err)
+	}
+	return &FileMailer{
+		Dir:  dir,
+		From: from,
+	}, nil
+}
+
+//Send writes the message to a file
+func (m *FileMailer) Send(msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	now := time.Now()
+
+	m.mx.Lock()
+	m.count++
+	name := fmt.Sprintf("%d-%04d.eml", now.UnixNano(), m.count)
+	m.mx.Unlock()
+
+	return ioutil.WriteFile(filepath.Join(m.Dir, name), msg.format(m.From, now), 0600)
+}
+
+//LogMailer logs each message instead of sending it.
+//Use it for development only, since messages contain secret links.
+type LogMailer struct {
+	Logger *log.Logger
+}
+
+//NewLogMailer constructs a new LogMailer.
+//If `logger` is nil, the standard logger is used.
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	return &LogMailer{
+		Logger: logger,
+	}
+}
+
+//Send logs the message
+func (m *LogMailer) Send(msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	if m.Logger == nil {
+		log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+	m.Logger.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
@@ -0,0 +1,76 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mailer")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := NewFileMailer(filepath.Join(dir, "outbox"), "noreply@synapse.test")
+	if err != nil {
+		t.Fatalf("error creating mailer: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		msg         *Message
+		expectError bool
+	}{
+		{
+			"Valid Message",
+			&Message{To: "fredhw@uw.edu", Subject: "Hello", Body: "line one\nline two"},
+			false,
+		},
+		{
+			"No Recipient",
+			&Message{Subject: "Hello", Body: "body"},
+			true,
+		},
+		{
+			"Header Injection",
+			&Message{To: "fredhw@uw.edu\r\nBcc: eve@evil.test", Subject: "Hello", Body: "body"},
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		err := m.Send(c.msg)
+		if c.expectError && err == nil {
+			t.Errorf("case %s: expected error but didn't get one", c.name)
+		}
+		if !c.expectError && err != nil {
+			t.Errorf("case %s: unexpected error: %v", c.name, err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		t.Fatalf("error reading mail directory: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 message file but got %d", len(files))
+	}
+	contents, err := ioutil.ReadFile(filepath.Join(m.Dir, files[0].Name()))
+	if err != nil {
+		t.Fatalf("error reading message file: %v", err)
+	}
+	for _, expected := range []string{
+		"From: noreply@synapse.test\r\n",
+		"To: fredhw@uw.edu\r\n",
+		"Subject: Hello\r\n",
+		"\r\n\r\nline one\r\nline two",
+	} {
+		if !strings.Contains(string(contents), expected) {
+			t.Errorf("expected message to contain %q but got:\n%s", expected, contents)
+		}
+	}
+}
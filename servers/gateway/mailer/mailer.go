@@ -0,0 +1,51 @@
+//Package mailer sends email to users, such as password reset
+//and email verification links
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+//Message is an email message with a plain text body
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+//Mailer sends email messages. This is an abstract interface
+//so that messages can be sent through an SMTP server, or written
+//to local files or the log during development and testing.
+type Mailer interface {
+	//Send sends the message
+	Send(msg *Message) error
+}
+
+//format returns the message in RFC 5322 format
+func (msg *Message) format(from string, date time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(buf, "\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+	return buf.Bytes()
+}
+
+//validate ensures the message headers can't be used to inject other headers
+func (msg *Message) validate() error {
+	if len(msg.To) == 0 {
+		return fmt.Errorf("message has no recipient")
+	}
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("message headers must not contain line breaks")
+	}
+	return nil
+}
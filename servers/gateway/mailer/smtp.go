@@ -0,0 +1,43 @@
+package mailer
+
+import (
+	"net"
+	"net/smtp"
+	"time"
+)
+
+//SMTPMailer sends messages through an SMTP server
+type SMTPMailer struct {
+	//Addr is the host:port of the SMTP server
+	Addr string
+	//From is the sender address
+	From string
+	//Auth authenticates with the server, or is nil
+	Auth smtp.Auth
+}
+
+//NewSMTPMailer constructs a new SMTPMailer. If `username` is
+//non-empty, it authenticates with PLAIN auth, which net/smtp
+//only allows over TLS or to localhost.
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	m := &SMTPMailer{
+		Addr: addr,
+		From: from,
+	}
+	if len(username) > 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+//Send sends the message
+func (m *SMTPMailer) Send(msg *Message) error {
+	if err := msg.validate(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, msg.format(m.From, time.Now()))
+}
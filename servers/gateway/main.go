@@ -1,22 +1,57 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"gopkg.in/mgo.v2"
-
+	"github.com/synapse-api/servers/gateway/apierr"
+	"github.com/synapse-api/servers/gateway/audit"
+	"github.com/synapse-api/servers/gateway/config"
+	"github.com/synapse-api/servers/gateway/health"
+	"github.com/synapse-api/servers/gateway/indexes"
+	"github.com/synapse-api/servers/gateway/lockout"
+	"github.com/synapse-api/servers/gateway/mailer"
+	"github.com/synapse-api/servers/gateway/metrics"
 	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/reqlog"
 	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/sso"
+	"github.com/synapse-api/servers/gateway/tracing"
+	"github.com/synapse-api/servers/gateway/xuser"
+	"gopkg.in/mgo.v2/bson"
 
-	"github.com/go-redis/redis"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/synapse-api/servers/gateway/handlers"
 )
 
+//trieRebuildRetry is how long to wait before trying again when
+//the user search trie can't be built as the gateway starts
+const trieRebuildRetry = 30 * time.Second
+
+//trieSnapshotInterval is how often the snapshot of the user search trie is saved
+const trieSnapshotInterval = 10 * time.Minute
+
+//readyCacheTTL is how long the public readiness endpoint reuses
+//the results of checking the dependencies
+const readyCacheTTL = 5 * time.Second
+
+//shutdownTimeout is how long requests in flight have to finish
+//once the gateway has stopped accepting new ones
+const shutdownTimeout = 30 * time.Second
+
 //RootHandler handles requests for the root resource
 func RootHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/plain")
@@ -26,6 +61,18 @@ func RootHandler(w http.ResponseWriter, r *http.Request) {
 //main is the main entry point for the server
 func main() {
 
+	//the log package writes through the default logger too
+	logger, err := config.Logger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := config.Tracing(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	addr := os.Getenv("ADDR")
 	if len(addr) == 0 {
 		addr = ":443"
@@ -37,33 +84,12 @@ func main() {
 		log.Fatal("please set TLSKEY and TLSCERT")
 	}
 
-	sskey := os.Getenv("SESSIONKEY")
-	if len(sskey) == 0 {
-		log.Fatal("please set SESSIONKEY")
-	}
-
-	redisAddr := os.Getenv("REDISADDR")
-	if len(redisAddr) == 0 {
-		redisAddr = "redis:6379"
-	}
-
-	client := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	redisStore := sessions.NewRedisStore(client, 0)
-
-	dbAddr := os.Getenv("DBADDR")
-	if len(dbAddr) == 0 {
-		dbAddr = "mymongo:27017"
-	}
-
-	fmt.Printf("dialing mogo with: %s\n", dbAddr)
+	client := config.RedisClient()
 
-	sess, err := mgo.Dial(dbAddr)
+	userStore, auditLog, err := config.Stores(context.Background())
 	if err != nil {
-		log.Fatalf("failed to dial mongodb: %v", err)
+		log.Fatal(err)
 	}
-	mongoStore := users.NewMongoStore(sess, "mgo", "users")
 
 	messageSvcAddrs := os.Getenv("MESSAGESSVC_ADDRS")
 	splitMessageSvcAddrs := strings.Split(messageSvcAddrs, ",")
@@ -83,37 +109,355 @@ func main() {
 		splitQeegSvcAddrs = append(splitQeegSvcAddrs, ":80")
 	}
 
-	handlerCtx := handlers.NewHandlerContext(sskey, mongoStore, redisStore)
+	gatewayMetrics := metrics.New()
+	sessionManager, err := config.SessionManager(client, func(store sessions.Store) sessions.Store {
+		return tracing.SessionStore(gatewayMetrics.SessionStore(store))
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionManager = tracing.SessionManager(sessionManager)
+
+	//XUSER_KEY signs the X-User header sent to microservices with HMAC-SHA256,
+	//or XUSER_ED25519_SEED signs it with Ed25519 so services only need the public key
+	var userSigner *xuser.Signer
+	if seed := os.Getenv("XUSER_ED25519_SEED"); len(seed) > 0 {
+		seedBytes, err := base64.StdEncoding.DecodeString(seed)
+		if err != nil || len(seedBytes) != ed25519.SeedSize {
+			log.Fatalf("XUSER_ED25519_SEED must be a base64-encoded %d-byte seed", ed25519.SeedSize)
+		}
+		userSigner = xuser.NewEd25519Signer(ed25519.NewKeyFromSeed(seedBytes))
+	} else if xuserKey := os.Getenv("XUSER_KEY"); len(xuserKey) > 0 {
+		userSigner = xuser.NewHMACSigner([]byte(xuserKey))
+	} else {
+		log.Fatal("please set XUSER_KEY or XUSER_ED25519_SEED")
+	}
+
+	handlerCtx := handlers.NewHandlerContext(sessionManager, userStore, userSigner)
+	handlerCtx.SetMetrics(gatewayMetrics)
+	handlerCtx.SetLoginGuard(lockout.NewGuard(lockout.NewRedisStore(client)))
+	handlerCtx.SetAuditLog(auditLog)
+	handlerCtx.SetLockoutNotifier(func(user *users.User, until time.Time) {
+		slog.Warn("user locked out", "userName", user.UserName, "until", until)
+	})
+
+	//ADMIN_EMAILS bootstraps the first admins, since only admins can change roles
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); len(email) == 0 {
+			continue
+		}
+		admin, err := userStore.GetByEmail(context.Background(), email)
+		if err != nil {
+			slog.Error("error finding admin", "email", email, "error", err)
+			continue
+		}
+		if err := userStore.SetRole(context.Background(), admin.ID, users.RoleAdmin); err != nil {
+			log.Fatalf("error making %s an admin: %v", email, err)
+		}
+	}
+
+	//SMTP_ADDR sends password reset and verification emails through an SMTP server,
+	//or MAIL_DIR writes them to files there. Otherwise they are only logged.
+	mailFrom := os.Getenv("MAIL_FROM")
+	if len(mailFrom) == 0 {
+		mailFrom = "noreply@synapse-api"
+	}
+	if smtpAddr := os.Getenv("SMTP_ADDR"); len(smtpAddr) > 0 {
+		handlerCtx.SetMailer(mailer.NewSMTPMailer(smtpAddr, mailFrom,
+			os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")), os.Getenv("APP_URL"))
+	} else if mailDir := os.Getenv("MAIL_DIR"); len(mailDir) > 0 {
+		fileMailer, err := mailer.NewFileMailer(mailDir, mailFrom)
+		if err != nil {
+			log.Fatalf("error creating file mailer: %v", err)
+		}
+		handlerCtx.SetMailer(fileMailer, os.Getenv("APP_URL"))
+	} else {
+		handlerCtx.SetMailer(mailer.NewLogMailer(nil), os.Getenv("APP_URL"))
+	}
+	handlerCtx.SetRequireVerified(os.Getenv("REQUIRE_VERIFIED_EMAIL") == "true")
+
+	//files of deleted accounts are kept for FILE_RETENTION before they are purged
+	fileDir := config.DataDir()
+
+	//the gateway is ready when its dependencies can each be reached within READY_TIMEOUT
+	readyTimeout := 2 * time.Second
+	if t := os.Getenv("READY_TIMEOUT"); len(t) > 0 {
+		if readyTimeout, err = time.ParseDuration(t); err != nil {
+			log.Fatalf("invalid READY_TIMEOUT: %v", err)
+		}
+	}
+	checker := health.NewChecker(readyTimeout)
+	checker.Add("redis", func(ctx context.Context) error {
+		return client.WithContext(ctx).Ping().Err()
+	})
+	userStoreName := os.Getenv("USER_STORE")
+	if len(userStoreName) == 0 {
+		userStoreName = "mongo"
+	}
+	checker.Add(userStoreName, userStore.Ping)
+	checker.Add("rawData", func(ctx context.Context) error {
+		return fileDir.CheckWritable()
+	})
+	qeegInstances := map[string]health.Check{}
+	for _, qeegAddr := range splitQeegSvcAddrs {
+		if len(qeegAddr) > 0 {
+			qeegInstances[qeegAddr] = health.HTTP(http.DefaultClient, "http://"+qeegAddr+"/")
+		}
+	}
+	checker.AddPool("qeeg", qeegInstances)
+	handlerCtx.SetFiles(fileDir)
+	//recordings that can't be indexed are left out of searches, but can still be read
+	if err := handlerCtx.LoadRecordings(); err != nil {
+		slog.Error("error indexing recordings", "error", err)
+	}
+
+	retention := 30 * 24 * time.Hour
+	if r := os.Getenv("FILE_RETENTION"); len(r) > 0 {
+		if retention, err = time.ParseDuration(r); err != nil {
+			log.Fatalf("invalid FILE_RETENTION: %v", err)
+		}
+	}
+	go func() {
+		for now := range time.Tick(time.Hour) {
+			n, err := fileDir.Purge(retention, now)
+			if err != nil {
+				slog.Error("error purging files of deleted users", "error", err)
+			}
+			if n > 0 {
+				slog.Info("purged files of deleted users", "users", n)
+			}
+		}
+	}()
+
+	//the user search trie is restored from the snapshot at TRIE_SNAPSHOT, if there is
+	//one, so that searches work straight away, and rebuilt from the user store in the
+	//background. Gateways share the changes made through them on a redis channel.
+	snapshotPath := os.Getenv("TRIE_SNAPSHOT")
+	if len(snapshotPath) > 0 {
+		if err := handlerCtx.RestoreTrie(snapshotPath); err != nil && !os.IsNotExist(err) {
+			slog.Error("error restoring trie", "error", err)
+		}
+	}
+	trieStream, err := indexes.NewRedisStream[bson.ObjectId](client, config.TrieUpdateChannel)
+	if err != nil {
+		log.Fatalf("error subscribing to trie updates: %v", err)
+	}
+	handlerCtx.SetTrieStream(trieStream)
+	go handlerCtx.ApplyTrieUpdates()
+
+	rebuildTrie := func() error {
+		if err := handlerCtx.RebuildTrie(); err != nil {
+			return err
+		}
+		slog.Info("rebuilt trie")
+		if len(snapshotPath) > 0 {
+			if err := handlerCtx.SaveTrie(snapshotPath); err != nil {
+				slog.Error("error saving trie snapshot", "error", err)
+			}
+		}
+		return nil
+	}
+	//the gateway isn't ready until the trie has been built, so that searches are complete
+	checker.Block("trie")
+	go func() {
+		for err := rebuildTrie(); err != nil; err = rebuildTrie() {
+			slog.Error("error rebuilding trie", "retryIn", trieRebuildRetry, "error", err)
+			time.Sleep(trieRebuildRetry)
+		}
+		checker.Unblock("trie")
+	}()
+	//synapsectl asks for the trie to be rebuilt after users were changed in the database
+	go func() {
+		for range client.Subscribe(config.TrieRebuildChannel).Channel() {
+			if err := rebuildTrie(); err != nil {
+				slog.Error("error rebuilding trie", "error", err)
+			}
+		}
+	}()
+	//the snapshot is kept up to date with the changes made since the trie was rebuilt
+	if len(snapshotPath) > 0 {
+		go func() {
+			for range time.Tick(trieSnapshotInterval) {
+				if err := handlerCtx.SaveTrie(snapshotPath); err != nil {
+					slog.Error("error saving trie snapshot", "error", err)
+				}
+			}
+		}()
+	}
+
+	//OIDC_ISSUER enables single sign-on with an institutional OpenID Connect provider,
+	//where the gateway is registered as OIDC_CLIENT_ID with OIDC_CLIENT_SECRET.
+	//The provider sends users back to OIDC_REDIRECT_URL, a page of the web client.
+	if issuer := os.Getenv("OIDC_ISSUER"); len(issuer) > 0 {
+		provider, err := sso.NewProvider(context.Background(), issuer, os.Getenv("OIDC_CLIENT_ID"),
+			os.Getenv("OIDC_CLIENT_SECRET"), os.Getenv("OIDC_REDIRECT_URL"))
+		if err != nil {
+			log.Fatalf("error setting up single sign-on: %v", err)
+		}
+		handlerCtx.SetSSO(provider, sso.NewRedisStore(client), os.Getenv("OIDC_CREATE_USERS") == "true")
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", RootHandler)
+	mux.HandleFunc("/healthz", checker.LivenessHandler)
 
 	mux.HandleFunc("/v1/users/", handlerCtx.UsersHandler)
 	mux.HandleFunc("/v1/users/me/", handlerCtx.UsersMeHandler)
 	mux.HandleFunc("/v1/sessions/", handlerCtx.SessionsHandler)
 	mux.HandleFunc("/v1/sessions/mine/", handlerCtx.SessionsMineHandler)
-	mux.HandleFunc("/v1/users", handlerCtx.SearchHandler)
-	mux.HandleFunc("/v1/upload", handlerCtx.FileHandler)
-
-	mux.Handle("/v1/channels", handlerCtx.NewServiceProxy(splitMessageSvcAddrs))
-	mux.Handle("/v1/channels/", handlerCtx.NewServiceProxy(splitMessageSvcAddrs))
-	mux.Handle("/v1/messages/", handlerCtx.NewServiceProxy(splitMessageSvcAddrs))
-	mux.Handle("/v1/summary/", handlerCtx.NewServiceProxy(splitSummarySvcAddrs))
-	mux.Handle("/v1/hello", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-	mux.Handle("/v1/spectrum/", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-	mux.Handle("/v1/sumfile/", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-	mux.Handle("/v1/specfile/", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-	mux.Handle("/v1/cohrfile/", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-	mux.Handle("/v1/clean/", handlerCtx.NewServiceProxy(splitQeegSvcAddrs))
-
-	corsHandler := handlers.NewCORSHandler(mux)
+	mux.HandleFunc("/v1/sessions/refresh", handlerCtx.SessionsRefreshHandler)
+	mux.HandleFunc("/v1/sessions/totp", handlerCtx.SessionsTOTPHandler)
+	mux.HandleFunc("/v1/sessions/sso", handlerCtx.SessionsSSOHandler)
+	mux.HandleFunc("/v1/users/me/totp", handlerCtx.UsersMeTOTPHandler)
+	mux.HandleFunc("/v1/users/me/password", handlerCtx.UsersMePasswordHandler)
+	mux.HandleFunc("/v1/users/me/email", handlerCtx.UsersMeEmailHandler)
+	mux.HandleFunc("/v1/resets", handlerCtx.ResetsHandler)
+	mux.HandleFunc("/v1/resets/", handlerCtx.SpecificResetHandler)
+	mux.HandleFunc("/v1/verifications", handlerCtx.VerificationsHandler)
+	mux.HandleFunc("/v1/verifications/", handlerCtx.SpecificVerificationHandler)
+	mux.Handle("/v1/users", handlerCtx.Require(users.PermSearchUsers, http.HandlerFunc(handlerCtx.SearchHandler)))
+	mux.Handle("/v1/upload", handlerCtx.Authorize(handlers.MethodPermissions{
+		"GET": users.PermReadFiles,
+		"*":   users.PermWriteFiles,
+	}, http.HandlerFunc(handlerCtx.FileHandler)))
+	mux.Handle("/v1/files/search", handlerCtx.Require(users.PermReadFiles, http.HandlerFunc(handlerCtx.RecordingSearchHandler)))
+	mux.Handle("/v1/admin/users", handlerCtx.Require(users.PermManageUsers, http.HandlerFunc(handlerCtx.AdminUsersHandler)))
+	mux.Handle("/v1/admin/users/", handlerCtx.Require(users.PermManageUsers, http.HandlerFunc(handlerCtx.SpecificAdminUserHandler)))
+	mux.Handle("/v1/admin/lockouts/", handlerCtx.Require(users.PermManageUsers, http.HandlerFunc(handlerCtx.AdminLockoutsHandler)))
+	mux.Handle("/v1/admin/audit", handlerCtx.Require(users.PermViewAudit, http.HandlerFunc(handlerCtx.AdminAuditHandler)))
+	mux.Handle("/v1/admin/audit/export", handlerCtx.Require(users.PermViewAudit, http.HandlerFunc(handlerCtx.AdminAuditExportHandler)))
+
+	//METRICS_ADDR serves /metrics on a listener of its own, without TLS or
+	//authentication, for Prometheus to scrape from the internal network,
+	//along with /healthz and /readyz for probes that don't speak TLS.
+	//Otherwise /metrics is served with the API, to admins, and /readyz is
+	//served to anyone, but from cached checks and without internal addresses.
+	if metricsAddr := os.Getenv("METRICS_ADDR"); len(metricsAddr) > 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", gatewayMetrics.Handler())
+		metricsMux.HandleFunc("/healthz", checker.LivenessHandler)
+		metricsMux.HandleFunc("/readyz", checker.ReadinessHandler)
+		go func() {
+			slog.Info("metrics server is listening", "addr", metricsAddr)
+			log.Fatal(http.ListenAndServe(metricsAddr, metricsMux))
+		}()
+	} else {
+		mux.Handle("/metrics", handlerCtx.Require(users.PermViewMetrics, gatewayMetrics.Handler()))
+		mux.HandleFunc("/readyz", checker.PublicReadinessHandler(readyCacheTTL))
+	}
+
+	messagesProxy := handlerCtx.NewServiceProxy("messaging", splitMessageSvcAddrs)
+	summaryProxy := handlerCtx.NewServiceProxy("summary", splitSummarySvcAddrs)
+	qeegProxy := handlerCtx.NewServiceProxy("qeeg", splitQeegSvcAddrs)
+
+	analysisFiles := handlers.MethodPermissions{
+		"GET": users.PermReadFiles,
+		"*":   users.PermRunAnalysis,
+	}
+	analysisActions := handlers.MethodActions{
+		"GET": audit.ActionReadAnalysis,
+		"*":   audit.ActionRunAnalysis,
+	}
+
+	mux.Handle("/v1/channels", handlerCtx.Require(users.PermMessaging, messagesProxy))
+	mux.Handle("/v1/channels/", handlerCtx.Require(users.PermMessaging, messagesProxy))
+	mux.Handle("/v1/messages/", handlerCtx.Require(users.PermMessaging, messagesProxy))
+	mux.Handle("/v1/summary/", summaryProxy)
+	mux.Handle("/v1/hello", qeegProxy)
+	//analyses are recorded in the audit log, including ones that were denied
+	mux.Handle("/v1/spectrum/", handlerCtx.Audit(audit.ActionRunAnalysis, handlerCtx.Require(users.PermRunAnalysis, qeegProxy)))
+	mux.Handle("/v1/sumfile/", handlerCtx.AuditMethods(analysisActions, handlerCtx.Authorize(analysisFiles, qeegProxy)))
+	mux.Handle("/v1/specfile/", handlerCtx.AuditMethods(analysisActions, handlerCtx.Authorize(analysisFiles, qeegProxy)))
+	mux.Handle("/v1/cohrfile/", handlerCtx.AuditMethods(analysisActions, handlerCtx.Authorize(analysisFiles, qeegProxy)))
+	mux.Handle("/v1/clean/", handlerCtx.Audit(audit.ActionRunAnalysis, handlerCtx.Require(users.PermRunAnalysis, qeegProxy)))
+
+	corsOrigins := os.Getenv("CORS_ORIGINS")
+	if len(corsOrigins) == 0 {
+		corsOrigins = "*"
+	}
+	origins := []string{}
+	for _, o := range strings.Split(corsOrigins, ",") {
+		if o = strings.TrimSpace(o); len(o) > 0 {
+			origins = append(origins, o)
+		}
+	}
+
+	corsPolicy, err := handlers.NewCORSPolicy(origins, os.Getenv("CORS_CREDENTIALS") == "true")
+	if err != nil {
+		log.Fatalf("invalid CORS_ORIGINS: %v", err)
+	}
+	corsPolicy.AllowedHeaders = append(corsPolicy.AllowedHeaders, reqlog.HeaderRequestID)
+	corsPolicy.ExposedHeaders = append(corsPolicy.ExposedHeaders, sessions.HeaderRefreshToken, "Retry-After", "Link", apierr.HeaderRequestID)
+	if maxAge := os.Getenv("CORS_MAXAGE"); len(maxAge) > 0 {
+		secs, err := strconv.Atoi(maxAge)
+		if err != nil {
+			log.Fatalf("invalid CORS_MAXAGE: %v", err)
+		}
+		corsPolicy.MaxAge = secs
+	}
+
+	fileHeaders := []string{"Content-Type", "Authorization", "filename", "subject", "session", "device", "tags", "recorded-at"}
+	corsPolicy.AddRoute("/v1/users/me", []string{"GET", "PATCH", "DELETE"}, nil)
+	corsPolicy.AddRoute("/v1/sessions/mine", []string{"DELETE"}, nil)
+	corsPolicy.AddRoute("/v1/users/me/totp", []string{"POST", "PUT", "DELETE"}, nil)
+	corsPolicy.AddRoute("/v1/users/me/password", []string{"PUT"}, nil)
+	corsPolicy.AddRoute("/v1/users/me/email", []string{"PUT"}, nil)
+	corsPolicy.AddRoute("/v1/sessions/refresh", []string{"POST"}, nil)
+	corsPolicy.AddRoute("/v1/sessions/totp", []string{"POST"}, nil)
+	corsPolicy.AddRoute("/v1/sessions/sso", []string{"GET", "POST"}, nil)
+	corsPolicy.AddRoute("/v1/resets", []string{"POST"}, nil)
+	corsPolicy.AddRoute("/v1/resets/", []string{"PUT"}, nil)
+	corsPolicy.AddRoute("/v1/verifications", []string{"POST"}, nil)
+	corsPolicy.AddRoute("/v1/verifications/", []string{"PUT"}, nil)
+	corsPolicy.AddRoute("/v1/admin/users/", []string{"GET", "PATCH"}, nil)
+	corsPolicy.AddRoute("/v1/admin/lockouts/", []string{"DELETE"}, nil)
+	corsPolicy.AddRoute("/v1/admin/audit", []string{"GET"}, nil)
+	corsPolicy.AddRoute("/v1/admin/audit/export", []string{"GET"}, nil)
+	corsPolicy.AddRoute("/v1/upload", []string{"GET", "POST", "DELETE"}, fileHeaders)
+	corsPolicy.AddRoute("/v1/files/search", []string{"GET"}, nil)
+	corsPolicy.AddRoute("/v1/sumfile/", []string{"GET", "POST"}, fileHeaders)
+	corsPolicy.AddRoute("/v1/specfile/", []string{"GET", "POST"}, fileHeaders)
+	corsPolicy.AddRoute("/v1/cohrfile/", []string{"GET", "POST"}, fileHeaders)
+
+	//every request, including preflight requests, is traced, given an ID, logged and counted
+	corsHandler := tracing.Handler(mux, reqlog.Middleware(logger, gatewayMetrics.Middleware(mux, handlers.NewCORSHandler(mux, corsPolicy))))
 
 	dir, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("failed to get working directory: %v", err)
 	}
 
-	fmt.Printf("current directory %s\n", dir)
-	fmt.Printf("server is listening on %s\n", addr)
-	log.Fatal(http.ListenAndServeTLS(addr, tlscert, tlskey, corsHandler))
+	//SHUTDOWN_DELAY is how long the gateway keeps serving after it is asked to stop
+	//and stops being ready, so that load balancers stop sending it requests first
+	shutdownDelay := 5 * time.Second
+	if d := os.Getenv("SHUTDOWN_DELAY"); len(d) > 0 {
+		if shutdownDelay, err = time.ParseDuration(d); err != nil {
+			log.Fatalf("invalid SHUTDOWN_DELAY: %v", err)
+		}
+	}
+
+	server := &http.Server{Addr: addr, Handler: corsHandler}
+	go func() {
+		slog.Info("server is listening", "addr", addr, "dir", dir)
+		if err := server.ListenAndServeTLS(tlscert, tlskey); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	<-stop.Done()
+	checker.Block("shutdown")
+	slog.Info("shutting down", "delay", shutdownDelay)
+	time.Sleep(shutdownDelay)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("error shutting down", "error", err)
+	}
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("error flushing spans", "error", err)
+	}
+	slog.Info("server stopped")
 }
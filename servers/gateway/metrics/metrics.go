@@ -0,0 +1,292 @@
+//Package metrics collects the gateway's Prometheus metrics: the requests
+//it handles, the requests it proxies to the microservices, the latency of
+//the session store, the size of the user search trie and the volume of
+//uploads. Metrics serves them in the Prometheus text format.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//namespace prefixes the names of the gateway's metrics
+const namespace = "gateway"
+
+//methods are the request methods that are labelled as they are.
+//Others are labelled "OTHER", so that clients can't create labels.
+var methods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true,
+	"PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+//Metrics holds the gateway's metrics. It is safe for concurrent use.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+
+	proxyDuration *prometheus.HistogramVec
+	proxyErrors   *prometheus.CounterVec
+	proxyInFlight *prometheus.GaugeVec
+
+	sessionStoreDuration *prometheus.HistogramVec
+
+	uploadBytes prometheus.Counter
+
+	//trieSize returns the size of the user search trie, if it is set
+	trieSize func() int
+	mx       sync.RWMutex
+}
+
+//New returns Metrics with a registry of their own, which also
+//collects the Go runtime's and the process's metrics
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle requests, by route, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "Requests being handled.",
+		}),
+		//analyses can take a while, so the buckets go up to about 40 seconds
+		proxyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "proxy_request_duration_seconds",
+			Help:      "Time until microservices respond with headers, by service, upstream and status.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 13),
+		}, []string{"service", "upstream", "status"}),
+		proxyErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "proxy_errors_total",
+			Help:      "Proxied requests that failed or got a 5xx response, by service, upstream and reason.",
+		}, []string{"service", "upstream", "reason"}),
+		proxyInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "proxy_requests_in_flight",
+			Help:      "Requests waiting for a microservice to respond, by service.",
+		}, []string{"service"}),
+		sessionStoreDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "session_store_duration_seconds",
+			Help:      "Time taken by session store operations, by operation and result.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 12),
+		}, []string{"operation", "result"}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upload_bytes_total",
+			Help:      "Bytes of files uploaded.",
+		}),
+	}
+	trieEntries := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "trie_entries",
+		Help:      "Key/value pairs in the user search trie.",
+	}, func() float64 {
+		m.mx.RLock()
+		defer m.mx.RUnlock()
+		if m.trieSize == nil {
+			return 0
+		}
+		return float64(m.trieSize())
+	})
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.requestDuration, m.inFlight,
+		m.proxyDuration, m.proxyErrors, m.proxyInFlight,
+		m.sessionStoreDuration, m.uploadBytes, trieEntries,
+	)
+	return m
+}
+
+//Handler returns a handler that serves the metrics in the Prometheus text format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+//Middleware wraps `next` so that the requests it handles are counted and
+//timed. Requests are labelled with the pattern `routes` matches them to,
+//rather than their path, so that IDs in paths don't each get a label.
+func (m *Metrics) Middleware(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		_, route := routes.Handler(r)
+		method := r.Method
+		if !methods[method] {
+			method = "OTHER"
+		}
+		status := strconv.Itoa(rec.status)
+		m.requests.WithLabelValues(route, method, status).Inc()
+		m.requestDuration.WithLabelValues(route, method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+//Transport wraps `next` so that the requests proxied through it to the
+//`service` are timed by upstream, and failures and 5xx responses counted.
+//Requests are timed until the response headers arrive.
+func (m *Metrics) Transport(service string, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		start := time.Now()
+		inFlight := m.proxyInFlight.WithLabelValues(service)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		upstream := r.URL.Host
+		resp, err := next.RoundTrip(r)
+		if err != nil {
+			m.proxyErrors.WithLabelValues(service, upstream, errorReason(err)).Inc()
+			m.proxyDuration.WithLabelValues(service, upstream, "error").Observe(time.Since(start).Seconds())
+			return nil, err
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			m.proxyErrors.WithLabelValues(service, upstream, "server_error").Inc()
+		}
+		m.proxyDuration.WithLabelValues(service, upstream, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+		return resp, nil
+	})
+}
+
+//SessionStore wraps the store so that its operations are timed
+func (m *Metrics) SessionStore(store sessions.Store) sessions.Store {
+	return &sessionStore{Store: store, duration: m.sessionStoreDuration}
+}
+
+//SetTrieSize sets the function returning the size of the user search trie
+func (m *Metrics) SetTrieSize(size func() int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.trieSize = size
+}
+
+//AddUploadBytes counts the bytes of an uploaded file
+func (m *Metrics) AddUploadBytes(n int64) {
+	m.uploadBytes.Add(float64(n))
+}
+
+//errorReason returns the reason label of an error reaching a microservice
+func errorReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "unavailable"
+	}
+}
+
+//roundTripperFunc lets a function be used as an http.RoundTripper
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+//RoundTrip calls the function
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+//sessionStore is a sessions.Store whose operations are timed
+type sessionStore struct {
+	sessions.Store
+	duration *prometheus.HistogramVec
+}
+
+//Save saves the state and times it
+func (s *sessionStore) Save(sid sessions.SessionID, sessionState interface{}) error {
+	start := time.Now()
+	err := s.Store.Save(sid, sessionState)
+	s.observe("save", start, err)
+	return err
+}
+
+//Get gets the state and times it
+func (s *sessionStore) Get(sid sessions.SessionID, sessionState interface{}) error {
+	start := time.Now()
+	err := s.Store.Get(sid, sessionState)
+	s.observe("get", start, err)
+	return err
+}
+
+//Modify modifies the state and times it
+func (s *sessionStore) Modify(sid sessions.SessionID, sessionState interface{}, fn func() error) error {
+	start := time.Now()
+	err := s.Store.Modify(sid, sessionState, fn)
+	s.observe("modify", start, err)
+	return err
+}
+
+//Delete deletes the state and times it
+func (s *sessionStore) Delete(sid sessions.SessionID) error {
+	start := time.Now()
+	err := s.Store.Delete(sid)
+	s.observe("delete", start, err)
+	return err
+}
+
+//observe records how long the operation that started at `start` took
+func (s *sessionStore) observe(operation string, start time.Time, err error) {
+	result := "ok"
+	if err == sessions.ErrStateNotFound {
+		result = "not_found"
+	} else if err != nil {
+		result = "error"
+	}
+	s.duration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+//recorder is a ResponseWriter that remembers the status code
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+//WriteHeader records the status code and writes it
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+//Write marks the header as written
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+//Unwrap returns the original ResponseWriter, so that
+//http.ResponseController can flush it
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := New()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte("{}"))
+	})
+	handler := m.Middleware(mux, mux)
+
+	cases := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/v1/users/5c3b0f9e8d1a2b3c4d5e6f70"},
+		{"GET", "/v1/users/5c3b0f9e8d1a2b3c4d5e6f71"},
+		{"POST", "/v1/users/"},
+		{"GET", "/not/a/route"},
+		{"BREW", "/v1/users/"},
+	}
+	for _, c := range cases {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil))
+	}
+
+	expected := []struct {
+		name   string
+		route  string
+		method string
+		status string
+		count  float64
+	}{
+		{"Paths Share A Route", "/v1/users/", "GET", "200", 2},
+		{"Status", "/v1/users/", "POST", "201", 1},
+		{"Unknown Path", "/", "GET", "200", 1},
+		{"Unknown Method", "/v1/users/", "OTHER", "200", 1},
+	}
+	for _, e := range expected {
+		if count := testutil.ToFloat64(m.requests.WithLabelValues(e.route, e.method, e.status)); count != e.count {
+			t.Errorf("case %s: expected %v requests but got %v", e.name, e.count, count)
+		}
+	}
+	if series := testutil.CollectAndCount(m.requestDuration); series != len(expected) {
+		t.Errorf("expected %d latency series but got %d", len(expected), series)
+	}
+	if inFlight := testutil.ToFloat64(m.inFlight); inFlight != 0 {
+		t.Errorf("expected no requests in flight but got %v", inFlight)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	m := New()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	//nothing listens on a closed listener's address
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	l.Close()
+	down := l.Addr().String()
+
+	client := &http.Client{Transport: m.Transport("qeeg", http.DefaultTransport)}
+	for _, target := range []string{upstream.URL + "/ok", upstream.URL + "/ok", upstream.URL + "/fail", "http://" + down + "/ok"} {
+		resp, err := client.Get(target)
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	cases := []struct {
+		name     string
+		upstream string
+		reason   string
+		expected float64
+	}{
+		{"Server Error", u.Host, "server_error", 1},
+		{"Unavailable", down, "unavailable", 1},
+		{"No Errors", u.Host, "unavailable", 0},
+	}
+	for _, c := range cases {
+		if count := testutil.ToFloat64(m.proxyErrors.WithLabelValues("qeeg", c.upstream, c.reason)); count != c.expected {
+			t.Errorf("case %s: expected %v errors but got %v", c.name, c.expected, count)
+		}
+	}
+	//200s and 503s from the upstream, and errors from the one that's down
+	if series := testutil.CollectAndCount(m.proxyDuration); series != 3 {
+		t.Errorf("expected 3 latency series but got %d", series)
+	}
+	if inFlight := testutil.ToFloat64(m.proxyInFlight.WithLabelValues("qeeg")); inFlight != 0 {
+		t.Errorf("expected no requests in flight but got %v", inFlight)
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	m := New()
+	store := m.SessionStore(sessions.NewMemStore(time.Hour, time.Minute))
+	sid := sessions.SessionID("abc")
+
+	if err := store.Save(sid, "state"); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+	state := ""
+	if err := store.Get(sid, &state); err != nil || state != "state" {
+		t.Fatalf("expected the saved state but got %q, %v", state, err)
+	}
+	if err := store.Delete(sid); err != nil {
+		t.Fatalf("error deleting state: %v", err)
+	}
+	if err := store.Get(sid, &state); err != sessions.ErrStateNotFound {
+		t.Fatalf("expected ErrStateNotFound but got %v", err)
+	}
+
+	//save, get, delete and get of a missing state
+	if series := testutil.CollectAndCount(m.sessionStoreDuration); series != 4 {
+		t.Errorf("expected 4 latency series but got %d", series)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.SetTrieSize(func() int { return 42 })
+	m.AddUploadBytes(1000)
+	m.AddUploadBytes(24)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, expected := range []string{
+		"gateway_trie_entries 42",
+		"gateway_upload_bytes_total 1024",
+		"gateway_http_requests_in_flight 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in the metrics but got:\n%s", expected, body)
+		}
+	}
+}
@@ -1,8 +1,11 @@
 package users
 
 import (
-	"encoding/json"
-	"strings"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/synapse-api/servers/gateway/indexes"
@@ -15,6 +18,7 @@ import (
 //Production systems should use a shared server store like redis
 type MemStore struct {
 	entries *cache.Cache
+	mx      sync.Mutex
 }
 
 //NewMemStore constructs and returns a new MemStore
@@ -25,25 +29,25 @@ func NewMemStore(sessionDuration time.Duration, purgeInterval time.Duration) *Me
 }
 
 //GetByID returns the User with the given ID
-func (ms *MemStore) GetByID(id bson.ObjectId) (*User, error) {
+func (ms *MemStore) GetByID(ctx context.Context, id bson.ObjectId) (*User, error) {
 	user := &User{}
 	j, found := ms.entries.Get(string(id))
 	if !found {
 		return nil, ErrUserNotFound
 	}
 
-	if err := json.Unmarshal(j.([]byte), user); err != nil {
+	if err := decodeUser(j.([]byte), user); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
 //GetByEmail returns the User with the given email
-func (ms *MemStore) GetByEmail(email string) (*User, error) {
-	user := &User{}
+func (ms *MemStore) GetByEmail(ctx context.Context, email string) (*User, error) {
 	m := ms.entries.Items()
 	for _, v := range m {
-		if err := json.Unmarshal((v.Object).([]byte), user); err != nil {
+		user := &User{}
+		if err := decodeUser((v.Object).([]byte), user); err != nil {
 			return nil, err
 		}
 		if user.Email == email {
@@ -54,11 +58,11 @@ func (ms *MemStore) GetByEmail(email string) (*User, error) {
 }
 
 //GetByUserName returns the User with the given Username
-func (ms *MemStore) GetByUserName(username string) (*User, error) {
-	user := &User{}
+func (ms *MemStore) GetByUserName(ctx context.Context, username string) (*User, error) {
 	m := ms.entries.Items()
 	for _, v := range m {
-		if err := json.Unmarshal((v.Object).([]byte), user); err != nil {
+		user := &User{}
+		if err := decodeUser((v.Object).([]byte), user); err != nil {
 			return nil, err
 		}
 		if user.UserName == username {
@@ -68,14 +72,38 @@ func (ms *MemStore) GetByUserName(username string) (*User, error) {
 	return nil, ErrUserNotFound
 }
 
+//GetBySSO returns the User linked to the identity at a single sign-on provider
+func (ms *MemStore) GetBySSO(ctx context.Context, issuer string, subject string) (*User, error) {
+	m := ms.entries.Items()
+	for _, v := range m {
+		user := &User{}
+		if err := decodeUser((v.Object).([]byte), user); err != nil {
+			return nil, err
+		}
+		if user.SSO != nil && user.SSO.Issuer == issuer && user.SSO.Subject == subject {
+			return user, nil
+		}
+	}
+	return nil, ErrUserNotFound
+}
+
 //Insert converts the NewUser to a User, inserts
 //it into the database, and returns it
-func (ms *MemStore) Insert(newUser *NewUser) (*User, error) {
+func (ms *MemStore) Insert(ctx context.Context, newUser *NewUser) (*User, error) {
+	if err := newUser.Validate(); err != nil {
+		return nil, err
+	}
 	user, err := newUser.ToUser()
 	if err != nil {
 		return nil, err
 	}
-	j, err := json.Marshal(user)
+
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	if err := ms.checkUnique(ctx, user); err != nil {
+		return nil, err
+	}
+	j, err := encodeUser(user)
 	if nil != err {
 		return nil, err
 	}
@@ -84,16 +112,146 @@ func (ms *MemStore) Insert(newUser *NewUser) (*User, error) {
 }
 
 //Update applies UserUpdates to the given user ID
-func (ms *MemStore) Update(userID bson.ObjectId, updates *Updates) error {
-	user, err := ms.GetByID(userID)
+func (ms *MemStore) Update(ctx context.Context, userID bson.ObjectId, updates *Updates) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		return user.ApplyUpdates(updates)
+	})
+}
+
+//UpdateTOTP replaces the two-factor settings of the given user ID
+func (ms *MemStore) UpdateTOTP(ctx context.Context, userID bson.ObjectId, totp *TOTP) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.TOTP = totp
+		return nil
+	})
+}
+
+//UseSecondFactor marks the two-factor code as used, unless it already was
+func (ms *MemStore) UseSecondFactor(ctx context.Context, userID bson.ObjectId, factor *SecondFactor) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		return user.TOTP.use(factor)
+	})
+}
+
+//SetToken stores a one-time token for the purpose
+func (ms *MemStore) SetToken(ctx context.Context, userID bson.ObjectId, purpose string, token *OneTimeToken) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		if token == nil {
+			delete(user.Tokens, purpose)
+			return nil
+		}
+		if user.Tokens == nil {
+			user.Tokens = map[string]*OneTimeToken{}
+		}
+		user.Tokens[purpose] = token
+		return nil
+	})
+}
+
+//UseToken checks the one-time token for the purpose and removes it
+func (ms *MemStore) UseToken(ctx context.Context, userID bson.ObjectId, purpose string, token string) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		if err := user.Tokens[purpose].Check(token, time.Now()); err != nil {
+			return err
+		}
+		delete(user.Tokens, purpose)
+		return nil
+	})
+}
+
+//SetPassHash replaces the password hash of the given user ID
+func (ms *MemStore) SetPassHash(ctx context.Context, userID bson.ObjectId, passHash []byte) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.PassHash = passHash
+		return nil
+	})
+}
+
+//SetEmail changes the email address of the given user ID, and marks it unverified
+func (ms *MemStore) SetEmail(ctx context.Context, userID bson.ObjectId, email string) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		if other, err := ms.GetByEmail(ctx, email); err == nil && other.ID != userID {
+			return ErrEmailTaken
+		} else if err != nil && err != ErrUserNotFound {
+			return err
+		}
+		user.Email = email
+		user.EmailVerified = false
+		return nil
+	})
+}
+
+//SetEmailVerified sets whether the email address of the given user ID is verified
+func (ms *MemStore) SetEmailVerified(ctx context.Context, userID bson.ObjectId, verified bool) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.EmailVerified = verified
+		return nil
+	})
+}
+
+//SetRole changes the role of the given user ID
+func (ms *MemStore) SetRole(ctx context.Context, userID bson.ObjectId, role string) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+//SetDisabled sets whether the account of the given user ID is disabled
+func (ms *MemStore) SetDisabled(ctx context.Context, userID bson.ObjectId, disabled bool) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.Disabled = disabled
+		return nil
+	})
+}
+
+//SetSSO links the given user ID to an identity at a single sign-on provider
+func (ms *MemStore) SetSSO(ctx context.Context, userID bson.ObjectId, identity *SSOIdentity) error {
+	return ms.modify(ctx, userID, func(user *User) error {
+		user.SSO = identity
+		return nil
+	})
+}
+
+//List returns up to `limit` users ordered by ID, skipping the first `offset`
+func (ms *MemStore) List(ctx context.Context, offset int, limit int) ([]*User, error) {
+	users := []*User{}
+	for _, v := range ms.entries.Items() {
+		user := &User{}
+		if err := decodeUser((v.Object).([]byte), user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+
+	if offset >= len(users) {
+		return []*User{}, nil
+	}
+	users = users[offset:]
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+//modify gets the user, applies `fn` and saves the user unless `fn`
+//returns an error. The user is locked while `fn` runs.
+func (ms *MemStore) modify(ctx context.Context, userID bson.ObjectId, fn func(user *User) error) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	user, err := ms.GetByID(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if err := user.ApplyUpdates(updates); err != nil {
+	if err := fn(user); err != nil {
 		return err
 	}
 
-	j, err := json.Marshal(user)
+	j, err := encodeUser(user)
 	if nil != err {
 		return err
 	}
@@ -102,41 +260,81 @@ func (ms *MemStore) Update(userID bson.ObjectId, updates *Updates) error {
 }
 
 //Delete deletes the user with the given ID
-func (ms *MemStore) Delete(userID bson.ObjectId) error {
+func (ms *MemStore) Delete(ctx context.Context, userID bson.ObjectId) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	if _, found := ms.entries.Get(string(userID)); !found {
+		return ErrUserNotFound
+	}
 	ms.entries.Delete(string(userID))
 	return nil
 }
 
-//GetByIDSlice returns Users with the given IDs from a slice {
-func (ms *MemStore) GetByIDSlice(ids []bson.ObjectId) []*User {
+//checkUnique returns an error if another user has the email address
+//or user name of `user`. The caller must hold the lock.
+func (ms *MemStore) checkUnique(ctx context.Context, user *User) error {
+	if other, err := ms.GetByEmail(ctx, user.Email); err == nil && other.ID != user.ID {
+		return ErrEmailTaken
+	} else if err != nil && err != ErrUserNotFound {
+		return err
+	}
+	if other, err := ms.GetByUserName(ctx, user.UserName); err == nil && other.ID != user.ID {
+		return ErrUserNameTaken
+	} else if err != nil && err != ErrUserNotFound {
+		return err
+	}
+	return nil
+}
+
+//GetByIDSlice returns Users with the given IDs, in the same order
+func (ms *MemStore) GetByIDSlice(ctx context.Context, ids []bson.ObjectId) ([]*User, error) {
 	users := []*User{}
 	for _, id := range ids {
-		user, err := ms.GetByID(id)
-		if err == nil {
-			users = append(users, user)
+		user, err := ms.GetByID(ctx, id)
+		if err == ErrUserNotFound {
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
 	}
-	return users
+	return users, nil
+}
+
+//Ping does nothing, since the store is in memory
+func (ms *MemStore) Ping(ctx context.Context) error {
+	return nil
 }
 
 //GetAll adds all users to a trie
-func (ms *MemStore) GetAll(tr *indexes.Trie) error {
+func (ms *MemStore) GetAll(ctx context.Context, tr *indexes.Trie[bson.ObjectId]) error {
 	m := ms.entries.Items()
 	for _, v := range m {
 		user := &User{}
-		if err := json.Unmarshal((v.Object).([]byte), user); err != nil {
+		if err := decodeUser((v.Object).([]byte), user); err != nil {
 			return err
 		}
 
-		em := strings.ToLower(user.Email)
-		un := strings.ToLower(user.UserName)
-		fn := strings.ToLower(user.FirstName)
-		ln := strings.ToLower(user.LastName)
-
-		tr.Add(em, user.ID)
-		tr.Add(un, user.ID)
-		tr.Add(fn, user.ID)
-		tr.Add(ln, user.ID)
+		tr.Add(user.Email, user.ID)
+		tr.Add(user.UserName, user.ID)
+		tr.Add(user.FirstName, user.ID)
+		tr.Add(user.LastName, user.ID)
 	}
 	return nil
 }
+
+//encodeUser encodes the user with gob rather than JSON,
+//so that fields never sent to clients are kept too
+func encodeUser(user *User) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(user); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//decodeUser decodes a user encoded by encodeUser
+func decodeUser(j []byte, user *User) error {
+	return gob.NewDecoder(bytes.NewReader(j)).Decode(user)
+}
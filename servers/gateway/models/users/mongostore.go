@@ -1,130 +1,368 @@
 package users
 
 import (
-	"strings"
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
 
 	"github.com/synapse-api/servers/gateway/indexes"
-	"gopkg.in/mgo.v2"
+	mongobson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+	"go.mongodb.org/mongo-driver/bson/bsonrw"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"gopkg.in/mgo.v2/bson"
 )
 
 //MongoStore implements Store for MongoDB
 type MongoStore struct {
-	session *mgo.Session
-	dbname  string
-	colname string
+	col *mongo.Collection
 }
 
 //NewMongoStore constructs a new MongoStore
-func NewMongoStore(sess *mgo.Session, dbName string, collectionName string) *MongoStore {
-	if sess == nil {
-		panic("nil pointer passed for session")
+func NewMongoStore(client *mongo.Client, dbName string, collectionName string) *MongoStore {
+	if client == nil {
+		panic("nil pointer passed for client")
 	}
 	return &MongoStore{
-		session: sess,
-		dbname:  dbName,
-		colname: collectionName,
+		col: client.Database(dbName).Collection(collectionName,
+			options.Collection().SetRegistry(mongoRegistry)),
 	}
 }
 
-//GetByID returns the User with the given ID
-func (s *MongoStore) GetByID(id bson.ObjectId) (*User, error) {
-	user := &User{}
-	col := s.session.DB(s.dbname).C(s.colname)
-	err := col.FindId(id).One(user)
+//mongoRegistry encodes the bson.ObjectId IDs used throughout the
+//gateway as MongoDB ObjectIDs, so that documents written by earlier
+//versions of the store, which used mgo, are read back unchanged
+var mongoRegistry = newMongoRegistry()
+
+//newMongoRegistry returns the default registry with codecs for bson.ObjectId
+func newMongoRegistry() *bsoncodec.Registry {
+	reg := mongobson.NewRegistry()
+	idType := reflect.TypeOf(bson.ObjectId(""))
+	reg.RegisterTypeEncoder(idType, bsoncodec.ValueEncoderFunc(
+		func(_ bsoncodec.EncodeContext, vw bsonrw.ValueWriter, val reflect.Value) error {
+			id := bson.ObjectId(val.String())
+			if !id.Valid() {
+				return fmt.Errorf("invalid ObjectId %q", val.String())
+			}
+			var oid primitive.ObjectID
+			copy(oid[:], id)
+			return vw.WriteObjectID(oid)
+		}))
+	reg.RegisterTypeDecoder(idType, bsoncodec.ValueDecoderFunc(
+		func(_ bsoncodec.DecodeContext, vr bsonrw.ValueReader, val reflect.Value) error {
+			oid, err := vr.ReadObjectID()
+			if err != nil {
+				return err
+			}
+			val.SetString(string(oid[:]))
+			return nil
+		}))
+	return reg
+}
+
+//names of the unique indexes created by EnsureIndexes
+const (
+	emailIndex    = "email_1"
+	userNameIndex = "username_1"
+)
+
+//dupIndexPattern matches the name of the index in a duplicate key error message
+var dupIndexPattern = regexp.MustCompile(`index: (\S+)`)
+
+//EnsureIndexes creates the unique indexes on email addresses and
+//user names, which Insert and SetEmail rely on, and the index used
+//by GetBySSO. It should be called once at startup.
+func (s *MongoStore) EnsureIndexes(ctx context.Context) error {
+	_, err := s.col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: mongobson.D{{Key: "email", Value: 1}}, Options: options.Index().SetName(emailIndex).SetUnique(true)},
+		{Keys: mongobson.D{{Key: "username", Value: 1}}, Options: options.Index().SetName(userNameIndex).SetUnique(true)},
+		{Keys: mongobson.D{{Key: "sso.issuer", Value: 1}, {Key: "sso.subject", Value: 1}}, Options: options.Index().SetSparse(true)},
+	})
 	if err != nil {
-		return nil, ErrUserNotFound
+		return fmt.Errorf("error creating indexes: %v", err)
 	}
+	return nil
+}
 
-	return user, nil
+//GetByID returns the User with the given ID
+func (s *MongoStore) GetByID(ctx context.Context, id bson.ObjectId) (*User, error) {
+	return s.findOne(ctx, mongobson.M{"_id": id})
 }
 
 //GetByEmail returns the User with the given email
-func (s *MongoStore) GetByEmail(email string) (*User, error) {
-	user := &User{}
-	col := s.session.DB(s.dbname).C(s.colname)
-	err := col.Find(bson.M{"email": email}).Limit(1).One(user)
-	if err != nil {
-		return nil, ErrUserNotFound
-	}
-	return user, nil
+func (s *MongoStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.findOne(ctx, mongobson.M{"email": email})
 }
 
 //GetByUserName returns the User with the given Username
-func (s *MongoStore) GetByUserName(username string) (*User, error) {
+func (s *MongoStore) GetByUserName(ctx context.Context, username string) (*User, error) {
+	return s.findOne(ctx, mongobson.M{"username": username})
+}
+
+//GetBySSO returns the User linked to the identity at a single sign-on provider
+func (s *MongoStore) GetBySSO(ctx context.Context, issuer string, subject string) (*User, error) {
+	return s.findOne(ctx, mongobson.M{"sso.issuer": issuer, "sso.subject": subject})
+}
+
+//findOne returns the User matching the filter
+func (s *MongoStore) findOne(ctx context.Context, filter mongobson.M) (*User, error) {
 	user := &User{}
-	col := s.session.DB(s.dbname).C(s.colname)
-	err := col.Find(bson.M{"username": username}).Limit(1).One(user)
-	if err != nil {
+	if err := s.col.FindOne(ctx, filter).Decode(user); err == mongo.ErrNoDocuments {
 		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("error getting user: %v", err)
 	}
 	return user, nil
 }
 
-//Insert converts the NewUser to a User, inserts
-//it into the database, and returns it
-func (s *MongoStore) Insert(newUser *NewUser) (*User, error) {
+//Insert validates the NewUser, converts it to a User,
+//inserts it into the database, and returns it
+func (s *MongoStore) Insert(ctx context.Context, newUser *NewUser) (*User, error) {
+	if err := newUser.Validate(); err != nil {
+		return nil, err
+	}
 	user, err := newUser.ToUser()
 	if err != nil {
 		return nil, err
 	}
-	col := s.session.DB(s.dbname).C(s.colname)
-	if err := col.Insert(user); err != nil {
-		return nil, err
+	if _, err := s.col.InsertOne(ctx, user); err != nil {
+		if err := dupError(err); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error inserting user: %v", err)
 	}
-
 	return user, nil
 }
 
-//Update applies UserUpdates to the given user ID
-func (s *MongoStore) Update(userID bson.ObjectId, updates *Updates) error {
-	change := mgo.Change{
-		Update:    bson.M{"$set": updates}, // $ tells to patch instead of replacing
-		ReturnNew: true,                    // returns the old version if not set to true
+//Update validates and applies UserUpdates to the given user ID
+func (s *MongoStore) Update(ctx context.Context, userID bson.ObjectId, updates *Updates) error {
+	if err := (&User{}).ApplyUpdates(updates); err != nil {
+		return err
 	}
-	user := &User{}
-	col := s.session.DB(s.dbname).C(s.colname)
-	if _, err := col.FindId(userID).Apply(change, user); err != nil {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{
+		"firstname": updates.FirstName,
+		"lastname":  updates.LastName,
+	}})
+}
+
+//UpdateTOTP replaces the two-factor settings of the given user ID
+func (s *MongoStore) UpdateTOTP(ctx context.Context, userID bson.ObjectId, totp *TOTP) error {
+	update := mongobson.M{"$set": mongobson.M{"totp": totp}}
+	if totp == nil {
+		update = mongobson.M{"$unset": mongobson.M{"totp": ""}}
+	}
+	return s.updateID(ctx, userID, update)
+}
+
+//UseSecondFactor marks the two-factor code as used, unless it already was.
+//The check and the change happen in a single update, so that
+//concurrent requests can't use the same code twice.
+func (s *MongoStore) UseSecondFactor(ctx context.Context, userID bson.ObjectId, factor *SecondFactor) error {
+	filter := mongobson.M{"_id": userID, "totp.enabled": true}
+	update := mongobson.M{"$set": mongobson.M{"totp.lastStep": factor.Step}}
+	if len(factor.RecoveryCode) > 0 {
+		filter["totp.recoveryCodes"] = factor.RecoveryCode
+		update = mongobson.M{"$pull": mongobson.M{"totp.recoveryCodes": factor.RecoveryCode}}
+	} else {
+		filter["totp.lastStep"] = mongobson.M{"$lt": factor.Step}
+	}
+	res, err := s.col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("error using two-factor code: %v", err)
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	//tell a used code from a missing user
+	if _, err := s.GetByID(ctx, userID); err != nil {
 		return err
 	}
-	return nil
+	return ErrInvalidCode
 }
 
-//Delete deletes the user with the given ID
-func (s *MongoStore) Delete(userID bson.ObjectId) error {
-	col := s.session.DB(s.dbname).C(s.colname)
-	return col.RemoveId(userID)
+//SetToken stores a one-time token for the purpose
+func (s *MongoStore) SetToken(ctx context.Context, userID bson.ObjectId, purpose string, token *OneTimeToken) error {
+	update := mongobson.M{"$set": mongobson.M{"tokens." + purpose: token}}
+	if token == nil {
+		update = mongobson.M{"$unset": mongobson.M{"tokens." + purpose: ""}}
+	}
+	return s.updateID(ctx, userID, update)
+}
+
+//UseToken checks the one-time token for the purpose and removes it.
+//The check and removal happen in a single update, so that
+//concurrent requests can't use the same token twice.
+func (s *MongoStore) UseToken(ctx context.Context, userID bson.ObjectId, purpose string, token string) error {
+	key := "tokens." + purpose
+	res, err := s.col.UpdateOne(ctx, mongobson.M{
+		"_id":            userID,
+		key + ".hash":    HashToken(token),
+		key + ".expires": mongobson.M{"$gt": time.Now()},
+	}, mongobson.M{"$unset": mongobson.M{key: ""}})
+	if err != nil {
+		return fmt.Errorf("error using token: %v", err)
+	}
+	if res.MatchedCount == 1 {
+		return nil
+	}
+
+	//tell a wrong token from a missing user
+	if _, err := s.GetByID(ctx, userID); err != nil {
+		return err
+	}
+	return ErrInvalidToken
 }
 
-//GetByIDSlice returns Users with the given IDs from a slice {
-func (s *MongoStore) GetByIDSlice(ids []bson.ObjectId) []*User {
+//SetPassHash replaces the password hash of the given user ID
+func (s *MongoStore) SetPassHash(ctx context.Context, userID bson.ObjectId, passHash []byte) error {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{"passhash": passHash}})
+}
+
+//SetEmail changes the email address of the given user ID, and marks it unverified
+func (s *MongoStore) SetEmail(ctx context.Context, userID bson.ObjectId, email string) error {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{"email": email, "emailverified": false}})
+}
+
+//SetEmailVerified sets whether the email address of the given user ID is verified
+func (s *MongoStore) SetEmailVerified(ctx context.Context, userID bson.ObjectId, verified bool) error {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{"emailverified": verified}})
+}
+
+//SetRole changes the role of the given user ID
+func (s *MongoStore) SetRole(ctx context.Context, userID bson.ObjectId, role string) error {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{"role": role}})
+}
+
+//SetDisabled sets whether the account of the given user ID is disabled
+func (s *MongoStore) SetDisabled(ctx context.Context, userID bson.ObjectId, disabled bool) error {
+	return s.updateID(ctx, userID, mongobson.M{"$set": mongobson.M{"disabled": disabled}})
+}
+
+//SetSSO links the given user ID to an identity at a single sign-on provider
+func (s *MongoStore) SetSSO(ctx context.Context, userID bson.ObjectId, identity *SSOIdentity) error {
+	update := mongobson.M{"$set": mongobson.M{"sso": identity}}
+	if identity == nil {
+		update = mongobson.M{"$unset": mongobson.M{"sso": ""}}
+	}
+	return s.updateID(ctx, userID, update)
+}
+
+//List returns up to `limit` users ordered by ID, skipping the first `offset`
+func (s *MongoStore) List(ctx context.Context, offset int, limit int) ([]*User, error) {
+	opts := options.Find().
+		SetSort(mongobson.D{{Key: "_id", Value: 1}}).
+		SetSkip(int64(offset)).
+		SetLimit(int64(limit))
+	return s.find(ctx, mongobson.M{}, opts)
+}
+
+//find returns all Users matching the filter
+func (s *MongoStore) find(ctx context.Context, filter mongobson.M, opts ...*options.FindOptions) ([]*User, error) {
+	cur, err := s.col.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding users: %v", err)
+	}
 	users := []*User{}
-	for _, id := range ids {
-		user, err := s.GetByID(id)
-		if err == nil {
-			users = append(users, user)
+	if err := cur.All(ctx, &users); err != nil {
+		return nil, fmt.Errorf("error decoding users: %v", err)
+	}
+	return users, nil
+}
+
+//updateID applies the update to the user with the given ID
+func (s *MongoStore) updateID(ctx context.Context, userID bson.ObjectId, update mongobson.M) error {
+	res, err := s.col.UpdateOne(ctx, mongobson.M{"_id": userID}, update)
+	if err != nil {
+		if err := dupError(err); err != nil {
+			return err
 		}
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrUserNotFound
 	}
-	return users
+	return nil
 }
 
-//GetAll adds all users to a trie
-func (s *MongoStore) GetAll(tr *indexes.Trie) error {
-	users := []*User{}
-	col := s.session.DB(s.dbname).C(s.colname)
-	if err := col.Find(nil).All(&users); err != nil {
-		return err
+//dupError converts duplicate key errors from the unique indexes to
+//ErrEmailTaken or ErrUserNameTaken, and returns nil for other errors.
+//The index is told by its name, since the message also quotes the
+//duplicate value, which could contain the other index's field name.
+func dupError(err error) error {
+	we, ok := err.(mongo.WriteException)
+	if !ok {
+		return nil
 	}
-	for _, user := range users {
-		em := strings.ToLower(user.Email)
-		un := strings.ToLower(user.UserName)
-		fn := strings.ToLower(user.FirstName)
-		ln := strings.ToLower(user.LastName)
+	for _, e := range we.WriteErrors {
+		if !e.HasErrorCode(11000) {
+			continue
+		}
+		match := dupIndexPattern.FindStringSubmatch(e.Message)
+		if match == nil {
+			continue
+		}
+		switch match[1] {
+		case emailIndex:
+			return ErrEmailTaken
+		case userNameIndex:
+			return ErrUserNameTaken
+		}
+	}
+	return nil
+}
 
-		tr.Add(em, user.ID)
-		tr.Add(un, user.ID)
-		tr.Add(fn, user.ID)
-		tr.Add(ln, user.ID)
+//Delete deletes the user with the given ID
+func (s *MongoStore) Delete(ctx context.Context, userID bson.ObjectId) error {
+	res, err := s.col.DeleteOne(ctx, mongobson.M{"_id": userID})
+	if err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrUserNotFound
 	}
 	return nil
 }
+
+//GetByIDSlice returns Users with the given IDs, in the same order,
+//skipping IDs that aren't found. They are fetched in a single query.
+func (s *MongoStore) GetByIDSlice(ctx context.Context, ids []bson.ObjectId) ([]*User, error) {
+	if len(ids) == 0 {
+		return []*User{}, nil
+	}
+	found, err := s.find(ctx, mongobson.M{"_id": mongobson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	return orderByIDs(found, ids), nil
+}
+
+//Ping checks that the MongoDB server can be reached
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.col.Database().Client().Ping(ctx, nil)
+}
+
+//GetAll adds all users to a trie
+func (s *MongoStore) GetAll(ctx context.Context, tr *indexes.Trie[bson.ObjectId]) error {
+	opts := options.Find().SetProjection(mongobson.M{"email": 1, "username": 1, "firstname": 1, "lastname": 1})
+	cur, err := s.col.Find(ctx, mongobson.M{}, opts)
+	if err != nil {
+		return fmt.Errorf("error finding users: %v", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		user := &User{}
+		if err := cur.Decode(user); err != nil {
+			return fmt.Errorf("error decoding user: %v", err)
+		}
+		tr.Add(user.Email, user.ID)
+		tr.Add(user.UserName, user.ID)
+		tr.Add(user.FirstName, user.ID)
+		tr.Add(user.LastName, user.ID)
+	}
+	return cur.Err()
+}
@@ -0,0 +1,58 @@
+package users
+
+import (
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestDupError(t *testing.T) {
+	cases := []struct {
+		name        string
+		err         error
+		expectedErr error
+	}{
+		{
+			"Email Taken",
+			mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000,
+				Message: `E11000 duplicate key error collection: users.users index: email_1 dup key: { email: "fred@uw.edu" }`}}},
+			ErrEmailTaken,
+		},
+		{
+			"User Name Taken",
+			mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000,
+				Message: `E11000 duplicate key error collection: users.users index: username_1 dup key: { username: "fred" }`}}},
+			ErrUserNameTaken,
+		},
+		{
+			"Email Containing Username",
+			mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000,
+				Message: `E11000 duplicate key error collection: users.users index: email_1 dup key: { email: "username@uw.edu" }`}}},
+			ErrEmailTaken,
+		},
+		{
+			"Other Index",
+			mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000,
+				Message: `E11000 duplicate key error collection: users.users index: _id_ dup key: { _id: "email" }`}}},
+			nil,
+		},
+		{
+			"Other Write Error",
+			mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121,
+				Message: "Document failed validation"}}},
+			nil,
+		},
+		{
+			"Other Error",
+			errors.New("index: email_1"),
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		if err := dupError(c.err); err != c.expectedErr {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expectedErr, err)
+		}
+	}
+}
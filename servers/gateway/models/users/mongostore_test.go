@@ -1,90 +1,69 @@
-package users
+package users_test
 
 import (
+	"context"
 	"testing"
+	"time"
 
-	"gopkg.in/mgo.v2"
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/models/users/storetest"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
 )
 
-/*
-TestMemStore tests the MemStore object
-
-Since a Store is like a database, you can't really test methods like Get()
-or Delete() without also calling (and therefore testing) methods like Save(),
-so instead of testing individual methods in isolation, this test runs through
-a full CRUD cycle, ensuring the correct behavior occurs at each point in that
-cycle. You should use a similar approach when testing your RedisStore implementation.
-*/
+//TestMongoStore tests the MongoStore object against a local MongoDB server
 func TestMongoStore(t *testing.T) {
-
-	nu := NewUser{
-		Email:        "foobar@uw.edu",
-		Password:     "123456",
-		PasswordConf: "123456",
-		UserName:     "foobar",
-		FirstName:    "Frederick",
-		LastName:     "Wijaya",
-	}
-
-	upd := &Updates{
-		FirstName: "Fred",
-		LastName:  "Harrison",
-	}
-
-	session, err := mgo.Dial("127.0.0.1")
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:27017"))
 	if err != nil {
 		t.Fatalf("error connecting to mongo: %v", err)
 	}
-
-	store := NewMongoStore(session, "mgo", "content")
-
-	if _, err := store.GetByEmail(nu.Email); err != ErrUserNotFound {
-		t.Errorf("incorrect error when getting user that was never stored: expected %v but got %v", ErrUserNotFound, err)
-	}
-
-	if _, err := store.GetByUserName(nu.UserName); err != ErrUserNotFound {
-		t.Errorf("incorrect error when getting user that was never stored: expected %v but got %v", ErrUserNotFound, err)
-	}
-
-	user, err := store.Insert(&nu)
-	if err != nil {
-		t.Fatalf("error inserting user: %v", err)
+	defer client.Disconnect(ctx)
+	if err := client.Ping(ctx, nil); err != nil {
+		t.Fatalf("error connecting to mongo: %v", err)
 	}
 
-	if err := store.Update(user.ID, upd); err != nil {
-		t.Fatalf("error updating user: %v", err)
-	}
+	storetest.Run(t, func() users.Store {
+		col := client.Database("mgo").Collection("content")
+		if err := col.Drop(ctx); err != nil {
+			t.Fatalf("error dropping collection: %v", err)
+		}
+		store := users.NewMongoStore(client, "mgo", "content")
+		if err := store.EnsureIndexes(ctx); err != nil {
+			t.Fatalf("error creating indexes: %v", err)
+		}
+		return store
+	})
+}
 
-	user2, err := store.GetByID(user.ID)
+//TestMongoStoreOutage tests that a MongoStore that can't reach its
+//server reports that, rather than that the user wasn't found
+func TestMongoStoreOutage(t *testing.T) {
+	ctx := context.Background()
+	//nothing listens on port 1
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(100*time.Millisecond))
 	if err != nil {
-		t.Fatalf("error getting user from ID: %v", err)
-	}
-
-	if _, err := store.GetByUserName(nu.UserName); err != nil {
-		t.Fatalf("error getting user from UserName: %v", err)
-	}
-
-	if _, err := store.GetByEmail(nu.Email); err != nil {
-		t.Fatalf("error getting user from Email:: %v", err)
-	}
-
-	if user2.FirstName != upd.FirstName || user2.LastName != upd.LastName {
-		t.Errorf("error in updated name: expected %s but got %s", user.FullName(), user2.FullName())
-	}
-
-	if err := store.Delete(user.ID); err != nil {
-		t.Errorf("error deleting state: %v", err)
+		t.Fatalf("error creating client: %v", err)
 	}
-
-	if _, err := store.GetByID(user.ID); err != ErrUserNotFound {
-		t.Fatalf("incorrect error when getting state that was deleted: expected %v but got %v", ErrUserNotFound, err)
+	defer client.Disconnect(ctx)
+	store := users.NewMongoStore(client, "mgo", "content")
+
+	cases := []struct {
+		name string
+		fn   func() error
+	}{
+		{"GetByID", func() error { _, err := store.GetByID(ctx, bson.NewObjectId()); return err }},
+		{"GetByEmail", func() error { _, err := store.GetByEmail(ctx, "fredhw@uw.edu"); return err }},
+		{"GetByIDSlice", func() error { _, err := store.GetByIDSlice(ctx, []bson.ObjectId{bson.NewObjectId()}); return err }},
+		{"SetRole", func() error { return store.SetRole(ctx, bson.NewObjectId(), users.RoleAdmin) }},
+		{"UseToken", func() error { return store.UseToken(ctx, bson.NewObjectId(), users.PurposePasswordReset, "token") }},
+		{"Delete", func() error { return store.Delete(ctx, bson.NewObjectId()) }},
 	}
-
-	if _, err := store.GetByEmail(nu.Email); err != ErrUserNotFound {
-		t.Errorf("incorrect error when getting user that was never stored: expected %v but got %v", ErrUserNotFound, err)
-	}
-
-	if _, err := store.GetByUserName(nu.UserName); err != ErrUserNotFound {
-		t.Errorf("incorrect error when getting user that was never stored: expected %v but got %v", ErrUserNotFound, err)
+	for _, c := range cases {
+		if err := c.fn(); err == nil || err == users.ErrUserNotFound || err == users.ErrInvalidToken {
+			t.Errorf("%s: expected a connection error but got %v", c.name, err)
+		}
 	}
 }
@@ -0,0 +1,91 @@
+package users
+
+import "fmt"
+
+//Permission is something a user may be allowed to do
+type Permission string
+
+//Permissions checked by the gateway
+const (
+	//PermReadFiles allows listing and downloading recordings and results
+	PermReadFiles Permission = "files:read"
+	//PermWriteFiles allows uploading and deleting recordings
+	PermWriteFiles Permission = "files:write"
+	//PermRunAnalysis allows running qEEG analyses
+	PermRunAnalysis Permission = "analysis:run"
+	//PermMessaging allows using channels and messages
+	PermMessaging Permission = "messages:use"
+	//PermSearchUsers allows searching for other users
+	PermSearchUsers Permission = "users:search"
+	//PermManageUsers allows listing users, changing their roles,
+	//disabling accounts and unlocking them
+	PermManageUsers Permission = "users:manage"
+	//PermViewAudit allows viewing and exporting the audit log
+	PermViewAudit Permission = "audit:read"
+	//PermViewMetrics allows reading the gateway's metrics
+	PermViewMetrics Permission = "metrics:read"
+)
+
+//Roles a user may have
+const (
+	RoleAdmin      = "admin"
+	RoleResearcher = "researcher"
+	RoleViewer     = "viewer"
+)
+
+//DefaultRole is the role of new users, and of users stored before roles existed
+const DefaultRole = RoleResearcher
+
+var viewerPermissions = []Permission{
+	PermReadFiles,
+	PermMessaging,
+	PermSearchUsers,
+}
+
+var researcherPermissions = append([]Permission{
+	PermWriteFiles,
+	PermRunAnalysis,
+}, viewerPermissions...)
+
+var adminPermissions = append([]Permission{
+	PermManageUsers,
+	PermViewAudit,
+	PermViewMetrics,
+}, researcherPermissions...)
+
+//rolePermissions maps each role to the permissions it grants
+var rolePermissions = map[string][]Permission{
+	RoleAdmin:      adminPermissions,
+	RoleResearcher: researcherPermissions,
+	RoleViewer:     viewerPermissions,
+}
+
+//ValidateRole returns an error if `role` isn't a known role
+func ValidateRole(role string) error {
+	if _, found := rolePermissions[role]; !found {
+		return fmt.Errorf("unknown role %q", role)
+	}
+	return nil
+}
+
+//EffectiveRole returns the user's role, or DefaultRole if none was stored
+func (u *User) EffectiveRole() string {
+	if len(u.Role) == 0 {
+		return DefaultRole
+	}
+	return u.Role
+}
+
+//Can reports whether the user has the permission.
+//Disabled users have no permissions.
+func (u *User) Can(perm Permission) bool {
+	if u.Disabled {
+		return false
+	}
+	for _, p := range rolePermissions[u.EffectiveRole()] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package users
+
+import "testing"
+
+func TestCan(t *testing.T) {
+	cases := []struct {
+		name     string
+		user     *User
+		perm     Permission
+		expected bool
+	}{
+		{"Admin Manages Users", &User{Role: RoleAdmin}, PermManageUsers, true},
+		{"Admin Uploads", &User{Role: RoleAdmin}, PermWriteFiles, true},
+		{"Researcher Uploads", &User{Role: RoleResearcher}, PermWriteFiles, true},
+		{"Researcher Can't Manage Users", &User{Role: RoleResearcher}, PermManageUsers, false},
+		{"Admin Reads Metrics", &User{Role: RoleAdmin}, PermViewMetrics, true},
+		{"Researcher Can't Read Metrics", &User{Role: RoleResearcher}, PermViewMetrics, false},
+		{"Viewer Reads", &User{Role: RoleViewer}, PermReadFiles, true},
+		{"Viewer Can't Upload", &User{Role: RoleViewer}, PermWriteFiles, false},
+		{"Viewer Can't Analyze", &User{Role: RoleViewer}, PermRunAnalysis, false},
+		{"No Role Is Default Role", &User{}, PermRunAnalysis, true},
+		{"Unknown Role", &User{Role: "superuser"}, PermReadFiles, false},
+		{"Disabled Admin", &User{Role: RoleAdmin, Disabled: true}, PermReadFiles, false},
+	}
+
+	for _, c := range cases {
+		if got := c.user.Can(c.perm); got != c.expected {
+			t.Errorf("case %s: expected Can(%s) to be %t but got %t", c.name, c.perm, c.expected, got)
+		}
+	}
+
+	if err := ValidateRole(RoleViewer); err != nil {
+		t.Errorf("unexpected error validating role: %v", err)
+	}
+	if err := ValidateRole("superuser"); err == nil {
+		t.Errorf("expected error validating unknown role")
+	}
+}
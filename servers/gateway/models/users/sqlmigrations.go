@@ -0,0 +1,81 @@
+package users
+
+import (
+	"fmt"
+	"strings"
+)
+
+//sqlMigrations are the schema changes of SQLStore, applied in order. Each is
+//applied once, and recorded in the schema_migrations table. Never change a
+//migration that was released; add a new one instead. {{blob}} is replaced
+//with the binary column type of the driver.
+var sqlMigrations = []string{
+	//1: users, with the fields that don't need their own columns stored as JSON
+	`CREATE TABLE users (
+		id             CHAR(24) PRIMARY KEY,
+		email          VARCHAR(320) NOT NULL,
+		pass_hash      {{blob}} NOT NULL,
+		user_name      VARCHAR(255) NOT NULL,
+		first_name     VARCHAR(255) NOT NULL DEFAULT '',
+		last_name      VARCHAR(255) NOT NULL DEFAULT '',
+		photo_url      VARCHAR(255) NOT NULL DEFAULT '',
+		totp           TEXT,
+		tokens         TEXT,
+		email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+		role           VARCHAR(32) NOT NULL DEFAULT '',
+		disabled       BOOLEAN NOT NULL DEFAULT FALSE,
+		sso_issuer     VARCHAR(255),
+		sso_subject    VARCHAR(255)
+	);
+	CREATE UNIQUE INDEX users_email ON users (email);
+	CREATE UNIQUE INDEX users_user_name ON users (user_name);
+	CREATE UNIQUE INDEX users_sso ON users (sso_issuer, sso_subject);`,
+}
+
+//migrate applies the migrations that haven't been applied yet
+func (s *SQLStore) migrate() error {
+	if _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)"); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+		return err
+	}
+
+	blob := "BLOB"
+	if s.driver == DriverPostgres {
+		blob = "BYTEA"
+	}
+	for i := current; i < len(sqlMigrations); i++ {
+		version := i + 1
+		if err := s.applyMigration(version, strings.Replace(sqlMigrations[i], "{{blob}}", blob, -1)); err != nil {
+			return fmt.Errorf("error applying migration %d: %v", version, err)
+		}
+	}
+	return nil
+}
+
+//applyMigration applies a migration and records its version in one transaction.
+//If another gateway applies the same migration at the same time, recording
+//the version fails for one of them, and its changes are rolled back.
+func (s *SQLStore) applyMigration(version int, migration string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(s.rebind("INSERT INTO schema_migrations (version) VALUES (?)"), version); err != nil {
+		return err
+	}
+	for _, stmt := range strings.Split(migration, ";") {
+		if len(strings.TrimSpace(stmt)) == 0 {
+			continue
+		}
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
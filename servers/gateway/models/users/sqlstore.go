@@ -0,0 +1,433 @@
+package users
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/indexes"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//SQL drivers supported by SQLStore
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite3"
+)
+
+//sqlUserColumns are the columns of the users table, in the order scanUser reads them
+const sqlUserColumns = "id, email, pass_hash, user_name, first_name, last_name, photo_url, " +
+	"totp, tokens, email_verified, role, disabled, sso_issuer, sso_subject"
+
+//SQLStore implements Store for SQL databases through database/sql.
+//PostgreSQL and SQLite are supported; the caller registers the driver.
+//Fields without a column of their own, like two-factor settings and
+//one-time tokens, are stored as JSON.
+type SQLStore struct {
+	db     *sql.DB
+	driver string
+}
+
+//NewSQLStore constructs a new SQLStore for a database opened with `driver`,
+//and brings its schema up to date
+func NewSQLStore(db *sql.DB, driver string) (*SQLStore, error) {
+	if db == nil {
+		panic("nil pointer passed for db")
+	}
+	if driver != DriverPostgres && driver != DriverSQLite {
+		return nil, fmt.Errorf("unsupported SQL driver %q", driver)
+	}
+	s := &SQLStore{
+		db:     db,
+		driver: driver,
+	}
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("error migrating database: %v", err)
+	}
+	return s, nil
+}
+
+//GetByID returns the User with the given ID
+func (s *SQLStore) GetByID(ctx context.Context, id bson.ObjectId) (*User, error) {
+	return s.getBy(ctx, "id", id.Hex())
+}
+
+//GetByEmail returns the User with the given email
+func (s *SQLStore) GetByEmail(ctx context.Context, email string) (*User, error) {
+	return s.getBy(ctx, "email", email)
+}
+
+//GetByUserName returns the User with the given Username
+func (s *SQLStore) GetByUserName(ctx context.Context, username string) (*User, error) {
+	return s.getBy(ctx, "user_name", username)
+}
+
+//GetBySSO returns the User linked to the identity at a single sign-on provider
+func (s *SQLStore) GetBySSO(ctx context.Context, issuer string, subject string) (*User, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+sqlUserColumns+" FROM users WHERE sso_issuer = ? AND sso_subject = ?"), issuer, subject)
+	return scanUser(row)
+}
+
+//getBy returns the User whose `column` equals `value`
+func (s *SQLStore) getBy(ctx context.Context, column string, value string) (*User, error) {
+	row := s.db.QueryRowContext(ctx, s.rebind("SELECT "+sqlUserColumns+" FROM users WHERE "+column+" = ?"), value)
+	return scanUser(row)
+}
+
+//Insert converts the NewUser to a User, inserts
+//it into the database, and returns it
+func (s *SQLStore) Insert(ctx context.Context, newUser *NewUser) (*User, error) {
+	if err := newUser.Validate(); err != nil {
+		return nil, err
+	}
+	user, err := newUser.ToUser()
+	if err != nil {
+		return nil, err
+	}
+	args, err := userArgs(user)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind("INSERT INTO users ("+sqlUserColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		args...)
+	if err := uniqueError(err); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+//Update applies UserUpdates to the given user ID
+func (s *SQLStore) Update(ctx context.Context, userID bson.ObjectId, updates *Updates) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		return user.ApplyUpdates(updates)
+	})
+}
+
+//UpdateTOTP replaces the two-factor settings of the given user ID
+func (s *SQLStore) UpdateTOTP(ctx context.Context, userID bson.ObjectId, totp *TOTP) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.TOTP = totp
+		return nil
+	})
+}
+
+//UseSecondFactor marks the two-factor code as used, unless it already was.
+//The check and the change happen in one transaction, so that
+//concurrent requests can't use the same code twice.
+func (s *SQLStore) UseSecondFactor(ctx context.Context, userID bson.ObjectId, factor *SecondFactor) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		return user.TOTP.use(factor)
+	})
+}
+
+//SetToken stores a one-time token for the purpose
+func (s *SQLStore) SetToken(ctx context.Context, userID bson.ObjectId, purpose string, token *OneTimeToken) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		if token == nil {
+			delete(user.Tokens, purpose)
+			return nil
+		}
+		if user.Tokens == nil {
+			user.Tokens = map[string]*OneTimeToken{}
+		}
+		user.Tokens[purpose] = token
+		return nil
+	})
+}
+
+//UseToken checks the one-time token for the purpose and removes it.
+//The check and removal happen in one transaction, so that
+//concurrent requests can't use the same token twice.
+func (s *SQLStore) UseToken(ctx context.Context, userID bson.ObjectId, purpose string, token string) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		if err := user.Tokens[purpose].Check(token, time.Now()); err != nil {
+			return err
+		}
+		delete(user.Tokens, purpose)
+		return nil
+	})
+}
+
+//SetPassHash replaces the password hash of the given user ID
+func (s *SQLStore) SetPassHash(ctx context.Context, userID bson.ObjectId, passHash []byte) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.PassHash = passHash
+		return nil
+	})
+}
+
+//SetEmail changes the email address of the given user ID, and marks it unverified
+func (s *SQLStore) SetEmail(ctx context.Context, userID bson.ObjectId, email string) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.Email = email
+		user.EmailVerified = false
+		return nil
+	})
+}
+
+//SetEmailVerified sets whether the email address of the given user ID is verified
+func (s *SQLStore) SetEmailVerified(ctx context.Context, userID bson.ObjectId, verified bool) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.EmailVerified = verified
+		return nil
+	})
+}
+
+//SetRole changes the role of the given user ID
+func (s *SQLStore) SetRole(ctx context.Context, userID bson.ObjectId, role string) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+//SetDisabled sets whether the account of the given user ID is disabled
+func (s *SQLStore) SetDisabled(ctx context.Context, userID bson.ObjectId, disabled bool) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.Disabled = disabled
+		return nil
+	})
+}
+
+//SetSSO links the given user ID to an identity at a single sign-on provider
+func (s *SQLStore) SetSSO(ctx context.Context, userID bson.ObjectId, identity *SSOIdentity) error {
+	return s.modify(ctx, userID, func(user *User) error {
+		user.SSO = identity
+		return nil
+	})
+}
+
+//List returns up to `limit` users ordered by ID, skipping the first `offset`
+func (s *SQLStore) List(ctx context.Context, offset int, limit int) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT "+sqlUserColumns+" FROM users ORDER BY id LIMIT ? OFFSET ?"), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+//modify gets the user, applies `fn` and saves the user unless `fn` returns
+//an error. This happens in a transaction, and on PostgreSQL the row is
+//locked until it commits. SQLite locks the whole database for writes.
+func (s *SQLStore) modify(ctx context.Context, userID bson.ObjectId, fn func(user *User) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT " + sqlUserColumns + " FROM users WHERE id = ?"
+	if s.driver == DriverPostgres {
+		query += " FOR UPDATE"
+	}
+	user, err := scanUser(tx.QueryRowContext(ctx, s.rebind(query), userID.Hex()))
+	if err != nil {
+		return err
+	}
+	if err := fn(user); err != nil {
+		return err
+	}
+
+	args, err := userArgs(user)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind("UPDATE users SET email = ?, pass_hash = ?, user_name = ?, first_name = ?, last_name = ?, "+
+		"photo_url = ?, totp = ?, tokens = ?, email_verified = ?, role = ?, disabled = ?, sso_issuer = ?, sso_subject = ? "+
+		"WHERE id = ?"), append(args[1:], args[0])...)
+	if err := uniqueError(err); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//Delete deletes the user with the given ID
+func (s *SQLStore) Delete(ctx context.Context, userID bson.ObjectId) error {
+	res, err := s.db.ExecContext(ctx, s.rebind("DELETE FROM users WHERE id = ?"), userID.Hex())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+//uniqueError converts violations of the unique indexes on email
+//addresses and user names to ErrEmailTaken or ErrUserNameTaken.
+//Neither driver has typed errors for this, so the message is checked:
+//both name the index or column that was violated.
+func uniqueError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if !strings.Contains(strings.ToLower(msg), "unique") {
+		return err
+	}
+	if strings.Contains(msg, "user_name") {
+		return ErrUserNameTaken
+	}
+	if strings.Contains(msg, "email") {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+//GetByIDSlice returns Users with the given IDs from a slice,
+//in the same order, skipping IDs that aren't found
+func (s *SQLStore) GetByIDSlice(ctx context.Context, ids []bson.ObjectId) ([]*User, error) {
+	if len(ids) == 0 {
+		return []*User{}, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id.Hex()
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	rows, err := s.db.QueryContext(ctx, s.rebind("SELECT "+sqlUserColumns+" FROM users WHERE id IN ("+placeholders+")"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := []*User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orderByIDs(found, ids), nil
+}
+
+//Ping checks that the database can be reached
+func (s *SQLStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+//GetAll adds all users to a trie
+func (s *SQLStore) GetAll(ctx context.Context, tr *indexes.Trie[bson.ObjectId]) error {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, email, user_name, first_name, last_name FROM users")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, em, un, fn, ln string
+		if err := rows.Scan(&id, &em, &un, &fn, &ln); err != nil {
+			return err
+		}
+		userID := bson.ObjectIdHex(id)
+		tr.Add(em, userID)
+		tr.Add(un, userID)
+		tr.Add(fn, userID)
+		tr.Add(ln, userID)
+	}
+	return rows.Err()
+}
+
+//rebind replaces the ? placeholders in the query with the driver's placeholders
+func (s *SQLStore) rebind(query string) string {
+	if s.driver != DriverPostgres {
+		return query
+	}
+	b := &strings.Builder{}
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+//scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//scanUser reads a user from a row of sqlUserColumns
+func scanUser(row scanner) (*User, error) {
+	user := &User{}
+	var id string
+	var totp, tokens, ssoIssuer, ssoSubject sql.NullString
+	err := row.Scan(&id, &user.Email, &user.PassHash, &user.UserName, &user.FirstName, &user.LastName, &user.PhotoURL,
+		&totp, &tokens, &user.EmailVerified, &user.Role, &user.Disabled, &ssoIssuer, &ssoSubject)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.ID = bson.ObjectIdHex(id)
+	if totp.Valid {
+		user.TOTP = &TOTP{}
+		if err := json.Unmarshal([]byte(totp.String), user.TOTP); err != nil {
+			return nil, err
+		}
+	}
+	if tokens.Valid {
+		if err := json.Unmarshal([]byte(tokens.String), &user.Tokens); err != nil {
+			return nil, err
+		}
+	}
+	if ssoIssuer.Valid && ssoSubject.Valid {
+		user.SSO = &SSOIdentity{
+			Issuer:  ssoIssuer.String,
+			Subject: ssoSubject.String,
+		}
+	}
+	return user, nil
+}
+
+//userArgs returns the values of sqlUserColumns for the user
+func userArgs(user *User) ([]interface{}, error) {
+	var totp, tokens, ssoIssuer, ssoSubject sql.NullString
+	if user.TOTP != nil {
+		j, err := json.Marshal(user.TOTP)
+		if err != nil {
+			return nil, err
+		}
+		totp = sql.NullString{String: string(j), Valid: true}
+	}
+	if len(user.Tokens) > 0 {
+		j, err := json.Marshal(user.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		tokens = sql.NullString{String: string(j), Valid: true}
+	}
+	if user.SSO != nil {
+		ssoIssuer = sql.NullString{String: user.SSO.Issuer, Valid: true}
+		ssoSubject = sql.NullString{String: user.SSO.Subject, Valid: true}
+	}
+	return []interface{}{user.ID.Hex(), user.Email, user.PassHash, user.UserName, user.FirstName, user.LastName,
+		user.PhotoURL, totp, tokens, user.EmailVerified, user.Role, user.Disabled, ssoIssuer, ssoSubject}, nil
+}
@@ -0,0 +1,72 @@
+package users_test
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/synapse-api/servers/gateway/models/users"
+	"github.com/synapse-api/servers/gateway/models/users/storetest"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//TestSQLiteStore tests the SQLStore object with SQLite
+func TestSQLiteStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlstore-test")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbs := 0
+	storetest.Run(t, func() users.Store {
+		//a new database for each test, opened like main does so
+		//that concurrent writers wait for each other
+		dbs++
+		dsn := filepath.Join(dir, fmt.Sprintf("users%d.db", dbs)) + "?_txlock=immediate&_busy_timeout=5000"
+		db, err := sql.Open(users.DriverSQLite, dsn)
+		if err != nil {
+			t.Fatalf("error opening database: %v", err)
+		}
+		store, err := users.NewSQLStore(db, users.DriverSQLite)
+		if err != nil {
+			t.Fatalf("error creating store: %v", err)
+		}
+
+		//migrations that were already applied are skipped
+		if _, err := users.NewSQLStore(db, users.DriverSQLite); err != nil {
+			t.Fatalf("error creating store again: %v", err)
+		}
+		return store
+	})
+}
+
+//TestPostgresStore tests the SQLStore object with the PostgreSQL
+//database at POSTGRES_DSN, and is skipped if that isn't set
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if len(dsn) == 0 {
+		t.Skip("POSTGRES_DSN not set")
+	}
+	db, err := sql.Open(users.DriverPostgres, dsn)
+	if err != nil {
+		t.Fatalf("error opening database: %v", err)
+	}
+	defer db.Close()
+
+	storetest.Run(t, func() users.Store {
+		store, err := users.NewSQLStore(db, users.DriverPostgres)
+		if err != nil {
+			t.Fatalf("error creating store: %v", err)
+		}
+		if _, err := db.Exec("DELETE FROM users"); err != nil {
+			t.Fatalf("error emptying users table: %v", err)
+		}
+		return store
+	})
+}
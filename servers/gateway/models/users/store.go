@@ -1,6 +1,7 @@
 package users
 
 import (
+	"context"
 	"errors"
 
 	"github.com/synapse-api/servers/gateway/indexes"
@@ -10,30 +11,104 @@ import (
 //ErrUserNotFound is returned when the user can't be found
 var ErrUserNotFound = errors.New("user not found")
 
-//Store represents a store for Users
+//ErrEmailTaken is returned when the email address is used by another user
+var ErrEmailTaken = errors.New("email address is already in use")
+
+//ErrUserNameTaken is returned when the user name is used by another user
+var ErrUserNameTaken = errors.New("user name is already in use")
+
+//Store represents a store for Users. Every method takes the context
+//of the request it serves, so that slow queries are cancelled with it.
+//Any other error means the store itself failed.
 type Store interface {
 	//GetByID returns the User with the given ID
-	GetByID(id bson.ObjectId) (*User, error)
+	GetByID(ctx context.Context, id bson.ObjectId) (*User, error)
 
 	//GetByEmail returns the User with the given email
-	GetByEmail(email string) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
 
 	//GetByUserName returns the User with the given Username
-	GetByUserName(username string) (*User, error)
+	GetByUserName(ctx context.Context, username string) (*User, error)
+
+	//GetBySSO returns the User linked to the identity at a single sign-on provider
+	GetBySSO(ctx context.Context, issuer string, subject string) (*User, error)
+
+	//Insert validates the NewUser, converts it to a User, inserts
+	//it into the database, and returns it. ErrEmailTaken or
+	//ErrUserNameTaken is returned if another user has the same ones.
+	Insert(ctx context.Context, newUser *NewUser) (*User, error)
+
+	//Update validates and applies UserUpdates to the given user ID
+	Update(ctx context.Context, userID bson.ObjectId, updates *Updates) error
+
+	//UpdateTOTP replaces the two-factor settings of the given user ID.
+	//A nil `totp` removes them.
+	UpdateTOTP(ctx context.Context, userID bson.ObjectId, totp *TOTP) error
+
+	//UseSecondFactor marks a two-factor code accepted by User.VerifySecondFactor
+	//as used, so that it can only be used once. The check and the change happen
+	//together. ErrInvalidCode is returned if the code was used since it was
+	//accepted, or two-factor authentication was disabled, and nothing is changed.
+	UseSecondFactor(ctx context.Context, userID bson.ObjectId, factor *SecondFactor) error
+
+	//SetToken stores a one-time token for the purpose, replacing
+	//any earlier one. A nil `token` removes it.
+	SetToken(ctx context.Context, userID bson.ObjectId, purpose string, token *OneTimeToken) error
+
+	//UseToken checks the one-time token for the purpose and removes it, so
+	//that it can only be used once. ErrInvalidToken is returned if the token
+	//is wrong or expired, in which case the stored token is kept.
+	UseToken(ctx context.Context, userID bson.ObjectId, purpose string, token string) error
 
-	//Insert converts the NewUser to a User, inserts
-	//it into the database, and returns it
-	Insert(newUser *NewUser) (*User, error)
+	//SetPassHash replaces the password hash of the given user ID
+	SetPassHash(ctx context.Context, userID bson.ObjectId, passHash []byte) error
 
-	//Update applies UserUpdates to the given user ID
-	Update(userID bson.ObjectId, updates *Updates) error
+	//SetEmail changes the email address of the given user ID,
+	//and marks the new address as not yet verified.
+	//ErrEmailTaken is returned if another user has the address.
+	SetEmail(ctx context.Context, userID bson.ObjectId, email string) error
+
+	//SetEmailVerified sets whether the email address of the given user ID is verified
+	SetEmailVerified(ctx context.Context, userID bson.ObjectId, verified bool) error
+
+	//SetRole changes the role of the given user ID
+	SetRole(ctx context.Context, userID bson.ObjectId, role string) error
+
+	//SetDisabled sets whether the account of the given user ID is disabled
+	SetDisabled(ctx context.Context, userID bson.ObjectId, disabled bool) error
+
+	//SetSSO links the given user ID to an identity at a single sign-on provider.
+	//A nil `identity` removes the link.
+	SetSSO(ctx context.Context, userID bson.ObjectId, identity *SSOIdentity) error
+
+	//List returns up to `limit` users ordered by ID, skipping the first `offset`
+	List(ctx context.Context, offset int, limit int) ([]*User, error)
 
 	//Delete deletes the user with the given ID
-	Delete(userID bson.ObjectId) error
+	Delete(ctx context.Context, userID bson.ObjectId) error
+
+	//GetByIDSlice returns the Users with the given IDs, in the
+	//same order, skipping IDs that aren't found
+	GetByIDSlice(ctx context.Context, ids []bson.ObjectId) ([]*User, error)
 
-	//GetByIDSlice returns all Users from a given slice of ids
-	GetByIDSlice(ids []bson.ObjectId) []*User
+	//GetAll loads all existing user accounts from the store into a trie
+	GetAll(ctx context.Context, tr *indexes.Trie[bson.ObjectId]) error
+
+	//Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+}
 
-	//GetAll loads all existing user accounts from the stor into a trie
-	GetAll(tr *indexes.Trie) error
+//orderByIDs returns the users in the order of `ids`, skipping IDs without a user
+func orderByIDs(found []*User, ids []bson.ObjectId) []*User {
+	byID := make(map[bson.ObjectId]*User, len(found))
+	for _, user := range found {
+		byID[user.ID] = user
+	}
+	users := []*User{}
+	for _, id := range ids {
+		if user, ok := byID[id]; ok {
+			users = append(users, user)
+		}
+	}
+	return users
 }
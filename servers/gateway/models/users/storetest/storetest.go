@@ -0,0 +1,539 @@
+//Package storetest provides a conformance test suite for users.Store
+//implementations, so that every implementation behaves the same way
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/models/users"
+	"gopkg.in/mgo.v2/bson"
+)
+
+//totpSecret is a base32-encoded two-factor secret
+const totpSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+//Run runs the suite. `newStore` must return a new, empty store each time it is called.
+func Run(t *testing.T, newStore func() users.Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, store users.Store)
+	}{
+		{"CRUD", testCRUD},
+		{"NotFound", testNotFound},
+		{"Validation", testValidation},
+		{"Uniqueness", testUniqueness},
+		{"Tokens", testTokens},
+		{"SecondFactor", testSecondFactor},
+		{"Ordering", testOrdering},
+		{"Concurrency", testConcurrency},
+		{"Ping", testPing},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStore())
+		})
+	}
+}
+
+//newUser returns a valid NewUser whose email address and user name start with `name`
+func newUser(name string) *users.NewUser {
+	return &users.NewUser{
+		Email:        name + "@uw.edu",
+		Password:     "123456",
+		PasswordConf: "123456",
+		UserName:     name,
+		FirstName:    "Frederick",
+		LastName:     "Wijaya",
+	}
+}
+
+//insert inserts a new user, failing the test on error
+func insert(t *testing.T, store users.Store, name string) *users.User {
+	ctx := context.Background()
+	user, err := store.Insert(ctx, newUser(name))
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+	return user
+}
+
+/*
+testCRUD runs through a full CRUD cycle.
+
+Since a Store is like a database, you can't really test methods like Get()
+or Delete() without also calling (and therefore testing) methods like Save(),
+so instead of testing individual methods in isolation, this test runs through
+a full CRUD cycle, ensuring the correct behavior occurs at each point in that
+cycle.
+*/
+func testCRUD(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	nu := newUser("fredhw")
+	upd := &users.Updates{
+		FirstName: "Fred",
+		LastName:  "Harrison",
+	}
+
+	user, err := store.Insert(ctx, nu)
+	if err != nil {
+		t.Fatalf("error inserting user: %v", err)
+	}
+
+	if err := store.Update(ctx, user.ID, upd); err != nil {
+		t.Fatalf("error updating user: %v", err)
+	}
+
+	user2, err := store.GetByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user from ID: %v", err)
+	}
+	if user2.FirstName != upd.FirstName || user2.LastName != upd.LastName {
+		t.Errorf("error in updated name: expected %s %s but got %s", upd.FirstName, upd.LastName, user2.FullName())
+	}
+	if err := user2.Authenticate(nu.Password); err != nil {
+		t.Errorf("error authenticating stored user: %v", err)
+	}
+	if user2.EffectiveRole() != users.DefaultRole {
+		t.Errorf("expected role %s but got %s", users.DefaultRole, user2.EffectiveRole())
+	}
+
+	if u, err := store.GetByUserName(ctx, nu.UserName); err != nil || u.ID != user.ID {
+		t.Errorf("error getting user from UserName: %v", err)
+	}
+	if u, err := store.GetByEmail(ctx, nu.Email); err != nil || u.ID != user.ID {
+		t.Errorf("error getting user from Email: %v", err)
+	}
+
+	if err := store.UpdateTOTP(ctx, user.ID, &users.TOTP{Secret: totpSecret, Enabled: true}); err != nil {
+		t.Fatalf("error updating TOTP: %v", err)
+	}
+	if u, err := store.GetByEmail(ctx, nu.Email); err != nil {
+		t.Fatalf("error getting user from Email: %v", err)
+	} else if !u.TOTPEnabled() || u.TOTP.Secret != totpSecret {
+		t.Errorf("TOTP settings were not stored: %+v", u.TOTP)
+	}
+	if err := store.UpdateTOTP(ctx, user.ID, nil); err != nil {
+		t.Fatalf("error removing TOTP: %v", err)
+	}
+	if u, _ := store.GetByID(ctx, user.ID); u.TOTPEnabled() {
+		t.Errorf("expected TOTP to be removed")
+	}
+
+	if err := store.SetPassHash(ctx, user.ID, []byte("hash")); err != nil {
+		t.Fatalf("error setting password hash: %v", err)
+	}
+	if err := store.SetEmailVerified(ctx, user.ID, true); err != nil {
+		t.Fatalf("error verifying email: %v", err)
+	}
+	if err := store.SetRole(ctx, user.ID, users.RoleViewer); err != nil {
+		t.Fatalf("error setting role: %v", err)
+	}
+	if err := store.SetDisabled(ctx, user.ID, true); err != nil {
+		t.Fatalf("error disabling user: %v", err)
+	}
+	if u, _ := store.GetByID(ctx, user.ID); string(u.PassHash) != "hash" || !u.EmailVerified ||
+		u.Role != users.RoleViewer || !u.Disabled {
+		t.Errorf("expected changes to be stored but got %+v", u)
+	}
+
+	if err := store.SetEmail(ctx, user.ID, "fred@uw.edu"); err != nil {
+		t.Fatalf("error setting email: %v", err)
+	}
+	if u, err := store.GetByEmail(ctx, "fred@uw.edu"); err != nil {
+		t.Errorf("error getting user by new email: %v", err)
+	} else if u.EmailVerified {
+		t.Errorf("expected new email to be unverified")
+	}
+	if _, err := store.GetByEmail(ctx, nu.Email); err != users.ErrUserNotFound {
+		t.Errorf("incorrect error getting user by old email: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+
+	sso := &users.SSOIdentity{Issuer: "https://idp.uw.edu", Subject: "12345"}
+	if err := store.SetSSO(ctx, user.ID, sso); err != nil {
+		t.Fatalf("error linking SSO identity: %v", err)
+	}
+	if u, err := store.GetBySSO(ctx, sso.Issuer, sso.Subject); err != nil || u.ID != user.ID {
+		t.Errorf("expected to get user by SSO identity but got %v", err)
+	}
+	if err := store.SetSSO(ctx, user.ID, nil); err != nil {
+		t.Fatalf("error unlinking SSO identity: %v", err)
+	}
+	if _, err := store.GetBySSO(ctx, sso.Issuer, sso.Subject); err != users.ErrUserNotFound {
+		t.Errorf("incorrect error for unlinked SSO identity: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+
+	if err := store.Delete(ctx, user.ID); err != nil {
+		t.Errorf("error deleting user: %v", err)
+	}
+	if _, err := store.GetByID(ctx, user.ID); err != users.ErrUserNotFound {
+		t.Errorf("incorrect error when getting user that was deleted: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+	if _, err := store.GetByEmail(ctx, "fred@uw.edu"); err != users.ErrUserNotFound {
+		t.Errorf("incorrect error when getting user that was deleted: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+	if _, err := store.GetByUserName(ctx, nu.UserName); err != users.ErrUserNotFound {
+		t.Errorf("incorrect error when getting user that was deleted: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+}
+
+//testNotFound checks that every method taking a user ID returns
+//ErrUserNotFound for users that were never stored
+func testNotFound(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	id := bson.NewObjectId()
+
+	if _, err := store.GetByID(ctx, id); err != users.ErrUserNotFound {
+		t.Errorf("GetByID: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+	if _, err := store.GetByEmail(ctx, "nobody@uw.edu"); err != users.ErrUserNotFound {
+		t.Errorf("GetByEmail: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+	if _, err := store.GetByUserName(ctx, "nobody"); err != users.ErrUserNotFound {
+		t.Errorf("GetByUserName: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+	if _, err := store.GetBySSO(ctx, "https://idp.uw.edu", "nobody"); err != users.ErrUserNotFound {
+		t.Errorf("GetBySSO: expected %v but got %v", users.ErrUserNotFound, err)
+	}
+
+	cases := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Update", func() error { return store.Update(ctx, id, &users.Updates{FirstName: "Fred", LastName: "Wijaya"}) }},
+		{"UpdateTOTP", func() error { return store.UpdateTOTP(ctx, id, nil) }},
+		{"UseSecondFactor", func() error { return store.UseSecondFactor(ctx, id, &users.SecondFactor{Step: 1}) }},
+		{"SetToken", func() error { return store.SetToken(ctx, id, users.PurposePasswordReset, nil) }},
+		{"UseToken", func() error { return store.UseToken(ctx, id, users.PurposePasswordReset, "token") }},
+		{"SetPassHash", func() error { return store.SetPassHash(ctx, id, []byte("hash")) }},
+		{"SetEmail", func() error { return store.SetEmail(ctx, id, "nobody@uw.edu") }},
+		{"SetEmailVerified", func() error { return store.SetEmailVerified(ctx, id, true) }},
+		{"SetRole", func() error { return store.SetRole(ctx, id, users.RoleViewer) }},
+		{"SetDisabled", func() error { return store.SetDisabled(ctx, id, true) }},
+		{"SetSSO", func() error { return store.SetSSO(ctx, id, nil) }},
+		{"Delete", func() error { return store.Delete(ctx, id) }},
+	}
+	for _, c := range cases {
+		if err := c.fn(); err != users.ErrUserNotFound {
+			t.Errorf("%s: expected %v but got %v", c.name, users.ErrUserNotFound, err)
+		}
+	}
+}
+
+//testValidation checks that invalid updates are rejected and not stored
+func testValidation(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	user := insert(t, store, "fredhw")
+	if err := store.Update(ctx, user.ID, &users.Updates{FirstName: "", LastName: "Harrison"}); err == nil {
+		t.Errorf("expected error for an update with an empty first name")
+	}
+	if u, _ := store.GetByID(ctx, user.ID); u.LastName != user.LastName {
+		t.Errorf("expected invalid update not to be stored, but last name is %s", u.LastName)
+	}
+
+	invalid := newUser("invalid")
+	invalid.PasswordConf = "654321"
+	if _, err := store.Insert(ctx, invalid); err == nil {
+		t.Errorf("expected error inserting an invalid user")
+	}
+}
+
+//testUniqueness checks that email addresses and user names can't be used twice
+func testUniqueness(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	user := insert(t, store, "fredhw")
+	other := insert(t, store, "other")
+
+	dupeEmail := newUser("someone")
+	dupeEmail.Email = user.Email
+	if _, err := store.Insert(ctx, dupeEmail); err != users.ErrEmailTaken {
+		t.Errorf("expected %v inserting a duplicate email address but got %v", users.ErrEmailTaken, err)
+	}
+	dupeUserName := newUser("someone")
+	dupeUserName.UserName = user.UserName
+	if _, err := store.Insert(ctx, dupeUserName); err != users.ErrUserNameTaken {
+		t.Errorf("expected %v inserting a duplicate user name but got %v", users.ErrUserNameTaken, err)
+	}
+	if _, err := store.GetByEmail(ctx, "someone@uw.edu"); err != users.ErrUserNotFound {
+		t.Errorf("expected duplicate users not to be stored but got %v", err)
+	}
+
+	if err := store.SetEmail(ctx, other.ID, user.Email); err != users.ErrEmailTaken {
+		t.Errorf("expected %v changing to a used email address but got %v", users.ErrEmailTaken, err)
+	}
+	if u, _ := store.GetByID(ctx, other.ID); u.Email != other.Email {
+		t.Errorf("expected email address not to change but got %s", u.Email)
+	}
+	if err := store.SetEmail(ctx, user.ID, user.Email); err != nil {
+		t.Errorf("expected setting a user's own email address to succeed but got %v", err)
+	}
+}
+
+//testTokens checks that one-time tokens can only be used once,
+//for their purpose, before they expire
+func testTokens(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	user := insert(t, store, "fredhw")
+
+	token, ott, err := users.NewOneTimeToken(time.Hour)
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if err := store.SetToken(ctx, user.ID, users.PurposePasswordReset, ott); err != nil {
+		t.Fatalf("error setting token: %v", err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposeEmailVerification, token); err != users.ErrInvalidToken {
+		t.Errorf("expected %v using a token for another purpose but got %v", users.ErrInvalidToken, err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposePasswordReset, "wrong"); err != users.ErrInvalidToken {
+		t.Errorf("expected %v using a wrong token but got %v", users.ErrInvalidToken, err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposePasswordReset, token); err != nil {
+		t.Errorf("error using token: %v", err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposePasswordReset, token); err != users.ErrInvalidToken {
+		t.Errorf("expected %v using a token twice but got %v", users.ErrInvalidToken, err)
+	}
+
+	expired, ott, err := users.NewOneTimeToken(-time.Second)
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if err := store.SetToken(ctx, user.ID, users.PurposeEmailVerification, ott); err != nil {
+		t.Fatalf("error setting token: %v", err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposeEmailVerification, expired); err != users.ErrInvalidToken {
+		t.Errorf("expected %v using an expired token but got %v", users.ErrInvalidToken, err)
+	}
+
+	token, ott, err = users.NewOneTimeToken(time.Hour)
+	if err != nil {
+		t.Fatalf("error generating token: %v", err)
+	}
+	if err := store.SetToken(ctx, user.ID, users.PurposeEmailVerification, ott); err != nil {
+		t.Fatalf("error setting token: %v", err)
+	}
+	if err := store.SetToken(ctx, user.ID, users.PurposeEmailVerification, nil); err != nil {
+		t.Fatalf("error removing token: %v", err)
+	}
+	if err := store.UseToken(ctx, user.ID, users.PurposeEmailVerification, token); err != users.ErrInvalidToken {
+		t.Errorf("expected %v using a removed token but got %v", users.ErrInvalidToken, err)
+	}
+}
+
+//testSecondFactor checks that each two-factor code and recovery
+//code can only be used once, even by concurrent requests
+func testSecondFactor(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	const n = 10
+	user := insert(t, store, "fredhw")
+
+	totp := &users.TOTP{Secret: totpSecret, Enabled: true}
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("error generating recovery codes: %v", err)
+	}
+	if err := store.UpdateTOTP(ctx, user.ID, totp); err != nil {
+		t.Fatalf("error updating TOTP: %v", err)
+	}
+	now := time.Now()
+	code, err := totp.Code(now)
+	if err != nil {
+		t.Fatalf("error generating code: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		code string
+	}{
+		{"Code", code},
+		{"Recovery Code", codes[0]},
+	}
+	for _, c := range cases {
+		//every request reads the user before any of them uses the code
+		factors := make([]*users.SecondFactor, n)
+		for i := range factors {
+			stored, err := store.GetByID(ctx, user.ID)
+			if err != nil {
+				t.Fatalf("error getting user: %v", err)
+			}
+			if factors[i], err = stored.VerifySecondFactor(c.code, now); err != nil {
+				t.Fatalf("case %s: error verifying code: %v", c.name, err)
+			}
+		}
+		errs := make(chan error, n)
+		for _, factor := range factors {
+			go func(factor *users.SecondFactor) {
+				errs <- store.UseSecondFactor(ctx, user.ID, factor)
+			}(factor)
+		}
+		used := 0
+		for i := 0; i < n; i++ {
+			err := <-errs
+			if err == nil {
+				used++
+			} else if err != users.ErrInvalidCode {
+				t.Errorf("case %s: expected %v using a code twice but got %v", c.name, users.ErrInvalidCode, err)
+			}
+		}
+		if used != 1 {
+			t.Errorf("case %s: expected the code to be used once but it was used %d times", c.name, used)
+		}
+
+		stored, err := store.GetByID(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("error getting user: %v", err)
+		}
+		if _, err := stored.VerifySecondFactor(c.code, now); err != users.ErrInvalidCode {
+			t.Errorf("case %s: expected %v verifying a used code but got %v", c.name, users.ErrInvalidCode, err)
+		}
+	}
+
+	stored, err := store.GetByID(ctx, user.ID)
+	if err != nil {
+		t.Fatalf("error getting user: %v", err)
+	}
+	if len(stored.TOTP.RecoveryCodes) != len(codes)-1 {
+		t.Errorf("expected %d unused recovery codes but got %d", len(codes)-1, len(stored.TOTP.RecoveryCodes))
+	}
+	if err := store.UseSecondFactor(ctx, user.ID, &users.SecondFactor{Step: stored.TOTP.LastStep - 1}); err != users.ErrInvalidCode {
+		t.Errorf("expected %v using an earlier code but got %v", users.ErrInvalidCode, err)
+	}
+
+	factor, err := stored.VerifySecondFactor(codes[1], now)
+	if err != nil {
+		t.Fatalf("error verifying recovery code: %v", err)
+	}
+	if err := store.UpdateTOTP(ctx, user.ID, nil); err != nil {
+		t.Fatalf("error removing TOTP: %v", err)
+	}
+	if err := store.UseSecondFactor(ctx, user.ID, factor); err != users.ErrInvalidCode {
+		t.Errorf("expected %v using a code after disabling two-factor authentication but got %v", users.ErrInvalidCode, err)
+	}
+}
+
+//testOrdering checks that users are listed by ID, and that
+//GetByIDSlice keeps the order of the IDs and skips unknown ones
+func testOrdering(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	inserted := []*users.User{}
+	for i := 0; i < 5; i++ {
+		inserted = append(inserted, insert(t, store, fmt.Sprintf("user%d", i)))
+	}
+
+	all, err := store.List(ctx, 0, 10)
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+	if len(all) != len(inserted) {
+		t.Fatalf("expected %d users but got %d", len(inserted), len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1].ID >= all[i].ID {
+			t.Errorf("expected users ordered by ID but %s came before %s", all[i-1].ID.Hex(), all[i].ID.Hex())
+		}
+	}
+	page, err := store.List(ctx, 2, 2)
+	if err != nil {
+		t.Fatalf("error listing users: %v", err)
+	}
+	if len(page) != 2 || page[0].ID != all[2].ID || page[1].ID != all[3].ID {
+		t.Errorf("expected the third and fourth users but got %d users", len(page))
+	}
+	if page, err := store.List(ctx, 10, 2); err != nil || len(page) != 0 {
+		t.Errorf("expected no users past the end but got %d, %v", len(page), err)
+	}
+
+	ids := []bson.ObjectId{inserted[3].ID, bson.NewObjectId(), inserted[0].ID, inserted[4].ID}
+	found, err := store.GetByIDSlice(ctx, ids)
+	if err != nil {
+		t.Fatalf("error getting users by IDs: %v", err)
+	}
+	if len(found) != 3 || found[0].ID != ids[0] || found[1].ID != ids[2] || found[2].ID != ids[3] {
+		t.Errorf("expected users in the order of the IDs but got %d users", len(found))
+	}
+	if found, err := store.GetByIDSlice(ctx, nil); err != nil || len(found) != 0 {
+		t.Errorf("expected no users for no IDs but got %d, %v", len(found), err)
+	}
+}
+
+//testConcurrency checks that concurrent changes to the same
+//user or the same email address don't interfere
+func testConcurrency(t *testing.T, store users.Store) {
+	ctx := context.Background()
+	const n = 10
+
+	//only one of the users with the same email address is inserted
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			nu := newUser(fmt.Sprintf("racer%d", i))
+			nu.Email = "racer@uw.edu"
+			_, err := store.Insert(ctx, nu)
+			errs <- err
+		}(i)
+	}
+	inserted := 0
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if err == nil {
+			inserted++
+		} else if err != users.ErrEmailTaken {
+			t.Errorf("expected %v inserting a duplicate email address but got %v", users.ErrEmailTaken, err)
+		}
+	}
+	if inserted != 1 {
+		t.Errorf("expected 1 user to be inserted but %d were", inserted)
+	}
+
+	//changes to different fields of the same user are all kept
+	user := insert(t, store, "fredhw")
+	tokens := make([]string, n)
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		token, ott, err := users.NewOneTimeToken(time.Hour)
+		if err != nil {
+			t.Fatalf("error generating token: %v", err)
+		}
+		tokens[i] = token
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.SetToken(ctx, user.ID, fmt.Sprintf("purpose%d", i), ott); err != nil {
+				t.Errorf("error setting token: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	//and each token can only be used once
+	for i := 0; i < n; i++ {
+		for j := 0; j < 3; j++ {
+			go func(i int) {
+				errs <- store.UseToken(ctx, user.ID, fmt.Sprintf("purpose%d", i), tokens[i])
+			}(i)
+		}
+		used := 0
+		for j := 0; j < 3; j++ {
+			err := <-errs
+			if err == nil {
+				used++
+			} else if err != users.ErrInvalidToken {
+				t.Errorf("expected %v using a token twice but got %v", users.ErrInvalidToken, err)
+			}
+		}
+		if used != 1 {
+			t.Errorf("expected token %d to be used once but it was used %d times", i, used)
+		}
+	}
+}
+
+func testPing(t *testing.T, store users.Store) {
+	if err := store.Ping(context.Background()); err != nil {
+		t.Errorf("error pinging store: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//PurposePasswordReset is the purpose of tokens sent to reset a forgotten password
+const PurposePasswordReset = "reset"
+
+//PurposeEmailVerification is the purpose of tokens sent to verify an email address
+const PurposeEmailVerification = "verify"
+
+//ErrInvalidToken is returned when a one-time token is wrong, expired or already used
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+//OneTimeToken is a single-use, expiring token sent to the user's email address.
+//Only its hash is stored, so a leaked database can't be used to take over accounts.
+type OneTimeToken struct {
+	Hash    string    `bson:"hash"`
+	Expires time.Time `bson:"expires"`
+}
+
+//NewOneTimeToken generates a token that expires after `ttl`.
+//It returns the token to send to the user, and the OneTimeToken to store.
+func NewOneTimeToken(ttl time.Duration) (string, *OneTimeToken, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, fmt.Errorf("error generating token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, &OneTimeToken{
+		Hash:    HashToken(token),
+		Expires: time.Now().Add(ttl),
+	}, nil
+}
+
+//HashToken returns the hash of a one-time token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//Check returns nil if `token` matches and hasn't expired at time `now`
+func (t *OneTimeToken) Check(token string, now time.Time) error {
+	if t == nil || !now.Before(t.Expires) {
+		return ErrInvalidToken
+	}
+	if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(HashToken(token))) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
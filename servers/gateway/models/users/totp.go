@@ -0,0 +1,228 @@
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//totpPeriod is the number of seconds each code is valid for
+const totpPeriod = 30
+
+//totpDigits is the number of digits in each code
+const totpDigits = 6
+
+//totpSkew is the number of periods before and after the current
+//one that are also accepted, to allow for clock drift
+const totpSkew = 1
+
+//recoveryCodeCount is the number of recovery codes generated on enrollment
+const recoveryCodeCount = 10
+
+//ErrInvalidCode is returned when a two-factor code is wrong,
+//has already been used, or the recovery code is unknown
+var ErrInvalidCode = errors.New("invalid two-factor code")
+
+//ErrTOTPNotEnabled is returned when verifying a code for a user
+//who hasn't enabled two-factor authentication
+var ErrTOTPNotEnabled = errors.New("two-factor authentication is not enabled")
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//TOTP holds a user's time-based one-time password (RFC 6238) settings.
+//It is never encoded to clients.
+type TOTP struct {
+	//Secret is the base32-encoded shared secret
+	Secret string `bson:"secret"`
+	//Enabled is false until the user has proven they can generate codes
+	Enabled bool `bson:"enabled"`
+	//LastStep is the time step of the last accepted code,
+	//so that a code can't be used twice
+	LastStep int64 `bson:"lastStep"`
+	//RecoveryCodes are SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `bson:"recoveryCodes"`
+}
+
+//NewTOTP generates a new, not yet enabled, TOTP secret
+func NewTOTP() (*TOTP, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating secret: %v", err)
+	}
+	return &TOTP{
+		Secret: b32.EncodeToString(secret),
+	}, nil
+}
+
+//URI returns the otpauth:// provisioning URI for the secret,
+//which authenticator apps read from a QR code
+func (t *TOTP) URI(issuer string, account string) string {
+	q := url.Values{}
+	q.Set("secret", t.Secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+//Code returns the code for the time `at`
+func (t *TOTP) Code(at time.Time) (string, error) {
+	return t.codeForStep(at.Unix() / totpPeriod)
+}
+
+//codeForStep computes the HOTP (RFC 4226) value for the time step
+func (t *TOTP) codeForStep(step int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(t.Secret))
+	if err != nil {
+		return "", fmt.Errorf("error decoding secret: %v", err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+//Verify checks the code against the time `at`, allowing for some clock
+//drift. A code that is accepted, or any earlier one, can't be used again.
+func (t *TOTP) Verify(code string, at time.Time) error {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return ErrInvalidCode
+	}
+	now := at.Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		expected, err := t.codeForStep(step)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			t.LastStep = step
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+//GenerateRecoveryCodes replaces the recovery codes with new ones,
+//and returns them. Only their hashes are kept, so they must be shown
+//to the user now.
+func (t *TOTP) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	t.RecoveryCodes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, fmt.Errorf("error generating recovery code: %v", err)
+		}
+		code := strings.ToLower(b32.EncodeToString(buf))
+		codes[i] = code[:4] + "-" + code[4:]
+		t.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, nil
+}
+
+//UseRecoveryCode checks the recovery code, and removes it
+//so that it can't be used again
+func (t *TOTP) UseRecoveryCode(code string) error {
+	hashed := hashRecoveryCode(code)
+	for i, rc := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(rc), []byte(hashed)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+//hashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+//use marks the code as used, unless it already was or
+//two-factor authentication was disabled since it was checked
+func (t *TOTP) use(factor *SecondFactor) error {
+	if t == nil || !t.Enabled {
+		return ErrInvalidCode
+	}
+	if len(factor.RecoveryCode) > 0 {
+		for i, rc := range t.RecoveryCodes {
+			if rc == factor.RecoveryCode {
+				t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrInvalidCode
+	}
+	if factor.Step <= t.LastStep {
+		return ErrInvalidCode
+	}
+	t.LastStep = factor.Step
+	return nil
+}
+
+//SecondFactor is a two-factor code accepted by User.VerifySecondFactor.
+//It must be passed to Store.UseSecondFactor, which only accepts it if it
+//hasn't been used since, so that concurrent requests can't use it twice.
+type SecondFactor struct {
+	//Step is the time step of a code from an authenticator app
+	Step int64
+	//RecoveryCode is the hash of a recovery code, if one was used instead
+	RecoveryCode string
+}
+
+//TOTPEnabled reports whether the user must enter a two-factor code to sign in
+func (u *User) TOTPEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Enabled
+}
+
+//VerifySecondFactor checks a code from the user's authenticator app,
+//or one of their recovery codes, and returns what must be passed to
+//Store.UseSecondFactor to use it. The user's TOTP settings are updated.
+func (u *User) VerifySecondFactor(code string, at time.Time) (*SecondFactor, error) {
+	if !u.TOTPEnabled() {
+		return nil, ErrTOTPNotEnabled
+	}
+	if err := u.TOTP.Verify(code, at); err != ErrInvalidCode {
+		if err != nil {
+			return nil, err
+		}
+		return &SecondFactor{Step: u.TOTP.LastStep}, nil
+	}
+	if err := u.TOTP.UseRecoveryCode(code); err != nil {
+		return nil, err
+	}
+	return &SecondFactor{RecoveryCode: hashRecoveryCode(code)}, nil
+}
@@ -0,0 +1,118 @@
+package users
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+//rfcSecret is the SHA-1 key from the RFC 6238 test vectors
+var rfcSecret = b32.EncodeToString([]byte("12345678901234567890"))
+
+func TestTOTPCode(t *testing.T) {
+	//the RFC 6238 test vectors, truncated to 6 digits
+	cases := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	totp := &TOTP{Secret: rfcSecret}
+	for _, c := range cases {
+		code, err := totp.Code(time.Unix(c.unix, 0))
+		if err != nil {
+			t.Fatalf("error generating code: %v", err)
+		}
+		if code != c.expected {
+			t.Errorf("incorrect code at %d: expected %s but got %s", c.unix, c.expected, code)
+		}
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+	totp, err := NewTOTP()
+	if err != nil {
+		t.Fatalf("error generating TOTP: %v", err)
+	}
+	now := time.Now()
+	code := func(at time.Time) string {
+		c, err := totp.Code(at)
+		if err != nil {
+			t.Fatalf("error generating code: %v", err)
+		}
+		return c
+	}
+
+	if err := totp.Verify(code(now.Add(-10*time.Minute)), now); err != ErrInvalidCode {
+		t.Errorf("expected old code to be rejected but got %v", err)
+	}
+	if err := totp.Verify("abc", now); err != ErrInvalidCode {
+		t.Errorf("expected malformed code to be rejected but got %v", err)
+	}
+	if err := totp.Verify(code(now.Add(-totpPeriod*time.Second)), now); err != nil {
+		t.Errorf("expected code from previous period to be accepted but got %v", err)
+	}
+	if err := totp.Verify(code(now), now); err != nil {
+		t.Errorf("expected current code to be accepted but got %v", err)
+	}
+	if err := totp.Verify(code(now), now); err != ErrInvalidCode {
+		t.Errorf("expected reused code to be rejected but got %v", err)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	totp := &TOTP{Secret: rfcSecret}
+	uri := totp.URI("Synapse", "fredhw@uw.edu")
+	for _, expected := range []string{
+		"otpauth://totp/Synapse:fredhw@uw.edu?",
+		"secret=" + rfcSecret,
+		"issuer=Synapse",
+		"digits=6",
+		"period=30",
+	} {
+		if !strings.Contains(uri, expected) {
+			t.Errorf("expected URI %q to contain %q", uri, expected)
+		}
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	totp, err := NewTOTP()
+	if err != nil {
+		t.Fatalf("error generating TOTP: %v", err)
+	}
+	user := &User{TOTP: totp}
+	now := time.Now()
+
+	codes, err := totp.GenerateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("error generating recovery codes: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes but got %d", recoveryCodeCount, len(codes))
+	}
+
+	if _, err := user.VerifySecondFactor(codes[0], now); err != ErrTOTPNotEnabled {
+		t.Errorf("expected %v before enabling but got %v", ErrTOTPNotEnabled, err)
+	}
+	totp.Enabled = true
+
+	if factor, err := user.VerifySecondFactor(strings.ToUpper(codes[0]), now); err != nil || len(factor.RecoveryCode) == 0 {
+		t.Errorf("expected recovery code to be accepted but got %v", err)
+	}
+	if _, err := user.VerifySecondFactor(codes[0], now); err != ErrInvalidCode {
+		t.Errorf("expected used recovery code to be rejected but got %v", err)
+	}
+	if _, err := user.VerifySecondFactor("aaaa-bbbb", now); err != ErrInvalidCode {
+		t.Errorf("expected unknown recovery code to be rejected but got %v", err)
+	}
+	if len(totp.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("expected %d unused recovery codes but got %d", recoveryCodeCount-1, len(totp.RecoveryCodes))
+	}
+}
@@ -25,6 +25,21 @@ type User struct {
 	FirstName string        `json:"firstName"`
 	LastName  string        `json:"lastName"`
 	PhotoURL  string        `json:"photoURL"`
+	TOTP      *TOTP         `json:"-" bson:"totp,omitempty"` //stored, but not encoded to clients
+
+	EmailVerified bool                     `json:"emailVerified"`
+	Tokens        map[string]*OneTimeToken `json:"-" bson:"tokens,omitempty"` //one-time tokens by purpose
+
+	Role     string `json:"role"`
+	Disabled bool   `json:"disabled"`
+
+	SSO *SSOIdentity `json:"-" bson:"sso,omitempty"` //identity at the single sign-on provider, if linked
+}
+
+//SSOIdentity identifies a user at an OpenID Connect provider
+type SSOIdentity struct {
+	Issuer  string `bson:"issuer"`
+	Subject string `bson:"subject"`
 }
 
 //Credentials represents user sign-in credentials
@@ -63,19 +78,32 @@ func (nu *NewUser) Validate() error {
 	if em, err := mail.ParseAddress(nu.Email); err != nil {
 		return fmt.Errorf("invalid email address: %v", em)
 	}
-	if len(nu.Password) < 6 {
-		return fmt.Errorf("password must be at least 6 characters: %v", len(nu.Password))
-	}
-	if nu.Password != nu.PasswordConf {
-		return fmt.Errorf("password: %v ; passwordConf: %v", nu.Password, nu.PasswordConf)
+	if err := ValidatePassword(nu.Password, nu.PasswordConf); err != nil {
+		return err
 	}
 	if len(nu.UserName) == 0 {
 		return fmt.Errorf("username must be non-zero length")
 	}
+	//the user name also names the directory holding the user's files
+	if strings.HasPrefix(nu.UserName, ".") || strings.ContainsAny(nu.UserName, "/\\\x00") {
+		return fmt.Errorf("username must not start with a dot or contain slashes")
+	}
 
 	return nil
 }
 
+//ValidatePassword returns an error if the password is too short,
+//or doesn't match its confirmation
+func ValidatePassword(password string, passwordConf string) error {
+	if len(password) < 6 {
+		return fmt.Errorf("password must be at least 6 characters: %v", len(password))
+	}
+	if password != passwordConf {
+		return fmt.Errorf("password and passwordConf must match")
+	}
+	return nil
+}
+
 //ToUser converts the NewUser to a User, setting the
 //PhotoURL and PassHash fields appropriately
 func (nu *NewUser) ToUser() (*User, error) {
@@ -98,6 +126,7 @@ func (nu *NewUser) ToUser() (*User, error) {
 		FirstName: nu.FirstName,
 		LastName:  nu.LastName,
 		PhotoURL:  url,
+		Role:      DefaultRole,
 	}
 
 	if err := user.SetPassword(nu.Password); err != nil {
@@ -129,6 +158,11 @@ func (u *User) FullName() string {
 	}
 }
 
+//SearchKeys returns the fields by which the user can be found in user search
+func (u *User) SearchKeys() []string {
+	return []string{u.Email, u.UserName, u.FirstName, u.LastName}
+}
+
 //SetPassword hashes the password and stores it in the PassHash field
 func (u *User) SetPassword(password string) error {
 	//TODO: use the bcrypt package to generate a new hash of the password
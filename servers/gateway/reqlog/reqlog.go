@@ -0,0 +1,156 @@
+//Package reqlog identifies the requests the gateway handles and logs them.
+//Middleware gives every request an ID, which is passed on to the
+//microservices and returned to the client, and a structured logger that
+//adds the ID to everything logged while the request is handled.
+package reqlog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+//HeaderRequestID carries the ID of a request
+const HeaderRequestID = "X-Request-ID"
+
+//maxIDLength is the longest request ID accepted from a client
+const maxIDLength = 64
+
+//contextKey is the type of keys for values this package adds to request contexts
+type contextKey int
+
+//requestKey is the request context key of the *request
+const requestKey contextKey = iota
+
+//request holds what is known about a request while it is handled
+type request struct {
+	id     string
+	logger *slog.Logger
+	//userID is set once the user making the request is known
+	userID string
+}
+
+//NewID returns a random request ID
+func NewID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		slog.Error("error generating request ID", "error", err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+//ValidID reports whether a request ID sent by a client can be used. IDs
+//are written to logs and headers, so only short IDs of letters, digits,
+//dashes, underscores and dots are kept.
+func ValidID(id string) bool {
+	if len(id) == 0 || len(id) > maxIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+//Middleware wraps `next` so that every request has an ID and a logger.
+//The ID is the one in the request's X-Request-ID header if it is valid,
+//or a new one, and is set on the request, so that proxies pass it on, and
+//on the response. Once the request is handled, it is logged with its
+//method, path, status, latency, the size of the response and the user.
+func Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if !ValidID(id) {
+			id = NewID()
+			r.Header.Set(HeaderRequestID, id)
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		req := &request{id: id, logger: logger.With("requestId", id)}
+		//with tracing, lines can be matched with the request's trace
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			req.logger = req.logger.With("traceId", span.TraceID().String())
+		}
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestKey, req)))
+
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"latency", time.Since(start),
+			"bytes", rec.bytes,
+		}
+		if len(req.userID) > 0 {
+			attrs = append(attrs, "userId", req.userID)
+		}
+		req.logger.Info("request", attrs...)
+	})
+}
+
+//Logger returns the logger of the request the context belongs to,
+//or the default logger outside of requests
+func Logger(ctx context.Context) *slog.Logger {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req.logger
+	}
+	return slog.Default()
+}
+
+//RequestID returns the ID of the request the context belongs
+//to, or an empty string outside of requests
+func RequestID(ctx context.Context) string {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		return req.id
+	}
+	return ""
+}
+
+//SetUser records the ID of the user making the request the context
+//belongs to, which is added to its access log. It does nothing
+//outside of requests.
+func SetUser(ctx context.Context, userID string) {
+	if req, ok := ctx.Value(requestKey).(*request); ok {
+		req.userID = userID
+	}
+}
+
+//recorder is a ResponseWriter that remembers the
+//status code and the number of bytes written
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+//WriteHeader records the status code and writes it
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+//Write counts the bytes written
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+//Unwrap returns the original ResponseWriter, so that
+//http.ResponseController can flush it
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
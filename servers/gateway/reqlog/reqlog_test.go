@@ -0,0 +1,148 @@
+package reqlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestValidID(t *testing.T) {
+	cases := []struct {
+		name  string
+		id    string
+		valid bool
+	}{
+		{"Generated", NewID(), true},
+		{"UUID", "3f2b8c1e-5d4a-4e6f-9a7b-0c1d2e3f4a5b", true},
+		{"Dots And Underscores", "web_client.1234", true},
+		{"Empty", "", false},
+		{"Too Long", strings.Repeat("a", maxIDLength+1), false},
+		{"Spaces", "abc 123", false},
+		{"Newline", "abc\n123", false},
+		{"Quotes", `abc"123`, false},
+	}
+
+	for _, c := range cases {
+		if valid := ValidID(c.id); valid != c.valid {
+			t.Errorf("case %s: expected valid to be %t for %q", c.name, c.valid, c.id)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	cases := []struct {
+		name           string
+		requestID      string
+		userID         string
+		status         int
+		body           string
+		keepsRequestID bool
+	}{
+		{"Client ID", "abc-123", "", http.StatusOK, "hello", true},
+		{"No ID", "", "", http.StatusOK, "hello", false},
+		{"Invalid ID", "abc 123", "", http.StatusOK, "hello", false},
+		{"User", "abc-123", "5c3b0f9e8d1a2b3c4d5e6f70", http.StatusCreated, `{"id": 1}`, true},
+		{"No Body", "", "", http.StatusNoContent, "", false},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		logger := slog.New(slog.NewJSONHandler(buf, nil))
+
+		var handledID string
+		handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handledID = RequestID(r.Context())
+			if r.Header.Get(HeaderRequestID) != handledID {
+				t.Errorf("case %s: expected the request header to carry the ID %q but got %q",
+					c.name, handledID, r.Header.Get(HeaderRequestID))
+			}
+			if len(c.userID) > 0 {
+				SetUser(r.Context(), c.userID)
+			}
+			Logger(r.Context()).Info("handling")
+			w.WriteHeader(c.status)
+			w.Write([]byte(c.body))
+		}))
+
+		r := httptest.NewRequest("POST", "/v1/upload", nil)
+		if len(c.requestID) > 0 {
+			r.Header.Set(HeaderRequestID, c.requestID)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if !ValidID(handledID) || w.Header().Get(HeaderRequestID) != handledID {
+			t.Errorf("case %s: expected the response header to carry the ID %q but got %q",
+				c.name, handledID, w.Header().Get(HeaderRequestID))
+		}
+		if (handledID == c.requestID) != c.keepsRequestID {
+			t.Errorf("case %s: expected keeping the client's ID to be %t but got %q", c.name, c.keepsRequestID, handledID)
+		}
+
+		//both the handler's line and the access log carry the ID
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("case %s: expected 2 log lines but got %d: %s", c.name, len(lines), buf.String())
+		}
+		for _, line := range lines {
+			entry := map[string]any{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("case %s: error decoding log line: %v", c.name, err)
+			}
+			if entry["requestId"] != handledID {
+				t.Errorf("case %s: expected requestId %q in %s", c.name, handledID, line)
+			}
+		}
+		entry := map[string]any{}
+		json.Unmarshal([]byte(lines[1]), &entry)
+		if entry["msg"] != "request" || entry["method"] != "POST" || entry["path"] != "/v1/upload" {
+			t.Errorf("case %s: unexpected access log %s", c.name, lines[1])
+		}
+		if entry["status"] != float64(c.status) || entry["bytes"] != float64(len(c.body)) {
+			t.Errorf("case %s: expected status %d and %d bytes in %s", c.name, c.status, len(c.body), lines[1])
+		}
+		if _, found := entry["latency"]; !found {
+			t.Errorf("case %s: expected latency in %s", c.name, lines[1])
+		}
+		if userID, found := entry["userId"]; found != (len(c.userID) > 0) || found && userID != c.userID {
+			t.Errorf("case %s: expected userId %q in %s", c.name, c.userID, lines[1])
+		}
+	}
+}
+
+func TestOutsideRequests(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if id := RequestID(r.Context()); len(id) != 0 {
+		t.Errorf("expected no request ID outside of requests but got %q", id)
+	}
+	if Logger(r.Context()) != slog.Default() {
+		t.Errorf("expected the default logger outside of requests")
+	}
+	//does nothing, rather than panicking
+	SetUser(r.Context(), "5c3b0f9e8d1a2b3c4d5e6f70")
+}
+
+func TestTraceID(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	span := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})
+
+	buf := &bytes.Buffer{}
+	handler := Middleware(slog.New(slog.NewJSONHandler(buf, nil)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	r := httptest.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r.WithContext(trace.ContextWithSpanContext(r.Context(), span)))
+
+	entry := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("error decoding log line: %v", err)
+	}
+	if entry["traceId"] != traceID.String() {
+		t.Errorf("expected traceId %s in %s", traceID, buf.String())
+	}
+}
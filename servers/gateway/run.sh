@@ -17,6 +17,7 @@ docker rm -f qeeg4
 export TLSCERT=/etc/letsencrypt/live/api.synapse-solutions.net/fullchain.pem
 export TLSKEY=/etc/letsencrypt/live/api.synapse-solutions.net/privkey.pem
 export DBADDR="mymongo:27017"
+export XUSER_KEY=$(openssl rand -base64 32)
 
 docker run -d \
 --name devredis \
@@ -32,34 +33,40 @@ mongo
 docker run -d \
 --name summary1 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 fredhw/summary
 
 docker run -d \
 --name messaging1 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 fredhw/messaging
 
 docker run -d \
 --name qeeg1 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 -v ~/raw-data:/app/raw-data \
 fredhw/qeeg-api
 
 docker run -d \
 --name qeeg2 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 -v ~/raw-data:/app/raw-data \
 fredhw/qeeg-api
 
 docker run -d \
 --name qeeg3 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 -v ~/raw-data:/app/raw-data \
 fredhw/qeeg-api
 
 docker run -d \
 --name qeeg4 \
 --network appnet \
+-e XUSER_KEY=$XUSER_KEY \
 -v ~/raw-data:/app/raw-data \
 fredhw/qeeg-api
 
@@ -74,8 +81,10 @@ docker run -d \
 -e SESSIONKEY="testing" \
 -e REDISADDR="devredis:6379" \
 -e DBADDR=$DBADDR \
+-e XUSER_KEY=$XUSER_KEY \
 -e MESSAGESSVC_ADDRS=messaging1 \
 -e SUMMARYSVC_ADDRS=summary1 \
 -e QEEGSVC_ADDRS=qeeg1,qeeg2,qeeg3,qeeg4 \
+-e METRICS_ADDR=":9090" \
 fredhw/gateway
 
@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/patrickmn/go-cache"
+)
+
+//Denylist records revoked token and session identifiers until
+//the credentials they identify would have expired anyway
+type Denylist interface {
+	//Add revokes `id` for the duration of `ttl`
+	Add(id string, ttl time.Duration) error
+
+	//Contains reports whether any of the `ids` are revoked
+	Contains(ids ...string) (bool, error)
+}
+
+//MemDenylist is a Denylist kept in process memory.
+//This should be used only for testing and single-instance deployments.
+type MemDenylist struct {
+	entries *cache.Cache
+}
+
+//NewMemDenylist constructs and returns a new MemDenylist
+func NewMemDenylist(purgeInterval time.Duration) *MemDenylist {
+	return &MemDenylist{
+		entries: cache.New(cache.NoExpiration, purgeInterval),
+	}
+}
+
+//Add revokes `id` for the duration of `ttl`
+func (md *MemDenylist) Add(id string, ttl time.Duration) error {
+	md.entries.Set(id, true, ttl)
+	return nil
+}
+
+//Contains reports whether any of the `ids` are revoked
+func (md *MemDenylist) Contains(ids ...string) (bool, error) {
+	for _, id := range ids {
+		if _, found := md.entries.Get(id); found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//RedisDenylist is a Denylist shared through redis
+type RedisDenylist struct {
+	Client *redis.Client
+}
+
+//NewRedisDenylist constructs a new RedisDenylist
+func NewRedisDenylist(client *redis.Client) *RedisDenylist {
+	if client == nil {
+		panic("nil pointer passed for client")
+	}
+	return &RedisDenylist{
+		Client: client,
+	}
+}
+
+//Add revokes `id` for the duration of `ttl`
+func (rd *RedisDenylist) Add(id string, ttl time.Duration) error {
+	return rd.Client.Set(getDenyKey(id), 1, ttl).Err()
+}
+
+//Contains reports whether any of the `ids` are revoked,
+//using a single round trip to redis
+func (rd *RedisDenylist) Contains(ids ...string) (bool, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = getDenyKey(id)
+	}
+	n, err := rd.Client.Exists(keys...).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+//getDenyKey returns the redis key for a revoked identifier
+func getDenyKey(id string) string {
+	return "deny:" + id
+}
@@ -0,0 +1,152 @@
+package sessions
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//Index records which sessions belong to which subject, so that all
+//of a user's sessions can be listed or ended. Entries for sessions
+//that have since ended or expired may remain until they are pruned.
+type Index interface {
+	//Add records that the session belongs to `subject`. Adding
+	//a session again keeps its record from expiring.
+	Add(subject string, sid SessionID) error
+
+	//Remove forgets the session of `subject`
+	Remove(subject string, sid SessionID) error
+
+	//List returns the sessions recorded for `subject`
+	List(subject string) ([]SessionID, error)
+}
+
+//MemIndex is an Index kept in process memory.
+//This should be used only for testing and single-instance deployments.
+type MemIndex struct {
+	subjects map[string]map[SessionID]bool
+	mx       sync.RWMutex
+}
+
+//NewMemIndex constructs and returns a new MemIndex
+func NewMemIndex() *MemIndex {
+	return &MemIndex{
+		subjects: map[string]map[SessionID]bool{},
+	}
+}
+
+//Add records that the session belongs to `subject`
+func (mi *MemIndex) Add(subject string, sid SessionID) error {
+	mi.mx.Lock()
+	defer mi.mx.Unlock()
+	if mi.subjects[subject] == nil {
+		mi.subjects[subject] = map[SessionID]bool{}
+	}
+	mi.subjects[subject][sid] = true
+	return nil
+}
+
+//Remove forgets the session of `subject`
+func (mi *MemIndex) Remove(subject string, sid SessionID) error {
+	mi.mx.Lock()
+	defer mi.mx.Unlock()
+	delete(mi.subjects[subject], sid)
+	if len(mi.subjects[subject]) == 0 {
+		delete(mi.subjects, subject)
+	}
+	return nil
+}
+
+//List returns the sessions recorded for `subject`
+func (mi *MemIndex) List(subject string) ([]SessionID, error) {
+	mi.mx.RLock()
+	defer mi.mx.RUnlock()
+	sids := make([]SessionID, 0, len(mi.subjects[subject]))
+	for sid := range mi.subjects[subject] {
+		sids = append(sids, sid)
+	}
+	return sids, nil
+}
+
+//RedisIndex is an Index kept in redis sets
+type RedisIndex struct {
+	Client *redis.Client
+	//Expiry is how long the set of a subject is kept after a session
+	//was last added to it. It must be at least the session duration.
+	//Sets are kept until they are emptied if it is 0.
+	Expiry time.Duration
+}
+
+//NewRedisIndex constructs a new RedisIndex
+func NewRedisIndex(client *redis.Client, expiry time.Duration) *RedisIndex {
+	if client == nil {
+		panic("nil pointer passed for client")
+	}
+	return &RedisIndex{
+		Client: client,
+		Expiry: expiry,
+	}
+}
+
+//Add records that the session belongs to `subject`, and resets the
+//expiry time of the set in the same transaction, so that the sets of
+//users whose sessions were never listed don't grow forever
+func (ri *RedisIndex) Add(subject string, sid SessionID) error {
+	key := getIndexKey(subject)
+	pipe := ri.Client.TxPipeline()
+	pipe.SAdd(key, sid.String())
+	if ri.Expiry > 0 {
+		pipe.PExpire(key, ri.Expiry)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+//Remove forgets the session of `subject`
+func (ri *RedisIndex) Remove(subject string, sid SessionID) error {
+	return ri.Client.SRem(getIndexKey(subject), sid.String()).Err()
+}
+
+//List returns the sessions recorded for `subject`
+func (ri *RedisIndex) List(subject string) ([]SessionID, error) {
+	members, err := ri.Client.SMembers(getIndexKey(subject)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sids := make([]SessionID, len(members))
+	for i, m := range members {
+		sids[i] = SessionID(m)
+	}
+	return sids, nil
+}
+
+//getIndexKey returns the redis key of the set of sessions of `subject`
+func getIndexKey(subject string) string {
+	return "subject:" + subject
+}
+
+//listSessions returns the sessions of `subject` that still have state in
+//the store, removing the ones that have ended or expired from the index
+func listSessions(index Index, store Store, subject string) ([]SessionID, error) {
+	sids, err := index.List(subject)
+	if err != nil {
+		return nil, err
+	}
+	active := []SessionID{}
+	for _, sid := range sids {
+		var state interface{}
+		err := store.Get(sid, &state)
+		if err == ErrStateNotFound {
+			if err := index.Remove(subject, sid); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		active = append(active, sid)
+	}
+	return active, nil
+}
@@ -0,0 +1,70 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestManagerSessions(t *testing.T) {
+	hs, err := NewHS256Signer("jwt key")
+	if err != nil {
+		t.Fatalf("error creating HS256 signer: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		manager Manager
+	}{
+		{
+			"Opaque",
+			NewOpaqueManager("test key", NewMemStore(time.Hour, time.Minute)),
+		},
+		{
+			"Token",
+			NewTokenManager("test key", NewMemStore(time.Hour, time.Minute), hs, NewMemDenylist(time.Minute), time.Minute),
+		},
+	}
+
+	for _, c := range cases {
+		sids := []SessionID{}
+		for _, userID := range []string{"user1", "user1", "user1", "user2"} {
+			sid, err := c.manager.Begin(&tokenState{UserID: userID}, httptest.NewRecorder())
+			if err != nil {
+				t.Fatalf("%s: error beginning session: %v", c.name, err)
+			}
+			sids = append(sids, sid)
+		}
+
+		active, err := c.manager.Sessions("user1")
+		if err != nil {
+			t.Fatalf("%s: error listing sessions: %v", c.name, err)
+		}
+		if len(active) != 3 {
+			t.Errorf("%s: expected 3 sessions but got %d", c.name, len(active))
+		}
+
+		if err := c.manager.Revoke(sids[0]); err != nil {
+			t.Fatalf("%s: error revoking session: %v", c.name, err)
+		}
+		active, err = c.manager.Sessions("user1")
+		if err != nil {
+			t.Fatalf("%s: error listing sessions: %v", c.name, err)
+		}
+		if len(active) != 2 {
+			t.Errorf("%s: expected 2 sessions after revoking one but got %d", c.name, len(active))
+		}
+		for _, sid := range active {
+			if sid == sids[0] {
+				t.Errorf("%s: revoked session is still listed", c.name)
+			}
+		}
+
+		if active, _ := c.manager.Sessions("user2"); len(active) != 1 || active[0] != sids[3] {
+			t.Errorf("%s: expected only the session of user2 but got %v", c.name, active)
+		}
+		if active, _ := c.manager.Sessions("nobody"); len(active) != 0 {
+			t.Errorf("%s: expected no sessions for unknown subject but got %v", c.name, active)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package sessions
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//ErrInvalidToken is returned when an access token is malformed or its signature doesn't verify
+var ErrInvalidToken = errors.New("invalid access token")
+
+//ErrTokenExpired is returned when an access token has expired
+var ErrTokenExpired = errors.New("access token has expired")
+
+//TokenSigner signs and verifies JSON Web Tokens
+type TokenSigner interface {
+	//Algorithm returns the JWS "alg" header value for this signer
+	Algorithm() string
+	//Sign returns the signature of the JWS signing input
+	Sign(signingInput []byte) ([]byte, error)
+	//Verify reports whether `signature` is valid for the signing input
+	Verify(signingInput []byte, signature []byte) bool
+}
+
+//HS256Signer signs tokens with HMAC-SHA256
+type HS256Signer struct {
+	key []byte
+}
+
+//NewHS256Signer constructs a new HS256Signer using `key` as the HMAC key
+func NewHS256Signer(key string) (*HS256Signer, error) {
+	if len(key) == 0 {
+		return nil, errors.New("HS256 signing key may not be empty")
+	}
+	return &HS256Signer{key: []byte(key)}, nil
+}
+
+//Algorithm returns "HS256"
+func (s *HS256Signer) Algorithm() string {
+	return "HS256"
+}
+
+//Sign returns the HMAC of the signing input
+func (s *HS256Signer) Sign(signingInput []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, s.key)
+	h.Write(signingInput)
+	return h.Sum(nil), nil
+}
+
+//Verify compares the HMAC of the signing input with `signature`
+func (s *HS256Signer) Verify(signingInput []byte, signature []byte) bool {
+	expected, _ := s.Sign(signingInput)
+	return hmac.Equal(expected, signature)
+}
+
+//EdDSASigner signs tokens with Ed25519
+type EdDSASigner struct {
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+//NewEdDSASigner constructs a new EdDSASigner from a 32-byte Ed25519 seed
+func NewEdDSASigner(seed []byte) (*EdDSASigner, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Ed25519 seed must be %d bytes but was %d", ed25519.SeedSize, len(seed))
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	return &EdDSASigner{
+		privateKey: priv,
+		publicKey:  priv.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+//Algorithm returns "EdDSA"
+func (s *EdDSASigner) Algorithm() string {
+	return "EdDSA"
+}
+
+//Sign returns the Ed25519 signature of the signing input
+func (s *EdDSASigner) Sign(signingInput []byte) ([]byte, error) {
+	return ed25519.Sign(s.privateKey, signingInput), nil
+}
+
+//Verify checks the Ed25519 signature against the public key
+func (s *EdDSASigner) Verify(signingInput []byte, signature []byte) bool {
+	return ed25519.Verify(s.publicKey, signingInput, signature)
+}
+
+//Claims are the claims carried by an access token
+type Claims struct {
+	ID        string          `json:"jti"`
+	Subject   string          `json:"sub,omitempty"`
+	SessionID SessionID       `json:"sid"`
+	IssuedAt  int64           `json:"iat"`
+	ExpiresAt int64           `json:"exp"`
+	State     json.RawMessage `json:"state,omitempty"`
+}
+
+//jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+var b64 = base64.RawURLEncoding
+
+//encodeToken signs the claims and returns the compact serialization of the token
+func encodeToken(signer TokenSigner, claims *Claims) (string, error) {
+	header, err := json.Marshal(&jwtHeader{Algorithm: signer.Algorithm(), Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sig, err := signer.Sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + b64.EncodeToString(sig), nil
+}
+
+//decodeToken verifies the token signature and expiry, and returns its claims
+func decodeToken(signer TokenSigner, token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	header := &jwtHeader{}
+	if err := json.Unmarshal(headerJSON, header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	//never let the token pick the algorithm
+	if header.Algorithm != signer.Algorithm() {
+		return nil, ErrInvalidToken
+	}
+
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !signer.Verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
@@ -0,0 +1,100 @@
+package sessions
+
+import (
+	"net/http"
+)
+
+//Manager begins, reads, updates and ends sessions. Handlers use it so
+//they work the same whether clients hold opaque session IDs or
+//signed access tokens.
+type Manager interface {
+	//Begin starts a new session for `sessionState`, adds the credentials
+	//for it to the response headers, and returns the new SessionID
+	Begin(sessionState interface{}, w http.ResponseWriter) (SessionID, error)
+
+	//Get populates `sessionState` with the state of the session
+	//identified by the request credentials, and returns its SessionID
+	Get(r *http.Request, sessionState interface{}) (SessionID, error)
+
+	//Update replaces the state of an existing session. Managers that
+	//carry state in the credentials add refreshed credentials to `w`.
+	Update(sid SessionID, sessionState interface{}, w http.ResponseWriter) error
+
+	//End ends the session identified by the request credentials
+	//and returns its SessionID
+	End(r *http.Request) (SessionID, error)
+
+	//Sessions returns the SessionIDs of the active sessions whose state
+	//names `subject` (see Subjecter)
+	Sessions(subject string) ([]SessionID, error)
+
+	//Revoke ends the session with the given SessionID
+	Revoke(sid SessionID) error
+}
+
+//OpaqueManager is a Manager for sessions identified by signed
+//SessionIDs whose state is kept in a Store
+type OpaqueManager struct {
+	SigningKey string
+	Store      Store
+	Index      Index
+}
+
+//NewOpaqueManager constructs a new OpaqueManager. Sessions are
+//indexed in memory until the Index is replaced.
+func NewOpaqueManager(signingKey string, store Store) *OpaqueManager {
+	return &OpaqueManager{
+		SigningKey: signingKey,
+		Store:      store,
+		Index:      NewMemIndex(),
+	}
+}
+
+//Begin starts a new session for `sessionState`
+func (om *OpaqueManager) Begin(sessionState interface{}, w http.ResponseWriter) (SessionID, error) {
+	sid, err := BeginSession(om.SigningKey, om.Store, sessionState, w)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	if subject := subjectOf(sessionState); len(subject) > 0 {
+		if err := om.Index.Add(subject, sid); err != nil {
+			return InvalidSessionID, err
+		}
+	}
+	return sid, nil
+}
+
+//Get populates `sessionState` from the store. Using a session keeps it
+//from expiring, so it is added to the index again to keep it listed.
+func (om *OpaqueManager) Get(r *http.Request, sessionState interface{}) (SessionID, error) {
+	sid, err := GetState(r, om.SigningKey, om.Store, sessionState)
+	if err != nil {
+		return sid, err
+	}
+	if subject := subjectOf(sessionState); len(subject) > 0 {
+		if err := om.Index.Add(subject, sid); err != nil {
+			return InvalidSessionID, err
+		}
+	}
+	return sid, nil
+}
+
+//Update saves `sessionState` to the store
+func (om *OpaqueManager) Update(sid SessionID, sessionState interface{}, w http.ResponseWriter) error {
+	return om.Store.Save(sid, sessionState)
+}
+
+//End deletes the session state from the store
+func (om *OpaqueManager) End(r *http.Request) (SessionID, error) {
+	return EndSession(r, om.SigningKey, om.Store)
+}
+
+//Sessions returns the SessionIDs of the active sessions of `subject`
+func (om *OpaqueManager) Sessions(subject string) ([]SessionID, error) {
+	return listSessions(om.Index, om.Store, subject)
+}
+
+//Revoke deletes the session state from the store
+func (om *OpaqueManager) Revoke(sid SessionID) error {
+	return om.Store.Delete(sid)
+}
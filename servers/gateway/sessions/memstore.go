@@ -2,6 +2,7 @@ package sessions
 
 import (
 	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -12,6 +13,7 @@ import (
 //Production systems should use a shared server store like redis
 type MemStore struct {
 	entries *cache.Cache
+	mx      sync.Mutex
 }
 
 //NewMemStore constructs and returns a new MemStore
@@ -29,6 +31,8 @@ func (ms *MemStore) Save(sid SessionID, state interface{}) error {
 	if nil != err {
 		return err
 	}
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
 	ms.entries.Set(sid.String(), j, cache.DefaultExpiration)
 	return nil
 }
@@ -36,6 +40,8 @@ func (ms *MemStore) Save(sid SessionID, state interface{}) error {
 //Get populates `sessionState` with the data previously saved
 //for the given SessionID
 func (ms *MemStore) Get(sid SessionID, state interface{}) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
 	j, found := ms.entries.Get(sid.String())
 	if !found {
 		return ErrStateNotFound
@@ -46,8 +52,33 @@ func (ms *MemStore) Get(sid SessionID, state interface{}) error {
 	return json.Unmarshal(j.([]byte), state)
 }
 
+//Modify gets the state, changes it with `fn` and saves it,
+//holding the lock so that nothing else changes it in between
+func (ms *MemStore) Modify(sid SessionID, state interface{}, fn func() error) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	j, found := ms.entries.Get(sid.String())
+	if !found {
+		return ErrStateNotFound
+	}
+	if err := json.Unmarshal(j.([]byte), state); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	j, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	ms.entries.Set(sid.String(), j, cache.DefaultExpiration)
+	return nil
+}
+
 //Delete deletes all state data associated with the SessionID from the store.
 func (ms *MemStore) Delete(sid SessionID) error {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
 	ms.entries.Delete(sid.String())
 	return nil
 }
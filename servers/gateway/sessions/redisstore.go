@@ -2,16 +2,25 @@ package sessions
 
 import (
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/go-redis/redis"
 )
 
+//maxModifyAttempts is how many times Modify tries when the state was changed
+//by someone else while it was modified. Each attempt only fails if another
+//change succeeded, so this many modifications can be made at once.
+const maxModifyAttempts = 10
+
+//errModifyConflict is returned when the state kept being changed by someone else
+var errModifyConflict = errors.New("session state kept changing while it was modified")
+
 //RedisStore represents a session.Store backed by redis.
 type RedisStore struct {
 	//Redis client used to talk to redis server.
 	Client *redis.Client
-	//Used for key expiry time on redis.
+	//Used for key expiry time on redis. Sessions don't expire if it is 0.
 	SessionDuration time.Duration
 }
 
@@ -51,25 +60,61 @@ func (rs *RedisStore) Save(sid SessionID, sessionState interface{}) error {
 //Get populates `sessionState` with the data previously saved
 //for the given SessionID
 func (rs *RedisStore) Get(sid SessionID, sessionState interface{}) error {
-	//TODO: get the previously-saved session state data from redis,
-	//unmarshal it back into the `sessionState` parameter
-	//and reset the expiry time, so that it doesn't get deleted until
-	//the SessionDuration has elapsed.
-
-	//for extra-credit using the Pipeline feature of the redis
-	//package to do both the get and the reset of the expiry time
-	//in just one network round trip!
-	data, err := rs.Client.Get(sid.getRedisKey()).Result()
-	if err != nil {
+	//get the data and reset the expiry time in one round trip.
+	//PEXPIRE with 0 would delete the key, so it is left alone then.
+	pipe := rs.Client.Pipeline()
+	get := pipe.Get(sid.getRedisKey())
+	if rs.SessionDuration > 0 {
+		pipe.PExpire(sid.getRedisKey(), rs.SessionDuration)
+	}
+	if _, err := pipe.Exec(); err == redis.Nil {
 		return ErrStateNotFound
+	} else if err != nil {
+		return err
 	}
 
-	err = rs.Client.Set(sid.getRedisKey(), data, rs.SessionDuration).Err()
+	data, err := get.Bytes()
 	if err != nil {
 		return err
 	}
+	return json.Unmarshal(data, sessionState)
+}
 
-	return json.Unmarshal([]byte(data), sessionState)
+//Modify gets the state, changes it with `fn` and saves it in a transaction
+//that fails if the key changes after it was read, watching it with WATCH.
+//When that happens, it starts over with the state saved in the meantime.
+func (rs *RedisStore) Modify(sid SessionID, sessionState interface{}, fn func() error) error {
+	key := sid.getRedisKey()
+	for i := 0; i < maxModifyAttempts; i++ {
+		err := rs.Client.Watch(func(tx *redis.Tx) error {
+			data, err := tx.Get(key).Bytes()
+			if err == redis.Nil {
+				return ErrStateNotFound
+			} else if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(data, sessionState); err != nil {
+				return err
+			}
+			if err := fn(); err != nil {
+				return err
+			}
+			ss, err := json.Marshal(sessionState)
+			if err != nil {
+				return err
+			}
+			//only runs if nobody changed the key since WATCH
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(key, ss, rs.SessionDuration)
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return errModifyConflict
 }
 
 //Delete deletes all state data associated with the SessionID from the store.
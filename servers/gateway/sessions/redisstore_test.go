@@ -1,44 +1,26 @@
-package sessions
+package sessions_test
 
 import (
-	"encoding/json"
-	"reflect"
+	"os"
 	"testing"
 	"time"
 
-	"os"
-
 	"github.com/go-redis/redis"
+	"github.com/synapse-api/servers/gateway/sessions"
+	"github.com/synapse-api/servers/gateway/sessions/storetest"
+	"gopkg.in/mgo.v2/bson"
 )
 
 /*
 TestRedisStore tests the RedisStore object
 Because the redis.Client is a struct and not an interface,
 this is really more of an integration than a unit test.
-It tests the basic CRUD cycle, ensuring that session state
-saved to redis can be retrieved again.
 
 By default, the test will try to use a local instance of
 redis running on its default port (6379). If you want to
 use a different address, set the REDISADDR environment variable.
 */
 func TestRedisStore(t *testing.T) {
-	type sessionState struct {
-		Sval string
-		Ival int
-	}
-
-	state := &sessionState{
-		Sval: "testing",
-		Ival: 99,
-	}
-	stateRet := &sessionState{}
-
-	sid, err := NewSessionID("test key")
-	if err != nil {
-		t.Fatalf("error generating new SessionID: %v", err)
-	}
-
 	redisaddr := os.Getenv("REDISADDR")
 	if len(redisaddr) == 0 {
 		redisaddr = "127.0.0.1:6379"
@@ -47,37 +29,52 @@ func TestRedisStore(t *testing.T) {
 	client := redis.NewClient(&redis.Options{
 		Addr: redisaddr,
 	})
+	defer client.Close()
 
-	store := NewRedisStore(client, time.Hour)
-
-	if err := store.Get(sid, stateRet); err != ErrStateNotFound {
-		t.Errorf("incorrect error when getting state that was never stored: expected %v but got %v", ErrStateNotFound, err)
-	}
+	storetest.Run(t, func(sessionDuration time.Duration) sessions.Store {
+		return sessions.NewRedisStore(client, sessionDuration)
+	})
+}
 
-	if err := store.Save(sid, &state); err != nil {
-		t.Fatalf("error saving state: %v", err)
+func TestRedisIndex(t *testing.T) {
+	redisaddr := os.Getenv("REDISADDR")
+	if len(redisaddr) == 0 {
+		redisaddr = "127.0.0.1:6379"
 	}
 
-	//verify that trying to save an unmarshalable session state
-	//generates an error (function values can't be encoded in JSON)
-	if err := store.Save(sid, func() {}); err == nil {
-		t.Error("expected erorr when attempting to save an unmarshalable session state")
+	client := redis.NewClient(&redis.Options{
+		Addr: redisaddr,
+	})
+	defer client.Close()
+
+	const expiry = 500 * time.Millisecond
+	index := sessions.NewRedisIndex(client, expiry)
+	subject := bson.NewObjectId().Hex()
+	sids := make([]sessions.SessionID, 2)
+	for i := range sids {
+		sid, err := sessions.NewSessionID("test key")
+		if err != nil {
+			t.Fatalf("error generating new SessionID: %v", err)
+		}
+		sids[i] = sid
 	}
 
-	if err := store.Get(sid, &stateRet); err != nil {
-		t.Fatalf("error getting state: %v", err)
+	//adding a session keeps the sessions added before it listed
+	if err := index.Add(subject, sids[0]); err != nil {
+		t.Fatalf("error adding session: %v", err)
 	}
-	if !reflect.DeepEqual(state, stateRet) {
-		jexp, _ := json.MarshalIndent(state, "", "  ")
-		jact, _ := json.MarshalIndent(state, "", "  ")
-		t.Errorf("incorrect state retrieved:\nEXPECTED\n%s\nACTUAL\n%s", string(jexp), string(jact))
+	time.Sleep(expiry * 3 / 5)
+	if err := index.Add(subject, sids[1]); err != nil {
+		t.Fatalf("error adding session: %v", err)
 	}
-
-	if err := store.Delete(sid); err != nil {
-		t.Errorf("error deleting state: %v", err)
+	time.Sleep(expiry * 3 / 5)
+	if listed, err := index.List(subject); err != nil || len(listed) != 2 {
+		t.Errorf("expected 2 sessions to be listed but got %v, %v", listed, err)
 	}
 
-	if err := store.Get(sid, &stateRet); err != ErrStateNotFound {
-		t.Fatalf("incorrect error when getting state that was deleted: expected %v but got %v", ErrStateNotFound, err)
+	//the set expires once no session has been added for the expiry time
+	time.Sleep(expiry)
+	if listed, err := index.List(subject); err != nil || len(listed) != 0 {
+		t.Errorf("expected the sessions to expire but got %v, %v", listed, err)
 	}
 }
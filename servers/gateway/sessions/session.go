@@ -48,6 +48,21 @@ func GetSessionID(r *http.Request, signingKey string) (SessionID, error) {
 	//or the "auth" query string parameter if no Authorization header is present,
 	//and validate it. If it's valid, return the SessionID. If not
 	//return the validation error.
+	val, err := getBearerToken(r)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+
+	sid, err := ValidateID(val, signingKey)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	return sid, nil
+}
+
+//getBearerToken returns the bearer token from the Authorization header,
+//or the "auth" query string parameter if no Authorization header is present
+func getBearerToken(r *http.Request) (string, error) {
 	val := r.Header.Get(headerAuthorization)
 
 	if len(val) == 0 {
@@ -55,16 +70,10 @@ func GetSessionID(r *http.Request, signingKey string) (SessionID, error) {
 	}
 
 	if !strings.HasPrefix(val, schemeBearer) {
-		return InvalidSessionID, ErrInvalidScheme
+		return "", ErrInvalidScheme
 	}
 
-	val = val[len(schemeBearer):]
-
-	sid, err := ValidateID(val, signingKey)
-	if err != nil {
-		return InvalidSessionID, err
-	}
-	return sid, nil
+	return val[len(schemeBearer):], nil
 }
 
 //GetState extracts the SessionID from the request,
@@ -20,9 +20,17 @@ type Store interface {
 	Save(sid SessionID, sessionState interface{}) error
 
 	//Get populates `sessionState` with the data previously saved
-	//for the given SessionID
+	//for the given SessionID, and resets its expiry time.
+	//ErrStateNotFound is returned if there is none, or it expired.
 	Get(sid SessionID, sessionState interface{}) error
 
+	//Modify populates `sessionState` like Get, calls `fn` to change it, and saves
+	//it like Save, as one atomic operation: the state can't change in between,
+	//so `fn` can check it before changing it. Nothing is saved if `fn` returns an
+	//error, which Modify returns. ErrStateNotFound is returned if there is no state.
+	Modify(sid SessionID, sessionState interface{}, fn func() error) error
+
 	//Delete deletes all state data associated with the SessionID from the store.
+	//Deleting a SessionID that isn't in the store is not an error.
 	Delete(sid SessionID) error
 }
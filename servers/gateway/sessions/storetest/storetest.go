@@ -0,0 +1,245 @@
+//Package storetest provides a conformance test suite for sessions.Store
+//implementations, so that every implementation behaves the same way
+package storetest
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//sessionDuration is the duration of sessions in stores for tests
+//that don't wait for sessions to expire
+const sessionDuration = time.Hour
+
+//expiryDuration is the duration of sessions in stores for tests that do
+const expiryDuration = 500 * time.Millisecond
+
+//sessionState is the state saved in the tests
+type sessionState struct {
+	Sval string
+	Ival int
+}
+
+//Run runs the suite. `newStore` must return a new store each time it is
+//called, whose sessions expire after `sessionDuration`, or never if it is 0.
+func Run(t *testing.T, newStore func(sessionDuration time.Duration) sessions.Store) {
+	tests := []struct {
+		name     string
+		duration time.Duration
+		fn       func(t *testing.T, store sessions.Store)
+	}{
+		{"CRUD", sessionDuration, testCRUD},
+		{"Unmarshalable", sessionDuration, testUnmarshalable},
+		{"Expiry", expiryDuration, testExpiry},
+		{"NoExpiry", 0, testNoExpiry},
+		{"Concurrency", sessionDuration, testConcurrency},
+		{"Modify", sessionDuration, testModify},
+	}
+	for _, test := range tests {
+		fn := test.fn
+		duration := test.duration
+		t.Run(test.name, func(t *testing.T) {
+			fn(t, newStore(duration))
+		})
+	}
+}
+
+//newSessionID returns a new SessionID, failing the test on error
+func newSessionID(t *testing.T) sessions.SessionID {
+	sid, err := sessions.NewSessionID("test key")
+	if err != nil {
+		t.Fatalf("error generating new SessionID: %v", err)
+	}
+	return sid
+}
+
+/*
+testCRUD runs through a full CRUD cycle.
+
+Since a Store is like a database, you can't really test methods like Get()
+or Delete() without also calling (and therefore testing) methods like Save(),
+so instead of testing individual methods in isolation, this test runs through
+a full CRUD cycle, ensuring the correct behavior occurs at each point in that
+cycle.
+*/
+func testCRUD(t *testing.T, store sessions.Store) {
+	state := &sessionState{Sval: "testing", Ival: 99}
+	sid := newSessionID(t)
+
+	if err := store.Get(sid, &sessionState{}); err != sessions.ErrStateNotFound {
+		t.Errorf("incorrect error when getting state that was never stored: expected %v but got %v", sessions.ErrStateNotFound, err)
+	}
+
+	if err := store.Save(sid, state); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+	stateRet := &sessionState{}
+	if err := store.Get(sid, stateRet); err != nil {
+		t.Fatalf("error getting state: %v", err)
+	}
+	if !reflect.DeepEqual(state, stateRet) {
+		t.Errorf("incorrect state retrieved: expected %+v but got %+v", state, stateRet)
+	}
+
+	//saving again replaces the state
+	state.Ival = 100
+	if err := store.Save(sid, state); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+	if err := store.Get(sid, stateRet); err != nil || stateRet.Ival != state.Ival {
+		t.Errorf("expected saved state to be replaced but got %+v, %v", stateRet, err)
+	}
+
+	//other sessions are independent
+	other := newSessionID(t)
+	if err := store.Save(other, &sessionState{Sval: "other"}); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+
+	if err := store.Delete(sid); err != nil {
+		t.Errorf("error deleting state: %v", err)
+	}
+	if err := store.Get(sid, stateRet); err != sessions.ErrStateNotFound {
+		t.Errorf("incorrect error when getting state that was deleted: expected %v but got %v", sessions.ErrStateNotFound, err)
+	}
+	if err := store.Delete(sid); err != nil {
+		t.Errorf("expected deleting state twice to succeed but got %v", err)
+	}
+	if err := store.Get(other, stateRet); err != nil || stateRet.Sval != "other" {
+		t.Errorf("expected other state to be kept but got %+v, %v", stateRet, err)
+	}
+}
+
+//testUnmarshalable checks that saving a state that can't
+//be encoded fails, and leaves the stored state alone
+func testUnmarshalable(t *testing.T, store sessions.Store) {
+	sid := newSessionID(t)
+	if err := store.Save(sid, &sessionState{Sval: "testing"}); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+	//function values can't be marshaled into JSON
+	if err := store.Save(sid, func() {}); err == nil {
+		t.Error("expected error when attempting to save a session state with an unmarshalable field")
+	}
+	stateRet := &sessionState{}
+	if err := store.Get(sid, stateRet); err != nil || stateRet.Sval != "testing" {
+		t.Errorf("expected stored state to be kept but got %+v, %v", stateRet, err)
+	}
+}
+
+//testExpiry checks that sessions expire, and that getting
+//a session resets its expiry time
+func testExpiry(t *testing.T, store sessions.Store) {
+	sid := newSessionID(t)
+	if err := store.Save(sid, &sessionState{Sval: "testing"}); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+
+	//each Get happens before the session expires,
+	//though together they take longer than a session lasts
+	for i := 0; i < 3; i++ {
+		time.Sleep(expiryDuration * 3 / 5)
+		if err := store.Get(sid, &sessionState{}); err != nil {
+			t.Fatalf("expected session to be kept alive but got %v", err)
+		}
+	}
+
+	time.Sleep(expiryDuration * 2)
+	if err := store.Get(sid, &sessionState{}); err != sessions.ErrStateNotFound {
+		t.Errorf("incorrect error when getting state that expired: expected %v but got %v", sessions.ErrStateNotFound, err)
+	}
+}
+
+//testNoExpiry checks that sessions of stores without a session duration are kept
+func testNoExpiry(t *testing.T, store sessions.Store) {
+	sid := newSessionID(t)
+	if err := store.Save(sid, &sessionState{Sval: "testing"}); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Get(sid, &sessionState{}); err != nil {
+			t.Fatalf("expected session to be kept but got %v on get %d", err, i+1)
+		}
+	}
+}
+
+//testConcurrency checks that concurrent use of different sessions doesn't interfere
+func testConcurrency(t *testing.T, store sessions.Store) {
+	const n = 20
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		sid := newSessionID(t)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if err := store.Save(sid, &sessionState{Ival: i*10 + j}); err != nil {
+					t.Errorf("error saving state: %v", err)
+					return
+				}
+				stateRet := &sessionState{}
+				if err := store.Get(sid, stateRet); err != nil {
+					t.Errorf("error getting state: %v", err)
+					return
+				}
+				if stateRet.Ival != i*10+j {
+					t.Errorf("expected state %d but got %d", i*10+j, stateRet.Ival)
+				}
+			}
+			if err := store.Delete(sid); err != nil {
+				t.Errorf("error deleting state: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+//testModify checks that Modify changes the state, saves nothing when the
+//function fails, and that concurrent modifications don't overwrite each other
+func testModify(t *testing.T, store sessions.Store) {
+	sid := newSessionID(t)
+	if err := store.Modify(sid, &sessionState{}, func() error { return nil }); err != sessions.ErrStateNotFound {
+		t.Errorf("incorrect error when modifying state that was never stored: expected %v but got %v", sessions.ErrStateNotFound, err)
+	}
+	if err := store.Save(sid, &sessionState{Sval: "testing"}); err != nil {
+		t.Fatalf("error saving state: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	state := &sessionState{}
+	if err := store.Modify(sid, state, func() error {
+		state.Sval = "changed"
+		return errStop
+	}); err != errStop {
+		t.Errorf("expected the function's error but got %v", err)
+	}
+	stateRet := &sessionState{}
+	if err := store.Get(sid, stateRet); err != nil || stateRet.Sval != "testing" {
+		t.Errorf("expected state to be kept when the function fails but got %+v, %v", stateRet, err)
+	}
+
+	const n = 10
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			state := &sessionState{}
+			if err := store.Modify(sid, state, func() error {
+				state.Ival++
+				return nil
+			}); err != nil {
+				t.Errorf("error modifying state: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := store.Get(sid, stateRet); err != nil || stateRet.Ival != n || stateRet.Sval != "testing" {
+		t.Errorf("expected every modification to be kept but got %+v, %v", stateRet, err)
+	}
+}
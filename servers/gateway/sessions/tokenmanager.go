@@ -0,0 +1,339 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//HeaderRefreshToken is the response header carrying newly issued refresh tokens
+const HeaderRefreshToken = "X-Refresh-Token"
+
+//ErrInvalidRefreshToken is returned when a refresh token is malformed, unknown or already used
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+//ErrTokenRevoked is returned when an access token or its session has been revoked
+var ErrTokenRevoked = errors.New("access token has been revoked")
+
+//errRefreshTokenReused is returned from rotating a refresh token whose
+//secret was already replaced, which means the token was used before
+var errRefreshTokenReused = errors.New("refresh token was already used")
+
+//Subjecter is implemented by session states that can name their subject,
+//which is then carried in the "sub" claim of access tokens and used
+//to index the subject's sessions
+type Subjecter interface {
+	Subject() string
+}
+
+//TokenPair is the pair of credentials issued to a client
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	TokenType    string `json:"tokenType"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+//tokenSession is the record kept in the Store for each token session.
+//Only a hash of the current refresh secret is stored.
+type tokenSession struct {
+	Subject    string
+	SecretHash []byte
+	State      json.RawMessage
+}
+
+//TokenManager is a Manager that issues short-lived signed access tokens
+//carrying the session state, plus opaque refresh tokens kept in a Store.
+//Reading a session only verifies the token and checks the denylist, so
+//it doesn't need to load the session state from the store. Checking the
+//denylist is still a round trip when it is shared through redis, which
+//is what lets ending a session revoke its access token straight away.
+//
+//A refresh token has the form "<SessionID>.<secret>": the SessionID names
+//the record in the store and is also carried in the access token's "sid"
+//claim, while the secret is rotated every time the token is used.
+type TokenManager struct {
+	SigningKey     string
+	Store          Store
+	Signer         TokenSigner
+	Denylist       Denylist
+	Index          Index
+	AccessDuration time.Duration
+}
+
+//NewTokenManager constructs a new TokenManager. The `signingKey` signs
+//the SessionIDs of refresh tokens, while `signer` signs access tokens.
+//Sessions are indexed in memory until the Index is replaced.
+func NewTokenManager(signingKey string, store Store, signer TokenSigner, denylist Denylist, accessDuration time.Duration) *TokenManager {
+	if store == nil || signer == nil || denylist == nil {
+		panic("nil store, signer or denylist passed to NewTokenManager")
+	}
+	return &TokenManager{
+		SigningKey:     signingKey,
+		Store:          store,
+		Signer:         signer,
+		Denylist:       denylist,
+		Index:          NewMemIndex(),
+		AccessDuration: accessDuration,
+	}
+}
+
+//Begin starts a new token session for `sessionState`, adding the access token
+//to the Authorization header and the refresh token to the X-Refresh-Token header
+func (tm *TokenManager) Begin(sessionState interface{}, w http.ResponseWriter) (SessionID, error) {
+	sid, err := NewSessionID(tm.SigningKey)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	state, err := json.Marshal(sessionState)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	subject := subjectOf(sessionState)
+	pair, err := tm.issue(sid, subject, state)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	if len(subject) > 0 {
+		if err := tm.Index.Add(subject, sid); err != nil {
+			return InvalidSessionID, err
+		}
+	}
+	setTokenHeaders(w, pair)
+	return sid, nil
+}
+
+//Get verifies the access token in the request and populates `sessionState`
+//from its claims. It returns the SessionID of the token session.
+func (tm *TokenManager) Get(r *http.Request, sessionState interface{}) (SessionID, error) {
+	claims, err := tm.GetClaims(r)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	if err := json.Unmarshal(claims.State, sessionState); err != nil {
+		return InvalidSessionID, err
+	}
+	return claims.SessionID, nil
+}
+
+//GetClaims verifies the access token in the request and returns its claims
+func (tm *TokenManager) GetClaims(r *http.Request) (*Claims, error) {
+	token, err := getBearerToken(r)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := decodeToken(tm.Signer, token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := tm.Denylist.Contains(getDenyID(claims.SessionID))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+//Update replaces the session state kept for refreshes, and adds a new
+//access token carrying the updated state to the Authorization header
+func (tm *TokenManager) Update(sid SessionID, sessionState interface{}, w http.ResponseWriter) error {
+	state, err := json.Marshal(sessionState)
+	if err != nil {
+		return err
+	}
+	//the refresh secret may be rotated at the same time, and must be kept
+	ts := &tokenSession{}
+	if err := tm.Store.Modify(sid, ts, func() error {
+		ts.Subject = subjectOf(sessionState)
+		ts.State = state
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := tm.keepIndexed(sid, ts.Subject); err != nil {
+		return err
+	}
+	access, err := tm.newAccessToken(sid, ts.Subject, state)
+	if err != nil {
+		return err
+	}
+	w.Header().Set(headerAuthorization, schemeBearer+access)
+	return nil
+}
+
+//End revokes every access token issued for the session of the access
+//token in the request, and deletes its refresh token
+func (tm *TokenManager) End(r *http.Request) (SessionID, error) {
+	claims, err := tm.GetClaims(r)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	if err := tm.Revoke(claims.SessionID); err != nil {
+		return InvalidSessionID, err
+	}
+	return claims.SessionID, nil
+}
+
+//Revoke ends the token session with the given SessionID. Access tokens
+//already issued for it are rejected until they would have expired.
+func (tm *TokenManager) Revoke(sid SessionID) error {
+	if err := tm.Denylist.Add(getDenyID(sid), tm.AccessDuration); err != nil {
+		return err
+	}
+	return tm.Store.Delete(sid)
+}
+
+//Sessions returns the SessionIDs of the active token sessions of `subject`
+func (tm *TokenManager) Sessions(subject string) ([]SessionID, error) {
+	return listSessions(tm.Index, tm.Store, subject)
+}
+
+//keepIndexed adds the session to the index again after its refresh
+//record was saved, which keeps it from expiring, so it stays listed
+func (tm *TokenManager) keepIndexed(sid SessionID, subject string) error {
+	if len(subject) == 0 {
+		return nil
+	}
+	return tm.Index.Add(subject, sid)
+}
+
+//Refresher is implemented by Managers that issue refresh tokens,
+//which can be exchanged for new credentials
+type Refresher interface {
+	Refresh(refreshToken string) (*TokenPair, error)
+}
+
+//Refresh exchanges a refresh token for a new access token and a new
+//refresh token. Each refresh token may only be used once: presenting
+//an already-used token revokes the whole session, since it means the
+//token was copied. The secret is checked and replaced atomically, so
+//of several requests using the same token at once, only one succeeds.
+func (tm *TokenManager) Refresh(refreshToken string) (*TokenPair, error) {
+	idx := strings.LastIndex(refreshToken, ".")
+	if idx < 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+	sid, err := ValidateID(refreshToken[:idx], tm.SigningKey)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	secret, newHash, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(refreshToken[idx+1:]))
+	ts := &tokenSession{}
+	err = tm.Store.Modify(sid, ts, func() error {
+		if subtle.ConstantTimeCompare(hash[:], ts.SecretHash) != 1 {
+			return errRefreshTokenReused
+		}
+		ts.SecretHash = newHash
+		return nil
+	})
+	if err == errRefreshTokenReused {
+		if err := tm.Revoke(sid); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	if err == ErrStateNotFound {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tm.keepIndexed(sid, ts.Subject); err != nil {
+		return nil, err
+	}
+
+	return tm.newTokenPair(sid, ts.Subject, ts.State, secret)
+}
+
+//issue saves the session state with a new refresh secret,
+//and returns a new pair of tokens
+func (tm *TokenManager) issue(sid SessionID, subject string, state json.RawMessage) (*TokenPair, error) {
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		return nil, err
+	}
+	ts := &tokenSession{
+		Subject:    subject,
+		SecretHash: hash,
+		State:      state,
+	}
+	if err := tm.Store.Save(sid, ts); err != nil {
+		return nil, err
+	}
+	return tm.newTokenPair(sid, subject, state, secret)
+}
+
+//newRefreshSecret returns a new encoded refresh secret and the hash of it to store
+func newRefreshSecret() (string, []byte, error) {
+	secret := make([]byte, idLength)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	encodedSecret := b64.EncodeToString(secret)
+	hash := sha256.Sum256([]byte(encodedSecret))
+	return encodedSecret, hash[:], nil
+}
+
+//newTokenPair signs a new access token, and returns it along with
+//the refresh token carrying the encoded secret
+func (tm *TokenManager) newTokenPair(sid SessionID, subject string, state json.RawMessage, encodedSecret string) (*TokenPair, error) {
+	access, err := tm.newAccessToken(sid, subject, state)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  access,
+		RefreshToken: sid.String() + "." + encodedSecret,
+		TokenType:    strings.TrimSpace(schemeBearer),
+		ExpiresIn:    int64(tm.AccessDuration / time.Second),
+	}, nil
+}
+
+//newAccessToken signs a new access token for the token session
+func (tm *TokenManager) newAccessToken(sid SessionID, subject string, state json.RawMessage) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &Claims{
+		ID:        b64.EncodeToString(jti),
+		Subject:   subject,
+		SessionID: sid,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(tm.AccessDuration).Unix(),
+		State:     state,
+	}
+	return encodeToken(tm.Signer, claims)
+}
+
+//subjectOf returns the subject of the session state, if it names one
+func subjectOf(sessionState interface{}) string {
+	if sub, ok := sessionState.(Subjecter); ok {
+		return sub.Subject()
+	}
+	return ""
+}
+
+//setTokenHeaders adds the token pair to the response headers
+func setTokenHeaders(w http.ResponseWriter, pair *TokenPair) {
+	w.Header().Set(headerAuthorization, schemeBearer+pair.AccessToken)
+	w.Header().Set(HeaderRefreshToken, pair.RefreshToken)
+}
+
+//getDenyID returns the denylist identifier for a token session
+func getDenyID(sid SessionID) string {
+	return "sid:" + sid.String()
+}
@@ -0,0 +1,231 @@
+package sessions
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type tokenState struct {
+	UserID string
+	Name   string
+}
+
+func (ts *tokenState) Subject() string {
+	return ts.UserID
+}
+
+func newTestTokenManager(t *testing.T, signer TokenSigner) *TokenManager {
+	return NewTokenManager("test key", NewMemStore(time.Hour, time.Minute), signer, NewMemDenylist(time.Minute), time.Minute)
+}
+
+//requestWithAccessToken returns a request carrying the access token from the response
+func requestWithAccessToken(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(headerAuthorization, w.Header().Get(headerAuthorization))
+	return r
+}
+
+func TestTokenManager(t *testing.T) {
+	hs, err := NewHS256Signer("jwt key")
+	if err != nil {
+		t.Fatalf("error creating HS256 signer: %v", err)
+	}
+	ed, err := NewEdDSASigner([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("error creating EdDSA signer: %v", err)
+	}
+
+	for _, signer := range []TokenSigner{hs, ed} {
+		tm := newTestTokenManager(t, signer)
+		state := &tokenState{UserID: "user1", Name: "Fred"}
+
+		w := httptest.NewRecorder()
+		sid, err := tm.Begin(state, w)
+		if err != nil {
+			t.Fatalf("%s: error beginning session: %v", signer.Algorithm(), err)
+		}
+		refresh := w.Header().Get(HeaderRefreshToken)
+		if !strings.HasPrefix(refresh, sid.String()+".") {
+			t.Errorf("%s: refresh token should start with the SessionID", signer.Algorithm())
+		}
+
+		r := requestWithAccessToken(w)
+		claims, err := tm.GetClaims(r)
+		if err != nil {
+			t.Fatalf("%s: error getting claims: %v", signer.Algorithm(), err)
+		}
+		if claims.Subject != "user1" || claims.SessionID != sid {
+			t.Errorf("%s: incorrect claims: got sub %q, sid %q", signer.Algorithm(), claims.Subject, claims.SessionID)
+		}
+
+		got := &tokenState{}
+		if _, err := tm.Get(r, got); err != nil {
+			t.Fatalf("%s: error getting state: %v", signer.Algorithm(), err)
+		}
+		if *got != *state {
+			t.Errorf("%s: incorrect state: expected %v but got %v", signer.Algorithm(), state, got)
+		}
+
+		//updating the state issues a new access token carrying it
+		state.Name = "Frederick"
+		w2 := httptest.NewRecorder()
+		if err := tm.Update(sid, state, w2); err != nil {
+			t.Fatalf("%s: error updating state: %v", signer.Algorithm(), err)
+		}
+		if _, err := tm.Get(requestWithAccessToken(w2), got); err != nil || got.Name != "Frederick" {
+			t.Errorf("%s: expected updated state but got %v (err %v)", signer.Algorithm(), got, err)
+		}
+
+		//refreshing rotates the refresh token and keeps the updated state
+		pair, err := tm.Refresh(refresh)
+		if err != nil {
+			t.Fatalf("%s: error refreshing: %v", signer.Algorithm(), err)
+		}
+		if pair.RefreshToken == refresh {
+			t.Errorf("%s: refresh token was not rotated", signer.Algorithm())
+		}
+		r3 := httptest.NewRequest("GET", "/", nil)
+		r3.Header.Set(headerAuthorization, schemeBearer+pair.AccessToken)
+		if _, err := tm.Get(r3, got); err != nil || got.Name != "Frederick" || got.UserID != "user1" {
+			t.Errorf("%s: expected refreshed state but got %v (err %v)", signer.Algorithm(), got, err)
+		}
+
+		//reusing a spent refresh token revokes the whole session
+		if _, err := tm.Refresh(refresh); err != ErrInvalidRefreshToken {
+			t.Errorf("%s: expected %v when reusing refresh token but got %v", signer.Algorithm(), ErrInvalidRefreshToken, err)
+		}
+		if _, err := tm.Get(r3, got); err != ErrTokenRevoked {
+			t.Errorf("%s: expected %v after refresh token reuse but got %v", signer.Algorithm(), ErrTokenRevoked, err)
+		}
+		if _, err := tm.Refresh(pair.RefreshToken); err != ErrInvalidRefreshToken {
+			t.Errorf("%s: expected %v after session revoked but got %v", signer.Algorithm(), ErrInvalidRefreshToken, err)
+		}
+	}
+}
+
+func TestTokenManagerEnd(t *testing.T) {
+	signer, _ := NewHS256Signer("jwt key")
+	tm := newTestTokenManager(t, signer)
+
+	w := httptest.NewRecorder()
+	if _, err := tm.Begin(&tokenState{UserID: "user1"}, w); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	r := requestWithAccessToken(w)
+	if _, err := tm.End(r); err != nil {
+		t.Fatalf("error ending session: %v", err)
+	}
+	if _, err := tm.Get(r, &tokenState{}); err != ErrTokenRevoked {
+		t.Errorf("expected %v after ending session but got %v", ErrTokenRevoked, err)
+	}
+	if _, err := tm.Refresh(w.Header().Get(HeaderRefreshToken)); err != ErrInvalidRefreshToken {
+		t.Errorf("expected %v after ending session but got %v", ErrInvalidRefreshToken, err)
+	}
+}
+
+//slowStore is a Store that takes a while between reading a state and
+//writing it, so that concurrent requests overlap
+type slowStore struct {
+	Store
+}
+
+//Get gets the state and waits
+func (s *slowStore) Get(sid SessionID, sessionState interface{}) error {
+	err := s.Store.Get(sid, sessionState)
+	time.Sleep(10 * time.Millisecond)
+	return err
+}
+
+//Modify waits between getting the state and changing it
+func (s *slowStore) Modify(sid SessionID, sessionState interface{}, fn func() error) error {
+	return s.Store.Modify(sid, sessionState, func() error {
+		time.Sleep(10 * time.Millisecond)
+		return fn()
+	})
+}
+
+func TestTokenManagerConcurrentRefresh(t *testing.T) {
+	signer, _ := NewHS256Signer("jwt key")
+	tm := NewTokenManager("test key", &slowStore{NewMemStore(time.Hour, time.Minute)}, signer, NewMemDenylist(time.Minute), time.Minute)
+
+	w := httptest.NewRecorder()
+	if _, err := tm.Begin(&tokenState{UserID: "user1"}, w); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	refresh := w.Header().Get(HeaderRefreshToken)
+
+	//a copied refresh token is used at the same time as the original
+	const n = 10
+	pairs := make(chan *TokenPair, n)
+	start := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			pair, err := tm.Refresh(refresh)
+			if err == nil {
+				pairs <- pair
+			} else if err != ErrInvalidRefreshToken {
+				t.Errorf("expected %v but got %v", ErrInvalidRefreshToken, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(pairs)
+
+	if len(pairs) != 1 {
+		t.Fatalf("expected exactly one refresh to succeed but %d did", len(pairs))
+	}
+	//the others reused the token, which revoked the session
+	pair := <-pairs
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(headerAuthorization, schemeBearer+pair.AccessToken)
+	if _, err := tm.Get(r, &tokenState{}); err != ErrTokenRevoked {
+		t.Errorf("expected %v after the refresh token was reused but got %v", ErrTokenRevoked, err)
+	}
+	if _, err := tm.Refresh(pair.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Errorf("expected %v after the session was revoked but got %v", ErrInvalidRefreshToken, err)
+	}
+}
+
+func TestDecodeToken(t *testing.T) {
+	signer, _ := NewHS256Signer("jwt key")
+	other, _ := NewHS256Signer("other key")
+	ed, _ := NewEdDSASigner([]byte("0123456789abcdef0123456789abcdef"))
+	now := time.Now()
+
+	token, err := encodeToken(signer, &Claims{ID: "1", SessionID: "sid", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatalf("error encoding token: %v", err)
+	}
+	parts := strings.Split(token, ".")
+
+	cases := []struct {
+		name      string
+		signer    TokenSigner
+		token     string
+		now       time.Time
+		expectErr error
+	}{
+		{"Valid Token", signer, token, now, nil},
+		{"Expired Token", signer, token, now.Add(time.Hour), ErrTokenExpired},
+		{"Wrong Key", other, token, now, ErrInvalidToken},
+		{"Wrong Algorithm", ed, token, now, ErrInvalidToken},
+		{"Tampered Payload", signer, parts[0] + "." + b64.EncodeToString([]byte(`{"sid":"other","exp":9999999999}`)) + "." + parts[2], now, ErrInvalidToken},
+		{"Unsigned Token", signer, b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", now, ErrInvalidToken},
+		{"Malformed Token", signer, "not-a-token", now, ErrInvalidToken},
+	}
+
+	for _, c := range cases {
+		if _, err := decodeToken(c.signer, c.token, c.now); err != c.expectErr {
+			t.Errorf("case %s: expected error %v but got %v", c.name, c.expectErr, err)
+		}
+	}
+}
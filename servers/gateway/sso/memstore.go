@@ -0,0 +1,42 @@
+package sso
+
+import (
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+//MemStore is an in-process memory Store.
+//This should be used only for testing and single-instance deployments.
+type MemStore struct {
+	entries *cache.Cache
+	mx      sync.Mutex
+}
+
+//NewMemStore constructs and returns a new MemStore
+func NewMemStore(purgeInterval time.Duration) *MemStore {
+	return &MemStore{
+		entries: cache.New(cache.NoExpiration, purgeInterval),
+	}
+}
+
+//Save keeps the login until `ttl` has passed
+func (ms *MemStore) Save(login *Login, ttl time.Duration) error {
+	ms.entries.Set(login.State, *login, ttl)
+	return nil
+}
+
+//Take returns the login started with `state` and removes it
+func (ms *MemStore) Take(state string) (*Login, error) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+
+	login, found := ms.entries.Get(state)
+	if !found {
+		return nil, ErrLoginNotFound
+	}
+	ms.entries.Delete(state)
+	copied := login.(Login)
+	return &copied, nil
+}
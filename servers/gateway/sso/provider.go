@@ -0,0 +1,136 @@
+//Package sso signs users in through an institutional OpenID Connect identity
+//provider, using the authorization code flow with PKCE. The provider's
+//endpoints and signing keys are found through OpenID Connect discovery.
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+//ErrNonceMismatch is returned when the ID token wasn't issued for the login being finished
+var ErrNonceMismatch = errors.New("ID token nonce doesn't match the sign-in")
+
+//Identity is what the provider asserts about a signed-in user
+type Identity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	GivenName         string
+	FamilyName        string
+	PreferredUsername string
+}
+
+//Login is a sign-in that was started by sending the user to the provider,
+//and is finished when the provider sends them back with a code. It is kept
+//by the gateway, so the nonce and PKCE verifier never reach the client.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+//Provider is an OpenID Connect identity provider
+type Provider struct {
+	Issuer   string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+//NewProvider discovers the provider at `issuer` and returns a Provider for the
+//client registered there. `redirectURL` is where the provider sends users back.
+func NewProvider(ctx context.Context, issuer string, clientID string, clientSecret string, redirectURL string) (*Provider, error) {
+	p, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering provider: %v", err)
+	}
+	return &Provider{
+		Issuer: issuer,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     p.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+		},
+		verifier: p.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+//Begin starts a sign-in, and returns the URL to send the user to
+//along with the Login to keep until they come back
+func (p *Provider) Begin() (string, *Login, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", nil, err
+	}
+	login := &Login{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: oauth2.GenerateVerifier(),
+	}
+	authURL := p.config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(login.Verifier))
+	return authURL, login, nil
+}
+
+//Finish exchanges the code the provider sent the user back with for an
+//ID token, verifies its signature, audience, expiry and nonce, and
+//returns the identity it asserts
+func (p *Provider) Finish(ctx context.Context, login *Login, code string) (*Identity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		return nil, fmt.Errorf("error exchanging code: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("token response has no ID token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("error verifying ID token: %v", err)
+	}
+	if idToken.Nonce != login.Nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	claims := struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		GivenName         string `json:"given_name"`
+		FamilyName        string `json:"family_name"`
+		PreferredUsername string `json:"preferred_username"`
+	}{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("error decoding ID token claims: %v", err)
+	}
+
+	return &Identity{
+		Issuer:            idToken.Issuer,
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		GivenName:         claims.GivenName,
+		FamilyName:        claims.FamilyName,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+//randomString returns 32 random bytes encoded for use in a URL
+func randomString() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating random value: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,122 @@
+package sso
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/synapse-api/servers/gateway/sso/ssotest"
+)
+
+func TestProvider(t *testing.T) {
+	fake := ssotest.NewProvider("synapse", "secret")
+	defer fake.Close()
+
+	ctx := context.Background()
+	p, err := NewProvider(ctx, fake.Issuer, "synapse", "secret", "https://synapse.test/sso")
+	if err != nil {
+		t.Fatalf("error creating provider: %v", err)
+	}
+
+	claims := &ssotest.Claims{
+		Subject:       "12345",
+		Email:         "fredhw@uw.edu",
+		EmailVerified: true,
+		GivenName:     "Fred",
+		FamilyName:    "Wijaya",
+	}
+
+	cases := []struct {
+		name        string
+		tamper      func(login *Login)
+		unknownKey  bool
+		expectError bool
+	}{
+		{
+			"Valid Sign-In",
+			func(login *Login) {},
+			false,
+			false,
+		},
+		{
+			"Wrong PKCE Verifier",
+			func(login *Login) { login.Verifier = "wrong-verifier-wrong-verifier-wrong-verifier" },
+			false,
+			true,
+		},
+		{
+			"Wrong Nonce",
+			func(login *Login) { login.Nonce = "wrong" },
+			false,
+			true,
+		},
+		{
+			"Unknown Signing Key",
+			func(login *Login) {},
+			true,
+			true,
+		},
+	}
+
+	for _, c := range cases {
+		authURL, login, err := p.Begin()
+		if err != nil {
+			t.Fatalf("case %s: error beginning sign-in: %v", c.name, err)
+		}
+		code, state, err := fake.Authorize(authURL, claims)
+		if err != nil {
+			t.Fatalf("case %s: error authorizing: %v", c.name, err)
+		}
+		if state != login.State {
+			t.Errorf("case %s: expected state %s but got %s", c.name, login.State, state)
+		}
+
+		c.tamper(login)
+		fake.SignWithUnknownKey = c.unknownKey
+		id, err := p.Finish(ctx, login, code)
+		if c.expectError {
+			if err == nil {
+				t.Errorf("case %s: expected error but got none", c.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("case %s: unexpected error: %v", c.name, err)
+		}
+		if id.Issuer != fake.Issuer || id.Subject != claims.Subject || id.Email != claims.Email ||
+			!id.EmailVerified || id.GivenName != claims.GivenName || id.FamilyName != claims.FamilyName {
+			t.Errorf("case %s: unexpected identity %+v", c.name, id)
+		}
+
+		//codes can only be exchanged once
+		if _, err := p.Finish(ctx, login, code); err == nil {
+			t.Errorf("case %s: expected error reusing code", c.name)
+		}
+	}
+}
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore(time.Minute)
+	login := &Login{State: "state", Nonce: "nonce", Verifier: "verifier"}
+	if err := store.Save(login, time.Minute); err != nil {
+		t.Fatalf("error saving login: %v", err)
+	}
+	taken, err := store.Take("state")
+	if err != nil {
+		t.Fatalf("error taking login: %v", err)
+	}
+	if *taken != *login {
+		t.Errorf("expected %+v but got %+v", login, taken)
+	}
+	if _, err := store.Take("state"); err != ErrLoginNotFound {
+		t.Errorf("expected ErrLoginNotFound taking a login twice but got %v", err)
+	}
+
+	if err := store.Save(login, time.Millisecond); err != nil {
+		t.Fatalf("error saving login: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Take("state"); err != ErrLoginNotFound {
+		t.Errorf("expected ErrLoginNotFound for an expired login but got %v", err)
+	}
+}
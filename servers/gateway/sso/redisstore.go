@@ -0,0 +1,58 @@
+package sso
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//RedisStore is a Store shared through redis, so that a sign-in
+//can be finished by a different gateway instance than started it
+type RedisStore struct {
+	Client *redis.Client
+}
+
+//NewRedisStore constructs a new RedisStore
+func NewRedisStore(client *redis.Client) *RedisStore {
+	if client == nil {
+		panic("nil pointer passed for client")
+	}
+	return &RedisStore{
+		Client: client,
+	}
+}
+
+//Save keeps the login until `ttl` has passed
+func (rs *RedisStore) Save(login *Login, ttl time.Duration) error {
+	j, err := json.Marshal(login)
+	if err != nil {
+		return err
+	}
+	return rs.Client.Set(getRedisKey(login.State), j, ttl).Err()
+}
+
+//Take returns the login started with `state` and removes it.
+//The login is read and deleted in a single transaction.
+func (rs *RedisStore) Take(state string) (*Login, error) {
+	rkey := getRedisKey(state)
+	pipe := rs.Client.TxPipeline()
+	get := pipe.Get(rkey)
+	pipe.Del(rkey)
+	if _, err := pipe.Exec(); err == redis.Nil {
+		return nil, ErrLoginNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	login := &Login{}
+	if err := json.Unmarshal([]byte(get.Val()), login); err != nil {
+		return nil, err
+	}
+	return login, nil
+}
+
+//getRedisKey returns the redis key for a login state
+func getRedisKey(state string) string {
+	return "sso:" + state
+}
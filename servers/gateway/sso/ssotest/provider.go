@@ -0,0 +1,257 @@
+//Package ssotest provides an in-process OpenID Connect provider for
+//testing sign-ins through the sso package without a real identity provider
+package ssotest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+//Claims are what the provider asserts about a user signing in
+type Claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email,omitempty"`
+	EmailVerified     bool   `json:"email_verified"`
+	GivenName         string `json:"given_name,omitempty"`
+	FamilyName        string `json:"family_name,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+}
+
+//grant is an authorization code waiting to be exchanged for tokens
+type grant struct {
+	claims      *Claims
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+//Provider is a fake OpenID Connect provider serving discovery, JWKS and
+//token endpoints. Users don't sign in through a browser; tests call
+//Authorize with the claims of the user instead.
+type Provider struct {
+	Server       *httptest.Server
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	//SignWithUnknownKey makes ID tokens be signed with a key
+	//that isn't published, so that their signatures don't verify
+	SignWithUnknownKey bool
+
+	key     *rsa.PrivateKey
+	unknown *rsa.PrivateKey
+	mx      sync.Mutex
+	grants  map[string]*grant
+}
+
+//NewProvider starts a fake provider for a single registered client.
+//Call Close when done.
+func NewProvider(clientID string, clientSecret string) *Provider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	unknown, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		key:          key,
+		unknown:      unknown,
+		grants:       map[string]*grant{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discoveryHandler)
+	mux.HandleFunc("/keys", p.keysHandler)
+	mux.HandleFunc("/token", p.tokenHandler)
+	p.Server = httptest.NewServer(mux)
+	p.Issuer = p.Server.URL
+	return p
+}
+
+//Close shuts down the provider
+func (p *Provider) Close() {
+	p.Server.Close()
+}
+
+//Authorize does what the provider's authorization endpoint would do once the
+//user signed in: it checks the authorization URL and returns the code and
+//state that the user would be sent back to the redirect URL with
+func (p *Provider) Authorize(authURL string, claims *Claims) (string, string, error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	switch {
+	case u.Path != "/authorize":
+		return "", "", fmt.Errorf("unexpected authorization path %q", u.Path)
+	case q.Get("client_id") != p.ClientID:
+		return "", "", errors.New("unknown client")
+	case q.Get("response_type") != "code":
+		return "", "", errors.New("response_type must be code")
+	case q.Get("code_challenge_method") != "S256" || len(q.Get("code_challenge")) == 0:
+		return "", "", errors.New("PKCE S256 challenge required")
+	case len(q.Get("state")) == 0 || len(q.Get("nonce")) == 0:
+		return "", "", errors.New("state and nonce required")
+	}
+
+	code := randomString()
+	p.mx.Lock()
+	p.grants[code] = &grant{
+		claims:      claims,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	p.mx.Unlock()
+	return code, q.Get("state"), nil
+}
+
+//discoveryHandler serves the OpenID Connect discovery document
+func (p *Provider) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	respond(w, map[string]interface{}{
+		"issuer":                                p.Issuer,
+		"authorization_endpoint":                p.Issuer + "/authorize",
+		"token_endpoint":                        p.Issuer + "/token",
+		"jwks_uri":                              p.Issuer + "/keys",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+//keysHandler serves the public keys that ID tokens are signed with
+func (p *Provider) keysHandler(w http.ResponseWriter, r *http.Request) {
+	respond(w, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.key.PublicKey,
+		KeyID:     "test",
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+//tokenHandler exchanges an authorization code and its PKCE verifier for tokens
+func (p *Provider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	p.mx.Lock()
+	g, found := p.grants[code]
+	delete(p.grants, code)
+	p.mx.Unlock()
+	if !found || g.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	idToken, err := p.signIDToken(g)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respond(w, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+//signIDToken returns a signed ID token for the grant
+func (p *Provider) signIDToken(g *grant) (string, error) {
+	key := p.key
+	if p.SignWithUnknownKey {
+		key = p.unknown
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: key, KeyID: "test"},
+	}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(g.claims)
+	if err != nil {
+		return "", err
+	}
+	payload := map[string]interface{}{}
+	if err := json.Unmarshal(claims, &payload); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	payload["iss"] = p.Issuer
+	payload["aud"] = p.ClientID
+	payload["iat"] = now.Unix()
+	payload["exp"] = now.Add(time.Hour).Unix()
+	payload["nonce"] = g.nonce
+	j, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	jws, err := signer.Sign(j)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+//respond encodes the value as JSON
+func respond(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+//tokenError responds with an OAuth2 error
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+//randomString returns a random, URL-safe string
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,21 @@
+package sso
+
+import (
+	"errors"
+	"time"
+)
+
+//ErrLoginNotFound is returned when no sign-in was started with a state,
+//or it expired, or it was already finished
+var ErrLoginNotFound = errors.New("no sign-in was started with this state")
+
+//Store keeps logins between Begin and Finish. This is an abstract interface
+//so that logins can be kept in memory or in a shared redis server.
+type Store interface {
+	//Save keeps the login, keyed by its state, until `ttl` has passed
+	Save(login *Login, ttl time.Duration) error
+
+	//Take returns the login started with `state` and removes it,
+	//so that each sign-in can only be finished once
+	Take(state string) (*Login, error)
+}
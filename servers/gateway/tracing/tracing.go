@@ -0,0 +1,175 @@
+//Package tracing traces the requests the gateway handles with OpenTelemetry:
+//the handling of each request, the session lookups made for it and the
+//requests proxied to the microservices, which are given the trace context
+//in a W3C traceparent header so that their spans join the same trace.
+//Operations on the session store are traced as well.
+//Spans are sent to the global TracerProvider; see config.Tracing.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//tracerName names the tracer of the gateway's own spans
+const tracerName = "github.com/synapse-api/servers/gateway/tracing"
+
+//credentialErrors are the errors sessions.Manager returns for requests
+//without valid credentials, which are the client's doing rather than
+//failures of the session store
+var credentialErrors = []error{
+	sessions.ErrNoSessionID,
+	sessions.ErrInvalidScheme,
+	sessions.ErrInvalidID,
+	sessions.ErrStateNotFound,
+	sessions.ErrInvalidToken,
+	sessions.ErrTokenExpired,
+	sessions.ErrTokenRevoked,
+}
+
+//Handler wraps `next` so that every request is handled in a span named
+//after its method and the pattern `routes` matches it to. The gateway
+//faces the internet, so the trace context clients send is linked to the
+//span rather than taken as its parent.
+func Handler(routes *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "gateway",
+		otelhttp.WithPublicEndpoint(),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			_, route := routes.Handler(r)
+			return r.Method + " " + route
+		}),
+	)
+}
+
+//Transport wraps `next` so that every request proxied through it to the
+//`service` is made in a span of its own, whose context is sent to the
+//service in the traceparent header
+func Transport(service string, next http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(next,
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			return "proxy " + service
+		}),
+	)
+}
+
+//SessionManager wraps the manager so that looking up and ending the
+//session of a request are traced as part of the request. Wrap the
+//manager's store with SessionStore to trace every store operation too.
+//It is a sessions.Refresher if `m` is.
+func SessionManager(m sessions.Manager) sessions.Manager {
+	traced := &sessionManager{Manager: m, tracer: otel.Tracer(tracerName)}
+	if refresher, ok := m.(sessions.Refresher); ok {
+		return &refreshingSessionManager{sessionManager: traced, Refresher: refresher}
+	}
+	return traced
+}
+
+//sessionManager is a sessions.Manager whose session lookups are traced
+type sessionManager struct {
+	sessions.Manager
+	tracer trace.Tracer
+}
+
+//refreshingSessionManager is a sessionManager for a
+//sessions.Manager that issues refresh tokens
+type refreshingSessionManager struct {
+	*sessionManager
+	sessions.Refresher
+}
+
+//Get gets the state of the request's session in a span
+func (m *sessionManager) Get(r *http.Request, sessionState interface{}) (sessions.SessionID, error) {
+	_, span := m.tracer.Start(r.Context(), "session.get", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	sid, err := m.Manager.Get(r, sessionState)
+	endSpan(span, err)
+	return sid, err
+}
+
+//End ends the request's session in a span
+func (m *sessionManager) End(r *http.Request) (sessions.SessionID, error) {
+	_, span := m.tracer.Start(r.Context(), "session.end", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	sid, err := m.Manager.End(r)
+	endSpan(span, err)
+	return sid, err
+}
+
+//SessionStore wraps the store so that each of its operations is traced,
+//including the saves made when sessions begin, are updated or are
+//refreshed. sessions.Store takes no context, so the spans are traces
+//of their own rather than part of the request that caused them.
+func SessionStore(store sessions.Store) sessions.Store {
+	return &sessionStore{Store: store, tracer: otel.Tracer(tracerName)}
+}
+
+//sessionStore is a sessions.Store whose operations are traced
+type sessionStore struct {
+	sessions.Store
+	tracer trace.Tracer
+}
+
+//Save saves the state in a span
+func (s *sessionStore) Save(sid sessions.SessionID, sessionState interface{}) error {
+	span := s.start("save")
+	defer span.End()
+	err := s.Store.Save(sid, sessionState)
+	endSpan(span, err)
+	return err
+}
+
+//Get gets the state in a span
+func (s *sessionStore) Get(sid sessions.SessionID, sessionState interface{}) error {
+	span := s.start("get")
+	defer span.End()
+	err := s.Store.Get(sid, sessionState)
+	endSpan(span, err)
+	return err
+}
+
+//Modify modifies the state in a span
+func (s *sessionStore) Modify(sid sessions.SessionID, sessionState interface{}, fn func() error) error {
+	span := s.start("modify")
+	defer span.End()
+	err := s.Store.Modify(sid, sessionState, fn)
+	endSpan(span, err)
+	return err
+}
+
+//Delete deletes the state in a span
+func (s *sessionStore) Delete(sid sessions.SessionID) error {
+	span := s.start("delete")
+	defer span.End()
+	err := s.Store.Delete(sid)
+	endSpan(span, err)
+	return err
+}
+
+//start starts the span of a store operation
+func (s *sessionStore) start(operation string) trace.Span {
+	_, span := s.tracer.Start(context.Background(), "session.store."+operation, trace.WithSpanKind(trace.SpanKindClient))
+	return span
+}
+
+//endSpan records the error a session operation returned. Only errors
+//that aren't down to the client's credentials mark the span as failed.
+func endSpan(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	for _, credentialErr := range credentialErrors {
+		if errors.Is(err, credentialErr) {
+			return
+		}
+	}
+	span.SetStatus(codes.Error, err.Error())
+}
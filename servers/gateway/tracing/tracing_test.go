@@ -0,0 +1,211 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/synapse-api/servers/gateway/sessions"
+)
+
+//newRecorder sets up a global TracerProvider whose spans are recorded
+func newRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(t.Context()) })
+	return recorder
+}
+
+//findSpan returns the last of the ended spans with the name, or nil
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for i := len(spans) - 1; i >= 0; i-- {
+		if spans[i].Name() == name {
+			return spans[i]
+		}
+	}
+	return nil
+}
+
+//failingStore is a sessions.Store that can't be reached
+type failingStore struct {
+	sessions.Store
+}
+
+//Get fails
+func (s *failingStore) Get(sid sessions.SessionID, sessionState interface{}) error {
+	return errors.New("dial tcp 10.0.0.3:6379: connect: connection refused")
+}
+
+func TestProxyTrace(t *testing.T) {
+	recorder := newRecorder(t)
+
+	var upstreamParent trace.SpanContext
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		upstreamParent = trace.SpanContextFromContext(ctx)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = Transport("qeeg", http.DefaultTransport)
+	mux := http.NewServeMux()
+	mux.Handle("/v1/spectrum/", proxy)
+	handler := Handler(mux, mux)
+
+	//a client's own trace context isn't trusted
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("GET", "/v1/spectrum/recording.edf", nil)
+	r.Header.Set("traceparent", "00-"+clientTraceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	server := findSpan(spans, "GET /v1/spectrum/")
+	hop := findSpan(spans, "proxy qeeg")
+	if server == nil || hop == nil {
+		t.Fatalf("expected a span for the handler and the proxy hop but got %d spans", len(spans))
+	}
+	if server.Parent().IsValid() || server.SpanContext().TraceID().String() == clientTraceID {
+		t.Errorf("expected the handler's span to start a new trace")
+	}
+	if len(server.Links()) != 1 || server.Links()[0].SpanContext.TraceID().String() != clientTraceID {
+		t.Errorf("expected the handler's span to link to the client's trace")
+	}
+	if hop.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("expected the proxy hop to be a child of the handler's span")
+	}
+	if hop.SpanKind() != trace.SpanKindClient {
+		t.Errorf("expected the proxy hop to be a client span but got %v", hop.SpanKind())
+	}
+	//the service continues the trace from the proxy hop
+	if upstreamParent.TraceID() != server.SpanContext().TraceID() || upstreamParent.SpanID() != hop.SpanContext().SpanID() {
+		t.Errorf("expected the service to get the proxy hop's trace context but got %v", upstreamParent)
+	}
+}
+
+func TestSessionManager(t *testing.T) {
+	recorder := newRecorder(t)
+	store := sessions.NewMemStore(time.Hour, time.Minute)
+	manager := SessionManager(sessions.NewOpaqueManager("test key", store))
+
+	w := httptest.NewRecorder()
+	if _, err := manager.Begin("state", w); err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	authorization := w.Header().Get("Authorization")
+	parentCtx, parent := otel.Tracer("test").Start(t.Context(), "request")
+
+	unknown, err := sessions.NewSessionID("test key")
+	if err != nil {
+		t.Fatalf("error creating session ID: %v", err)
+	}
+	unreachable := SessionManager(sessions.NewOpaqueManager("test key", &failingStore{store}))
+
+	cases := []struct {
+		name          string
+		manager       sessions.Manager
+		authorization string
+		failed        bool
+	}{
+		{"Session", manager, authorization, false},
+		{"No Credentials", manager, "", false},
+		{"Unknown Session", manager, "Bearer " + unknown.String(), false},
+		{"Store Unreachable", unreachable, authorization, true},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/v1/users/me", nil).WithContext(parentCtx)
+		if len(c.authorization) > 0 {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		state := ""
+		_, err := c.manager.Get(r, &state)
+		if (err == nil) != (c.name == "Session") {
+			t.Fatalf("case %s: unexpected error %v", c.name, err)
+		}
+
+		span := findSpan(recorder.Ended(), "session.get")
+		if span == nil {
+			t.Fatalf("case %s: expected a span for the lookup", c.name)
+		}
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("case %s: expected the lookup to be a child of the request's span", c.name)
+		}
+		if (err != nil) != (len(span.Events()) > 0) {
+			t.Errorf("case %s: expected the error %v to be recorded", c.name, err)
+		}
+		if failed := span.Status().Code == codes.Error; failed != c.failed {
+			t.Errorf("case %s: expected failed to be %t", c.name, c.failed)
+		}
+	}
+	parent.End()
+
+	//the refresh handler needs to tell managers that issue refresh tokens apart
+	if _, ok := manager.(sessions.Refresher); ok {
+		t.Errorf("expected opaque sessions not to be refreshable")
+	}
+	signer, err := sessions.NewHS256Signer("test key")
+	if err != nil {
+		t.Fatalf("error creating signer: %v", err)
+	}
+	tokens := sessions.NewTokenManager("test key", store, signer, sessions.NewMemDenylist(time.Minute), time.Minute)
+	if _, ok := SessionManager(tokens).(sessions.Refresher); !ok {
+		t.Errorf("expected token sessions to be refreshable")
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	recorder := newRecorder(t)
+	memStore := sessions.NewMemStore(time.Hour, time.Minute)
+	store := SessionStore(memStore)
+	sid, err := sessions.NewSessionID("test key")
+	if err != nil {
+		t.Fatalf("error creating session ID: %v", err)
+	}
+	unknown, err := sessions.NewSessionID("test key")
+	if err != nil {
+		t.Fatalf("error creating session ID: %v", err)
+	}
+
+	state := ""
+	cases := []struct {
+		name   string
+		span   string
+		op     func() error
+		failed bool
+	}{
+		{"Save", "session.store.save", func() error { return store.Save(sid, "state") }, false},
+		{"Get", "session.store.get", func() error { return store.Get(sid, &state) }, false},
+		{"Modify", "session.store.modify", func() error {
+			return store.Modify(sid, &state, func() error { state = "updated"; return nil })
+		}, false},
+		{"Unknown Session", "session.store.get", func() error { return store.Get(unknown, &state) }, false},
+		{"Store Unreachable", "session.store.get", func() error { return SessionStore(&failingStore{memStore}).Get(sid, &state) }, true},
+		{"Delete", "session.store.delete", func() error { return store.Delete(sid) }, false},
+	}
+	for _, c := range cases {
+		err := c.op()
+		span := findSpan(recorder.Ended(), c.span)
+		if span == nil {
+			t.Fatalf("case %s: expected a span named %s", c.name, c.span)
+		}
+		if (err != nil) != (len(span.Events()) > 0) {
+			t.Errorf("case %s: expected the error %v to be recorded", c.name, err)
+		}
+		if failed := span.Status().Code == codes.Error; failed != c.failed {
+			t.Errorf("case %s: expected failed to be %t", c.name, c.failed)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+//Package xuser signs and verifies the X-User header the gateway sends to
+//backend services. The gateway signs every proxied request, including
+//requests without a signed-in user, so that backends can reject requests
+//that didn't come through the gateway.
+//
+//The signature covers the audience (the name of the backend service),
+//a timestamp, a random nonce and the X-User JSON:
+//
+//	X-User:           {"id":"...","userName":"..."}   (absent when signed out)
+//	X-User-Audience:  qeeg
+//	X-User-Timestamp: 1700000000
+//	X-User-Nonce:     <base64 random bytes>
+//	X-User-Signature: hmac-sha256=<base64 signature>
+package xuser
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Header names used by the protocol
+const (
+	HeaderUser      = "X-User"
+	HeaderAudience  = "X-User-Audience"
+	HeaderTimestamp = "X-User-Timestamp"
+	HeaderNonce     = "X-User-Nonce"
+	HeaderSignature = "X-User-Signature"
+)
+
+const (
+	algHMAC    = "hmac-sha256"
+	algEd25519 = "ed25519"
+	nonceSize  = 16
+)
+
+//ErrMissingSignature is returned when a request carries no signature headers
+var ErrMissingSignature = errors.New("request is missing the X-User signature")
+
+//ErrInvalidSignature is returned when the signature doesn't verify
+var ErrInvalidSignature = errors.New("invalid X-User signature")
+
+//ErrWrongAudience is returned when the request was signed for another service
+var ErrWrongAudience = errors.New("X-User signature is for a different audience")
+
+//ErrStale is returned when the signature timestamp is outside the replay window
+var ErrStale = errors.New("X-User signature timestamp is outside the allowed window")
+
+//ErrReplayed is returned when a nonce has already been seen within the replay window
+var ErrReplayed = errors.New("X-User signature has already been used")
+
+//AllHeaders returns the names of every header used by the protocol
+func AllHeaders() []string {
+	return []string{HeaderUser, HeaderAudience, HeaderTimestamp, HeaderNonce, HeaderSignature}
+}
+
+//signingInput returns the bytes covered by the signature
+func signingInput(audience string, timestamp string, nonce string, user string) []byte {
+	return []byte("v1\n" + audience + "\n" + timestamp + "\n" + nonce + "\n" + user)
+}
+
+//Signer adds signed X-User headers to requests
+type Signer struct {
+	alg  string
+	sign func(msg []byte) []byte
+}
+
+//NewHMACSigner constructs a Signer using HMAC-SHA256 with a shared key
+func NewHMACSigner(key []byte) *Signer {
+	return &Signer{
+		alg: algHMAC,
+		sign: func(msg []byte) []byte {
+			h := hmac.New(sha256.New, key)
+			h.Write(msg)
+			return h.Sum(nil)
+		},
+	}
+}
+
+//NewEd25519Signer constructs a Signer using an Ed25519 private key,
+//so that backends only need the public key to verify requests
+func NewEd25519Signer(privateKey ed25519.PrivateKey) *Signer {
+	return &Signer{
+		alg: algEd25519,
+		sign: func(msg []byte) []byte {
+			return ed25519.Sign(privateKey, msg)
+		},
+	}
+}
+
+//Sign replaces any X-User headers in `h` with `user` (which may be empty
+//when no user is signed in) and a signature for the given audience
+func (s *Signer) Sign(h http.Header, user []byte, audience string) error {
+	for _, name := range AllHeaders() {
+		h.Del(name)
+	}
+
+	nonceBytes := make([]byte, nonceSize)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return fmt.Errorf("error generating nonce: %v", err)
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	sig := s.sign(signingInput(audience, timestamp, nonce, string(user)))
+
+	if len(user) > 0 {
+		h.Set(HeaderUser, string(user))
+	}
+	h.Set(HeaderAudience, audience)
+	h.Set(HeaderTimestamp, timestamp)
+	h.Set(HeaderNonce, nonce)
+	h.Set(HeaderSignature, s.alg+"="+base64.StdEncoding.EncodeToString(sig))
+	return nil
+}
+
+//Verifier checks X-User signatures on requests received by a backend service
+type Verifier struct {
+	alg      string
+	verify   func(msg []byte, sig []byte) bool
+	audience string
+	window   time.Duration
+	now      func() time.Time
+
+	mx        sync.Mutex
+	seen      map[string]time.Time
+	lastPurge time.Time
+}
+
+//NewHMACVerifier constructs a Verifier for HMAC-SHA256 signatures. Requests must
+//be signed for `audience` and have a timestamp within `window` of the current time.
+func NewHMACVerifier(key []byte, audience string, window time.Duration) *Verifier {
+	signer := NewHMACSigner(key)
+	return newVerifier(algHMAC, func(msg []byte, sig []byte) bool {
+		return hmac.Equal(signer.sign(msg), sig)
+	}, audience, window)
+}
+
+//NewEd25519Verifier constructs a Verifier for Ed25519 signatures. Requests must
+//be signed for `audience` and have a timestamp within `window` of the current time.
+func NewEd25519Verifier(publicKey ed25519.PublicKey, audience string, window time.Duration) *Verifier {
+	return newVerifier(algEd25519, func(msg []byte, sig []byte) bool {
+		return ed25519.Verify(publicKey, msg, sig)
+	}, audience, window)
+}
+
+func newVerifier(alg string, verify func([]byte, []byte) bool, audience string, window time.Duration) *Verifier {
+	return &Verifier{
+		alg:      alg,
+		verify:   verify,
+		audience: audience,
+		window:   window,
+		now:      time.Now,
+		seen:     map[string]time.Time{},
+	}
+}
+
+//Verify checks the X-User signature headers and returns the verified
+//X-User JSON, which is empty if the request has no signed-in user
+func (v *Verifier) Verify(h http.Header) ([]byte, error) {
+	sigHeader := h.Get(HeaderSignature)
+	timestamp := h.Get(HeaderTimestamp)
+	nonce := h.Get(HeaderNonce)
+	if len(sigHeader) == 0 || len(timestamp) == 0 || len(nonce) == 0 {
+		return nil, ErrMissingSignature
+	}
+
+	if h.Get(HeaderAudience) != v.audience {
+		return nil, ErrWrongAudience
+	}
+
+	if !strings.HasPrefix(sigHeader, v.alg+"=") {
+		return nil, ErrInvalidSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(sigHeader[len(v.alg)+1:])
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+
+	user := h.Get(HeaderUser)
+	if !v.verify(signingInput(v.audience, timestamp, nonce, user), sig) {
+		return nil, ErrInvalidSignature
+	}
+
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidSignature
+	}
+	now := v.now()
+	signedAt := time.Unix(secs, 0)
+	if signedAt.Before(now.Add(-v.window)) || signedAt.After(now.Add(v.window)) {
+		return nil, ErrStale
+	}
+
+	if err := v.checkNonce(nonce, now); err != nil {
+		return nil, err
+	}
+	return []byte(user), nil
+}
+
+//checkNonce records the nonce, failing if it was already seen within the window.
+//Nonces older than the window are forgotten, since their timestamps are stale anyway.
+func (v *Verifier) checkNonce(nonce string, now time.Time) error {
+	v.mx.Lock()
+	defer v.mx.Unlock()
+
+	if now.Sub(v.lastPurge) > v.window {
+		for n, seenAt := range v.seen {
+			if now.Sub(seenAt) > 2*v.window {
+				delete(v.seen, n)
+			}
+		}
+		v.lastPurge = now
+	}
+	if _, found := v.seen[nonce]; found {
+		return ErrReplayed
+	}
+	v.seen[nonce] = now
+	return nil
+}
+
+//Handler wraps `next` so that it only receives requests with a valid
+//X-User signature. Other requests are rejected with 401 Unauthorized.
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+package xuser
+
+import (
+	"crypto/ed25519"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	pairs := []struct {
+		name     string
+		signer   *Signer
+		verifier *Verifier
+	}{
+		{"HMAC", NewHMACSigner([]byte("key")), NewHMACVerifier([]byte("key"), "qeeg", time.Minute)},
+		{"Ed25519", NewEd25519Signer(priv), NewEd25519Verifier(pub, "qeeg", time.Minute)},
+	}
+
+	for _, p := range pairs {
+		h := http.Header{}
+		h.Set(HeaderUser, `{"userName":"mallory"}`)
+		user := []byte(`{"userName":"fredhw"}`)
+		if err := p.signer.Sign(h, user, "qeeg"); err != nil {
+			t.Fatalf("%s: error signing: %v", p.name, err)
+		}
+
+		got, err := p.verifier.Verify(h)
+		if err != nil {
+			t.Fatalf("%s: error verifying: %v", p.name, err)
+		}
+		if string(got) != string(user) {
+			t.Errorf("%s: incorrect user: expected %s but got %s", p.name, user, got)
+		}
+
+		if _, err := p.verifier.Verify(h); err != ErrReplayed {
+			t.Errorf("%s: expected %v for replayed headers but got %v", p.name, ErrReplayed, err)
+		}
+
+		//anonymous requests are signed too
+		anon := http.Header{}
+		anon.Set(HeaderUser, `{"userName":"mallory"}`)
+		if err := p.signer.Sign(anon, nil, "qeeg"); err != nil {
+			t.Fatalf("%s: error signing: %v", p.name, err)
+		}
+		if anon.Get(HeaderUser) != "" {
+			t.Errorf("%s: client-supplied X-User was not removed", p.name)
+		}
+		if got, err := p.verifier.Verify(anon); err != nil || len(got) != 0 {
+			t.Errorf("%s: expected verified anonymous request but got %q, %v", p.name, got, err)
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	signer := NewHMACSigner([]byte("key"))
+	sign := func(audience string) http.Header {
+		h := http.Header{}
+		if err := signer.Sign(h, []byte(`{"userName":"fredhw"}`), audience); err != nil {
+			t.Fatalf("error signing: %v", err)
+		}
+		return h
+	}
+
+	cases := []struct {
+		name      string
+		header    func() http.Header
+		verifier  *Verifier
+		expectErr error
+	}{
+		{
+			"Missing Signature",
+			func() http.Header {
+				h := http.Header{}
+				h.Set(HeaderUser, `{"userName":"fredhw"}`)
+				return h
+			},
+			NewHMACVerifier([]byte("key"), "qeeg", time.Minute),
+			ErrMissingSignature,
+		},
+		{
+			"Wrong Key",
+			func() http.Header { return sign("qeeg") },
+			NewHMACVerifier([]byte("other"), "qeeg", time.Minute),
+			ErrInvalidSignature,
+		},
+		{
+			"Wrong Audience",
+			func() http.Header { return sign("messaging") },
+			NewHMACVerifier([]byte("key"), "qeeg", time.Minute),
+			ErrWrongAudience,
+		},
+		{
+			"Tampered User",
+			func() http.Header {
+				h := sign("qeeg")
+				h.Set(HeaderUser, `{"userName":"mallory"}`)
+				return h
+			},
+			NewHMACVerifier([]byte("key"), "qeeg", time.Minute),
+			ErrInvalidSignature,
+		},
+		{
+			"Stale Timestamp",
+			func() http.Header { return sign("qeeg") },
+			func() *Verifier {
+				v := NewHMACVerifier([]byte("key"), "qeeg", time.Minute)
+				v.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+				return v
+			}(),
+			ErrStale,
+		},
+	}
+
+	for _, c := range cases {
+		if _, err := c.verifier.Verify(c.header()); err != c.expectErr {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.expectErr, err)
+		}
+	}
+}
+
+func TestVerifierHandler(t *testing.T) {
+	verifier := NewHMACVerifier([]byte("key"), "summary", time.Minute)
+	handler := verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	r := httptest.NewRequest("GET", "/v1/summary/", nil)
+	r.Header.Set(HeaderUser, `{"userName":"fredhw"}`)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d for unsigned request but got %d", http.StatusUnauthorized, w.Code)
+	}
+
+	if err := NewHMACSigner([]byte("key")).Sign(r.Header, []byte(`{"userName":"fredhw"}`), "summary"); err != nil {
+		t.Fatalf("error signing: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected %d for signed request but got %d", http.StatusOK, w.Code)
+	}
+}
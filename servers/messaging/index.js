@@ -1,6 +1,7 @@
 //@ts-check
 "use strict";
 
+const crypto = require("crypto");
 const mongodb = require("mongodb");
 const MongoStore = require("./mongostore.js");
 const express = require("express");
@@ -14,13 +15,84 @@ const portNum = parseInt(port);
 const mongoAddr = process.env.DBADDR || "mymongo:27017";
 const mongoURL = `mongodb://${mongoAddr}/mgo`;
 
+// XUSER_ED25519_PUBLIC verifies X-User signatures made with the gateway's
+// Ed25519 key, otherwise XUSER_KEY verifies ones made with the shared HMAC key
+let xuserAlg, xuserVerify;
+if (process.env.XUSER_ED25519_PUBLIC) {
+    let pub = Buffer.from(process.env.XUSER_ED25519_PUBLIC, "base64");
+    if (pub.length !== 32) {
+        console.error("XUSER_ED25519_PUBLIC must be a base64-encoded 32-byte public key");
+        process.exit(1);
+    }
+    let publicKey = crypto.createPublicKey({
+        key: { kty: "OKP", crv: "Ed25519", x: pub.toString("base64url") },
+        format: "jwk"
+    });
+    xuserAlg = "ed25519";
+    xuserVerify = (input, sig) => crypto.verify(null, Buffer.from(input), publicKey, sig);
+} else if (process.env.XUSER_KEY) {
+    let xuserKey = process.env.XUSER_KEY;
+    xuserAlg = "hmac-sha256";
+    xuserVerify = (input, sig) => {
+        let expected = crypto.createHmac("sha256", xuserKey).update(input).digest();
+        return sig.length === expected.length && crypto.timingSafeEqual(sig, expected);
+    };
+} else {
+    console.error("please set XUSER_KEY or XUSER_ED25519_PUBLIC");
+    process.exit(1);
+}
+const xuserAudience = "messaging";
+const xuserWindowSecs = 60;
+const seenNonces = new Map();
+
 const app = express();
 
 const contentType = "Content-Type";
 const typeJSON = "application/json";
 const typeText = "text/plain";
 
+// verifyXUser checks the signature the gateway adds to every proxied request,
+// so that requests which didn't come through the gateway can't pick their user
+function verifyXUser(req) {
+    let sigHeader = req.get("X-User-Signature") || "";
+    let timestamp = req.get("X-User-Timestamp") || "";
+    let nonce = req.get("X-User-Nonce") || "";
+    let fail = (msg) => {
+        let err = Error(msg);
+        err["status"] = 401;
+        throw err;
+    };
+
+    if (!sigHeader.startsWith(xuserAlg + "=") || !timestamp || !nonce) {
+        fail("request is missing the X-User signature");
+    }
+    if (req.get("X-User-Audience") !== xuserAudience) {
+        fail("X-User signature is for a different audience");
+    }
+
+    let input = ["v1", xuserAudience, timestamp, nonce, req.get("X-User") || ""].join("\n");
+    let actual = Buffer.from(sigHeader.substring(xuserAlg.length + 1), "base64");
+    if (!xuserVerify(input, actual)) {
+        fail("invalid X-User signature");
+    }
+
+    let now = Math.floor(Date.now() / 1000);
+    if (Math.abs(now - parseInt(timestamp)) > xuserWindowSecs) {
+        fail("X-User signature timestamp is outside the allowed window");
+    }
+    for (let [n, seenAt] of seenNonces) {
+        if (now - seenAt > 2 * xuserWindowSecs) {
+            seenNonces.delete(n);
+        }
+    }
+    if (seenNonces.has(nonce)) {
+        fail("X-User signature has already been used");
+    }
+    seenNonces.set(nonce, now);
+}
+
 function headerCheck(req, res) {
+    verifyXUser(req);
     let userJSON = req.get("X-User");
     if (!userJSON) {
         throw Error("No X-User header provided");
@@ -264,7 +336,7 @@ mongodb.MongoClient.connect(mongoURL)
             console.error(err.stack)
             res.set(contentType, typeText);
 
-            if (err.message == "No X-User header provided") {
+            if (err.message == "No X-User header provided" || err.status == 401) {
                 res.status(401).send(err.message);
             } else {
                 if (!res.status) {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,7 +12,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/synapse-api/servers/gateway/xuser"
 	"golang.org/x/net/html"
 )
 
@@ -49,7 +53,22 @@ func main() {
 	if len(addr) == 0 {
 		addr = ":80"
 	}
-	http.Handle("/v1/summary/", &SummaryHandler{addr})
+
+	//only accept requests the gateway has signed for this service
+	var verifier *xuser.Verifier
+	if pub := os.Getenv("XUSER_ED25519_PUBLIC"); len(pub) > 0 {
+		pubBytes, err := base64.StdEncoding.DecodeString(pub)
+		if err != nil || len(pubBytes) != ed25519.PublicKeySize {
+			log.Fatalf("XUSER_ED25519_PUBLIC must be a base64-encoded %d-byte public key", ed25519.PublicKeySize)
+		}
+		verifier = xuser.NewEd25519Verifier(ed25519.PublicKey(pubBytes), "summary", time.Minute)
+	} else if key := os.Getenv("XUSER_KEY"); len(key) > 0 {
+		verifier = xuser.NewHMACVerifier([]byte(key), "summary", time.Minute)
+	} else {
+		log.Fatal("please set XUSER_KEY or XUSER_ED25519_PUBLIC")
+	}
+
+	http.Handle("/v1/summary/", verifier.Handler(&SummaryHandler{addr}))
 	log.Printf("server is listening at http://%s...", addr)
 	log.Fatal(http.ListenAndServe(addr, nil))
 }